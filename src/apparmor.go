@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const appArmorDir = "/etc/apparmor.d"
+
+var unsafeProfileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func runAppArmor(args []string) int {
+	if len(args) == 0 || args[0] != "generate" {
+		fmt.Fprintf(os.Stderr, "apparmor: expected \"generate\"\n\n%s", usage)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("apparmor generate", flag.ContinueOnError)
+	write := fs.Bool("write", false, "write the profile to "+appArmorDir+" instead of printing it")
+	load := fs.Bool("load", false, "write the profile and load it with apparmor_parser")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "apparmor generate: expected the name of a managed AppImage")
+		return exitUsage
+	}
+
+	w, path, err := findManagedAppImage(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apparmor generate: %v\n", err)
+		return exitCode(err)
+	}
+	name := appArmorProfileName(appNameFromPath(path))
+	profile := renderAppArmorProfile(w, name, path)
+	if !*write && !*load {
+		fmt.Print(profile)
+		return 0
+	}
+
+	dest := filepath.Join(appArmorDir, name)
+	if err := os.WriteFile(dest, []byte(profile), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "apparmor generate: %v\n", err)
+		return exitCode(err)
+	}
+	fmt.Printf("Wrote %s.\n", dest)
+	if *load {
+		if out, err := exec.Command("apparmor_parser", "-r", dest).CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "apparmor generate: apparmor_parser failed: %v: %s\n", err, strings.TrimSpace(string(out)))
+			return exitCode(err)
+		}
+		fmt.Printf("Loaded profile %s.\n", name)
+	}
+	return 0
+}
+
+// findManagedAppImage looks up an AppImage by name in the app_path of every
+// configured watcher.
+func findManagedAppImage(appName string) (WatcherConfig, string, error) {
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		return WatcherConfig{}, "", err
+	}
+	for _, w := range cfg.watchers() {
+		paths, err := w.appImages()
+		if err != nil {
+			continue
+		}
+		for _, path := range paths {
+			if appNameFromPath(path) == appName {
+				return w, path, nil
+			}
+		}
+	}
+	return WatcherConfig{}, "", fmt.Errorf("no managed AppImage named %q", appName)
+}
+
+func appArmorProfileName(appName string) string {
+	return "desktopimage." + unsafeProfileChars.ReplaceAllString(appName, "_")
+}
+
+// appArmorPath quotes path for use as an attachment, escaping the
+// characters AppArmor treats as globs.
+func appArmorPath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[]{}^"\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return `"` + b.String() + `"`
+}
+
+// renderAppArmorProfile returns a starter profile for the AppImage at path.
+// Like the profiles distributions ship for desktop applications it leaves
+// the AppImage unconfined but attaches to it and grants user namespaces,
+// which Electron and other sandboxing runtimes need on systems restricting
+// them. Rules to tighten it can go into the local include.
+func renderAppArmorProfile(w WatcherConfig, name, path string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by \"desktopimage apparmor generate\" for %s\n", path)
+	fmt.Fprintf(&b, "# (watcher %s). Local additions belong in local/%s.\n\n", w.label(), name)
+	b.WriteString("abi <abi/4.0>,\n\ninclude <tunables/global>\n\n")
+	fmt.Fprintf(&b, "profile %s %s flags=(unconfined) {\n", name, appArmorPath(path))
+	b.WriteString("  userns,\n\n")
+	fmt.Fprintf(&b, "  include if exists <local/%s>\n", name)
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// display values, see AppConfig.
+const (
+	displayAuto    = ""
+	displayWayland = "wayland"
+	displayX11     = "x11"
+)
+
+// AppConfig holds settings for a single AppImage, configured in an
+// [App.<name>] table where name is the file name without .AppImage.
+type AppConfig struct {
+	// Display forces the AppImage onto native Wayland or XWayland, for apps
+	// whose toolkit picks the one they misbehave on.
+	Display string `toml:"display"`
+	// Updates pins the updates of the AppImage like a sidecar file next to
+	// it does, see updatePinSuffix.
+	Updates string `toml:"updates"`
+	// Quirks set to false leaves out the fixes of builtinQuirks and the
+	// [[Quirk]] blocks matching the AppImage, and the defaults for its
+	// toolkit.
+	Quirks *bool `toml:"quirks"`
+	// MimeDefaults overrides mime_defaults of the watcher for the AppImage.
+	MimeDefaults *bool `toml:"mime_defaults"`
+	// SchemeDefaults overrides scheme_defaults of the watcher.
+	SchemeDefaults *bool `toml:"scheme_defaults"`
+	// ExecArgs are appended to the Exec line after those of the watcher.
+	ExecArgs []string `toml:"exec_args"`
+	// RequiresRoot overrides whether the AppImage only works as root,
+	// which is guessed from its desktop file otherwise.
+	RequiresRoot *bool `toml:"requires_root"`
+}
+
+var (
+	appsMu     sync.Mutex
+	appConfigs map[string]AppConfig
+)
+
+func validateApps(cfg Config) error {
+	for name, app := range cfg.Apps {
+		switch app.Display {
+		case displayAuto, displayWayland, displayX11:
+		default:
+			return fmt.Errorf("display of app %s must be %q or %q, got %q", name, displayWayland, displayX11, app.Display)
+		}
+		if strings.Contains(app.Updates, "|") {
+			return fmt.Errorf("updates of app %s must be %q or a release channel, got %q", name, updatesNone, app.Updates)
+		}
+		if err := validateExecArgs(app.ExecArgs); err != nil {
+			return fmt.Errorf("exec_args of app %s: %w", name, err)
+		}
+	}
+	for _, w := range cfg.watchers() {
+		if err := validateExecArgs(w.ExecArgs); err != nil {
+			return fmt.Errorf("exec_args of watcher %s: %w", w.label(), err)
+		}
+	}
+	return nil
+}
+
+// validateExecArgs checks that args can be written to an Exec line: empty
+// arguments would be lost and NUL can't be written at all.
+func validateExecArgs(args []string) error {
+	for _, arg := range args {
+		if arg == "" || strings.ContainsRune(arg, 0) {
+			return fmt.Errorf("invalid argument %q", arg)
+		}
+	}
+	return nil
+}
+
+func configureApps(cfg Config) {
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	appConfigs = cfg.Apps
+}
+
+// appConfig returns the settings for the AppImage named appName, which are
+// empty unless it has an [App.<name>] table.
+func appConfig(appName string) AppConfig {
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	return appConfigs[appName]
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// metainfoMembers are where AppImages carry their AppStream metadata, the
+// older appdata location last.
+var metainfoMembers = []string{"usr/share/metainfo/*.xml", "usr/share/appdata/*.xml"}
+
+// appStreamInfo holds the translated strings of an AppStream component,
+// keyed by language with "" for the untranslated text.
+type appStreamInfo struct {
+	names     map[string]string
+	summaries map[string]string
+	// version is that of the newest release listed, escaped like names.
+	version    string
+	categories []string
+}
+
+type appStreamText struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Value string `xml:",chardata"`
+}
+
+type appStreamComponent struct {
+	Names     []appStreamText `xml:"name"`
+	Summaries []appStreamText `xml:"summary"`
+	// Categories are the desktop menu categories of the app.
+	Categories []string `xml:"categories>category"`
+	Releases   []struct {
+		Version string `xml:"version,attr"`
+	} `xml:"releases>release"`
+}
+
+// parseAppStream reads the name and summary translations and the version
+// from the metainfo file at path.
+func parseAppStream(path string) (appStreamInfo, error) {
+	var info appStreamInfo
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	var component appStreamComponent
+	if err := xml.Unmarshal(content, &component); err != nil {
+		return info, fmt.Errorf("failed to parse AppStream metadata: %w", err)
+	}
+	info.names = appStreamTranslations(component.Names)
+	info.summaries = appStreamTranslations(component.Summaries)
+	for _, category := range component.Categories {
+		// Categories are single words.
+		if category = strings.TrimSpace(category); category != "" && !strings.ContainsAny(category, "; \t\n\r") {
+			info.categories = append(info.categories, category)
+		}
+	}
+	// Releases are listed newest first.
+	for _, release := range component.Releases {
+		if version := strings.Join(strings.Fields(release.Version), " "); version != "" {
+			info.version = desktopString(version)
+			break
+		}
+	}
+	return info, nil
+}
+
+func appStreamTranslations(texts []appStreamText) map[string]string {
+	translations := make(map[string]string)
+	for _, text := range texts {
+		// Both end up in desktop entry keys, which are single lines and
+		// can't contain brackets in the locale.
+		value := strings.Join(strings.Fields(text.Value), " ")
+		if value == "" || strings.Trim(text.Lang, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-@.") != "" {
+			continue
+		}
+		translations[strings.ReplaceAll(text.Lang, "-", "_")] = desktopString(value)
+	}
+	return translations
+}
+
+// localizedKeys renders the translations of info as Name[lang] and
+// Comment[lang] desktop entry keys, with an untranslated summary as Comment.
+func (info appStreamInfo) localizedKeys() string {
+	var b strings.Builder
+	for _, lang := range sortedLangs(info.names) {
+		if lang != "" {
+			fmt.Fprintf(&b, "Name[%s]=%s\n", lang, info.names[lang])
+		}
+	}
+	for _, lang := range sortedLangs(info.summaries) {
+		if lang == "" {
+			fmt.Fprintf(&b, "Comment=%s\n", info.summaries[lang])
+		} else {
+			fmt.Fprintf(&b, "Comment[%s]=%s\n", lang, info.summaries[lang])
+		}
+	}
+	return b.String()
+}
+
+func sortedLangs(translations map[string]string) []string {
+	langs := make([]string, 0, len(translations))
+	for lang := range translations {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// installMetainfo copies the AppStream metadata extracted into root to
+// metainfoDir as appName.xml, or removes a copy left from an earlier build
+// that had some.
+func installMetainfo(root, metainfoDir, appName string) error {
+	for _, pattern := range metainfoMembers {
+		matches, _ := filepath.Glob(filepath.Join(root, pattern))
+		for _, match := range matches {
+			if !isRegularFile(match) {
+				continue
+			}
+			if err := os.MkdirAll(metainfoDir, 0755); err != nil {
+				return fmt.Errorf("failed to create metainfo directory: %w", err)
+			}
+			content, err := os.ReadFile(match)
+			if err != nil {
+				return err
+			}
+			return replaceFile(filepath.Join(metainfoDir, appName+".xml"), content)
+		}
+	}
+	removeExtractedMetainfo(metainfoDir, appName)
+	return nil
+}
+
+// extractedAppStream returns the translations extracted for appName, which
+// are empty when its AppImage has no AppStream metadata.
+func extractedAppStream(metainfoDir, appName string) appStreamInfo {
+	path := filepath.Join(metainfoDir, appName+".xml")
+	info, err := parseAppStream(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Could not read AppStream metadata %s: %v", path, err)
+	}
+	return info
+}
+
+// removeExtractedMetainfo removes the AppStream metadata extracted for
+// appName, and what was recorded about its payload.
+func removeExtractedMetainfo(metainfoDir, appName string) {
+	for _, path := range []string{filepath.Join(metainfoDir, appName+".xml"), filepath.Join(metainfoDir, appName+payloadSuffix)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error removing metainfo %s: %v", path, err)
+		}
+	}
+}
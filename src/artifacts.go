@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// generatedFiles returns the files extraction generated for the AppImage
+// named appName besides its entry, as far as they exist: its icon, its
+// AppStream metadata and what was learnt about its payload.
+func generatedFiles(iconDir, metainfoDir, appName string) []string {
+	var files []string
+	for _, ext := range iconExtensions {
+		if path := filepath.Join(iconDir, appName+ext); isRegularFile(path) {
+			files = append(files, path)
+		}
+	}
+	for _, suffix := range []string{".xml", payloadSuffix} {
+		if path := filepath.Join(metainfoDir, appName+suffix); isRegularFile(path) {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// generatedArtifacts returns the files generated for the AppImage at path
+// besides its entry desktopFilePath, as far as they exist: those of
+// generatedFiles, the entries of its bundled apps, its icon theme copies and
+// its polkit policy.
+func generatedArtifacts(w WatcherConfig, path, desktopFilePath string) []string {
+	opts, _ := currentExtraction()
+	appName := appNameFromPath(path)
+	files := append(generatedFiles(opts.iconDir, opts.metainfoDir, appName), splitArtifacts(appName, desktopFilePath)...)
+	files = append(files, themeIcons(w, desktopFilePath)...)
+	if policy := polkitPolicyPath(execPath(w, path)); rootHandling(w, appName) == rootAppsPkexec && isRegularFile(policy) {
+		files = append(files, policy)
+	}
+	return files
+}
+
+// artifactsOf returns the files to remove along with the entry of the
+// AppImage at path: the ones its record lists, or for records from before
+// they were listed, and AppImages without one, the ones named after it.
+// Files another recorded AppImage uses too, which happens when AppImages
+// in different watchers are named alike, are left out.
+func (s *stateStore) artifactsOf(path, iconDir, metainfoDir string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := generatedFiles(iconDir, metainfoDir, appNameFromPath(path))
+	if app, ok := s.apps[path]; ok && app.Artifacts != nil {
+		files = app.Artifacts
+	}
+	return s.ownFiles(path, files)
+}
+
+// ownArtifacts leaves out of files, generated for the AppImage at path, the
+// ones another recorded AppImage uses too.
+func (s *stateStore) ownArtifacts(path string, files []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ownFiles(path, files)
+}
+
+// ownFiles is ownArtifacts with s.mu held.
+func (s *stateStore) ownFiles(path string, files []string) []string {
+	appName := appNameFromPath(path)
+	var own []string
+	for _, file := range files {
+		shared := false
+		for _, other := range s.apps {
+			if other.Path == path {
+				continue
+			}
+			if other.Artifacts == nil && appNameFromPath(other.Path) == appName || containsString(other.Artifacts, file) {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			own = append(own, file)
+		}
+	}
+	return own
+}
+
+// removeArtifacts deletes files, which artifactsOf returned, and returns the
+// ones it removed.
+func removeArtifacts(files []string) []string {
+	var removed []string
+	for _, file := range files {
+		if err := os.Remove(file); err == nil {
+			removed = append(removed, file)
+		} else if !os.IsNotExist(err) {
+			log.Errorf("Error removing %s: %v", file, err)
+		}
+	}
+	return removed
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,19 @@
+//go:build freebsd || netbsd || darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the last access time recorded for info, or the zero
+// time when it is unavailable.
+func accessTime(info os.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(st.Atimespec.Sec, st.Atimespec.Nsec)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "sync/atomic"
+
+// auditEnabled is set from audit_mode. While it is on, the daemon watches and
+// logs what it would do but leaves AppImages, desktop entries, icons and the
+// state file untouched.
+var auditEnabled atomic.Bool
+
+// maintenanceEnabled is set while maintenance mode, switched at runtime with
+// "desktopimage maintenance", freezes the daemon the same way.
+var maintenanceEnabled atomic.Bool
+
+func configureAudit(cfg Config) {
+	if cfg.AuditMode && !auditEnabled.Load() {
+		log.Warn("Audit mode is on, changes are only logged and nothing is written.")
+	}
+	auditEnabled.Store(cfg.AuditMode)
+}
+
+func auditMode() bool {
+	return auditEnabled.Load() || maintenanceEnabled.Load()
+}
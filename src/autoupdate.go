@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// downloadClient fetches updates. Builds are large, so there is no overall
+// timeout, only one for the server to start answering.
+var downloadClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: time.Minute,
+}}
+
+// applyUpdate downloads update next to the AppImage at path, continuing the
+// download an earlier check left unfinished, and replaces the AppImage with
+// it once it matches the zsync file and passes the checks a new AppImage
+// goes through. The watcher then integrates the new build like any other
+// replaced AppImage.
+func applyUpdate(ctx context.Context, w WatcherConfig, path string, update *availableUpdate) error {
+	if update.url == "" {
+		return fmt.Errorf("the zsync file of %s names no download", update.file)
+	}
+	if auditMode() {
+		w.logger().Infof("Audit mode: would update %s to %s", path, update.file)
+		return nil
+	}
+	part := partialDownload(path, update.sha1)
+	removeStaleDownloads(path, part)
+	w.logger().Infof("Downloading %s to update %s", update.file, path)
+	if err := download(ctx, update.url, part, update.length); err != nil {
+		// Kept, the next check continues where this one stopped.
+		return err
+	}
+	if err := verifyDownload(part, update); err != nil {
+		os.Remove(part)
+		return err
+	}
+	if err := validateAppImage(ctx, part); err != nil {
+		os.Remove(part)
+		return fmt.Errorf("failed to validate the download: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(part, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(part, path); err != nil {
+		return fmt.Errorf("failed to replace the AppImage: %w", err)
+	}
+	w.logger().Infof("Updated %s to %s.", path, update.file)
+	return nil
+}
+
+// partialDownload returns where the build with the SHA-1 sum that updates
+// the AppImage at path is downloaded to: a hidden file next to it, so that
+// it replaces the AppImage by a rename, which watchers take for a single
+// change.
+func partialDownload(path, sum string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+sum+".part")
+}
+
+// removeStaleDownloads removes the unfinished downloads of earlier builds of
+// the AppImage at path, which were replaced by the one going to keep.
+func removeStaleDownloads(path, keep string) {
+	parts, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".*.part"))
+	for _, part := range parts {
+		if part != keep {
+			os.Remove(part)
+		}
+	}
+}
+
+// download fetches link into dest, which is to end up length bytes long
+// when length is known. What dest holds already is kept and only the rest
+// is requested, unless the server doesn't support ranges. A server sending
+// more than length bytes is cut off.
+func download(ctx context.Context, link, dest string, length int64) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "DesktopImage")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	start := offset
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == offset:
+		log.Debugf("Resuming the download of %s at %d bytes", link, offset)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Complete already, verification tells.
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		start = 0
+	default:
+		return fmt.Errorf("failed to fetch %s: %s", link, resp.Status)
+	}
+	body := io.Reader(resp.Body)
+	if length > 0 {
+		// The byte past length tells a build longer than announced.
+		body = io.LimitReader(resp.Body, length-start+1)
+	}
+	written, err := io.Copy(f, body)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", link, err)
+	}
+	if length > 0 && start+written > length {
+		// Not worth resuming.
+		f.Truncate(0)
+		return fmt.Errorf("the download of %s has more than the %d bytes announced", link, length)
+	}
+	if length > 0 && start+written < length {
+		return fmt.Errorf("the download of %s stopped at %d of %d bytes", link, start+written, length)
+	}
+	return f.Close()
+}
+
+// contentRangeStart returns the first byte of a partial response, or -1.
+func contentRangeStart(resp *http.Response) int64 {
+	rng := strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	start, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// verifyDownload checks the download at path against the length and SHA-1
+// the zsync file of update gives.
+func verifyDownload(path string, update *availableUpdate) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if update.length > 0 && info.Size() != update.length {
+		return fmt.Errorf("the download of %s has %d bytes, not %d", update.file, info.Size(), update.length)
+	}
+	sum, err := sha1File(path)
+	if err != nil {
+		return err
+	}
+	if sum != update.sha1 {
+		return fmt.Errorf("the download of %s has SHA-1 %s, not %s", update.file, sum, update.sha1)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// batchCommand is one line read by "desktopimage batch".
+type batchCommand struct {
+	// ID is passed back in the result, so that callers can match them up.
+	ID string `json:"id,omitempty"`
+	// Command is "integrate", "remove" or "rescan".
+	Command string `json:"command"`
+	// Path is the AppImage to integrate or remove, or the app_path of the
+	// watcher to rescan; without one a rescan covers every watcher.
+	Path string `json:"path,omitempty"`
+}
+
+// batchResult is written for every batchCommand, with the data of a
+// controlResponse: the entry written, the files removed or the watchers
+// rescanned.
+type batchResult struct {
+	ID string `json:"id,omitempty"`
+	controlResponse
+}
+
+// integrateResult is the data of an integrate command.
+type integrateResult struct {
+	DesktopFile string `json:"desktop_file"`
+	// Changed is false when the entry was up to date.
+	Changed bool `json:"changed"`
+}
+
+// runBatch handles "batch", which reads newline-delimited JSON commands
+// from stdin and writes a JSON result line for each to stdout, so that
+// download managers and scripts can integrate AppImages without a daemon.
+// Like import-dir it changes the daemon's state, so it only runs while the
+// daemon is stopped.
+func runBatch(args []string) int {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	desktopPath := fs.String("desktop-path", "", "directory for the entries of AppImages outside every app_path (default ~/.local/share/applications)")
+	categories := fs.String("categories", "", "categories of those entries (default from [defaults], or Application)")
+	verbose := fs.Bool("verbose", false, "log to stderr what is done")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "batch: expected the commands on stdin")
+		return exitUsage
+	}
+	if *desktopPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "batch: %v, pass --desktop-path\n", err)
+			return exitUsage
+		}
+		*desktopPath = filepath.Join(home, ".local", "share", "applications")
+	}
+
+	lock, err := lockDataDir(startupDataDir(configFilePath))
+	if errors.Is(err, errLockHeld) {
+		fmt.Fprintf(os.Stderr, "batch: the daemon is running (%v); stop it, or let its watchers pick the AppImages up\n", err)
+		return exitCode(err)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "batch: %v\n", err)
+		return exitCode(err)
+	}
+	defer lock.Close()
+
+	if !*verbose {
+		log.SetLevel(logrus.WarnLevel)
+	}
+	if err := loadConfig(configFilePath); err != nil {
+		fmt.Fprintf(os.Stderr, "batch: %v\n", err)
+		return exitCode(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	template := WatcherConfig{Name: importWatcherName, DesktopPath: *desktopPath, Categories: *categories}.withDefaults(config.Defaults)
+	if template.Categories == "" {
+		template.Categories = "Application"
+	}
+	if err := serveBatch(ctx, os.Stdin, os.Stdout, template); err != nil {
+		fmt.Fprintf(os.Stderr, "batch: %v\n", err)
+		return exitFailure
+	}
+	return 0
+}
+
+// serveBatch runs the commands read from in until it ends or ctx is done.
+// AppImages outside the app_path of every watcher are integrated with a
+// watcher like template. Each result is written, and the state flushed,
+// once the command is done.
+func serveBatch(ctx context.Context, in io.Reader, out io.Writer, template WatcherConfig) error {
+	refresher := newDBRefresher(config.refreshDelay(), config.refreshMaxDelay())
+	scanner := bufio.NewScanner(in)
+	enc := json.NewEncoder(out)
+	for ctx.Err() == nil && scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var cmd batchCommand
+		var result batchResult
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			result.controlResponse = errorResponse(fmt.Errorf("invalid command: %v", err))
+		} else {
+			result = batchResult{ID: cmd.ID, controlResponse: runBatchCommand(ctx, cmd, template, refresher)}
+		}
+		refresher.flush()
+		flushState(currentState())
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func runBatchCommand(ctx context.Context, cmd batchCommand, template WatcherConfig, refresher *dbRefresher) controlResponse {
+	path := cmd.Path
+	if path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return errorResponse(err)
+		}
+		path = abs
+	}
+	switch cmd.Command {
+	case "integrate":
+		if path == "" {
+			return errorResponse(errors.New("missing path"))
+		}
+		if !isRegularFile(path) {
+			return errorResponse(fmt.Errorf("%s is not a file", path))
+		}
+		w := batchWatcher(filepath.Dir(path), template)
+		changed := integrateAppImage(ctx, w, path, refresher)
+		if changed {
+			refresher.request(w.DesktopPath)
+		}
+		app, ok := currentState().get(path)
+		if !ok {
+			return errorResponse(fmt.Errorf("%s was not integrated, run with --verbose to see why", path))
+		}
+		return okResponse(integrateResult{DesktopFile: app.DesktopFile, Changed: changed})
+	case "remove":
+		if path == "" {
+			return errorResponse(errors.New("missing path"))
+		}
+		removed, err := removeSource(config, currentState(), path)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return okResponse(removed)
+	case "rescan":
+		rescanned := []string{}
+		for _, w := range batchWatchers() {
+			if path != "" && filepath.Clean(w.AppPath) != path {
+				continue
+			}
+			reconcile(ctx, w, scanWorkers(config), refresher)
+			rescanned = append(rescanned, w.label())
+		}
+		if path != "" && len(rescanned) == 0 {
+			return errorResponse(fmt.Errorf("no watcher watches %s", path))
+		}
+		return okResponse(rescanned)
+	default:
+		return errorResponse(fmt.Errorf("unknown command %q", cmd.Command))
+	}
+}
+
+// batchWatchers returns the watchers the daemon would run.
+func batchWatchers() []WatcherConfig {
+	var watchers []WatcherConfig
+	profile := activeProfile(config)
+	for _, w := range config.watchers() {
+		if w.enabled() && w.inProfile(profile) {
+			watchers = append(watchers, w)
+		}
+	}
+	return watchers
+}
+
+// batchWatcher returns the watcher whose app_path is dir, or one like
+// template for it.
+func batchWatcher(dir string, template WatcherConfig) WatcherConfig {
+	for _, w := range batchWatchers() {
+		if filepath.Clean(w.AppPath) == dir {
+			return w
+		}
+	}
+	w := template
+	w.AppPath = dir
+	return w
+}
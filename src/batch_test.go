@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeBatch(t *testing.T) {
+	cfg := Config{DataDir: t.TempDir()}
+	useTestConfig(t, cfg)
+	prev := config
+	config = cfg
+	t.Cleanup(func() { config = prev })
+	useFakeCommands(t)
+	w := newTestWatcher(t)
+	hello := addAppImage(t, w.AppPath, "Hello")
+	entry := filepath.Join(w.DesktopPath, "Hello.desktop")
+
+	in := strings.Join([]string{
+		`{"id":"1","command":"integrate","path":"` + hello + `"}`,
+		`{"id":"2","command":"integrate","path":"` + hello + `"}`,
+		`{"id":"3","command":"integrate","path":"` + filepath.Join(w.AppPath, "Missing.AppImage") + `"}`,
+		`not json`,
+		`{"id":"4","command":"launch"}`,
+		`{"id":"5","command":"remove","path":"` + hello + `"}`,
+	}, "\n")
+	var out bytes.Buffer
+	template := WatcherConfig{Name: importWatcherName, DesktopPath: w.DesktopPath, Categories: "Utility"}
+	if err := serveBatch(context.Background(), strings.NewReader(in), &out, template); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []batchResult
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var r batchResult
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, r)
+	}
+	if len(results) != 6 {
+		t.Fatalf("got %d results, want one per command: %+v", len(results), results)
+	}
+
+	for i, want := range []integrateResult{{DesktopFile: entry, Changed: true}, {DesktopFile: entry}} {
+		var got integrateResult
+		if !results[i].OK || json.Unmarshal(results[i].Data, &got) != nil || got != want {
+			t.Errorf("integrate %s: %+v (%s), want %+v", results[i].ID, results[i], results[i].Data, want)
+		}
+	}
+	for _, r := range results[2:5] {
+		if r.OK || r.Error == "" {
+			t.Errorf("result %+v, want an error", r)
+		}
+	}
+	if results[3].ID != "" || results[4].ID != "4" {
+		t.Errorf("IDs %q and %q, want none for the invalid line and 4", results[3].ID, results[4].ID)
+	}
+	var removed []string
+	if !results[5].OK || json.Unmarshal(results[5].Data, &removed) != nil || !containsString(removed, entry) {
+		t.Errorf("remove: %+v (%s), want %s removed", results[5], results[5].Data, entry)
+	}
+	if exists(entry) {
+		t.Errorf("%s still exists after remove", entry)
+	}
+}
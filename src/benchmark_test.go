@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// The benchmarks cover the stages every AppImage goes through. Compare runs
+// with benchstat before and after changes to the pipeline:
+//
+//	go test -run '^$' -bench . -count 10 > old.txt
+
+const benchScanSize = 200
+
+// unthrottled lifts the integration rate limit, which would otherwise
+// dominate every benchmark integrating more than a burst of AppImages.
+var unthrottled = Config{MaxIntegrationRate: 1e9, IntegrationBurst: 1 << 30}
+
+func BenchmarkRenderDesktopEntry(b *testing.B) {
+	useTestConfig(b, unthrottled)
+	w := newTestWatcher(b)
+	info := appStreamInfo{
+		names:     map[string]string{"de": "Hallo Welt", "fr": "Bonjour le monde"},
+		summaries: map[string]string{"": "Says hello", "de": "Sagt hallo"},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := renderDesktopEntry(context.Background(), w, "Hello World-1.2.3", "/icons/hello.png", "", info); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHandleEvent(b *testing.B) {
+	useTestConfig(b, unthrottled)
+	w := newTestWatcher(b)
+	cfg := unthrottled
+	cfg.SettleDelay = time.Hour
+	aw := newAppWatcher(w, cfg, newDBRefresher(time.Hour, time.Hour))
+	defer aw.cancelPending()
+
+	events := make([]fsnotify.Event, 64)
+	for i := range events {
+		events[i] = fsnotify.Event{Name: filepath.Join(w.AppPath, fmt.Sprintf("App%d.AppImage", i)), Op: fsnotify.Write}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Writes to a file being copied, which only push its timer back.
+		aw.handleEvent(context.Background(), events[i%len(events)])
+	}
+}
+
+// BenchmarkInitialScan integrates a directory of new AppImages with icon
+// extraction turned off.
+func BenchmarkInitialScan(b *testing.B) {
+	noIcons := false
+	cfg := unthrottled
+	cfg.ExtractIcons = &noIcons
+	useTestConfig(b, cfg)
+	w := newTestWatcher(b)
+	for i := 0; i < benchScanSize; i++ {
+		addAppImage(b, w.AppPath, fmt.Sprintf("App%d", i))
+	}
+	refresher := newDBRefresher(time.Hour, time.Hour)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		stateMu.Lock()
+		state = nil
+		stateMu.Unlock()
+		if err := os.RemoveAll(w.DesktopPath); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		reconcile(context.Background(), w, 4, refresher)
+	}
+}
+
+// BenchmarkRescan scans a directory whose AppImages are all integrated
+// already, which is what every startup after a configuration change costs.
+func BenchmarkRescan(b *testing.B) {
+	noIcons := false
+	cfg := unthrottled
+	cfg.ExtractIcons = &noIcons
+	useTestConfig(b, cfg)
+	w := newTestWatcher(b)
+	for i := 0; i < benchScanSize; i++ {
+		addAppImage(b, w.AppPath, fmt.Sprintf("App%d", i))
+	}
+	refresher := newDBRefresher(time.Hour, time.Hour)
+	reconcile(context.Background(), w, 4, refresher)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reconcile(context.Background(), w, 4, refresher)
+	}
+}
+
+// BenchmarkExtractIcon measures extraction with the unsquashfs stand-in,
+// that is everything but the decompression itself: listing and checking
+// the members, copying the icon and storing the metadata.
+func BenchmarkExtractIcon(b *testing.B) {
+	useTestConfig(b, unthrottled)
+	path := addAppImage(b, b.TempDir(), "Hello")
+	if opts, _ := currentExtraction(); !opts.enabled {
+		b.Skip("extraction is unavailable")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		icon, err := extractIcon(context.Background(), path, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if icon == "" {
+			b.Fatal("no icon extracted")
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mainCategories are the main categories of the freedesktop menu
+// specification, which menus sort entries by.
+var mainCategories = []string{
+	"AudioVideo", "Audio", "Video", "Development", "Education", "Game", "Graphics",
+	"Network", "Office", "Science", "Settings", "System", "Utility",
+}
+
+// additionalCategories are the additional categories of the specification,
+// by the main category they are usually listed with.
+var additionalCategories = map[string][]string{
+	"AudioVideo": {"Midi", "Mixer", "Sequencer", "Tuner", "TV", "AudioVideoEditing", "Player", "Recorder", "DiscBurning", "Music"},
+	"Development": {"Building", "Debugger", "IDE", "GUIDesigner", "Profiling", "RevisionControl", "Translation",
+		"WebDevelopment", "Documentation"},
+	"Education": {"Art", "Construction", "Languages", "Literature", "History", "Humanities", "Spirituality", "Sports"},
+	"Game": {"ActionGame", "AdventureGame", "ArcadeGame", "BoardGame", "BlocksGame", "CardGame", "KidsGame",
+		"LogicGame", "RolePlaying", "Shooter", "Simulation", "SportsGame", "StrategyGame", "Emulator"},
+	"Graphics": {"2DGraphics", "VectorGraphics", "RasterGraphics", "3DGraphics", "Scanning", "OCR", "Photography",
+		"Publishing", "Viewer", "ImageProcessing"},
+	"Network": {"Dialup", "InstantMessaging", "Chat", "IRCClient", "Feed", "FileTransfer", "HamRadio", "News",
+		"P2P", "RemoteAccess", "Telephony", "VideoConference", "WebBrowser", "Email"},
+	"Office": {"Calendar", "ContactManagement", "Database", "Dictionary", "Chart", "Finance", "FlowChart", "PDA",
+		"ProjectManagement", "Presentation", "Spreadsheet", "WordProcessor"},
+	"Science": {"ArtificialIntelligence", "Astronomy", "Biology", "Chemistry", "ComputerScience", "DataVisualization",
+		"Economy", "Electricity", "Geography", "Geology", "Geoscience", "Math", "NumericalAnalysis",
+		"MedicalSoftware", "Physics", "Robotics", "ParallelComputing", "Electronics", "Engineering", "Maps"},
+	"Settings": {"DesktopSettings", "HardwareSettings", "Printing", "PackageManager", "Accessibility", "Security"},
+	"System":   {"Filesystem", "Monitor", "TerminalEmulator", "FileManager", "Core"},
+	"Utility": {"TextTools", "TelephonyTools", "Archiving", "Compression", "FileTools", "Calculator", "Clock",
+		"TextEditor", "Amusement", "ConsoleOnly"},
+	// Desktops and toolkits, which don't need a main category of their
+	// own.
+	"": {"KDE", "GNOME", "XFCE", "DDE", "GTK", "Qt", "Motif", "Java", "Adult", "Screensaver", "TrayIcon", "Applet", "Shell"},
+}
+
+// categorySynonyms maps what users write for categories, lowercased without
+// spaces, to the categories they mean.
+var categorySynonyms = map[string][]string{
+	"multimedia": {"AudioVideo"}, "media": {"AudioVideo"}, "sound": {"Audio"}, "movie": {"Video"},
+	"programming": {"Development"}, "dev": {"Development"}, "developer": {"Development"}, "coding": {"Development"},
+	"learning": {"Education"}, "gaming": {"Game"}, "emulation": {"Game", "Emulator"},
+	"design": {"Graphics"}, "image": {"Graphics"}, "drawing": {"Graphics", "2DGraphics"}, "painting": {"Graphics", "RasterGraphics"},
+	"vector": {"Graphics", "VectorGraphics"}, "3d": {"Graphics", "3DGraphics"}, "photo": {"Graphics", "Photography"},
+	"internet": {"Network"}, "web": {"Network", "WebBrowser"}, "browser": {"Network", "WebBrowser"},
+	"mail": {"Network", "Email"}, "messaging": {"Network", "InstantMessaging"}, "messenger": {"Network", "InstantMessaging"},
+	"productivity": {"Office"}, "notes": {"Office"}, "wordprocessing": {"Office", "WordProcessor"},
+	"preferences": {"Settings"}, "systemtools": {"System"}, "administration": {"System"}, "terminal": {"System", "TerminalEmulator"},
+	"tools": {"Utility"}, "tool": {"Utility"}, "utilities": {"Utility"}, "accessories": {"Utility"},
+	"editor": {"Utility", "TextEditor"}, "maths": {"Science", "Math"}, "mathematics": {"Science", "Math"},
+	"application": {"Application"},
+}
+
+// knownCategories maps every category, lowercased, to how it is spelled,
+// and additionalParents the additional ones to their main category.
+var knownCategories, additionalParents = func() (map[string]string, map[string]string) {
+	known := make(map[string]string)
+	parents := make(map[string]string)
+	for _, category := range mainCategories {
+		known[strings.ToLower(category)] = category
+	}
+	for parent, categories := range additionalCategories {
+		for _, category := range categories {
+			known[strings.ToLower(category)] = category
+			parents[category] = parent
+		}
+	}
+	return known, parents
+}()
+
+// normalizeCategories turns value, such as "Graphics/Photo" or "Games", into
+// freedesktop categories, "Graphics;Photography;" and "Game;". Values are
+// split at semicolons, commas, slashes, bars and ampersands, and matched
+// ignoring case, spaces and plurals, or as one of categorySynonyms. The main
+// category of additional ones is added when it is missing; as the
+// specification asks, AudioVideo is added to Audio and Video. The legacy
+// Application and X- extensions are kept, and values that are valid already
+// are returned as they are. It also returns notes on what was
+// changed, other than the spelling, and what was left out.
+func normalizeCategories(value string) (string, []string) {
+	var categories, notes []string
+	add := func(category string) {
+		if !containsString(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(";,/|&", r) }) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.HasPrefix(field, "X-") && !strings.ContainsAny(field, " \t\n\r\\") {
+			add(field)
+			continue
+		}
+		matched := matchCategory(field)
+		if matched == nil {
+			notes = append(notes, fmt.Sprintf("%q isn't a freedesktop category and is left out", field))
+			continue
+		}
+		if !strings.EqualFold(strings.Join(matched, ""), strings.Join(strings.Fields(field), "")) {
+			notes = append(notes, fmt.Sprintf("%q is read as %s", field, strings.Join(matched, ";")))
+		}
+		for _, category := range matched {
+			add(category)
+		}
+	}
+
+	// Main categories go first, and every additional one needs one.
+	var ordered []string
+	hasMain := func(main string) bool { return containsString(ordered, main) }
+	for _, category := range categories {
+		if containsString(mainCategories, category) {
+			ordered = append(ordered, category)
+		}
+	}
+	if (hasMain("Audio") || hasMain("Video")) && !hasMain("AudioVideo") {
+		ordered = append([]string{"AudioVideo"}, ordered...)
+	}
+	for _, category := range categories {
+		if containsString(mainCategories, category) {
+			continue
+		}
+		if parent := additionalParents[category]; parent != "" && !hasAnyMain(ordered) {
+			ordered = append(ordered, parent)
+		}
+		ordered = append(ordered, category)
+	}
+	if len(ordered) == 0 {
+		return "", notes
+	}
+	// Valid values are kept as they were written.
+	var written []string
+	for _, field := range strings.Split(value, ";") {
+		if field != "" {
+			written = append(written, field)
+		}
+	}
+	if strings.Join(written, ";") == strings.Join(ordered, ";") {
+		return value, notes
+	}
+	return strings.Join(ordered, ";") + ";", notes
+}
+
+// matchCategory returns the categories field stands for, or nil.
+func matchCategory(field string) []string {
+	key := strings.ToLower(strings.Join(strings.Fields(field), ""))
+	for _, candidate := range []string{key, strings.TrimSuffix(key, "s")} {
+		if category, ok := knownCategories[candidate]; ok {
+			return []string{category}
+		}
+		if categories, ok := categorySynonyms[candidate]; ok {
+			return categories
+		}
+	}
+	return nil
+}
+
+func hasAnyMain(categories []string) bool {
+	for _, category := range categories {
+		if containsString(mainCategories, category) {
+			return true
+		}
+	}
+	return false
+}
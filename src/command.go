@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: desktopimage [command]
+
+Without a command the watcher daemon is started, with --profile NAME
+running only the watchers of that profile.
+
+Commands:
+  list [--quarantined|--failed|--updates]     list integrated (or quarantined, or failing) AppImages, or their updates
+  config show [--effective]                   print the configuration files, or the settings the daemon runs with
+  config check [--strict]                     validate the configuration and warn about risky setups
+  remove --source <appimage>                  remove the entry and icon generated for an AppImage
+  import-dir [--recursive] <dir>              integrate the AppImages of a directory once, without watching it
+  batch [--desktop-path D]                    run integrate, remove and rescan commands read as JSON lines from stdin
+  updates [--details]                         list the updates found by update_schedule, with their release notes
+  hold|unhold <app>                           keep auto_update from installing the updates of an AppImage, or stop
+  report unused [--older-than 90d] [--list]   list AppImages not launched recently
+  report size                                 show disk usage per managed AppImage
+  watcher list                                list configured watchers
+  watcher add --name N --app-path P --desktop-path D [--categories C] [--icon-path I] [--disabled]
+                                              add a watcher as a conf.d drop-in
+  watcher remove <name>                       remove a watcher from config.toml or conf.d
+  watcher enable|disable [--persist] <name>   toggle a watcher of the running daemon, --persist saves it
+  watcher pause [--policy queue|drop] <name>  stop a watcher of the running daemon from handling events for now
+  watcher resume <name>                       handle what happened while a watcher was paused
+  watcher trace [<name>]                      show the latest raw file system events, recorded with trace_events
+  maintenance [on|off]                        freeze all changes of the running daemon, only logging them, or rescan after
+  profile [<name>|--clear]                    show or switch the profile of the running daemon
+  apparmor generate <app> [--write|--load]    print, install or load a starter AppArmor profile
+  launch [--isolate] [--display=wayland|x11] <appimage> [args]
+                                              run an AppImage with its own home directory or display server
+  selftest [--verbose] [--keep]               check that AppImages get integrated, in a temporary directory
+  privileged write|remove <entry>|refresh <dir>|serve
+                                              change a system desktop directory, run as root for elevate
+  help                                        show this help
+`
+
+// runCommand dispatches a CLI subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case launchCommand:
+		return runLaunch(args[1:])
+	case "list":
+		return runList(args[1:])
+	case "config":
+		return runConfig(args[1:])
+	case "remove":
+		return runRemove(args[1:])
+	case "import-dir":
+		return runImport(args[1:])
+	case "batch":
+		return runBatch(args[1:])
+	case "maintenance":
+		return runMaintenance(args[1:])
+	case "updates":
+		return runUpdates(args[1:])
+	case "hold":
+		return runHold(args[1:], true)
+	case "unhold":
+		return runHold(args[1:], false)
+	case "report":
+		return runReport(args[1:])
+	case "watcher":
+		return runWatcherCommand(args[1:])
+	case "profile":
+		return runProfile(args[1:])
+	case "apparmor":
+		return runAppArmor(args[1:])
+	case "selftest":
+		return runSelftest(args[1:])
+	case privilegedCommand:
+		return runPrivileged(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+}
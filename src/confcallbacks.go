@@ -0,0 +1,175 @@
+package main
+
+import (
+	"reflect"
+	"runtime/debug"
+	"sync"
+)
+
+// ConfigCallback is called with each change of the configuration.
+type ConfigCallback func(change ConfigChange)
+
+// ConfigChange describes a change of the configuration. The watchers are
+// compared by label as Config.watchers returns them, with the defaults
+// applied, so that a change of [defaults] shows as a change of the watchers
+// it affects.
+type ConfigChange struct {
+	Old, New Config
+	// Added and Changed hold watchers of New, Removed watchers of Old.
+	Added, Removed, Changed []WatcherConfig
+	// Settings is set when anything besides the watchers changed, which
+	// may affect all of them.
+	Settings bool
+	// Logging is set when log_level, log_format or trace_events changed.
+	// They are left out of Settings, as they don't affect the watchers.
+	Logging bool
+}
+
+// diffConfigs returns the change from old to updated.
+func diffConfigs(old, updated Config) ConfigChange {
+	change := ConfigChange{
+		Old:      old,
+		New:      updated,
+		Settings: !reflect.DeepEqual(settingsOf(old), settingsOf(updated)),
+		Logging: old.logLevel() != updated.logLevel() || old.logFormat() != updated.logFormat() ||
+			old.TraceEvents != updated.TraceEvents,
+	}
+	before := make(map[string]WatcherConfig)
+	for _, w := range old.watchers() {
+		before[w.label()] = w
+	}
+	after := make(map[string]bool)
+	for _, w := range updated.watchers() {
+		after[w.label()] = true
+		if prev, ok := before[w.label()]; !ok {
+			change.Added = append(change.Added, w)
+		} else if !reflect.DeepEqual(prev, w) {
+			change.Changed = append(change.Changed, w)
+		}
+	}
+	for _, w := range old.watchers() {
+		if !after[w.label()] {
+			change.Removed = append(change.Removed, w)
+		}
+	}
+	return change
+}
+
+// settingsOf returns cfg without what defines its watchers, or logging.
+func settingsOf(cfg Config) Config {
+	cfg.LogLevel = ""
+	cfg.LogFormat = ""
+	cfg.TraceEvents = false
+	cfg.WatcherConfig = WatcherConfig{}
+	cfg.Watchers = nil
+	cfg.Defaults = EntryDefaults{}
+	cfg.UseDefaultWatchers = false
+	return cfg
+}
+
+// empty reports whether nothing changed.
+func (c ConfigChange) empty() bool {
+	return !c.Settings && !c.Logging && len(c.Added)+len(c.Removed)+len(c.Changed) == 0
+}
+
+// CallbackHandle stands for callbacks added together, until they are
+// removed with Remove.
+type CallbackHandle struct {
+	r  *callbackRegistry
+	id uint64
+}
+
+// callbackRegistry holds the callbacks of a ConfManager.
+type callbackRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	entries []callbackEntry
+	// running counts the asynchronous calls that haven't returned.
+	running sync.WaitGroup
+}
+
+type callbackEntry struct {
+	id   uint64
+	fn   ConfigCallback
+	sync bool
+}
+
+// AddCallbacks adds callbacks that are called with every change of the
+// configuration, each in a goroutine of its own. They may run concurrently
+// with each other and with the next change, so they must not depend on the
+// order they are called in; AddSyncCallbacks adds callbacks that may.
+func (m *ConfManager) AddCallbacks(fns ...ConfigCallback) *CallbackHandle {
+	return m.callbacks.add(fns, false)
+}
+
+// AddSyncCallbacks adds callbacks that are called one after the other, in
+// the order they were added, before the change is announced any further.
+// A synchronous callback holds up reloads while it runs, so it should
+// return quickly and must not wait for the ConfManager.
+func (m *ConfManager) AddSyncCallbacks(fns ...ConfigCallback) *CallbackHandle {
+	return m.callbacks.add(fns, true)
+}
+
+// WaitCallbacks waits for the asynchronous callbacks that are running.
+func (m *ConfManager) WaitCallbacks() {
+	m.callbacks.running.Wait()
+}
+
+func (r *callbackRegistry) add(fns []ConfigCallback, sync bool) *CallbackHandle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	for _, fn := range fns {
+		r.entries = append(r.entries, callbackEntry{id: r.nextID, fn: fn, sync: sync})
+	}
+	return &CallbackHandle{r: r, id: r.nextID}
+}
+
+// Remove removes the callbacks, which aren't called for later changes. A
+// call that has started already is left to finish. Removing them again does
+// nothing.
+func (h *CallbackHandle) Remove() {
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+	kept := h.r.entries[:0]
+	for _, e := range h.r.entries {
+		if e.id != h.id {
+			kept = append(kept, e)
+		}
+	}
+	// Cleared so that the removed callbacks can be collected.
+	for i := len(kept); i < len(h.r.entries); i++ {
+		h.r.entries[i] = callbackEntry{}
+	}
+	h.r.entries = kept
+}
+
+// notify calls the callbacks with change: the synchronous ones in order
+// before it returns, the others in goroutines of their own.
+func (r *callbackRegistry) notify(change ConfigChange) {
+	r.mu.Lock()
+	entries := append([]callbackEntry(nil), r.entries...)
+	r.mu.Unlock()
+	for _, e := range entries {
+		if e.sync {
+			callCallback(e.fn, change)
+			continue
+		}
+		r.running.Add(1)
+		go func(fn ConfigCallback) {
+			defer r.running.Done()
+			callCallback(fn, change)
+		}(e.fn)
+	}
+}
+
+// callCallback calls fn, logging a panic rather than letting one callback
+// take the daemon down with it.
+func callCallback(fn ConfigCallback, change ConfigChange) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Errorf("Error in configuration callback: panic: %v\n%s", v, debug.Stack())
+		}
+	}()
+	fn(change)
+}
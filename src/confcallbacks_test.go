@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConfManagerSyncCallbacks(t *testing.T) {
+	cm := newConfManager("/etc/desktopimage/config.toml")
+	var calls []string
+	cm.AddSyncCallbacks(
+		func(c ConfigChange) { calls = append(calls, "first "+c.New.Profile) },
+		func(c ConfigChange) { calls = append(calls, "second "+c.New.Profile) },
+	)
+	third := cm.AddSyncCallbacks(func(c ConfigChange) { calls = append(calls, "third "+c.New.Profile) })
+
+	cm.Reloaded(Config{Profile: "a"})
+	third.Remove()
+	third.Remove()
+	cm.Reloaded(Config{Profile: "b"})
+
+	want := []string{"first a", "second a", "third a", "first b", "second b"}
+	if strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestConfManagerAsyncCallbacks(t *testing.T) {
+	cm := newConfManager("/etc/desktopimage/config.toml")
+	var mu sync.Mutex
+	profiles := make(map[string]int)
+	h := cm.AddCallbacks(func(c ConfigChange) {
+		mu.Lock()
+		defer mu.Unlock()
+		profiles[c.New.Profile]++
+	})
+	cm.Reloaded(Config{Profile: "a"})
+	cm.Reloaded(Config{Profile: "b"})
+	cm.WaitCallbacks()
+	h.Remove()
+	cm.Reloaded(Config{Profile: "c"})
+	cm.WaitCallbacks()
+
+	if profiles["a"] != 1 || profiles["b"] != 1 || profiles["c"] != 0 {
+		t.Errorf("calls per configuration = %v", profiles)
+	}
+}
+
+func TestConfManagerCallbackPanics(t *testing.T) {
+	logs := recordLogs(t)
+	cm := newConfManager("/etc/desktopimage/config.toml")
+	called := 0
+	cm.AddSyncCallbacks(func(ConfigChange) { panic("bad subscriber") })
+	cm.AddCallbacks(func(ConfigChange) { panic("bad subscriber") })
+	cm.AddSyncCallbacks(func(ConfigChange) { called++ })
+
+	cm.Reloaded(Config{Profile: "work"})
+	cm.WaitCallbacks()
+	if called != 1 {
+		t.Errorf("the callback after a panicking one was called %d time(s)", called)
+	}
+	if n := logs.count("bad subscriber"); n != 2 {
+		t.Errorf("%d panic(s) logged, want 2", n)
+	}
+}
+
+func TestConfManagerSaveCallbacks(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", managedConfig)
+	cm := newConfManager("/etc/desktopimage/config.toml")
+	cm.Reloaded(readTestConfig(t, "/etc/desktopimage/config.toml"))
+	var got []ConfigChange
+	cm.AddSyncCallbacks(func(c ConfigChange) { got = append(got, c) })
+
+	if err := cm.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("saving without changes called the callbacks")
+	}
+	if err := cm.RemoveWatcher("shared"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(got[0].Removed) != 1 || got[0].Removed[0].label() != "shared" || len(got[0].New.Watchers) != 1 {
+		t.Errorf("callbacks got %+v, want the removal of shared", got)
+	}
+}
+
+func readTestConfig(tb testing.TB, path string) Config {
+	tb.Helper()
+	cfg, err := readConfig(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cfg
+}
+
+func TestDiffConfigs(t *testing.T) {
+	disabled := false
+	old := Config{
+		Defaults: EntryDefaults{Categories: "Utility;"},
+		Watchers: []WatcherConfig{
+			{Name: "kept", AppPath: "/kept", DesktopPath: "/applications"},
+			{Name: "edited", AppPath: "/edited", DesktopPath: "/applications"},
+			{Name: "gone", AppPath: "/gone", DesktopPath: "/applications"},
+		},
+	}
+	updated := old
+	updated.Watchers = []WatcherConfig{
+		old.Watchers[0],
+		{Name: "edited", AppPath: "/edited", DesktopPath: "/applications", Enabled: &disabled},
+		{Name: "new", AppPath: "/new", DesktopPath: "/applications"},
+	}
+
+	change := diffConfigs(old, updated)
+	labels := func(ws []WatcherConfig) string {
+		var names []string
+		for _, w := range ws {
+			names = append(names, w.label())
+		}
+		return strings.Join(names, ",")
+	}
+	if got := labels(change.Added); got != "new" {
+		t.Errorf("Added = %s, want new", got)
+	}
+	if got := labels(change.Removed); got != "gone" {
+		t.Errorf("Removed = %s, want gone", got)
+	}
+	if got := labels(change.Changed); got != "edited" {
+		t.Errorf("Changed = %s, want edited", got)
+	}
+	if change.Settings {
+		t.Error("Settings is set though only watchers changed")
+	}
+	if change.Changed[0].Categories != "Utility;" {
+		t.Errorf("the defaults weren't applied to the changed watcher: %+v", change.Changed[0])
+	}
+
+	updated = old
+	updated.Defaults.Categories = "Development;"
+	if got := labels(diffConfigs(old, updated).Changed); got != "kept,edited,gone" {
+		t.Errorf("changing the defaults changed %s, want every watcher", got)
+	}
+	updated = old
+	updated.Profile = "work"
+	if change := diffConfigs(old, updated); !change.Settings || len(change.Added)+len(change.Removed)+len(change.Changed) != 0 {
+		t.Errorf("changing the profile gave %+v, want only Settings", change)
+	}
+	updated = old
+	updated.LogLevel = "debug"
+	if change := diffConfigs(old, updated); !change.Logging || change.Settings || change.empty() {
+		t.Errorf("changing log_level gave %+v, want only Logging", change)
+	}
+	updated.LogLevel = "info"
+	if change := diffConfigs(old, updated); !change.empty() {
+		t.Errorf("setting log_level to the default gave %+v, want no change", change)
+	}
+}
+
+func TestApplyLogging(t *testing.T) {
+	prevLevel, prevFormatter := log.GetLevel(), log.Formatter
+	t.Cleanup(func() {
+		log.SetLevel(prevLevel)
+		log.SetFormatter(prevFormatter)
+	})
+	old := Config{Watchers: []WatcherConfig{{Name: "kept", AppPath: "/kept", DesktopPath: "/applications"}}}
+	updated := old
+	updated.LogLevel = "debug"
+	updated.LogFormat = logFormatJSON
+	applyLogging(diffConfigs(old, updated))
+	if log.GetLevel() != logrus.DebugLevel {
+		t.Errorf("level %s after switching to debug", log.GetLevel())
+	}
+	if _, ok := log.Formatter.(*logrus.JSONFormatter); !ok {
+		t.Errorf("formatter %T after switching to json", log.Formatter)
+	}
+	applyLogging(diffConfigs(updated, old))
+	if log.GetLevel() != logrus.InfoLevel {
+		t.Errorf("level %s after switching back", log.GetLevel())
+	}
+	for _, level := range []string{"loud", "panic", "fatal"} {
+		if err := validateLogging(Config{LogLevel: level}); err == nil {
+			t.Errorf("log_level = %q was accepted", level)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// runConfig handles "config show", which prints config.toml and its drop-ins
+// as they are on disk, or with --effective the configuration the daemon
+// runs with, and "config check".
+func runConfig(args []string) int {
+	if len(args) > 0 && args[0] == "check" {
+		return runConfigCheck(args[1:])
+	}
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Fprintf(os.Stderr, "config: expected show or check\n\n%s", usage)
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	effective := fs.Bool("effective", false, "show the settings the daemon runs with, defaults filled in")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config show: %v\n", err)
+		return exitCode(err)
+	}
+	if !*effective {
+		if err := printConfigFiles(configFilePath); err != nil {
+			fmt.Fprintf(os.Stderr, "config show: %v\n", err)
+			return exitCode(err)
+		}
+		return 0
+	}
+
+	var text string
+	resp, err := sendControl(cfg.controlSocket(), controlRequest{Command: "get-config"})
+	if err == nil {
+		err = json.Unmarshal(resp.Data, &text)
+	}
+	if err != nil {
+		// Without a daemon to ask, the profile picked at runtime and the
+		// watchers toggled by "watcher enable|disable" are unknown.
+		fmt.Fprintf(os.Stderr, "config show: not asking the daemon (%v), showing the configuration it would start with\n", err)
+		if text, err = formatConfig(effectiveConfig(cfg, activeProfile(cfg))); err != nil {
+			fmt.Fprintf(os.Stderr, "config show: %v\n", err)
+			return exitFailure
+		}
+	}
+	fmt.Print(text)
+	return 0
+}
+
+// runConfigCheck validates the configuration and prints the warnings of
+// lintConfig, which fail the check with --strict.
+func runConfigCheck(args []string) int {
+	fs := flag.NewFlagSet("config check", flag.ContinueOnError)
+	strict := fs.Bool("strict", false, "fail on warnings too")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	cfg, err := readConfig(configFilePath)
+	if err == nil {
+		if err = validateConfig(cfg); err != nil {
+			err = fmt.Errorf("%w: %w", errInvalidConfig, err)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config check: %v\n", err)
+		return exitCode(err)
+	}
+	warnings := lintConfig(cfg)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "config check: warning: %s\n", warning)
+	}
+	if *strict && len(warnings) > 0 {
+		return exitConfig
+	}
+	fmt.Printf("%s is valid.\n", configFilePath)
+	return 0
+}
+
+// printConfigFiles prints the config file at configFilePath followed by its
+// drop-ins, in the order they are read.
+func printConfigFiles(configFilePath string) error {
+	dropIns, err := fsys.Glob(filepath.Join(configDropInDir(configFilePath), "*.toml"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(dropIns)
+	for i, path := range append([]string{configFilePath}, dropIns...) {
+		content, err := fsys.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("# %s\n%s", path, content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+// effectiveConfig returns cfg as the daemon applies it with profile active:
+// unset settings have their defaults, the top-level watcher, the watchers
+// of drop-ins, mount patterns and use_default_watchers are all listed as
+// [[Watcher]] blocks, and [defaults] is folded into them.
+func effectiveConfig(cfg Config, profile string) Config {
+	eff := cfg
+	eff.WatcherConfig = WatcherConfig{}
+	eff.Defaults = EntryDefaults{}
+	eff.Profile = profile
+	eff.ScanWorkers = scanWorkers(cfg)
+	eff.RefreshDelay = cfg.refreshDelay()
+	eff.RefreshMaxDelay = cfg.refreshMaxDelay()
+	eff.MaxIntegrationRate = cfg.integrationRate()
+	eff.IntegrationBurst = cfg.integrationBurst()
+	eff.SettleDelay = cfg.settleDelay()
+	eff.PausePolicy = cfg.pausePolicy()
+	eff.DataDir = cfg.dataDir()
+	eff.MaxExtractMB = cfg.maxExtractSize() >> 20
+	eff.ExtractTimeout = cfg.extractTimeout()
+	eff.MaxHashMB = cfg.maxHashSize() >> 20
+	eff.ControlSocket = cfg.controlSocket()
+	eff.StatusFile = cfg.statusFile()
+	eff.StatusInterval = cfg.statusInterval()
+	if cfg.UpdateSchedule != "" {
+		eff.UpdateJitter = cfg.updateJitter()
+	}
+	if eff.MaxExtractions <= 0 {
+		eff.MaxExtractions = defaultMaxExtractions
+	}
+	if eff.ChangeDetection == "" {
+		eff.ChangeDetection = changeDetectionMtime
+	}
+	on := true
+	if eff.ExtractIcons == nil {
+		eff.ExtractIcons = &on
+	}
+	if eff.SandboxExtraction == nil {
+		eff.SandboxExtraction = &on
+	}
+	if u, err := url.Parse(cfg.SentryDSN); err == nil && u.User != nil {
+		// The key is a credential, and dumps end up in bug reports.
+		u.User = url.User("REDACTED")
+		eff.SentryDSN = u.String()
+	}
+
+	eff.Watchers = nil
+	for _, w := range append(cfg.watchers(), cfg.mountTemplates()...) {
+		enabled := w.enabled()
+		w.Enabled = &enabled
+		if w.Terminal == nil {
+			off := false
+			w.Terminal = &off
+		}
+		if w.RequireMount && w.OnUnmount == "" {
+			w.OnUnmount = onUnmountHide
+		}
+		eff.Watchers = append(eff.Watchers, w)
+	}
+	return eff
+}
+
+// formatConfig renders an effective configuration as TOML. The top-level
+// watcher keys and [defaults] are left out, effectiveConfig moved them into
+// the watcher blocks.
+func formatConfig(cfg Config) (string, error) {
+	content, err := toml.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	tree, err := toml.LoadBytes(content)
+	if err != nil {
+		return "", err
+	}
+	watcherKeys, err := toml.Marshal(WatcherConfig{})
+	if err != nil {
+		return "", err
+	}
+	keys, err := toml.LoadBytes(watcherKeys)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range append(keys.Keys(), "defaults") {
+		if tree.Has(key) {
+			if err := tree.Delete(key); err != nil {
+				return "", err
+			}
+		}
+	}
+	return tree.ToTomlString()
+}
+
+// printStartupBanner writes the configuration the daemon starts with to the
+// log output, so that the journal shows which settings were in effect. With
+// log_format = "json" it is logged as a field of a single entry instead,
+// keeping every line of the output JSON.
+func printStartupBanner(cfg Config) {
+	text, err := formatConfig(effectiveConfig(cfg, activeProfile(cfg)))
+	if err != nil {
+		log.Errorf("Error formatting the effective configuration: %v", err)
+		return
+	}
+	if cfg.logFormat() == logFormatJSON {
+		log.WithField("config", text).Info("DesktopImage is starting with this configuration.")
+		return
+	}
+	fmt.Fprintf(log.Out, "DesktopImage is starting with this configuration:\n%s\n", strings.TrimRight(text, "\n"))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configSettleDelay is how long the configuration directories have to be
+// quiet before the files are compared with what was loaded. Editors save in
+// several steps, such as truncating and then writing or renaming the old
+// file away before creating the new one, and none of those may be loaded.
+const configSettleDelay = 200 * time.Millisecond
+
+// watchConfigFile asks for a reload on reloadConfig whenever the content of
+// configFilePath or of the drop-ins next to it changes. The directories are
+// watched rather than the files, and any event in them only leads to the
+// contents being compared, so that every way of saving a file is noticed:
+// writing in place, renaming a new file over it, renaming it away and
+// creating a new one, or replacing the symlink to it.
+func watchConfigFile(ctx context.Context, configFilePath string, reloadConfig chan bool) {
+	watcher, err := newDirWatcher()
+	if err != nil {
+		exitWith(err, "Error initializing config file watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	// Creating the drop-in directory also creates the configuration
+	// directory, which has to exist before it can be watched.
+	dropInDir := configDropInDir(configFilePath)
+	if err := fsys.MkdirAll(dropInDir, 0755); err != nil {
+		exitWith(err, "Error creating drop-in config directory: %v", err)
+	}
+	if err := watcher.Add(filepath.Dir(configFilePath)); err != nil {
+		exitWith(err, "Error adding config directory to watcher: %v", err)
+	}
+	if err := watcher.Add(dropInDir); err != nil {
+		exitWith(err, "Error adding drop-in config directory to watcher: %v", err)
+	}
+	watched := map[string]bool{filepath.Dir(configFilePath): true, dropInDir: true}
+	// watch adds the directories that were recreated or that the
+	// configuration file links to since the last time.
+	watch := func() {
+		for _, dir := range configWatchDirs(configFilePath) {
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				if !os.IsNotExist(err) {
+					log.Errorf("Error adding %s to the config watcher: %v", dir, err)
+				}
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	watch()
+
+	loaded := configFilesSum(configFilePath)
+	settle := time.NewTimer(configSettleDelay)
+	settle.Stop()
+	defer settle.Stop()
+	// changedBy is the last file changed by someone other than the daemon
+	// since the contents were compared, which it names when reloading.
+	var changedBy string
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("Stopping config file watcher.")
+			return
+		case event := <-watcher.events():
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && watched[filepath.Clean(event.Name)] {
+				// The watch went with the directory; it is added again
+				// once the directory is back.
+				delete(watched, filepath.Clean(event.Name))
+				settle.Reset(configSettleDelay)
+			}
+			if !isConfigEvent(configFilePath, event.Name) {
+				continue
+			}
+			if configWrites.own(event.Name) {
+				log.Debugf("Ignoring the daemon's own write to %s.", event.Name)
+			} else {
+				changedBy = event.Name
+			}
+			settle.Reset(configSettleDelay)
+		case <-settle.C:
+			watch()
+			if _, err := fsys.Stat(configFilePath); os.IsNotExist(err) {
+				// Reloading would write the default template.
+				log.Warnf("Configuration file %s was removed, keeping the current configuration.", configFilePath)
+				continue
+			}
+			sum := configFilesSum(configFilePath)
+			if sum == loaded {
+				changedBy = ""
+				continue
+			}
+			loaded = sum
+			if changedBy == "" {
+				// Only the daemon's own writes, which are applied already.
+				continue
+			}
+			log.Infof("Configuration file %s changed, reloading...", changedBy)
+			changedBy = ""
+			select {
+			case reloadConfig <- true:
+			case <-ctx.Done():
+			}
+		case err := <-watcher.errs():
+			log.Errorf("Config watcher error: %v", err)
+		}
+	}
+}
+
+// configWatchDirs returns the directories whose events may mean that the
+// configuration changed: the one holding configFilePath, the drop-in
+// directory, and the directory of the file configFilePath links to.
+func configWatchDirs(configFilePath string) []string {
+	dirs := []string{filepath.Dir(configFilePath), configDropInDir(configFilePath)}
+	if target, err := filepath.EvalSymlinks(configFilePath); err == nil && filepath.Dir(target) != dirs[0] {
+		dirs = append(dirs, filepath.Dir(target))
+	}
+	return dirs
+}
+
+// isConfigEvent reports whether an event for name may have changed the
+// configuration. Temporary files, backups and swap files of editors don't.
+func isConfigEvent(configFilePath, name string) bool {
+	name = filepath.Clean(name)
+	dropInDir := configDropInDir(configFilePath)
+	switch {
+	case name == filepath.Clean(configFilePath), name == dropInDir:
+		return true
+	case filepath.Dir(name) == dropInDir:
+		return strings.HasSuffix(name, ".toml")
+	}
+	target, err := filepath.EvalSymlinks(configFilePath)
+	return err == nil && name == target
+}
+
+// configFilesSum hashes the names and contents of configFilePath and its
+// drop-ins.
+func configFilesSum(configFilePath string) [sha256.Size]byte {
+	h := sha256.New()
+	paths, _ := fsys.Glob(filepath.Join(configDropInDir(configFilePath), "*.toml"))
+	sort.Strings(paths)
+	for _, path := range append([]string{configFilePath}, paths...) {
+		content, err := fsys.ReadFile(path)
+		if err != nil {
+			content = []byte(err.Error())
+		}
+		h.Write([]byte(path))
+		h.Write([]byte{0})
+		h.Write(content)
+		h.Write([]byte{0})
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
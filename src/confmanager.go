@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+)
+
+// errConfigChanged is returned by Save when a file was edited by someone
+// else since the ConfManager read it.
+var errConfigChanged = errors.New("changed on disk since it was read")
+
+// ConfManager changes the [[Watcher]] blocks of a configuration file and its
+// drop-ins programmatically. SetWatcher and RemoveWatcher stage a change
+// after checking the whole configuration it results in the way loadConfig
+// would; Save writes the files that changed. Only the blocks concerned are
+// rewritten, so the comments and layout of the rest of each file are kept,
+// as are the comment lines directly above a block that is replaced.
+//
+// Callbacks added with AddCallbacks or AddSyncCallbacks are told how every
+// configuration Save writes or Reloaded is called with differs from the one
+// before.
+type ConfManager struct {
+	mu    sync.Mutex
+	path  string
+	files []*confFile
+	// applied is the configuration the callbacks were last told about.
+	applied   Config
+	callbacks callbackRegistry
+}
+
+// confFile is a configuration file split into its tables.
+type confFile struct {
+	path string
+	// original is what was read, nil when the file didn't exist.
+	original []byte
+	mode     os.FileMode
+	sections []confSection
+	changed  bool
+}
+
+// confSection is a table of a configuration file. The first section of a
+// file holds what comes before the first header. comments are the comment
+// lines right above the header, which belong to the table.
+type confSection struct {
+	comments string
+	body     string
+	watcher  *WatcherConfig
+}
+
+func newConfManager(configFilePath string) *ConfManager {
+	return &ConfManager{path: configFilePath}
+}
+
+// load reads the files unless they were read already; it is called with
+// m.mu held.
+func (m *ConfManager) load() error {
+	if m.files != nil {
+		return nil
+	}
+	dropIns, err := fsys.Glob(filepath.Join(configDropInDir(m.path), "*.toml"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(dropIns)
+	var files []*confFile
+	for _, path := range append([]string{m.path}, dropIns...) {
+		f := &confFile{path: path, mode: 0644}
+		content, err := fsys.ReadFile(path)
+		if err != nil && !(os.IsNotExist(err) && path == m.path) {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err == nil {
+			f.original = content
+			if info, err := fsys.Stat(path); err == nil {
+				f.mode = info.Mode().Perm()
+			}
+		}
+		if f.sections, err = splitSections(string(content)); err != nil {
+			return classify(errInvalidConfig, fmt.Errorf("failed to parse config file %s: %w", path, err))
+		}
+		files = append(files, f)
+	}
+	m.files = files
+	return nil
+}
+
+// splitSections splits content into its tables and decodes the [[Watcher]]
+// blocks among them.
+func splitSections(content string) ([]confSection, error) {
+	sections := []confSection{{}}
+	var comments strings.Builder
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		current := &sections[len(sections)-1]
+		switch {
+		case strings.HasPrefix(trimmed, "#"):
+			comments.WriteString(line)
+		case strings.HasPrefix(trimmed, "["):
+			sections = append(sections, confSection{comments: comments.String(), body: line})
+			comments.Reset()
+		default:
+			current.body += comments.String() + line
+			comments.Reset()
+		}
+	}
+	last := &sections[len(sections)-1]
+	last.body += comments.String()
+
+	for i := range sections[1:] {
+		s := &sections[i+1]
+		header, _, _ := strings.Cut(strings.TrimSpace(s.body), "\n")
+		header, _, _ = strings.Cut(header, "#")
+		if strings.Join(strings.Fields(strings.TrimSpace(header)), "") != "[[Watcher]]" {
+			continue
+		}
+		var block dropInConfig
+		if err := toml.Unmarshal([]byte(s.body), &block); err != nil {
+			return nil, err
+		}
+		if len(block.Watchers) == 1 {
+			s.watcher = &block.Watchers[0]
+		}
+	}
+	return sections, nil
+}
+
+func (f *confFile) String() string {
+	var b strings.Builder
+	for _, s := range f.sections {
+		b.WriteString(s.comments)
+		b.WriteString(s.body)
+	}
+	return b.String()
+}
+
+// staged returns the configuration the files amount to with the changes
+// made so far; it is called with m.mu held.
+func (m *ConfManager) staged() (Config, error) {
+	var cfg Config
+	if err := toml.Unmarshal([]byte(m.files[0].String()), &cfg); err != nil {
+		return cfg, classify(errInvalidConfig, fmt.Errorf("failed to parse config file: %w", err))
+	}
+	for _, f := range m.files[1:] {
+		var dropIn dropInConfig
+		if err := toml.Unmarshal([]byte(f.String()), &dropIn); err != nil {
+			return cfg, classify(errInvalidConfig, fmt.Errorf("failed to parse drop-in config file %s: %w", f.path, err))
+		}
+		cfg.Watchers = append(cfg.Watchers, dropIn.Watchers...)
+	}
+	return cfg, nil
+}
+
+// Config returns the configuration including the staged changes.
+func (m *ConfManager) Config() (Config, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return Config{}, err
+	}
+	return m.staged()
+}
+
+// find returns the file and section of the block defining the watcher
+// labelled name; it is called with m.mu held.
+func (m *ConfManager) find(name string) (*confFile, int) {
+	for _, f := range m.files {
+		for i, s := range f.sections {
+			if s.watcher != nil && s.watcher.label() == name {
+				return f, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// Source returns the file defining the watcher labelled name, or "".
+func (m *ConfManager) Source(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.load() != nil {
+		return ""
+	}
+	if f, _ := m.find(name); f != nil {
+		return f.path
+	}
+	return ""
+}
+
+// SetWatcher replaces the block of the watcher with w's label by w, or adds
+// w at the end of the configuration file when there is none.
+func (m *ConfManager) SetWatcher(w WatcherConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return err
+	}
+	if w.MountPattern == "" && !isWatcherValid(w) {
+		return fmt.Errorf("watcher %s needs app_path, desktop_path and categories", w.label())
+	}
+	if err := m.checkTopLevel(w.label()); err != nil {
+		return err
+	}
+	block, err := toml.Marshal(dropInConfig{Watchers: []WatcherConfig{w}})
+	if err != nil {
+		return err
+	}
+	body := strings.TrimLeft(string(block), "\n")
+
+	return m.stage(func() {
+		if f, i := m.find(w.label()); f != nil {
+			old := f.sections[i].body
+			trailing := old[len(strings.TrimRight(old, " \t\r\n")):]
+			f.sections[i].body = strings.TrimRight(body, "\n") + "\n" + strings.TrimPrefix(trailing, "\n")
+			f.sections[i].watcher = &w
+			f.changed = true
+			return
+		}
+		f := m.files[0]
+		if text := f.String(); text != "" {
+			if !strings.HasSuffix(text, "\n") {
+				body = "\n" + body
+			}
+			if !strings.HasSuffix(text, "\n\n") {
+				body = "\n" + body
+			}
+		}
+		f.sections = append(f.sections, confSection{body: body, watcher: &w})
+		f.changed = true
+	})
+}
+
+// RemoveWatcher removes the block of the watcher labelled name, along with
+// the comments right above it.
+func (m *ConfManager) RemoveWatcher(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return err
+	}
+	if err := m.checkTopLevel(name); err != nil {
+		return err
+	}
+	f, i := m.find(name)
+	if f == nil {
+		return fmt.Errorf("unknown watcher %q", name)
+	}
+	return m.stage(func() {
+		f.sections = append(f.sections[:i], f.sections[i+1:]...)
+		f.changed = true
+	})
+}
+
+// checkTopLevel refuses changes to the watcher the top-level keys of the
+// configuration file define, which isn't a block of its own.
+func (m *ConfManager) checkTopLevel(name string) error {
+	cfg, err := m.staged()
+	if err != nil {
+		return err
+	}
+	if cfg.WatcherConfig.AppPath != "" && cfg.WatcherConfig.label() == name {
+		return fmt.Errorf("%s is defined by the top-level keys of %s, edit it there", name, m.path)
+	}
+	return nil
+}
+
+// stage applies change to the files and keeps it if the configuration it
+// results in is valid; it is called with m.mu held.
+func (m *ConfManager) stage(change func()) error {
+	saved := make([]confFile, len(m.files))
+	for i, f := range m.files {
+		saved[i] = *f
+		saved[i].sections = append([]confSection(nil), f.sections...)
+	}
+	change()
+
+	cfg, err := m.staged()
+	if err == nil {
+		err = validateConfig(cfg)
+	}
+	if err != nil {
+		for i, f := range m.files {
+			*f = saved[i]
+		}
+		return fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+	return nil
+}
+
+// Save writes the files with staged changes. Each is replaced atomically,
+// keeping its permissions; a drop-in left without watchers is removed.
+func (m *ConfManager) Save() error {
+	cfg, saved, err := m.save()
+	if saved {
+		// Also after a failure, since some files may have been written.
+		m.announce(cfg)
+	}
+	return err
+}
+
+// save writes the files and returns the configuration they hold, and
+// whether any was written.
+func (m *ConfManager) save() (cfg Config, saved bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer func() {
+		if saved {
+			cfg, _ = m.staged()
+		}
+	}()
+	for _, f := range m.files {
+		if !f.changed {
+			continue
+		}
+		current, err := fsys.ReadFile(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return cfg, saved, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if !bytes.Equal(current, f.original) {
+			return cfg, saved, fmt.Errorf("%s: %w", f.path, errConfigChanged)
+		}
+
+		content := []byte(f.String())
+		remove := f.path != m.path && !hasWatchers(f)
+		if remove {
+			content = nil
+		}
+		// Marked first, since the watch may see the write before Save
+		// returns.
+		configWrites.mark(f.path, content)
+		if remove {
+			if err := fsys.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				configWrites.drop(f.path)
+				return cfg, saved, fmt.Errorf("failed to remove drop-in config file: %w", err)
+			}
+		} else {
+			if err := fsys.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+				configWrites.drop(f.path)
+				return cfg, saved, fmt.Errorf("failed to create configuration directory: %w", err)
+			}
+			if err := replaceFileMode(f.path, content, f.mode); err != nil {
+				configWrites.drop(f.path)
+				return cfg, saved, fmt.Errorf("failed to write config file: %w", err)
+			}
+		}
+		f.original = content
+		f.changed = false
+		saved = true
+	}
+	return cfg, saved, nil
+}
+
+// Reloaded tells m that the configuration was loaded again as cfg. The files
+// are read anew for the next change, and the callbacks are told what changed.
+// The first call, with the configuration loaded at startup, is compared with
+// an empty one.
+func (m *ConfManager) Reloaded(cfg Config) {
+	m.mu.Lock()
+	m.files = nil
+	m.mu.Unlock()
+	m.announce(cfg)
+}
+
+// announce calls the callbacks with the change from the configuration they
+// were last told about to cfg, unless there is none.
+func (m *ConfManager) announce(cfg Config) {
+	m.mu.Lock()
+	change := diffConfigs(m.applied, cfg)
+	m.applied = cfg
+	m.mu.Unlock()
+	if !change.empty() {
+		m.callbacks.notify(change)
+	}
+}
+
+// writeMarks remembers what this process last wrote to each configuration
+// file, so that the watch on the configuration directory can tell its own
+// writes from edits by others and doesn't reload what is applied already.
+type writeMarks struct {
+	mu    sync.Mutex
+	marks map[string]writeMark
+}
+
+type writeMark struct {
+	removed bool
+	sum     [sha256.Size]byte
+}
+
+var configWrites = &writeMarks{marks: make(map[string]writeMark)}
+
+// mark records that path is about to hold content, or to be removed when
+// content is nil.
+func (w *writeMarks) mark(path string, content []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.marks[filepath.Clean(path)] = writeMark{removed: content == nil, sum: sha256.Sum256(content)}
+}
+
+func (w *writeMarks) drop(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.marks, filepath.Clean(path))
+}
+
+// own reports whether path is as this process last left it. The mark is
+// kept for the further events of the same write and dropped once someone
+// else changed the file.
+func (w *writeMarks) own(path string) bool {
+	path = filepath.Clean(path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	mark, ok := w.marks[path]
+	if !ok {
+		return false
+	}
+	content, err := fsys.ReadFile(path)
+	if mark.removed && os.IsNotExist(err) || err == nil && !mark.removed && sha256.Sum256(content) == mark.sum {
+		return true
+	}
+	delete(w.marks, path)
+	return false
+}
+
+func hasWatchers(f *confFile) bool {
+	for _, s := range f.sections {
+		if s.watcher != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const managedConfig = `# Settings for the whole daemon.
+settle_delay = "2s"
+
+# Downloads are integrated too.
+[[Watcher]]
+name = "downloads" # inline comment
+app_path = "/home/me/Downloads"
+desktop_path = "/home/me/.local/share/applications"
+categories = "Utility;"
+
+# Applications shared by everyone.
+[[Watcher]]
+name = "shared"
+app_path = "/opt/apps"
+desktop_path = "/usr/share/applications"
+categories = "Utility;"
+`
+
+func managedFile(tb testing.TB, m *memFS) string {
+	tb.Helper()
+	content, err := m.ReadFile("/etc/desktopimage/config.toml")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestConfManagerSetWatcher(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", managedConfig)
+	cm := newConfManager("/etc/desktopimage/config.toml")
+
+	err := cm.SetWatcher(WatcherConfig{Name: "downloads", AppPath: "/home/me/Apps", DesktopPath: "/home/me/.local/share/applications", Categories: "Utility;"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := managedFile(t, m); got != managedConfig {
+		t.Fatalf("the file changed before Save:\n%s", got)
+	}
+	if err := cm.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Replace(managedConfig, `name = "downloads" # inline comment
+app_path = "/home/me/Downloads"
+desktop_path = "/home/me/.local/share/applications"
+categories = "Utility;"
+`, `  app_path = "/home/me/Apps"
+  categories = "Utility;"
+  desktop_path = "/home/me/.local/share/applications"
+  name = "downloads"
+`, 1)
+	if got := managedFile(t, m); got != want {
+		t.Errorf("config.toml =\n%s\nwant:\n%s", got, want)
+	}
+	cfg, err := readConfig("/etc/desktopimage/config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Watchers) != 2 || cfg.Watchers[0].AppPath != "/home/me/Apps" {
+		t.Errorf("watchers = %+v", cfg.Watchers)
+	}
+}
+
+func TestConfManagerAddWatcher(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", managedConfig)
+	cm := newConfManager("/etc/desktopimage/config.toml")
+
+	if err := cm.SetWatcher(WatcherConfig{Name: "games", AppPath: "/games", DesktopPath: "/applications", Categories: "Game;"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Save(); err != nil {
+		t.Fatal(err)
+	}
+	want := managedConfig + `
+[[Watcher]]
+  app_path = "/games"
+  categories = "Game;"
+  desktop_path = "/applications"
+  name = "games"
+`
+	if got := managedFile(t, m); got != want {
+		t.Errorf("config.toml =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestConfManagerRemoveWatcher(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", managedConfig)
+	writeMemFile(t, m, "/etc/desktopimage/conf.d/games.toml", "# Managed by \"desktopimage watcher\".\n\n[[Watcher]]\n  app_path = \"/games\"\n  categories = \"Game;\"\n  desktop_path = \"/applications\"\n  name = \"games\"\n")
+	cm := newConfManager("/etc/desktopimage/config.toml")
+
+	if err := cm.RemoveWatcher("shared"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.RemoveWatcher("games"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.RemoveWatcher("games"); err == nil {
+		t.Error("removing a watcher twice succeeded")
+	}
+	if err := cm.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := managedConfig[:strings.Index(managedConfig, "# Applications shared")]
+	if got := managedFile(t, m); got != want {
+		t.Errorf("config.toml =\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := m.Stat("/etc/desktopimage/conf.d/games.toml"); err == nil {
+		t.Error("the drop-in left without watchers was kept")
+	}
+}
+
+func TestConfManagerValidates(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", managedConfig)
+	cm := newConfManager("/etc/desktopimage/config.toml")
+
+	for _, w := range []WatcherConfig{
+		{Name: "incomplete", AppPath: "/apps"},
+		{Name: "bad-naming", AppPath: "/apps", DesktopPath: "/applications", Categories: "Utility;", Naming: "shout"},
+	} {
+		if err := cm.SetWatcher(w); err == nil {
+			t.Errorf("SetWatcher(%+v) succeeded", w)
+		}
+	}
+	cfg, err := cm.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Watchers) != 2 {
+		t.Errorf("rejected changes were staged: %+v", cfg.Watchers)
+	}
+}
+
+func TestConfManagerTopLevelWatcher(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", "app_path = \"/apps\"\ndesktop_path = \"/applications\"\ncategories = \"Utility;\"\n")
+	cm := newConfManager("/etc/desktopimage/config.toml")
+	if err := cm.RemoveWatcher("/apps"); err == nil || !strings.Contains(err.Error(), "top-level") {
+		t.Errorf("RemoveWatcher() = %v, want an error about the top-level keys", err)
+	}
+}
+
+func TestConfManagerSaveConflict(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", managedConfig)
+	if err := m.Chmod("/etc/desktopimage/config.toml", 0600); err != nil {
+		t.Fatal(err)
+	}
+	cm := newConfManager("/etc/desktopimage/config.toml")
+	if err := cm.RemoveWatcher("shared"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", managedConfig+"# edited meanwhile\n")
+	if err := cm.Save(); !errors.Is(err, errConfigChanged) {
+		t.Errorf("Save() = %v, want errConfigChanged", err)
+	}
+
+	cm = newConfManager("/etc/desktopimage/config.toml")
+	if err := cm.RemoveWatcher("shared"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := m.Stat("/etc/desktopimage/config.toml"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the permissions of config.toml weren't kept: %v %v", info.Mode(), err)
+	}
+}
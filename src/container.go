@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// container_exec values. With a wrapper the daemon may run inside a
+// container while its entries are launched from the host menu: Exec starts
+// the AppImage through the wrapper, and the host's desktop database is
+// refreshed rather than the container's.
+const (
+	containerExecOff          = "off"
+	containerExecAuto         = "auto"
+	containerExecDistrobox    = "distrobox"
+	containerExecFlatpakSpawn = "flatpak-spawn"
+)
+
+type containerOptions struct {
+	// wrapper is containerExecDistrobox, containerExecFlatpakSpawn or "".
+	wrapper string
+	// name is the distrobox container AppImages are launched in.
+	name string
+}
+
+var (
+	containerMu   sync.Mutex
+	containerOpts containerOptions
+)
+
+func validateContainerExec(cfg Config) error {
+	switch cfg.ContainerExec {
+	case "", containerExecOff, containerExecAuto, containerExecDistrobox, containerExecFlatpakSpawn:
+		return nil
+	default:
+		return fmt.Errorf("container_exec must be %q, %q, %q or %q, got %q", containerExecOff, containerExecAuto, containerExecDistrobox, containerExecFlatpakSpawn, cfg.ContainerExec)
+	}
+}
+
+// detectContainer reports which kind of container the daemon runs in, if
+// any, and the container's name when it is known.
+func detectContainer() (string, string) {
+	if id := os.Getenv("CONTAINER_ID"); id != "" {
+		// Set by distrobox-enter.
+		return "distrobox", id
+	}
+	if _, err := os.Stat("/.flatpak-info"); err == nil {
+		return "flatpak", ""
+	}
+	if name, ok := containerEnvName("/run/.containerenv"); ok {
+		if _, err := os.Stat("/run/.toolboxenv"); err == nil {
+			return "toolbox", name
+		}
+		return "podman", name
+	}
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker", ""
+	}
+	return "", ""
+}
+
+// containerEnvName reads the container name podman records in
+// /run/.containerenv.
+func containerEnvName(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), "="); ok && k == "name" {
+			return strings.Trim(v, `"`), true
+		}
+	}
+	return "", true
+}
+
+// configureContainer resolves container_exec against the container the
+// daemon is running in.
+func configureContainer(cfg Config) {
+	kind, name := detectContainer()
+	if cfg.ContainerName != "" {
+		name = cfg.ContainerName
+	}
+
+	var opts containerOptions
+	switch cfg.ContainerExec {
+	case containerExecDistrobox:
+		opts = containerOptions{wrapper: containerExecDistrobox, name: name}
+	case containerExecFlatpakSpawn:
+		opts = containerOptions{wrapper: containerExecFlatpakSpawn}
+	case containerExecAuto:
+		switch kind {
+		case "distrobox":
+			opts = containerOptions{wrapper: containerExecDistrobox, name: name}
+		case "flatpak", "toolbox":
+			opts = containerOptions{wrapper: containerExecFlatpakSpawn}
+		case "":
+		default:
+			log.Warnf("Running in a %s container, which offers no way to launch AppImages from the host.", kind)
+		}
+	default:
+		if kind != "" {
+			log.Infof("Running in a %s container, set container_exec = %q to create entries for the host.", kind, containerExecAuto)
+		}
+	}
+	if opts.wrapper == containerExecDistrobox && opts.name == "" {
+		log.Warn("The distrobox container name is unknown, set container_name.")
+		opts = containerOptions{}
+	}
+
+	containerMu.Lock()
+	defer containerMu.Unlock()
+	containerOpts = opts
+}
+
+func currentContainer() containerOptions {
+	containerMu.Lock()
+	defer containerMu.Unlock()
+	return containerOpts
+}
+
+// hostCommand runs name on the host when entries are created for it, and in
+// the daemon's own environment otherwise.
+func hostCommand(name string, args ...string) *exec.Cmd {
+	switch currentContainer().wrapper {
+	case containerExecDistrobox:
+		return exec.Command("distrobox-host-exec", append([]string{name}, args...)...)
+	case containerExecFlatpakSpawn:
+		return exec.Command("flatpak-spawn", append([]string{"--host", name}, args...)...)
+	default:
+		return exec.Command(name, args...)
+	}
+}
+
+// commandRunner runs the desktop utilities, such as update-desktop-database.
+// Tests swap in one that records the invocations instead.
+type commandRunner interface {
+	Run(name string, args ...string) error
+}
+
+// hostRunner runs the utilities with hostCommand.
+type hostRunner struct{}
+
+func (hostRunner) Run(name string, args ...string) error {
+	return hostCommand(name, args...).Run()
+}
+
+var desktopUtils commandRunner = hostRunner{}
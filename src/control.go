@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultControlSocket = "/run/desktopimage/control.sock"
+	controlTimeout       = 10 * time.Second
+)
+
+// controlRequest is one command sent to the daemon over the control socket.
+// Requests and responses are single JSON lines.
+type controlRequest struct {
+	Command string `json:"command"`
+	Watcher string `json:"watcher,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	// Policy is the pause_policy to pause a watcher with.
+	Policy string `json:"policy,omitempty"`
+	// Persist saves a watcher toggle to the configuration file as well.
+	Persist bool `json:"persist,omitempty"`
+}
+
+type controlResponse struct {
+	OK    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// controlCall carries a request to the main loop, which serves it so that
+// commands never race with configuration reloads.
+type controlCall struct {
+	req   controlRequest
+	reply chan controlResponse
+}
+
+// handleControl executes req against the running watchers; reload reloads
+// the configuration read from configFilePath.
+func handleControl(req controlRequest, watchers *watcherSet, configFilePath string, reload func() error) controlResponse {
+	switch req.Command {
+	case "reload":
+		if err := reload(); err != nil {
+			return errorResponse(err)
+		}
+		return okResponse(nil)
+	case "list-watchers":
+		return okResponse(watchers.status())
+	case "enable-watcher", "disable-watcher":
+		if req.Watcher == "" {
+			return errorResponse(errors.New("missing watcher name"))
+		}
+		enabled := req.Command == "enable-watcher"
+		if err := watchers.setEnabled(req.Watcher, enabled); err != nil {
+			return errorResponse(err)
+		}
+		if req.Persist {
+			if err := persistEnabled(configFilePath, req.Watcher, enabled); err != nil {
+				return errorResponse(fmt.Errorf("toggled the watcher, but could not save it: %w", err))
+			}
+		}
+		return okResponse(nil)
+	case "pause-watcher", "resume-watcher":
+		if req.Watcher == "" {
+			return errorResponse(errors.New("missing watcher name"))
+		}
+		if err := watchers.setPaused(req.Watcher, req.Command == "pause-watcher", req.Policy); err != nil {
+			return errorResponse(err)
+		}
+		return okResponse(nil)
+	case "get-maintenance", "start-maintenance", "end-maintenance":
+		return handleMaintenance(req.Command, watchers)
+	case "get-config":
+		text, err := formatConfig(watchers.effectiveConfig())
+		if err != nil {
+			return errorResponse(err)
+		}
+		return okResponse(text)
+	case "get-profile":
+		return okResponse(profileStatus{Active: activeProfile(config), Profiles: knownProfiles(config)})
+	case "set-profile":
+		if err := validateProfile(config, req.Profile); err != nil {
+			return errorResponse(err)
+		}
+		setProfileOverride(req.Profile)
+		if err := reload(); err != nil {
+			return errorResponse(err)
+		}
+		return okResponse(nil)
+	case "get-event-trace":
+		return okResponse(rawEvents.list(req.Watcher))
+	case "get-reconcile-report":
+		reports, err := reconcileReportsOf(req.Watcher)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return okResponse(reports)
+	case "hold", "unhold":
+		if req.Source == "" {
+			return errorResponse(errors.New("missing source"))
+		}
+		if err := currentState().setHeld(req.Source, req.Command == "hold"); err != nil {
+			return errorResponse(err)
+		}
+		flushState(currentState())
+		return okResponse(nil)
+	case "remove-source":
+		if req.Source == "" {
+			return errorResponse(errors.New("missing source"))
+		}
+		removed, err := removeSource(config, currentState(), req.Source)
+		if err != nil {
+			return errorResponse(err)
+		}
+		flushState(currentState())
+		return okResponse(removed)
+	default:
+		return errorResponse(fmt.Errorf("unknown command %q", req.Command))
+	}
+}
+
+// persistEnabled switches the block of the watcher labelled label on or off
+// in the configuration. The running watchers are toggled already, so the
+// write is one the config watch ignores.
+func persistEnabled(configFilePath, label string, enabled bool) error {
+	m := newConfManager(configFilePath)
+	cfg, err := m.Config()
+	if err != nil {
+		return err
+	}
+	for _, w := range cfg.Watchers {
+		if w.label() != label {
+			continue
+		}
+		w.Enabled = nil
+		if !enabled {
+			w.Enabled = &enabled
+		}
+		if err := m.SetWatcher(w); err != nil {
+			return err
+		}
+		return m.Save()
+	}
+	return fmt.Errorf("%s is not defined by a [[Watcher]] block", label)
+}
+
+func okResponse(data interface{}) controlResponse {
+	if data == nil {
+		return controlResponse{OK: true}
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return controlResponse{OK: true, Data: raw}
+}
+
+func errorResponse(err error) controlResponse {
+	return controlResponse{Error: err.Error()}
+}
+
+// controlListener is the listener of a control socket that was renamed
+// into place after binding it, reporting the path it has now.
+type controlListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+func (l controlListener) Addr() net.Addr { return l.addr }
+
+// listenControl opens the control socket. It is done before privileges are
+// dropped, since the socket usually lives in a directory only root may write.
+// The socket is bound in a directory only the daemon may enter and renamed
+// into place once it is 0660, so other users can't connect to it before.
+func listenControl(socketPath string) (net.Listener, error) {
+	dir := filepath.Dir(socketPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+	// A socket left behind by a previous run would be in the way.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	private, err := os.MkdirTemp(dir, ".ctl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+	defer os.RemoveAll(private)
+	bound := filepath.Join(private, filepath.Base(socketPath))
+	listener, err := net.Listen("unix", bound)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(bound, 0660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict control socket permissions: %w", err)
+	}
+	if err := os.Rename(bound, socketPath); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to move control socket into place: %w", err)
+	}
+	return controlListener{Listener: listener, addr: &net.UnixAddr{Name: socketPath, Net: "unix"}}, nil
+}
+
+// serveControl accepts control connections on listener until ctx is done
+// and forwards their requests to calls.
+func serveControl(ctx context.Context, listener net.Listener, calls chan<- controlCall) {
+	socketPath := listener.Addr().String()
+	defer os.Remove(socketPath)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Infof("Control socket listening on %s.", socketPath)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Info("Stopping control socket.")
+				return
+			}
+			log.Errorf("Control socket error: %v", err)
+			continue
+		}
+		go serveControlConn(ctx, conn, calls)
+	}
+}
+
+func serveControlConn(ctx context.Context, conn net.Conn, calls chan<- controlCall) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req controlRequest
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+
+	resp := errorResponse(fmt.Errorf("invalid request: %v", err))
+	if err == nil {
+		call := controlCall{req: req, reply: make(chan controlResponse, 1)}
+		select {
+		case calls <- call:
+			resp = <-call.reply
+		case <-ctx.Done():
+			resp = errorResponse(errors.New("daemon is shutting down"))
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Errorf("Error writing control response: %v", err)
+	}
+}
+
+// sendControl sends req to the daemon listening on socketPath.
+func sendControl(socketPath string, req controlRequest) (controlResponse, error) {
+	var resp controlResponse
+	conn, err := net.DialTimeout("unix", socketPath, controlTimeout)
+	if err != nil {
+		return resp, fmt.Errorf("cannot reach the daemon at %s: %w", socketPath, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, err
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("invalid response from daemon: %w", err)
+	}
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// controlSocketPath returns the control socket configured for the daemon.
+func controlSocketPath() string {
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		return defaultControlSocket
+	}
+	return cfg.controlSocket()
+}
@@ -0,0 +1,19 @@
+//go:build freebsd || netbsd || darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// changeTime returns when the inode of info last changed, which includes
+// permission changes, or the zero time when it is unavailable.
+func changeTime(info os.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(st.Ctimespec.Sec, st.Ctimespec.Nsec)
+}
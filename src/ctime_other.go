@@ -0,0 +1,14 @@
+//go:build !linux && !freebsd && !netbsd && !darwin
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// changeTime is not tracked on this platform; callers fall back to the
+// modification time.
+func changeTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// naming values, see WatcherConfig.Naming.
+const (
+	namingTransliterate = "transliterate"
+	namingLowercase     = "lowercase"
+)
+
+// EntryDefaults is the [defaults] table. Its settings apply to every watcher
+// block that doesn't set them itself.
+type EntryDefaults struct {
+	IconPath     string `toml:"icon_path"`
+	Categories   string `toml:"categories"`
+	Terminal     *bool  `toml:"terminal"`
+	Template     string `toml:"template"`
+	NameTemplate string `toml:"name_template"`
+	Naming       string `toml:"naming"`
+	NamePrefix   string `toml:"name_prefix"`
+	// RefreshCommand is the refresh_command of every watcher, see
+	// WatcherConfig.RefreshCommand.
+	RefreshCommand string `toml:"refresh_command"`
+	IconTheme      string `toml:"icon_theme"`
+	IconScope      string `toml:"icon_scope"`
+	IconDir        string `toml:"icon_dir"`
+}
+
+// withDefaults returns w with the settings it leaves unset taken from d.
+func (w WatcherConfig) withDefaults(d EntryDefaults) WatcherConfig {
+	if w.IconPath == "" {
+		w.IconPath = d.IconPath
+	}
+	if w.Categories == "" {
+		w.Categories = d.Categories
+	}
+	if w.Terminal == nil {
+		w.Terminal = d.Terminal
+	}
+	if w.Template == "" {
+		w.Template = d.Template
+	}
+	if w.NameTemplate == "" {
+		w.NameTemplate = d.NameTemplate
+	}
+	if w.Naming == "" {
+		w.Naming = d.Naming
+	}
+	if w.NamePrefix == "" {
+		w.NamePrefix = d.NamePrefix
+	}
+	if w.RefreshCommand == "" {
+		w.RefreshCommand = d.RefreshCommand
+	}
+	if w.IconTheme == "" {
+		w.IconTheme = d.IconTheme
+	}
+	if w.IconScope == "" {
+		w.IconScope = d.IconScope
+	}
+	if w.IconDir == "" {
+		w.IconDir = d.IconDir
+	}
+	return w
+}
+
+func validateNaming(cfg Config) error {
+	for _, w := range cfg.watchers() {
+		switch w.Naming {
+		case "", namingTransliterate, namingLowercase:
+		default:
+			return fmt.Errorf("naming of watcher %s must be %q or %q, got %q", w.label(), namingTransliterate, namingLowercase, w.Naming)
+		}
+		if strings.ContainsAny(w.NamePrefix, "/\x00") {
+			return fmt.Errorf("name_prefix of watcher %s may not contain '/'", w.label())
+		}
+	}
+	return nil
+}
+
+// entryTemplateData is what a template configured with template = ... can
+// refer to. The values are escaped for a desktop entry already, except for
+// the path AppImage; Localized holds the translated Name and Comment lines,
+// each ending in a newline. Hash is the SHA-256 of the AppImage, empty for
+// those above max_hash_mb, and Version empty when it isn't known. TryExec is
+// empty when entries launch through a container wrapper.
+type entryTemplateData struct {
+	Name       string
+	Exec       string
+	TryExec    string
+	Icon       string
+	Categories string
+	Terminal   bool
+	Localized  string
+	AppImage   string
+	Version    string
+	Hash       string
+	// StartupWMClass is the window class a quirk knows for the app, or "".
+	StartupWMClass string
+	// MimeType lists the MIME types the AppImage's own entry declares,
+	// with a trailing ';', or is "".
+	MimeType string
+	// NoDisplay hides the entry of an AppImage that only works as root,
+	// see root_apps.
+	NoDisplay bool
+}
+
+// entryNameData is what a name_template can refer to. The values are
+// escaped for a desktop entry already.
+type entryNameData struct {
+	Name    string
+	Version string
+}
+
+var (
+	templatesMu   sync.Mutex
+	templates     map[string]*template.Template
+	nameTemplates map[string]*template.Template
+)
+
+// configureTemplates parses the entry and name templates configured in cfg,
+// so that mistakes in them are reported when the configuration is loaded.
+func configureTemplates(cfg Config) error {
+	parsed, err := parseTemplates(cfg)
+	if err != nil {
+		return err
+	}
+	names, err := parseNameTemplates(cfg)
+	if err != nil {
+		return err
+	}
+
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	templates = parsed
+	nameTemplates = names
+	return nil
+}
+
+func validateTemplates(cfg Config) error {
+	if _, err := parseTemplates(cfg); err != nil {
+		return err
+	}
+	_, err := parseNameTemplates(cfg)
+	return err
+}
+
+func parseTemplates(cfg Config) (map[string]*template.Template, error) {
+	parsed := make(map[string]*template.Template)
+	for _, w := range cfg.watchers() {
+		if w.Template == "" || parsed[w.Template] != nil {
+			continue
+		}
+		content, err := fsys.ReadFile(w.Template)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry template: %w", err)
+		}
+		t, err := template.New(w.Template).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse entry template: %w", err)
+		}
+		parsed[w.Template] = t
+	}
+	return parsed, nil
+}
+
+func entryTemplate(path string) *template.Template {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	return templates[path]
+}
+
+// parseNameTemplates parses the name_template of every watcher, trying each
+// on an example so that references to unknown fields fail early.
+func parseNameTemplates(cfg Config) (map[string]*template.Template, error) {
+	parsed := make(map[string]*template.Template)
+	for _, w := range cfg.watchers() {
+		if w.NameTemplate == "" || parsed[w.NameTemplate] != nil {
+			continue
+		}
+		t, err := template.New("name_template").Option("missingkey=error").Parse(w.NameTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse name_template of watcher %s: %w", w.label(), err)
+		}
+		name, err := executeNameTemplate(t, entryNameData{Name: "Example", Version: "1.0"})
+		if err != nil {
+			return nil, fmt.Errorf("name_template of watcher %s: %w", w.label(), err)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("name_template of watcher %s gives empty names", w.label())
+		}
+		parsed[w.NameTemplate] = t
+	}
+	return parsed, nil
+}
+
+// entryName returns the Name shown for an AppImage called name, rendered with
+// the name_template of w when it has one.
+func entryName(w WatcherConfig, name, version string) (string, error) {
+	templatesMu.Lock()
+	t := nameTemplates[w.NameTemplate]
+	templatesMu.Unlock()
+	if t == nil {
+		return name, nil
+	}
+	rendered, err := executeNameTemplate(t, entryNameData{Name: name, Version: version})
+	if err != nil {
+		return "", err
+	}
+	if rendered == "" {
+		return name, nil
+	}
+	return rendered, nil
+}
+
+// executeNameTemplate renders t onto a single line, without the spaces left
+// around empty values such as a missing version.
+func executeNameTemplate(t *template.Template, data entryNameData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render name template: %w", err)
+	}
+	return strings.Join(strings.Fields(b.String()), " "), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// contentOwner is an AppImage found by the watcher w.
+type contentOwner struct {
+	path string
+	w    WatcherConfig
+}
+
+// duplicateIndex tracks, with detect_duplicates, which AppImage is
+// integrated for each content hash, and the identical copies left out.
+type duplicateIndex struct {
+	mu      sync.Mutex
+	enabled bool
+	// rank orders watchers by duplicate_order; the ones not listed
+	// come last, and among equals the copy integrated first stays.
+	rank    map[string]int
+	owners  map[string]contentOwner
+	skipped map[string][]contentOwner
+}
+
+var duplicates = &duplicateIndex{
+	owners:  make(map[string]contentOwner),
+	skipped: make(map[string][]contentOwner),
+}
+
+func validateDuplicates(cfg Config) error {
+	seen := make(map[string]bool)
+	for _, name := range cfg.DuplicateOrder {
+		if name == "" {
+			return fmt.Errorf("duplicate_order must not contain empty watcher names")
+		}
+		if seen[name] {
+			return fmt.Errorf("watcher %s is listed twice in duplicate_order", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// configureDuplicates applies detect_duplicates and duplicate_order. The
+// index is seeded from the records of the state, as the startup scan that
+// would fill it is skipped when the journal shows nothing changed.
+func configureDuplicates(cfg Config) {
+	var integrated []appState
+	watchers := make(map[string]WatcherConfig)
+	if cfg.DetectDuplicates {
+		st := currentState()
+		for _, w := range cfg.watchers() {
+			for _, app := range st.watchedBy(w) {
+				if app.SHA256 != "" {
+					integrated = append(integrated, app)
+					watchers[app.Path] = w
+				}
+			}
+		}
+	}
+
+	duplicates.mu.Lock()
+	defer duplicates.mu.Unlock()
+	duplicates.enabled = cfg.DetectDuplicates
+	duplicates.rank = make(map[string]int)
+	for i, name := range cfg.DuplicateOrder {
+		duplicates.rank[name] = i
+	}
+	// Copies integrated before detect_duplicates was set are sorted out by
+	// the next scan; until then the preferred one owns their content.
+	sort.Slice(integrated, func(i, j int) bool {
+		ri, rj := duplicates.rankOf(watchers[integrated[i].Path]), duplicates.rankOf(watchers[integrated[j].Path])
+		return ri < rj || (ri == rj && integrated[i].Path < integrated[j].Path)
+	})
+	for _, app := range integrated {
+		if _, ok := duplicates.owners[app.SHA256]; !ok {
+			duplicates.owners[app.SHA256] = contentOwner{path: app.Path, w: watchers[app.Path]}
+		}
+	}
+}
+
+func (d *duplicateIndex) rankOf(w WatcherConfig) int {
+	if rank, ok := d.rank[w.label()]; ok {
+		return rank
+	}
+	return len(d.rank)
+}
+
+// claim makes the AppImage at path, with the content hash sum, the one
+// integrated for it, unless an identical AppImage that is integrated already
+// is preferred. That AppImage is returned with dup set then. When the one at
+// path is preferred over it instead, it is returned with dup unset, and its
+// entry has to go. Without detect_duplicates every AppImage is integrated.
+func (d *duplicateIndex) claim(w WatcherConfig, path, sum string) (other contentOwner, dup bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.enabled {
+		return contentOwner{}, false
+	}
+	d.forget(path)
+	for other, owner := range d.owners {
+		if owner.path == path && other != sum {
+			// Its content changed since.
+			delete(d.owners, other)
+		}
+	}
+	claimant := contentOwner{path: path, w: w}
+	owner, ok := d.owners[sum]
+	if _, err := os.Stat(owner.path); !ok || owner.path == path || err != nil {
+		d.owners[sum] = claimant
+		return contentOwner{}, false
+	}
+	if d.rankOf(owner.w) <= d.rankOf(w) {
+		d.skipped[sum] = append(d.skipped[sum], claimant)
+		return owner, true
+	}
+	d.owners[sum] = claimant
+	d.skipped[sum] = append(d.skipped[sum], owner)
+	return owner, false
+}
+
+// owns reports whether the AppImage at path is the one integrated for the
+// content hash sum, which they all are without detect_duplicates.
+func (d *duplicateIndex) owns(path, sum string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.enabled || d.owners[sum].path == path
+}
+
+// released drops the AppImage at path, whose entry was removed, and returns
+// the most preferred copy left out for it that still exists.
+func (d *duplicateIndex) released(path string) (contentOwner, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for sum, owner := range d.owners {
+		if owner.path != path {
+			continue
+		}
+		delete(d.owners, sum)
+		candidates := d.skipped[sum]
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return d.rankOf(candidates[i].w) < d.rankOf(candidates[j].w)
+		})
+		for _, c := range candidates {
+			if _, err := os.Stat(c.path); err == nil {
+				return c, true
+			}
+		}
+		return contentOwner{}, false
+	}
+	d.forget(path)
+	return contentOwner{}, false
+}
+
+// forget removes path from the copies left out.
+func (d *duplicateIndex) forget(path string) {
+	for sum, copies := range d.skipped {
+		kept := copies[:0]
+		for _, c := range copies {
+			if c.path != path {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(d.skipped, sum)
+		} else {
+			d.skipped[sum] = kept
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+// TestDuplicatesFromState checks that the index knows the AppImages
+// integrated before a restart, whose startup scan the journal may skip.
+func TestDuplicatesFromState(t *testing.T) {
+	useTestConfig(t, Config{})
+	prevOwners, prevSkipped := duplicates.owners, duplicates.skipped
+	duplicates.owners, duplicates.skipped = make(map[string]contentOwner), make(map[string][]contentOwner)
+	t.Cleanup(func() {
+		duplicates.owners, duplicates.skipped = prevOwners, prevSkipped
+		configureDuplicates(Config{})
+	})
+	w := newTestWatcher(t)
+	other := newTestWatcher(t)
+	other.Name = "other"
+	integrated := addAppImage(t, w.AppPath, "Hello")
+	copied := addAppImage(t, other.AppPath, "Hello")
+	currentState().put(appState{Path: integrated, Watcher: w.label(), SHA256: "0123"})
+
+	configureDuplicates(Config{DetectDuplicates: true, Watchers: []WatcherConfig{w, other}})
+	if !duplicates.owns(integrated, "0123") {
+		t.Errorf("%s, integrated before, doesn't own its content", integrated)
+	}
+	if owner, dup := duplicates.claim(other, copied, "0123"); !dup || owner.path != integrated {
+		t.Errorf("claim of a copy = %v, %v, want it to be a duplicate of %s", owner, dup, integrated)
+	}
+}
@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// The end-to-end tests run the daemon against a configuration and watch
+// directories in a temporary directory, and check the entries it writes
+// as AppImages come and go.
+
+const e2eTimeout = 10 * time.Second
+
+// writeDaemonConfig writes a configuration for the single watcher w to
+// configFilePath, keeping everything the daemon writes below dataDir.
+func writeDaemonConfig(tb testing.TB, configFilePath, dataDir string, w WatcherConfig) {
+	tb.Helper()
+	content := fmt.Sprintf(`settle_delay = "50ms"
+refresh_delay = "10ms"
+data_dir = %q
+control_socket = %q
+status_file = %q
+sandbox_extraction = false
+
+[[Watcher]]
+name = %q
+app_path = %q
+desktop_path = %q
+categories = %q
+`, dataDir, filepath.Join(dataDir, "control.sock"), filepath.Join(dataDir, "status.json"),
+		w.Name, w.AppPath, w.DesktopPath, w.Categories)
+	if err := os.MkdirAll(filepath.Dir(configFilePath), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(configFilePath, []byte(content), 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// prependConfig adds top-level settings to the config file written by
+// writeDaemonConfig.
+func prependConfig(tb testing.TB, configFilePath, settings string) {
+	tb.Helper()
+	content, err := os.ReadFile(configFilePath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(configFilePath, append([]byte(settings), content...), 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// startDaemon runs the daemon on configFilePath until the test ends.
+func startDaemon(tb testing.TB, configFilePath string) {
+	tb.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runDaemon(ctx, configFilePath) }()
+	tb.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			tb.Errorf("runDaemon() = %v", err)
+		}
+	})
+}
+
+// waitFor polls cond until it holds, failing the test after e2eTimeout.
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(e2eTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestDaemon(t *testing.T) {
+	useTestConfig(t, Config{})
+	commands := useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+
+	hello := addAppImage(t, w.AppPath, "Hello")
+	helloEntry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	startDaemon(t, configFilePath)
+
+	t.Run("initial scan", func(t *testing.T) {
+		waitFor(t, "the entry of an AppImage present at startup", func() bool { return exists(helloEntry) })
+		if got := entryExecTarget(helloEntry); got != hello {
+			t.Errorf("Exec = %q, want %q", got, hello)
+		}
+		if got := desktopEntryValue(helloEntry, "TryExec"); got != hello {
+			t.Errorf("TryExec = %q, want %q", got, hello)
+		}
+		if got := desktopEntryValue(helloEntry, "Categories"); got != w.Categories {
+			t.Errorf("Categories = %q, want %q", got, w.Categories)
+		}
+		if sum, err := hashFile(hello); err != nil {
+			t.Error(err)
+		} else if got := desktopEntryValue(helloEntry, "X-DesktopImage-Hash"); got != "sha256:"+sum {
+			t.Errorf("X-DesktopImage-Hash = %q, want sha256:%s", got, sum)
+		}
+		icon := desktopEntryValue(helloEntry, "Icon")
+		if !strings.HasPrefix(icon, filepath.Join(dataDir, "icons")+"/") || !exists(icon) {
+			t.Errorf("Icon = %q, want the icon extracted into %s", icon, dataDir)
+		}
+		waitFor(t, "the desktop database to be refreshed", func() bool {
+			return commands.ran("update-desktop-database "+w.DesktopPath) > 0
+		})
+	})
+
+	worldEntry := filepath.Join(w.DesktopPath, desktopFileName(w, "World"))
+	t.Run("added", func(t *testing.T) {
+		world := addAppImage(t, w.AppPath, "World")
+		waitFor(t, "the entry of an added AppImage", func() bool { return exists(worldEntry) })
+		if got := entryExecTarget(worldEntry); got != world {
+			t.Errorf("Exec = %q, want %q", got, world)
+		}
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(w.AppPath, "World.AppImage")); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the entry of a removed AppImage to go", func() bool { return !exists(worldEntry) })
+		if !exists(helloEntry) {
+			t.Error("the entry of another AppImage was removed too")
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		w.Categories = "Development;"
+		writeDaemonConfig(t, configFilePath, dataDir, w)
+		waitFor(t, "the entry to be rewritten with the new categories", func() bool {
+			return desktopEntryValue(helloEntry, "Categories") == w.Categories
+		})
+	})
+}
+
+// TestDaemonRestart checks that a restarted daemon removes the entries of
+// AppImages deleted while it was down, and leaves the others alone.
+func TestDaemonRestart(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	addAppImage(t, w.AppPath, "Hello")
+	gone := addAppImage(t, w.AppPath, "Gone")
+	helloEntry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	goneEntry := filepath.Join(w.DesktopPath, desktopFileName(w, "Gone"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runDaemon(ctx, configFilePath) }()
+	waitFor(t, "the entries of the first run", func() bool { return exists(helloEntry) && exists(goneEntry) })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("runDaemon() = %v", err)
+	}
+
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	helloInfo, err := os.Stat(helloEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestConfig(t, Config{})
+	startDaemon(t, configFilePath)
+	waitFor(t, "the entry of the AppImage deleted while stopped to go", func() bool { return !exists(goneEntry) })
+	if info, err := os.Stat(helloEntry); err != nil || !info.ModTime().Equal(helloInfo.ModTime()) {
+		t.Errorf("the entry of the remaining AppImage was rewritten or removed: %v", err)
+	}
+}
+
+// TestDaemonPersistToggle checks that a watcher toggle saved by the daemon
+// itself doesn't make it reload, while an edit by someone else still does.
+func TestDaemonPersistToggle(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	logs := recordLogs(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	startDaemon(t, configFilePath)
+	socket := filepath.Join(dataDir, "control.sock")
+	waitFor(t, "the control socket", func() bool { return exists(socket) })
+	if info, err := os.Stat(socket); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0660 {
+		t.Errorf("control socket has mode %v, want 0660", info.Mode())
+	}
+
+	req := controlRequest{Command: "disable-watcher", Watcher: w.Name, Persist: true}
+	if _, err := sendControl(socket, req); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Watchers) != 1 || cfg.Watchers[0].enabled() {
+		t.Fatalf("the toggle wasn't saved: %+v", cfg.Watchers)
+	}
+	time.Sleep(2 * configSettleDelay)
+	if n := logs.count("changed, reloading"); n != 0 {
+		t.Errorf("the daemon reloaded %d time(s) after its own write", n)
+	}
+
+	w.Categories = "Development;"
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	waitFor(t, "the reload after an edit", func() bool { return logs.count("changed, reloading") > 0 })
+}
+
+// TestDaemonConfigSaves checks that the daemon reloads its configuration
+// however an editor saves it, and only once the save is complete.
+func TestDaemonConfigSaves(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	logs := recordLogs(t)
+	dataDir := t.TempDir()
+	configDir := filepath.Join(t.TempDir(), "desktopimage")
+	configFilePath := filepath.Join(configDir, "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	addAppImage(t, w.AppPath, "Hello")
+	helloEntry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	startDaemon(t, configFilePath)
+	waitFor(t, "the initial scan", func() bool { return exists(helloEntry) })
+
+	// edited writes the configuration with categories to a new file in the
+	// configuration directory and returns its name and content.
+	edited := func(t *testing.T, categories string) (string, []byte) {
+		w.Categories = categories
+		path := filepath.Join(configDir, ".config.toml.new")
+		writeDaemonConfig(t, path, dataDir, w)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path, content
+	}
+	waitForCategories := func(t *testing.T) {
+		waitFor(t, "the entry to be rewritten with "+w.Categories, func() bool {
+			return desktopEntryValue(helloEntry, "Categories") == w.Categories
+		})
+	}
+
+	t.Run("rename over", func(t *testing.T) {
+		path, _ := edited(t, "Development;")
+		if err := os.Rename(path, configFilePath); err != nil {
+			t.Fatal(err)
+		}
+		waitForCategories(t)
+	})
+
+	t.Run("backup and create", func(t *testing.T) {
+		// The way vim saves with backupcopy=no.
+		path, content := edited(t, "Graphics;")
+		os.Remove(path)
+		if err := os.Rename(configFilePath, configFilePath+"~"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(configSettleDelay / 4)
+		if err := os.WriteFile(configFilePath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(configFilePath + "~")
+		waitForCategories(t)
+		if n := logs.count("was removed"); n != 0 {
+			t.Errorf("the half-done save was noticed %d time(s)", n)
+		}
+	})
+
+	t.Run("truncate and write", func(t *testing.T) {
+		path, content := edited(t, "Office;")
+		os.Remove(path)
+		before := logs.count("Error loading")
+		f, err := os.OpenFile(configFilePath, os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(configSettleDelay / 4)
+		_, err = f.Write(content)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForCategories(t)
+		if n := logs.count("Error loading") - before; n != 0 {
+			t.Errorf("the truncated file was loaded %d time(s)", n)
+		}
+	})
+
+	t.Run("chmod", func(t *testing.T) {
+		before := logs.count("changed, reloading")
+		if err := os.Chmod(configFilePath, 0600); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * configSettleDelay)
+		if n := logs.count("changed, reloading") - before; n != 0 {
+			t.Errorf("changing the permissions reloaded %d time(s)", n)
+		}
+	})
+
+	t.Run("drop-in directory recreated", func(t *testing.T) {
+		dropInDir := configDropInDir(configFilePath)
+		if err := os.RemoveAll(dropInDir); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * configSettleDelay)
+		if err := os.Mkdir(dropInDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * configSettleDelay)
+		extra := newTestWatcher(t)
+		extra.Name = "extra"
+		addAppImage(t, extra.AppPath, "World")
+		stops := logs.count("Stopping AppImage watcher for " + w.AppPath)
+		dropIn := fmt.Sprintf("[[Watcher]]\nname = %q\napp_path = %q\ndesktop_path = %q\ncategories = %q\n",
+			extra.Name, extra.AppPath, extra.DesktopPath, extra.Categories)
+		if err := os.WriteFile(filepath.Join(dropInDir, "extra.toml"), []byte(dropIn), 0644); err != nil {
+			t.Fatal(err)
+		}
+		worldEntry := filepath.Join(extra.DesktopPath, desktopFileName(extra, "World"))
+		waitFor(t, "the entry of the watcher of the new drop-in", func() bool { return exists(worldEntry) })
+		if n := logs.count("Stopping AppImage watcher for "+w.AppPath) - stops; n != 0 {
+			t.Errorf("adding a watcher restarted the unchanged one %d time(s)", n)
+		}
+	})
+}
+
+// TestDaemonConfigSymlink checks that editing the file config.toml links to
+// reloads the configuration, as does pointing the link somewhere else.
+func TestDaemonConfigSymlink(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	target := filepath.Join(t.TempDir(), "dotfiles", "desktopimage.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, target, dataDir, w)
+	if err := os.MkdirAll(filepath.Dir(configFilePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, configFilePath); err != nil {
+		t.Fatal(err)
+	}
+	addAppImage(t, w.AppPath, "Hello")
+	helloEntry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	startDaemon(t, configFilePath)
+	waitFor(t, "the initial scan", func() bool { return exists(helloEntry) })
+
+	w.Categories = "Development;"
+	writeDaemonConfig(t, target, dataDir, w)
+	waitFor(t, "the entry to be rewritten after editing the target", func() bool {
+		return desktopEntryValue(helloEntry, "Categories") == w.Categories
+	})
+
+	w.Categories = "Graphics;"
+	other := filepath.Join(t.TempDir(), "other.toml")
+	writeDaemonConfig(t, other, dataDir, w)
+	link := configFilePath + ".new"
+	if err := os.Symlink(other, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(link, configFilePath); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the entry to be rewritten after relinking", func() bool {
+		return desktopEntryValue(helloEntry, "Categories") == w.Categories
+	})
+}
+
+// TestDaemonShutdownDuringExtraction checks that stopping the daemon stops
+// an extraction in progress rather than waiting for it, and leaves no entry
+// behind for the AppImage it interrupted.
+func TestDaemonShutdownDuringExtraction(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	logs := recordLogs(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	slow := addAppImage(t, w.AppPath, "Slow")
+	if err := os.WriteFile(slow+".sleep", []byte("30"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runDaemon(ctx, configFilePath) }()
+	waitFor(t, "the scan to start", func() bool { return logs.count("Scanning 1 AppImage(s)") > 0 })
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("runDaemon() = %v", err)
+		}
+	case <-time.After(e2eTimeout):
+		t.Fatal("the daemon waited for the extraction to finish")
+	}
+	if entry := filepath.Join(w.DesktopPath, desktopFileName(w, "Slow")); exists(entry) {
+		t.Errorf("the interrupted integration left %s behind", entry)
+	}
+}
+
+// TestDaemonSecondInstance checks that a second daemon on the same data
+// directory refuses to start, with the exit code for a held lock.
+func TestDaemonSecondInstance(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	startDaemon(t, configFilePath)
+	waitFor(t, "the control socket", func() bool { return exists(filepath.Join(dataDir, "control.sock")) })
+
+	err := runDaemon(context.Background(), configFilePath)
+	if code := exitCode(err); code != exitLockHeld {
+		t.Errorf("the second daemon returned %v, exit code %d, want %d", err, code, exitLockHeld)
+	}
+}
+
+// TestDaemonNotifyAdded checks that an added AppImage, but not one found at
+// startup, is announced with a notification whose "Launch now" action starts
+// it the way its entry does.
+func TestDaemonNotifyAdded(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	notified := useFakeNotifications(t, launchAction)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	prependConfig(t, configFilePath, "notify = true\n")
+
+	addAppImage(t, w.AppPath, "Hello")
+	startDaemon(t, configFilePath)
+	waitFor(t, "the entry of an AppImage present at startup", func() bool {
+		return exists(filepath.Join(w.DesktopPath, desktopFileName(w, "Hello")))
+	})
+
+	world := addAppImage(t, w.AppPath, "World")
+	waitFor(t, "the AppImage to be launched", func() bool { return len(notified.launches()) > 0 })
+	shown := notified.notifications()
+	if len(shown) != 1 {
+		t.Fatalf("%d notifications shown, want 1 for the added AppImage", len(shown))
+	}
+	if !strings.HasPrefix(shown[0].summary, "World") {
+		t.Errorf("summary = %q, want it to name the added AppImage", shown[0].summary)
+	}
+	entry := filepath.Join(w.DesktopPath, desktopFileName(w, "World"))
+	if want := desktopEntryValue(entry, "Icon"); shown[0].icon != want {
+		t.Errorf("icon = %q, want the entry's %q", shown[0].icon, want)
+	}
+	launched := notified.launches()[0]
+	if want := execFields(desktopEntryValue(entry, "Exec")); strings.Join(launched, " ") != strings.Join(want, " ") {
+		t.Errorf("launched %q, want the entry's Exec %q", launched, want)
+	}
+	if launched[len(launched)-1] != world {
+		t.Errorf("launched %q, want %s", launched, world)
+	}
+}
+
+// TestDaemonRemovalGrace checks that the entry of a vanished AppImage stays
+// for removal_grace, that one coming back in time keeps it, and that one
+// moved to the trash can be restored from the notification.
+func TestDaemonRemovalGrace(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	logs := recordLogs(t)
+	notified := useFakeNotifications(t, undoAction)
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	prependConfig(t, configFilePath, "removal_grace = \"500ms\"\nnotify = true\n")
+
+	hello := addAppImage(t, w.AppPath, "Hello")
+	entry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	startDaemon(t, configFilePath)
+	// A scan still running would remove the entry of the moved AppImage.
+	waitFor(t, "the startup scan", func() bool { return logs.count("Scan of") > 0 })
+	if !exists(entry) {
+		t.Fatal("the AppImage present at startup got no entry")
+	}
+
+	t.Run("moved back", func(t *testing.T) {
+		moved := filepath.Join(t.TempDir(), "Hello.AppImage")
+		if err := os.Rename(hello, moved); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := os.Rename(moved, hello); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
+		if !exists(entry) || logs.count("Removed .desktop file") > 0 {
+			t.Error("the entry was removed although the AppImage came back within removal_grace")
+		}
+		if n := len(notified.notifications()); n > 0 {
+			t.Errorf("%d notifications shown for an AppImage not moved to the trash", n)
+		}
+	})
+
+	t.Run("trashed", func(t *testing.T) {
+		trash := homeTrash()
+		for _, dir := range []string{"files", "info"} {
+			if err := os.MkdirAll(filepath.Join(trash, dir), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		info := "[Trash Info]\nPath=" + (&url.URL{Path: hello}).EscapedPath() + "\nDeletionDate=2026-01-02T03:04:05\n"
+		if err := os.WriteFile(filepath.Join(trash, "info", "Hello.AppImage.trashinfo"), []byte(info), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(hello, filepath.Join(trash, "files", "Hello.AppImage")); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the AppImage to be restored", func() bool { return exists(hello) })
+		if shown := notified.notifications(); len(shown) != 1 || !strings.Contains(shown[0].summary, "trash") {
+			t.Errorf("notifications = %+v, want one offering to undo moving it to the trash", shown)
+		}
+		time.Sleep(time.Second)
+		if !exists(entry) || logs.count("Removed .desktop file") > 0 {
+			t.Error("the entry of the restored AppImage was removed")
+		}
+		if exists(filepath.Join(trash, "info", "Hello.AppImage.trashinfo")) {
+			t.Error("the trash info was left behind")
+		}
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		if err := os.Remove(hello); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if !exists(entry) {
+			t.Error("the entry was removed before removal_grace ran out")
+		}
+		waitFor(t, "the entry of the deleted AppImage to go", func() bool { return !exists(entry) })
+	})
+}
+
+// TestDaemonDuplicates checks that an AppImage found identical in two
+// watchers gets one entry, from the watcher duplicate_order prefers, and that
+// the other copy takes over when the preferred one goes.
+func TestDaemonDuplicates(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	preferred := newTestWatcher(t)
+	preferred.Name = "preferred"
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	prependConfig(t, configFilePath, "detect_duplicates = true\nduplicate_order = [\"preferred\"]\n")
+	dropInDir := configDropInDir(configFilePath)
+	if err := os.Mkdir(dropInDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dropIn := fmt.Sprintf("[[Watcher]]\nname = %q\napp_path = %q\ndesktop_path = %q\ncategories = %q\n",
+		preferred.Name, preferred.AppPath, preferred.DesktopPath, preferred.Categories)
+	if err := os.WriteFile(filepath.Join(dropInDir, "preferred.toml"), []byte(dropIn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	addAppImage(t, w.AppPath, "Hello")
+	copied := addAppImage(t, preferred.AppPath, "Hello")
+	entry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	preferredEntry := filepath.Join(preferred.DesktopPath, desktopFileName(preferred, "Hello"))
+	startDaemon(t, configFilePath)
+
+	t.Run("startup", func(t *testing.T) {
+		waitFor(t, "the entry of the preferred copy", func() bool { return exists(preferredEntry) && !exists(entry) })
+		time.Sleep(200 * time.Millisecond)
+		if exists(entry) {
+			t.Error("the other copy got an entry too")
+		}
+	})
+
+	t.Run("preferred removed", func(t *testing.T) {
+		if err := os.Remove(copied); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the other copy to take over", func() bool { return exists(entry) && !exists(preferredEntry) })
+	})
+
+	t.Run("preferred added", func(t *testing.T) {
+		if err := os.RemoveAll(copied + ".contents"); err != nil {
+			t.Fatal(err)
+		}
+		addAppImage(t, preferred.AppPath, "Hello")
+		waitFor(t, "the preferred copy to take over", func() bool { return exists(preferredEntry) && !exists(entry) })
+	})
+}
+
+// TestDaemonMove checks that an AppImage moved to the app_path of another
+// watcher writing to the same desktop_path keeps its entry, which is updated
+// to launch it from there instead of being removed and written anew.
+func TestDaemonMove(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	logs := recordLogs(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	games := newTestWatcher(t)
+	games.Name = "games"
+	games.DesktopPath = w.DesktopPath
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	prependConfig(t, configFilePath, "removal_grace = \"300ms\"\n")
+	dropInDir := configDropInDir(configFilePath)
+	if err := os.Mkdir(dropInDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dropIn := fmt.Sprintf("[[Watcher]]\nname = %q\napp_path = %q\ndesktop_path = %q\ncategories = %q\n",
+		games.Name, games.AppPath, games.DesktopPath, games.Categories)
+	if err := os.WriteFile(filepath.Join(dropInDir, "games.toml"), []byte(dropIn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := addAppImage(t, w.AppPath, "Hello")
+	entry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	startDaemon(t, configFilePath)
+	waitFor(t, "the entry of Hello", func() bool { return entryExecTarget(entry) == hello })
+
+	moved := filepath.Join(games.AppPath, "Hello.AppImage")
+	if err := os.Rename(hello+".contents", moved+".contents"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(hello, moved); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the entry to launch the moved AppImage", func() bool { return entryExecTarget(entry) == moved })
+	if logs.count("was moved from "+hello) != 1 {
+		t.Errorf("the move wasn't recognised: %q", logs.messages)
+	}
+	// The removal of the AppImage at its old path leaves the entry alone.
+	time.Sleep(600 * time.Millisecond)
+	if got := entryExecTarget(entry); got != moved {
+		t.Errorf("Exec = %q after removal_grace, want %q", got, moved)
+	}
+	if app, ok := currentState().get(moved); !ok || app.Watcher != games.Name || app.DesktopFile != entry {
+		t.Errorf("record of the moved AppImage %+v, %v", app, ok)
+	}
+}
+
+// TestDaemonSingleFile checks that a watcher whose app_path is one AppImage
+// integrates only that file, through replacement and deletion.
+func TestDaemonSingleFile(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	dir := w.AppPath
+	hello := addAppImage(t, dir, "Hello")
+	addAppImage(t, dir, "Other")
+	w.AppPath = hello
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	entry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	startDaemon(t, configFilePath)
+
+	t.Run("initial scan", func(t *testing.T) {
+		waitFor(t, "the entry of the watched AppImage", func() bool { return exists(entry) })
+		if got := entryExecTarget(entry); got != hello {
+			t.Errorf("Exec = %q, want %q", got, hello)
+		}
+		addAppImage(t, dir, "World")
+		time.Sleep(300 * time.Millisecond)
+		for _, name := range []string{"Other", "World"} {
+			if other := filepath.Join(w.DesktopPath, desktopFileName(w, name)); exists(other) {
+				t.Errorf("%s.AppImage next to the watched one got an entry", name)
+			}
+		}
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		tmp := filepath.Join(dir, ".Hello.AppImage.part")
+		copyFile(t, hello, tmp, 0755)
+		if err := os.Rename(tmp, hello); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if !exists(entry) {
+			t.Error("replacing the AppImage removed its entry")
+		}
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		if err := os.Remove(hello); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the entry of the deleted AppImage to go", func() bool { return !exists(entry) })
+	})
+
+	t.Run("recreated", func(t *testing.T) {
+		copyFile(t, fixtureAppImage, hello, 0755)
+		waitFor(t, "the entry of the recreated AppImage", func() bool { return exists(entry) })
+	})
+}
+
+func TestDaemonFailedExtraction(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	logs := recordLogs(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	broken := []byte("#!/bin/sh\necho not an AppImage\n")
+	path := filepath.Join(w.AppPath, "Broken.AppImage")
+	if err := os.WriteFile(path, broken, 0755); err != nil {
+		t.Fatal(err)
+	}
+	startDaemon(t, configFilePath)
+	const warning = "Could not extract icon"
+
+	t.Run("recorded", func(t *testing.T) {
+		waitFor(t, "the entry of the broken AppImage", func() bool {
+			return exists(filepath.Join(w.DesktopPath, desktopFileName(w, "Broken")))
+		})
+		failed := openFailures(dataDir).list()
+		if len(failed) != 1 || failed[0].Path != path || failed[0].Failures != 1 {
+			t.Fatalf("failures = %+v, want one for %s", failed, path)
+		}
+		if failed[0].Class != failureInvalid || !failed[0].RetryAt.IsZero() {
+			t.Errorf("class %s, retry_at %s, want an invalid AppImage that isn't retried", failed[0].Class, failed[0].RetryAt)
+		}
+	})
+
+	t.Run("not retried", func(t *testing.T) {
+		if err := os.WriteFile(path, broken, 0755); err != nil {
+			t.Fatal(err)
+		}
+		copyPath := filepath.Join(w.AppPath, "Copy.AppImage")
+		if err := os.WriteFile(copyPath, broken, 0755); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the entry of the copy", func() bool {
+			return exists(filepath.Join(w.DesktopPath, desktopFileName(w, "Copy")))
+		})
+		time.Sleep(200 * time.Millisecond)
+		if n := logs.count(warning); n != 1 {
+			t.Errorf("extraction was tried %d times, want once", n)
+		}
+	})
+
+	t.Run("forgotten", func(t *testing.T) {
+		for _, name := range []string{"Broken", "Copy"} {
+			if err := os.Remove(filepath.Join(w.AppPath, name+".AppImage")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitFor(t, "the failure to be forgotten", func() bool { return len(openFailures(dataDir).list()) == 0 })
+	})
+}
+
+func TestDaemonEffectiveConfig(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	startDaemon(t, configFilePath)
+	socket := filepath.Join(dataDir, "control.sock")
+	waitFor(t, "the control socket", func() bool { return exists(socket) })
+
+	effective := func() Config {
+		t.Helper()
+		resp, err := sendControl(socket, controlRequest{Command: "get-config"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var text string
+		if err := json.Unmarshal(resp.Data, &text); err != nil {
+			t.Fatal(err)
+		}
+		var cfg Config
+		if err := toml.Unmarshal([]byte(text), &cfg); err != nil {
+			t.Fatalf("%v in\n%s", err, text)
+		}
+		return cfg
+	}
+
+	cfg := effective()
+	if cfg.SettleDelay != 50*time.Millisecond || cfg.RefreshMaxDelay != defaultRefreshMaxDelay || cfg.DataDir != dataDir {
+		t.Errorf("settle_delay, refresh_max_delay, data_dir = %s, %s, %s; want 50ms, the default and %s", cfg.SettleDelay, cfg.RefreshMaxDelay, cfg.DataDir, dataDir)
+	}
+	if len(cfg.Watchers) != 1 || cfg.Watchers[0].Name != w.Name || !cfg.Watchers[0].enabled() {
+		t.Fatalf("watchers = %+v, want %s enabled", cfg.Watchers, w.Name)
+	}
+
+	if _, err := sendControl(socket, controlRequest{Command: "disable-watcher", Watcher: w.Name}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := effective(); cfg.Watchers[0].enabled() {
+		t.Error("the watcher disabled at runtime is shown enabled")
+	}
+}
+
+// TestDaemonArtifacts checks that the icon extracted for an AppImage goes
+// with it, even when its entry was deleted already, but stays while another
+// AppImage of the same name uses it.
+func TestDaemonArtifacts(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	other := newTestWatcher(t)
+	other.Name = "other"
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	dropInDir := configDropInDir(configFilePath)
+	if err := os.Mkdir(dropInDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dropIn := fmt.Sprintf("[[Watcher]]\nname = %q\napp_path = %q\ndesktop_path = %q\ncategories = %q\n",
+		other.Name, other.AppPath, other.DesktopPath, other.Categories)
+	if err := os.WriteFile(filepath.Join(dropInDir, "other.toml"), []byte(dropIn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := addAppImage(t, w.AppPath, "Hello")
+	otherHello := addAppImage(t, other.AppPath, "Hello")
+	otherEntry := filepath.Join(other.DesktopPath, desktopFileName(other, "Hello"))
+	icon := filepath.Join(dataDir, "icons", "Hello.png")
+	startDaemon(t, configFilePath)
+	waitFor(t, "both copies to be recorded with the icon", func() bool {
+		for _, path := range []string{hello, otherHello} {
+			if app, ok := currentState().get(path); !ok || !containsString(app.Artifacts, icon) {
+				return false
+			}
+		}
+		return true
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		if err := os.Remove(hello); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the removed copy to be forgotten", func() bool {
+			_, ok := currentState().get(hello)
+			return !ok
+		})
+		if !exists(icon) {
+			t.Error("the icon the other copy uses was removed")
+		}
+	})
+
+	t.Run("entry deleted", func(t *testing.T) {
+		if err := os.Remove(otherEntry); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(otherHello); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the icon to go", func() bool { return !exists(icon) })
+	})
+}
+
+// TestDaemonHold checks that holds set through the daemon end up in the
+// state file.
+func TestDaemonHold(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	path := addAppImage(t, w.AppPath, "Hello")
+	startDaemon(t, configFilePath)
+	waitFor(t, "Hello to be recorded", func() bool {
+		_, ok := currentState().get(path)
+		return ok
+	})
+
+	socket := filepath.Join(dataDir, "control.sock")
+	for _, held := range []bool{true, false} {
+		command := "hold"
+		if !held {
+			command = "unhold"
+		}
+		if _, err := sendControl(socket, controlRequest{Command: command, Source: path}); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		st, err := openState(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if app, _ := st.get(path); app.Held != held {
+			t.Errorf("after %s the state file has held %v", command, app.Held)
+		}
+	}
+	if _, err := sendControl(socket, controlRequest{Command: "hold", Source: filepath.Join(w.AppPath, "Missing.AppImage")}); err == nil {
+		t.Error("holding an AppImage that isn't integrated succeeded")
+	}
+}
+
+func TestDaemonReconcileReport(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	path := addAppImage(t, w.AppPath, "Hello")
+	startDaemon(t, configFilePath)
+
+	socket := filepath.Join(dataDir, "control.sock")
+	var reports []reconcileReport
+	waitFor(t, "the report of the startup scan", func() bool {
+		resp, err := sendControl(socket, controlRequest{Command: "get-reconcile-report", Watcher: w.Name})
+		return err == nil && json.Unmarshal(resp.Data, &reports) == nil
+	})
+	if len(reports) != 1 || !reflect.DeepEqual(reports[0].Added, []string{path}) || !reports[0].Converged {
+		t.Errorf("reports = %+v, want one adding %s that converged", reports, path)
+	}
+	content, err := os.ReadFile(filepath.Join(dataDir, reconcileReportFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []reconcileReport
+	if err := json.Unmarshal(content, &saved); err != nil || len(saved) != 1 || saved[0].Watcher != w.Name {
+		t.Errorf("%s holds %s, want the report of %s", reconcileReportFileName, content, w.Name)
+	}
+	if _, err := sendControl(socket, controlRequest{Command: "get-reconcile-report", Watcher: "missing"}); err == nil {
+		t.Error("the report of an unknown watcher was returned")
+	}
+}
+
+func TestDaemonEventTrace(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	t.Cleanup(func() { configureEventTrace(Config{}) })
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	prependConfig(t, configFilePath, "trace_events = true\n")
+	startDaemon(t, configFilePath)
+	socket := filepath.Join(dataDir, "control.sock")
+	waitFor(t, "the watcher to start", func() bool {
+		_, err := reconcileReportsOf(w.Name)
+		return err == nil
+	})
+
+	// Not an AppImage, so filtered out, but still traced.
+	notes := filepath.Join(w.AppPath, "notes.txt")
+	if err := os.WriteFile(notes, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the event to be traced", func() bool {
+		resp, err := sendControl(socket, controlRequest{Command: "get-event-trace", Watcher: w.Name})
+		var traced []tracedEvent
+		if err != nil || json.Unmarshal(resp.Data, &traced) != nil {
+			return false
+		}
+		for _, e := range traced {
+			if e.Name == notes && e.Op == "CREATE" && e.Watcher == w.Name {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestDaemonPause(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	startDaemon(t, configFilePath)
+	socket := filepath.Join(dataDir, "control.sock")
+	waitFor(t, "the watcher to start", func() bool {
+		_, err := reconcileReportsOf(w.Name)
+		return err == nil
+	})
+
+	for policy, name := range map[string]string{pauseQueue: "Queued", pauseDrop: "Dropped"} {
+		policy, name := policy, name
+		t.Run(policy, func(t *testing.T) {
+			if _, err := sendControl(socket, controlRequest{Command: "pause-watcher", Watcher: w.Name, Policy: policy}); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := sendControl(socket, controlRequest{Command: "list-watchers"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statuses []watcherStatus
+			if err := json.Unmarshal(resp.Data, &statuses); err != nil || len(statuses) != 1 || statuses[0].Paused != policy {
+				t.Errorf("list-watchers = %s, want the watcher paused with %s", resp.Data, policy)
+			}
+
+			addAppImage(t, w.AppPath, name)
+			entry := filepath.Join(w.DesktopPath, desktopFileName(w, name))
+			time.Sleep(300 * time.Millisecond)
+			if exists(entry) {
+				t.Fatal("a paused watcher integrated an added AppImage")
+			}
+			if _, err := sendControl(socket, controlRequest{Command: "resume-watcher", Watcher: w.Name}); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the entry of the AppImage added while paused", func() bool { return exists(entry) })
+		})
+	}
+
+	if _, err := sendControl(socket, controlRequest{Command: "pause-watcher", Watcher: w.Name, Policy: "later"}); err == nil {
+		t.Error("pausing with an unknown policy succeeded")
+	}
+	if _, err := sendControl(socket, controlRequest{Command: "pause-watcher", Watcher: "missing"}); err == nil {
+		t.Error("pausing an unknown watcher succeeded")
+	}
+}
+
+func TestDaemonMaintenance(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	dataDir := t.TempDir()
+	configFilePath := filepath.Join(t.TempDir(), "desktopimage", "config.toml")
+	w := newTestWatcher(t)
+	writeDaemonConfig(t, configFilePath, dataDir, w)
+	hello := addAppImage(t, w.AppPath, "Hello")
+	helloEntry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	startDaemon(t, configFilePath)
+	waitFor(t, "the entry of Hello", func() bool { return exists(helloEntry) })
+
+	socket := filepath.Join(dataDir, "control.sock")
+	if _, err := sendControl(socket, controlRequest{Command: "start-maintenance"}); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(filepath.Join(dataDir, maintenanceFileName)) {
+		t.Error("maintenance mode was not marked in the data directory")
+	}
+	if err := os.Remove(hello); err != nil {
+		t.Fatal(err)
+	}
+	addAppImage(t, w.AppPath, "World")
+	worldEntry := filepath.Join(w.DesktopPath, desktopFileName(w, "World"))
+	time.Sleep(300 * time.Millisecond)
+	if exists(worldEntry) || !exists(helloEntry) {
+		t.Fatal("entries changed during maintenance")
+	}
+
+	resp, err := sendControl(socket, controlRequest{Command: "end-maintenance"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status maintenanceStatus
+	if err := json.Unmarshal(resp.Data, &status); err != nil || status.Active {
+		t.Errorf("end-maintenance returned %s, want maintenance off", resp.Data)
+	}
+	waitFor(t, "the rescan after maintenance", func() bool { return exists(worldEntry) && !exists(helloEntry) })
+	if exists(filepath.Join(dataDir, maintenanceFileName)) {
+		t.Error("the maintenance marker was left behind")
+	}
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenEntries renders entries for AppImages as they are found in the wild
+// and compares them with testdata/golden/NAME.desktop. After a deliberate
+// change to the output, rewrite those with
+//
+//	go test -run TestGoldenEntries -update
+//
+// and review the difference.
+var goldenEntries = []struct {
+	name     string
+	appName  string
+	icon     string
+	hash     string
+	metainfo string
+	// rawCategories leaves the categories as configured rather than
+	// normalizing them, so that their escaping is what is checked.
+	rawCategories bool
+	// configure changes the watcher the entry is rendered for.
+	configure func(w *WatcherConfig)
+}{
+	{name: "plain", appName: "Obsidian-1.5.3", icon: "/var/lib/desktopimage/icons/Obsidian-1.5.3.png",
+		hash: "5d41402abc4b2a76b9719d911017c592ae3c6a0b5ac2a4d6a6c0c62fbe0e0b1c"},
+	{name: "no-icon", appName: "balenaEtcher-1.18.11-x64"},
+	{name: "appstream", appName: "krita-5.2.2-x86_64", icon: "/var/lib/desktopimage/icons/krita-5.2.2-x86_64.svg", metainfo: "krita.appdata.xml",
+		hash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+	{name: "appstream-whitespace", appName: "Nextcloud-3.11.0-x86_64", metainfo: "nextcloud.appdata.xml"},
+	{name: "quoting", appName: `My "App" 100% $HOME`, icon: "/icons/my app.png"},
+	{name: "unicode", appName: "Cafe\u0301 \u202eTool\u202c-2.0"},
+	{name: "escaping", appName: `back\slash`, icon: "/icons/tab\there.png", rawCategories: true, configure: func(w *WatcherConfig) {
+		w.Categories = "Utility;\nDevelopment;"
+	}},
+	{name: "terminal", appName: "htop-3.3.0", configure: func(w *WatcherConfig) {
+		terminal := true
+		w.Terminal = &terminal
+		w.Categories = "System;Monitor;"
+	}},
+	{name: "template", appName: "krita-5.2.2-x86_64", icon: "/icons/krita.svg", metainfo: "krita.appdata.xml", configure: func(w *WatcherConfig) {
+		w.Template = filepath.Join("testdata", "golden", "custom.tmpl")
+	}},
+	{name: "name-template", appName: "krita-5.2.2-x86_64", metainfo: "krita.appdata.xml", configure: func(w *WatcherConfig) {
+		w.NameTemplate = "{{.Name}} {{.Version}}"
+	}},
+	{name: "name-template-no-version", appName: "Obsidian-1.5.3", configure: func(w *WatcherConfig) {
+		w.NameTemplate = "{{.Name}} {{.Version}} (AppImage)"
+	}},
+}
+
+func TestGoldenEntries(t *testing.T) {
+	for _, c := range goldenEntries {
+		t.Run(c.name, func(t *testing.T) {
+			w := WatcherConfig{Name: "golden", AppPath: "/opt/apps", DesktopPath: "/usr/share/applications", Categories: "Utility;"}
+			if c.configure != nil {
+				c.configure(&w)
+			}
+			if c.rawCategories {
+				prev := categoriesValue
+				categoriesValue = desktopString
+				t.Cleanup(func() { categoriesValue = prev })
+			}
+			dataDir := t.TempDir()
+			useTestConfig(t, Config{DataDir: dataDir, Watchers: []WatcherConfig{w}})
+			var info appStreamInfo
+			if c.metainfo != "" {
+				var err error
+				if info, err = parseAppStream(filepath.Join("testdata", "golden", c.metainfo)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := renderDesktopEntry(context.Background(), w, c.appName, c.icon, c.hash, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				// The translations come from maps.
+				if again, _ := renderDesktopEntry(context.Background(), w, c.appName, c.icon, c.hash, info); again != got {
+					t.Fatalf("rendering again gave a different entry:\n%s\nthen:\n%s", got, again)
+				}
+			}
+			// Stock icons are written into the data directory.
+			got = strings.ReplaceAll(got, dataDir, defaultDataDir)
+
+			golden := filepath.Join("testdata", "golden", c.name+".desktop")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v; run with -update to create it", err)
+			}
+			if got != string(want) {
+				t.Errorf("entry differs from %s:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestQuirks(t *testing.T) {
+	off := false
+	cfg := Config{
+		Apps: map[string]AppConfig{"Obsidian-1.4.0": {Quirks: &off}},
+		Quirks: []Quirk{
+			{Match: "obsidian-1.5*", StartupWMClass: "ObsidianBeta"},
+			{Match: "myapp*", Args: []string{"--disable-gpu"}},
+		},
+	}
+	useTestConfig(t, cfg)
+	sysctl := filepath.Join(t.TempDir(), "apparmor_restrict_unprivileged_userns")
+	if err := os.WriteFile(sysctl, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	usernsSysctls = map[string]string{sysctl: "1"}
+	configureQuirks(cfg)
+
+	w := WatcherConfig{AppPath: "/opt/apps"}
+	cases := []struct {
+		appName, exec, wmClass string
+	}{
+		{"Obsidian-1.5.3", "/opt/apps/Obsidian-1.5.3.AppImage --no-sandbox", "ObsidianBeta"},
+		{"Obsidian-1.4.0", "/opt/apps/Obsidian-1.4.0.AppImage", ""},
+		{"MyApp-2", "/opt/apps/MyApp-2.AppImage --disable-gpu", ""},
+		{"krita-5.2.2-x86_64", "/opt/apps/krita-5.2.2-x86_64.AppImage", ""},
+	}
+	for _, c := range cases {
+		if got := execLine(w, "/opt/apps/"+c.appName+".AppImage"); got != c.exec {
+			t.Errorf("Exec of %s = %q, want %q", c.appName, got, c.exec)
+		}
+		if got := appQuirk(c.appName).StartupWMClass; got != c.wmClass {
+			t.Errorf("StartupWMClass of %s = %q, want %q", c.appName, got, c.wmClass)
+		}
+	}
+
+	if err := os.WriteFile(sysctl, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configureQuirks(cfg)
+	if got := execLine(w, "/opt/apps/Obsidian-1.5.3.AppImage"); got != "/opt/apps/Obsidian-1.5.3.AppImage" {
+		t.Errorf("Exec = %q without restricted user namespaces, want no --no-sandbox", got)
+	}
+}
+
+func TestExecArgs(t *testing.T) {
+	cfg := Config{
+		Apps:   map[string]AppConfig{"MyApp-2": {ExecArgs: []string{"--disable-gpu", "--title", "My App 100% $HOME"}}},
+		Quirks: []Quirk{{Match: "myapp*", Args: []string{"--disable-gpu"}}},
+	}
+	useTestConfig(t, cfg)
+	w := WatcherConfig{AppPath: "/opt/apps", ExecArgs: []string{"--ozone-platform-hint=auto"}}
+	exec := execLine(w, "/opt/apps/MyApp-2.AppImage")
+	if want := `/opt/apps/MyApp-2.AppImage --ozone-platform-hint=auto --disable-gpu --title "My App 100%% \\$HOME"`; exec != want {
+		t.Errorf("Exec = %q, want %q", exec, want)
+	}
+	want := []string{"/opt/apps/MyApp-2.AppImage", "--ozone-platform-hint=auto", "--disable-gpu", "--title", "My App 100% $HOME"}
+	if got := execFields(exec); !equalStrings(got, want) {
+		t.Errorf("execFields(%q) = %q, want %q", exec, got, want)
+	}
+
+	// A quirk option with a value isn't split by exec_args setting the same
+	// option.
+	cfg.Apps["Editor"] = AppConfig{ExecArgs: []string{"--enable-features", "Foo"}}
+	cfg.Quirks = append(cfg.Quirks,
+		Quirk{Match: "editor*", Args: []string{"--enable-features", "WaylandWindowDecorations", "--disable-gpu"}},
+		Quirk{Match: "editor*", Args: []string{"--enable-features", "Vulkan", "--disable-gpu"}})
+	useTestConfig(t, cfg)
+	if got, want := execLine(WatcherConfig{AppPath: "/opt/apps"}, "/opt/apps/Editor.AppImage"),
+		"/opt/apps/Editor.AppImage --enable-features WaylandWindowDecorations --disable-gpu --enable-features Vulkan --enable-features Foo"; got != want {
+		t.Errorf("Exec = %q, want %q", got, want)
+	}
+
+	cfg.Apps["MyApp-2"] = AppConfig{ExecArgs: []string{""}}
+	if err := validateApps(cfg); err == nil {
+		t.Error("an empty exec_args argument is valid")
+	}
+}
+
+func TestToolkitDetection(t *testing.T) {
+	useTestConfig(t, Config{})
+	if opts, _ := currentExtraction(); !opts.enabled {
+		t.Skip("extraction is unavailable")
+	}
+	dir := t.TempDir()
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Like electron-builder, Notes links its icon to the icon theme copy.
+	notes := addAppImage(t, dir, "Notes")
+	icon, err := os.ReadFile(filepath.Join(notes+".contents", "hello.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(notes+".contents", "usr/share/icons/hicolor/512x512/apps/hello.png"), string(icon))
+	write(filepath.Join(notes+".contents", "chrome-sandbox"), "")
+	write(filepath.Join(notes+".contents", "resources/app.asar"), "")
+	if err := os.Remove(filepath.Join(notes+".contents", "hello.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("usr/share/icons/hicolor/512x512/apps/hello.png", filepath.Join(notes+".contents", "hello.png")); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(notes+".contents", "hello.desktop"), "[Desktop Entry]\nName=Notes\nExec=AppRun\nIcon=hello\nStartupWMClass=notes-app\n")
+
+	viewer := addAppImage(t, dir, "Viewer")
+	write(filepath.Join(viewer+".contents", "usr/lib/libQt5Core.so.5"), "")
+	write(filepath.Join(viewer+".contents", "hello.desktop"), "[Desktop Entry]\nName=Viewer\nExec=viewer %F\nIcon=hello\n")
+
+	cases := []struct {
+		path, toolkit, wmClass string
+		args                   bool
+	}{
+		{notes, toolkitElectron, "notes-app", true},
+		{viewer, toolkitQt, "viewer", false},
+		{addAppImage(t, dir, "Hello"), "", "", false},
+	}
+	for _, c := range cases {
+		appName := appNameFromPath(c.path)
+		if icon, err := extractIcon(context.Background(), c.path, true); err != nil || icon == "" {
+			t.Fatalf("extracting %s gave icon %q, %v", appName, icon, err)
+		}
+		if got := extractedPayload(appName); got.Toolkit != c.toolkit || got.StartupWMClass != c.wmClass {
+			t.Errorf("payload of %s = %+v, want toolkit %q and class %q", appName, got, c.toolkit, c.wmClass)
+		}
+		if got := strings.HasSuffix(execLine(WatcherConfig{}, c.path), " --ozone-platform-hint=auto"); got != c.args {
+			t.Errorf("Exec of %s = %q, want the Ozone hint: %v", appName, execLine(WatcherConfig{}, c.path), c.args)
+		}
+	}
+}
+
+func TestSplitEntries(t *testing.T) {
+	cfg := Config{Quirks: []Quirk{{Match: "office*", SplitEntries: true}}}
+	useTestConfig(t, cfg)
+	useFakeCommands(t)
+	if opts, _ := currentExtraction(); !opts.enabled {
+		t.Skip("extraction is unavailable")
+	}
+	w := newTestWatcher(t)
+	office := addAppImage(t, w.AppPath, "Office")
+	contents := office + ".contents"
+	icon, err := os.ReadFile(filepath.Join(contents, "hello.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"hello.desktop": "[Desktop Entry]\nName=Office\nExec=office %U\nIcon=hello\n",
+		"usr/share/applications/office-startcenter.desktop":       "[Desktop Entry]\nName=Office\nExec=office %U\n",
+		"usr/share/applications/office-writer.desktop":            "[Desktop Entry]\nName=Office Writer\nExec=office --writer %U\nIcon=office-writer\nStartupWMClass=office-writer\n",
+		"usr/share/applications/office-calc.desktop":              "[Desktop Entry]\nName=Office Calc\nExec=office --calc %U\n",
+		"usr/share/applications/office-xsltfilter.desktop":        "[Desktop Entry]\nName=XSLT\nExec=office --xslt\nNoDisplay=true\n",
+		"usr/share/icons/hicolor/scalable/apps/office-writer.png": string(icon),
+	}
+	for name, content := range files {
+		path := filepath.Join(contents, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refresher := newDBRefresher(time.Hour, time.Hour)
+
+	reconcile(context.Background(), w, 1, refresher)
+	entries, _ := filepath.Glob(filepath.Join(w.DesktopPath, "*.desktop"))
+	if len(entries) != 3 {
+		t.Fatalf("entries %v, want Office and its Writer and Calc", entries)
+	}
+	writer := filepath.Join(w.DesktopPath, "Office-office-writer.desktop")
+	if got := desktopEntryValue(writer, "Exec"); got != office+" --writer" {
+		t.Errorf("Exec of Writer = %q, want the AppImage with --writer", got)
+	}
+	if got := desktopEntryValue(writer, "Name"); got != "Office Writer" {
+		t.Errorf("Name of Writer = %q", got)
+	}
+	if got := desktopEntryValue(writer, "StartupWMClass"); got != "office-writer" {
+		t.Errorf("StartupWMClass of Writer = %q", got)
+	}
+	if got := desktopEntryValue(writer, "Icon"); got == "" || got == desktopEntryValue(filepath.Join(w.DesktopPath, "Office.desktop"), "Icon") {
+		t.Errorf("Icon of Writer = %q, want its own", got)
+	}
+	calc := filepath.Join(w.DesktopPath, "Office-office-calc.desktop")
+	if got := desktopEntryValue(calc, "Exec"); got != office+" --calc" {
+		t.Errorf("Exec of Calc = %q, want the AppImage with --calc", got)
+	}
+
+	// Without the quirk, the bundled apps lose their entries.
+	configureQuirks(Config{})
+	reconcile(context.Background(), w, 1, refresher)
+	if entries, _ := filepath.Glob(filepath.Join(w.DesktopPath, "*.desktop")); len(entries) != 1 {
+		t.Errorf("entries %v without split_entries, want only Office", entries)
+	}
+
+	configureQuirks(cfg)
+	reconcile(context.Background(), w, 1, refresher)
+	if entries, _ := filepath.Glob(filepath.Join(w.DesktopPath, "*.desktop")); len(entries) != 3 {
+		t.Errorf("entries %v with split_entries again, want three", entries)
+	}
+	if err := os.Remove(office); err != nil {
+		t.Fatal(err)
+	}
+	reconcile(context.Background(), w, 1, refresher)
+	if entries, _ := filepath.Glob(filepath.Join(w.DesktopPath, "*.desktop")); len(entries) != 0 {
+		t.Errorf("entries %v left after the AppImage was removed", entries)
+	}
+}
+
+func TestMimeDefaults(t *testing.T) {
+	off := false
+	useTestConfig(t, Config{Apps: map[string]AppConfig{"Viewer": {MimeDefaults: &off}}})
+	commands := useFakeCommands(t)
+	if opts, _ := currentExtraction(); !opts.enabled {
+		t.Skip("extraction is unavailable")
+	}
+	w := newTestWatcher(t)
+	w.MimeDefaults = true
+	for _, name := range []string{"Paint", "Viewer"} {
+		path := addAppImage(t, w.AppPath, name)
+		entry := "[Desktop Entry]\nName=" + name + "\nExec=paint %F\nIcon=hello\nMimeType=application/x-krita;image/openraster;\n"
+		if err := os.WriteFile(filepath.Join(path+".contents", "hello.desktop"), []byte(entry), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refresher := newDBRefresher(time.Hour, time.Hour)
+
+	reconcile(context.Background(), w, 1, refresher)
+	paint := filepath.Join(w.DesktopPath, "Paint.desktop")
+	if got := desktopEntryValue(paint, "MimeType"); got != "application/x-krita;image/openraster;" {
+		t.Errorf("MimeType = %q, want the types of the AppImage's entry", got)
+	}
+	if got := desktopEntryValue(paint, "Exec"); !strings.HasSuffix(got, "Paint.AppImage %F") {
+		t.Errorf("Exec = %q, want the files passed with %%F", got)
+	}
+	claim := "xdg-mime default Paint.desktop application/x-krita image/openraster"
+	if n := commands.ran(claim); n != 1 {
+		t.Errorf("%q ran %d time(s), want once", claim, n)
+	}
+	if n := commands.ran("xdg-mime default Viewer.desktop application/x-krita image/openraster"); n != 0 {
+		t.Error("Viewer was made the default although its mime_defaults is false")
+	}
+
+	// A default the user picked since is kept.
+	if err := os.WriteFile(paint, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reconcile(context.Background(), w, 1, refresher)
+	if n := commands.ran(claim); n != 1 {
+		t.Errorf("%q ran %d time(s) after a rescan, want once", claim, n)
+	}
+}
+
+func TestSchemeDefaults(t *testing.T) {
+	useTestConfig(t, Config{})
+	commands := useFakeCommands(t)
+	if opts, _ := currentExtraction(); !opts.enabled {
+		t.Skip("extraction is unavailable")
+	}
+	w := newTestWatcher(t)
+	w.SchemeDefaults = true
+	path := addAppImage(t, w.AppPath, "Chat")
+	entry := "[Desktop Entry]\nName=Chat\nExec=chat\nIcon=hello\nMimeType=x-scheme-handler/chat;text/x-chat-log;\n"
+	if err := os.WriteFile(filepath.Join(path+".contents", "hello.desktop"), []byte(entry), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reconcile(context.Background(), w, 1, newDBRefresher(time.Hour, time.Hour))
+	chat := filepath.Join(w.DesktopPath, "Chat.desktop")
+	if got := desktopEntryValue(chat, "Exec"); !strings.HasSuffix(got, "Chat.AppImage %u") {
+		t.Errorf("Exec = %q, want the URL passed with %%u", got)
+	}
+	if n := commands.ran("xdg-mime default Chat.desktop x-scheme-handler/chat"); n != 1 {
+		t.Errorf("Chat was made the default handler of its scheme %d time(s), want once", n)
+	}
+	if n := commands.ran("xdg-mime default Chat.desktop text/x-chat-log"); n != 0 {
+		t.Error("Chat was made the default for its file type without mime_defaults")
+	}
+}
+
+func TestResolvers(t *testing.T) {
+	cfg := Config{DataDir: t.TempDir(), Resolvers: ResolverConfig{
+		Name:       []string{resolveAppStream, resolveCatalog, resolveDesktop, resolveSnapshot, resolveFilename},
+		Icon:       []string{resolveCatalog, resolveConfig, resolveDesktop},
+		Categories: []string{resolveAppStream, resolveCatalog, resolveDesktop, resolveSnapshot, resolveConfig},
+	}}
+	useTestConfig(t, cfg)
+	feed := `{"items": [{"name": "Obsidian", "categories": ["Office"], "icons": ["Obsidian/icons/128x128/obsidian.png"]}]}`
+	if err := os.WriteFile(filepath.Join(cfg.DataDir, "catalog.json"), []byte(feed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Downloaded before.
+	catalogIcon := filepath.Join(cfg.iconDir(), "catalog", "obsidian.png")
+	if err := os.MkdirAll(filepath.Dir(catalogIcon), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(catalogIcon, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	metainfo := filepath.Join(t.TempDir(), "paint.appdata.xml")
+	if err := os.WriteFile(metainfo, []byte(`<component><name>Paint Studio</name><categories><category>Graphics</category><category>2DGraphics</category></categories></component>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseAppStream(metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, _ := currentExtraction()
+	if err := installPayloadInfo(opts.metainfoDir, "notes-2.0", payloadInfo{Name: "Notes", Categories: "Office;TextEditor;"}); err != nil {
+		t.Fatal(err)
+	}
+	iconPath := filepath.Join(t.TempDir(), "fallback.png")
+	if err := os.WriteFile(iconPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := WatcherConfig{Name: "resolvers", AppPath: "/opt/apps", DesktopPath: "/usr/share/applications", Categories: "Utility;", IconPath: iconPath}
+
+	for _, c := range []struct {
+		appName                string
+		info                   appStreamInfo
+		name, categories, icon string
+	}{
+		{appName: "paint-1.0-x86_64", info: info, name: "Paint Studio", categories: "Graphics;2DGraphics;", icon: iconPath},
+		{appName: "Obsidian-1.5.3-x64", name: "Obsidian", categories: "Office;", icon: catalogIcon},
+		{appName: "notes-2.0", name: "Notes", categories: "Office;TextEditor;", icon: iconPath},
+		{appName: "krita-5.2.2-x86_64", name: "Krita", categories: "Graphics;2DGraphics;RasterGraphics;", icon: iconPath},
+		{appName: "Unknown-3.1", name: "Unknown-3.1", categories: "Utility;", icon: iconPath},
+	} {
+		content, err := renderDesktopEntry(context.Background(), w, c.appName, "/icons/extracted.png", "", c.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "entry.desktop")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{"Name": c.name, "Categories": c.categories, "Icon": c.icon} {
+			if got := desktopEntryValue(path, key); got != want {
+				t.Errorf("%s: %s = %q, want %q", c.appName, key, got, want)
+			}
+		}
+	}
+
+	// Stages can't give fields they don't know.
+	if err := validateResolvers(Config{Resolvers: ResolverConfig{Name: []string{resolveConfig}}}); err == nil {
+		t.Error("name = [\"config\"] was accepted")
+	}
+	if err := validateResolvers(Config{Resolvers: ResolverConfig{Icon: []string{resolveSnapshot}}}); err == nil {
+		t.Error("icon = [\"snapshot\"] was accepted, the snapshot has no icons")
+	}
+	if err := validateResolvers(cfg); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCatalogIconOnDemand checks that the icon of a catalog app is only
+// downloaded when the icon chain gets to the catalog stage.
+func TestCatalogIconOnDemand(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		rw.Write([]byte("png"))
+	}))
+	defer server.Close()
+	cfg := Config{DataDir: t.TempDir(), Resolvers: ResolverConfig{Name: []string{resolveCatalog}, Icon: []string{resolveDesktop}}}
+	useTestConfig(t, cfg)
+	feed := fmt.Sprintf(`{"items": [{"name": "Obsidian", "icons": [%q]}]}`, server.URL+"/obsidian.png")
+	if err := os.WriteFile(filepath.Join(cfg.DataDir, "catalog.json"), []byte(feed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := WatcherConfig{Name: "catalog", AppPath: "/opt/apps", DesktopPath: "/usr/share/applications"}
+	if _, err := renderDesktopEntry(context.Background(), w, "Obsidian-1.5.3-x64", "/icons/extracted.png", "", appStreamInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("the catalog icon was downloaded %d time(s) for an icon chain without the catalog", n)
+	}
+
+	cfg.Resolvers.Icon = []string{resolveCatalog}
+	configureResolvers(cfg)
+	content, err := renderDesktopEntry(context.Background(), w, "Obsidian-1.5.3-x64", "", "", appStreamInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(cfg.iconDir(), "catalog", "obsidian.png"); !strings.Contains(content, "\nIcon="+want+"\n") || requests.Load() != 1 {
+		t.Errorf("entry with %d download(s), want the icon %s:\n%s", requests.Load(), want, content)
+	}
+}
+
+func TestNormalizeCategories(t *testing.T) {
+	for _, c := range []struct {
+		value, want string
+		notes       int
+	}{
+		{"Utility", "Utility", 0},
+		{"System;Monitor;", "System;Monitor;", 0},
+		{"Application", "Application", 0},
+		{"Graphics/Photo", "Graphics;Photography;", 1},
+		{"Games", "Game;", 1},
+		{"text editor", "Utility;TextEditor;", 0},
+		{"Audio, Multimedia", "Audio;AudioVideo;", 1},
+		{"Audio", "AudioVideo;Audio;", 0},
+		{"Emulator;X-Retro", "Game;Emulator;X-Retro;", 0},
+		{"Stuff & Things", "", 2},
+		{"Utility;\nDevelopment;", "Utility;Development;", 0},
+	} {
+		got, notes := normalizeCategories(c.value)
+		if got != c.want || len(notes) != c.notes {
+			t.Errorf("normalizeCategories(%q) = %q with notes %q, want %q with %d", c.value, got, notes, c.want, c.notes)
+		}
+	}
+}
+
+func TestIconTheme(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	if opts, _ := currentExtraction(); !opts.enabled {
+		t.Skip("extraction is unavailable")
+	}
+	w := newTestWatcher(t)
+	w.IconTheme = "custom"
+	w.IconDir = t.TempDir()
+	cfg := Config{Watchers: []WatcherConfig{w}}
+	if err := validateIconThemes(cfg); err == nil {
+		t.Error("an icon theme without index.theme is valid")
+	}
+	themeDir := filepath.Join(w.IconDir, "custom")
+	if err := os.MkdirAll(themeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(themeDir, "index.theme"), []byte("[Icon Theme]\nName=Custom\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateIconThemes(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.Watchers[0].IconScope = "global"
+	if err := validateIconThemes(cfg); err == nil {
+		t.Error("icon_scope = \"global\" is valid")
+	}
+
+	hello := addAppImage(t, w.AppPath, "Hello")
+	integrateAppImage(context.Background(), w, hello, newDBRefresher(time.Hour, time.Hour))
+	entry := filepath.Join(w.DesktopPath, desktopFileName(w, "Hello"))
+	content, err := os.ReadFile(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "\nIcon="+themeIconName(entry)+"\n") {
+		t.Errorf("entry refers to its icon by path instead of %s:\n%s", themeIconName(entry), content)
+	}
+	icons := themeIcons(w, entry)
+	if len(icons) != 1 || !strings.HasPrefix(icons[0], themeDir+"/") {
+		t.Fatalf("icons %v, want one in %s", icons, themeDir)
+	}
+	if app, ok := currentState().get(hello); !ok || !containsString(app.Artifacts, icons[0]) {
+		t.Errorf("artifacts %v, want %s listed", app.Artifacts, icons[0])
+	}
+
+	// report unused removes the theme copy along with the AppImage.
+	if err := removeAppImage(appImageUsage{path: hello, name: "Hello", w: w}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(entry) || exists(icons[0]) {
+		t.Errorf("entry or icon left behind: %v, %v", exists(entry), exists(icons[0]))
+	}
+	if _, ok := currentState().get(hello); ok {
+		t.Error("the record of the removed AppImage is left")
+	}
+}
+
+func TestStockIcons(t *testing.T) {
+	useTestConfig(t, Config{})
+	for categories, want := range map[string]string{
+		"Game;ArcadeGame;":  "game",
+		"Audio;AudioVideo;": "multimedia",
+		"Photography;":      "graphics",
+		"X-Custom;Network;": "network",
+		"Application;":      "application",
+		"":                  "application",
+	} {
+		if got := stockIconName(categories); got != want {
+			t.Errorf("stock icon of %q = %s, want %s", categories, got, want)
+		}
+	}
+	path := stockIcon("Development;IDE;")
+	content, err := os.ReadFile(path)
+	if err != nil || !strings.HasSuffix(path, "/icons/stock/development.svg") || !strings.Contains(string(content), "<svg") {
+		t.Errorf("stock icon %s (%v), want development.svg written into the icon directory", path, err)
+	}
+}
+
+func TestRootApps(t *testing.T) {
+	root := t.TempDir()
+	desktopFile := filepath.Join(root, "gparted.desktop")
+	for exec, want := range map[string]bool{"pkexec gparted %f": true, "gparted %f": false, "/usr/bin/gksu gparted": true} {
+		if err := os.WriteFile(desktopFile, []byte("[Desktop Entry]\nName=GParted\nExec="+exec+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := payloadNeedsRoot(root); got != want {
+			t.Errorf("Exec=%s needs root: %t, want %t", exec, got, want)
+		}
+	}
+
+	on := true
+	cfg := Config{Apps: map[string]AppConfig{"GParted": {RequiresRoot: &on}}, PolkitDir: t.TempDir()}
+	useTestConfig(t, cfg)
+	w := WatcherConfig{Name: "golden", AppPath: "/opt/apps", DesktopPath: "/usr/share/applications", Categories: "System;"}
+	path := "/opt/apps/GParted.AppImage"
+	content, err := renderDesktopEntry(context.Background(), w, "GParted", "", "", appStreamInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(content, "\nNoDisplay=true\n") || !strings.Contains(content, "\nExec="+path+"\n") {
+		t.Errorf("entry of an AppImage needing root isn't hidden by default:\n%s", content)
+	}
+
+	w.RootApps = rootAppsPkexec
+	line := execLine(w, path)
+	if line != "pkexec "+path || execProgram(line) != path {
+		t.Errorf("Exec = %q, want %s started through pkexec", line, path)
+	}
+	// The policy runs its target as root, so it needs one only root can
+	// replace, the way system programs are installed.
+	target, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := installPolkitPolicy(target); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := os.ReadFile(filepath.Join(cfg.PolkitDir, polkitAction(target)+".policy"))
+	if err != nil || !strings.Contains(string(policy), `<annotate key="org.freedesktop.policykit.exec.path">`+target+"</annotate>") {
+		t.Errorf("policy %s (%v), want one for %s", policy, err, target)
+	}
+	writable := filepath.Join(t.TempDir(), "GParted.AppImage")
+	if err := os.WriteFile(writable, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := installPolkitPolicy(writable); err == nil {
+		t.Errorf("installed a policy for %s, which others can replace", writable)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.PolkitDir, polkitAction(writable)+".policy")); !os.IsNotExist(err) {
+		t.Errorf("policy for %s exists: %v", writable, err)
+	}
+	if action := polkitAction(path); !strings.HasPrefix(action, polkitActionPrefix+"gparted-") || strings.ToLower(action) != action {
+		t.Errorf("action %s", action)
+	}
+
+	w.RootApps = "sudo"
+	if err := validateRootApps(Config{Watchers: []WatcherConfig{w}}); err == nil {
+		t.Error(`root_apps = "sudo" is valid`)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// failureReportThreshold is how many times in a row integrating the same
+	// AppImage has to fail before it is reported.
+	failureReportThreshold = 3
+	errorReportTimeout     = 5 * time.Second
+)
+
+// errorReporter sends events to a Sentry compatible store endpoint.
+type errorReporter struct {
+	storeURL string
+	auth     string
+	client   *http.Client
+}
+
+var (
+	reporterMu sync.Mutex
+	reporter   *errorReporter
+	// failures counts consecutive integration failures per AppImage path.
+	failures = make(map[string]int)
+	// failureErrors holds the error of the last of them.
+	failureErrors = make(map[string]string)
+)
+
+// parseSentryDSN turns a DSN of the form scheme://key@host[/path]/project into
+// a reporter.
+func parseSentryDSN(dsn string) (*errorReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry_dsn: %w", err)
+	}
+	project := u.Path[strings.LastIndex(u.Path, "/")+1:]
+	if (u.Scheme != "http" && u.Scheme != "https") || u.User == nil || u.User.Username() == "" || project == "" {
+		return nil, fmt.Errorf("invalid sentry_dsn %q, expected https://<key>@<host>/<project>", dsn)
+	}
+
+	prefix := strings.TrimSuffix(u.Path, project)
+	store := url.URL{Scheme: u.Scheme, Host: u.Host, Path: prefix + "api/" + project + "/store/"}
+	return &errorReporter{
+		storeURL: store.String(),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=desktopimage/1.0, sentry_key=%s", u.User.Username()),
+		client:   &http.Client{Timeout: errorReportTimeout},
+	}, nil
+}
+
+// configureErrorReporting enables reporting when cfg has a sentry_dsn.
+func validateErrorReporting(cfg Config) error {
+	if cfg.SentryDSN == "" {
+		return nil
+	}
+	_, err := parseSentryDSN(cfg.SentryDSN)
+	return err
+}
+
+func configureErrorReporting(cfg Config) error {
+	var r *errorReporter
+	if cfg.SentryDSN != "" {
+		var err error
+		if r, err = parseSentryDSN(cfg.SentryDSN); err != nil {
+			return err
+		}
+	}
+
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+	reporter = r
+	return nil
+}
+
+func currentReporter() *errorReporter {
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+	return reporter
+}
+
+func (r *errorReporter) send(level, message string, tags map[string]string, extra map[string]interface{}) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       level,
+		"logger":      "desktopimage",
+		"platform":    "go",
+		"server_name": hostname,
+		"message":     message,
+		"tags":        tags,
+		"extra":       extra,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error report rejected: %s", resp.Status)
+	}
+	return nil
+}
+
+// reportPanics is deferred at the top of long-running goroutines. A panic is
+// sent before it is passed on, so the process still crashes as it would
+// without reporting.
+func reportPanics() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if r := currentReporter(); r != nil {
+		extra := map[string]interface{}{"stack": string(debug.Stack())}
+		if err := r.send("fatal", fmt.Sprintf("panic: %v", v), nil, extra); err != nil {
+			log.Errorf("Error reporting panic: %v", err)
+		}
+	}
+	panic(v)
+}
+
+// integrationFailed records that integrating path failed, counting it in the
+// activity of w, and reports it once it has failed failureReportThreshold
+// times in a row.
+func integrationFailed(w WatcherConfig, path string, err error) {
+	countActivity(w, activityFailed)
+	reporterMu.Lock()
+	failures[path]++
+	failureErrors[path] = err.Error()
+	count := failures[path]
+	r := reporter
+	reporterMu.Unlock()
+	if r == nil || count != failureReportThreshold {
+		return
+	}
+
+	tags := map[string]string{"watcher": w.label()}
+	extra := map[string]interface{}{
+		"app_path":     w.AppPath,
+		"desktop_path": w.DesktopPath,
+		"appimage":     path,
+		"failures":     count,
+	}
+	go func() {
+		if err := r.send("error", fmt.Sprintf("Integrating %s keeps failing: %v", path, err), tags, extra); err != nil {
+			w.logger().Errorf("Error reporting integration failure: %v", err)
+		}
+	}()
+}
+
+func integrationSucceeded(path string) {
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+	delete(failures, path)
+	delete(failureErrors, path)
+}
+
+// integrationError returns the error integrating path failed with last, or
+// "" when its last integration didn't fail.
+func integrationError(path string) string {
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+	return failureErrors[path]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// eventTraceSize is how many raw events trace_events keeps for the
+// get-event-trace control command.
+const eventTraceSize = 1000
+
+// tracedEvent is a raw event a watcher got, before anything was filtered.
+type tracedEvent struct {
+	Time    time.Time `json:"time"`
+	Watcher string    `json:"watcher"`
+	Op      string    `json:"op"`
+	Name    string    `json:"name"`
+}
+
+// eventTrace is a ring buffer of the latest raw events, recorded while
+// trace_events is set, to find out why an AppImage wasn't picked up.
+type eventTrace struct {
+	mu      sync.Mutex
+	enabled bool
+	events  []tracedEvent
+	// next is where the next event goes once events is full.
+	next int
+}
+
+var rawEvents = &eventTrace{}
+
+func configureEventTrace(cfg Config) {
+	rawEvents.mu.Lock()
+	defer rawEvents.mu.Unlock()
+	rawEvents.enabled = cfg.TraceEvents
+}
+
+// record logs event of w and keeps it, when tracing.
+func (t *eventTrace) record(w WatcherConfig, event fsnotify.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.enabled {
+		return
+	}
+	w.logger().Infof("Raw event %s %s", event.Op, event.Name)
+	e := tracedEvent{Time: time.Now(), Watcher: w.label(), Op: event.Op.String(), Name: event.Name}
+	if len(t.events) < eventTraceSize {
+		t.events = append(t.events, e)
+		return
+	}
+	t.events[t.next] = e
+	t.next = (t.next + 1) % eventTraceSize
+}
+
+// list returns the kept events of the watcher labelled label, or of all
+// watchers for "", oldest first.
+func (t *eventTrace) list(label string) []tracedEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := []tracedEvent{}
+	for i := range t.events {
+		e := t.events[(t.next+i)%len(t.events)]
+		if label == "" || e.Watcher == label {
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestEventTrace(t *testing.T) {
+	trace := &eventTrace{}
+	a, b := WatcherConfig{Name: "a"}, WatcherConfig{Name: "b"}
+	trace.record(a, fsnotify.Event{Name: "/apps/Ignored.AppImage", Op: fsnotify.Create})
+	if got := trace.list(""); len(got) != 0 {
+		t.Errorf("recorded %v without trace_events", got)
+	}
+
+	trace.enabled = true
+	for i := 0; i < eventTraceSize+2; i++ {
+		w := a
+		if i%2 == 1 {
+			w = b
+		}
+		trace.record(w, fsnotify.Event{Name: fmt.Sprintf("/apps/%d.AppImage", i), Op: fsnotify.Write})
+	}
+	all := trace.list("")
+	if len(all) != eventTraceSize {
+		t.Fatalf("kept %d events, want %d", len(all), eventTraceSize)
+	}
+	if first, last := all[0].Name, all[len(all)-1].Name; first != "/apps/2.AppImage" || last != fmt.Sprintf("/apps/%d.AppImage", eventTraceSize+1) {
+		t.Errorf("kept %s to %s, want the latest oldest first", first, last)
+	}
+	if got := trace.list("b"); len(got) != eventTraceSize/2 || got[0].Watcher != "b" || got[0].Op != "WRITE" {
+		t.Errorf("events of b = %d starting with %+v", len(got), got[0])
+	}
+}
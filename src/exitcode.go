@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// Exit codes of the daemon and the commands, so that scripts and the
+// service manager can tell the classes of failures apart. Any other failure
+// exits with exitFailure.
+const (
+	exitFailure = 1
+	// exitUsage is for unknown commands and bad flags.
+	exitUsage = 2
+	// exitConfig is for configuration files that don't parse or validate.
+	exitConfig = 3
+	// exitEnvironment is for tools or services the system lacks.
+	exitEnvironment = 4
+	// exitPermission is for files or directories the process may not use.
+	exitPermission = 5
+	// exitLockHeld is for a data directory another daemon is using.
+	exitLockHeld = 6
+)
+
+// The classes of failures. Errors are marked with a class by wrapping it,
+// or with classify so that their message stays as it is.
+var (
+	errInvalidConfig = errors.New("invalid config file")
+	errEnvironment   = errors.New("missing from the environment")
+	errLockHeld      = errors.New("data directory in use by another daemon")
+)
+
+// classified is an error marked with the class of failure it belongs to.
+type classified struct {
+	err   error
+	class error
+}
+
+func (c classified) Error() string { return c.err.Error() }
+
+func (c classified) Unwrap() []error { return []error{c.err, c.class} }
+
+// classify marks err as belonging to class without changing its message.
+func classify(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return classified{err: err, class: class}
+}
+
+// exitCode returns the exit code for a failure with err.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errLockHeld):
+		return exitLockHeld
+	case errors.Is(err, fs.ErrPermission):
+		return exitPermission
+	case errors.Is(err, errInvalidConfig):
+		return exitConfig
+	case errors.Is(err, errEnvironment), errors.Is(err, exec.ErrNotFound):
+		return exitEnvironment
+	default:
+		return exitFailure
+	}
+}
+
+// exitWith logs a failure like log.Fatalf, but exits with the code of the
+// class of err.
+func exitWith(err error, format string, args ...interface{}) {
+	log.Errorf(format, args...)
+	log.Exit(exitCode(err))
+}
+
+// lockDataDir takes the lock on dataDir that keeps a second daemon from
+// using it, which lasts until the returned file is closed or the process
+// exits.
+func lockDataDir(dataDir string) (*os.File, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	path := filepath.Join(dataDir, "daemon.lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s is locked", errLockHeld, path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", "settle_delay = \n")
+	_, parseErr := readConfig("/etc/desktopimage/config.toml")
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", "nice = 40\n")
+	invalidErr := validateConfig(readTestConfig(t, "/etc/desktopimage/config.toml"))
+	if invalidErr != nil {
+		invalidErr = fmt.Errorf("%w: %w", errInvalidConfig, invalidErr)
+	}
+
+	for _, c := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"none", nil, 0},
+		{"other", fmt.Errorf("failed to do something"), exitFailure},
+		{"parse", parseErr, exitConfig},
+		{"validate", invalidErr, exitConfig},
+		{"permission", fmt.Errorf("failed to read config file: %w", &os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}), exitPermission},
+		{"tool", fmt.Errorf("failed to run: %w", exec.ErrNotFound), exitEnvironment},
+		{"lock", fmt.Errorf("%w: /x/daemon.lock is locked", errLockHeld), exitLockHeld},
+	} {
+		if got := exitCode(c.err); got != c.want {
+			t.Errorf("exitCode(%s: %v) = %d, want %d", c.name, c.err, got, c.want)
+		}
+	}
+	if parseErr == nil || parseErr.Error() == errInvalidConfig.Error() || exitCode(parseErr) != exitConfig {
+		t.Errorf("the parse error lost its message or class: %v", parseErr)
+	}
+}
+
+func TestLockDataDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := lockDataDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockDataDir(dir); exitCode(err) != exitLockHeld {
+		t.Errorf("locking a locked data directory = %v, want errLockHeld", err)
+	}
+	lock.Close()
+	again, err := lockDataDir(dir)
+	if err != nil {
+		t.Fatalf("locking a released data directory = %v", err)
+	}
+	again.Close()
+}
+
+func TestClassifyFailure(t *testing.T) {
+	exitErr := exec.Command("false").Run()
+	for _, c := range []struct {
+		name string
+		err  error
+		want failureClass
+	}{
+		{"other", fmt.Errorf("unsquashfs did not finish within extract_timeout (30s)"), failureTransient},
+		{"permission", &os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}, failurePermission},
+		{"unreadable", classify(os.ErrPermission, fmt.Errorf("unsquashfs failed: %w: Permission denied", exitErr)), failurePermission},
+		{"tool", fmt.Errorf("unsquashfs failed: %w", exec.ErrNotFound), failureMissingTool},
+		{"not an AppImage", errNotType2AppImage, failureInvalid},
+		{"corrupt", classify(errCorruptImage, fmt.Errorf("unsquashfs failed: %w: corrupt", exitErr)), failureInvalid},
+		{"killed", fmt.Errorf("unsquashfs failed: %w: ", exitErr), failureTransient},
+		{"rejected", fmt.Errorf("%w: member \"../x\" escapes the extraction directory", errRejected), failureInvalid},
+	} {
+		if got := classifyFailure(c.err); got != c.want {
+			t.Errorf("classifyFailure(%s: %v) = %s, want %s", c.name, c.err, got, c.want)
+		}
+	}
+
+	for output, corrupt := range map[string]bool{
+		"Can't find a SQUASHFS superblock on Foo.AppImage":    true,
+		"FATAL ERROR: read_filesystem_tables: failed to read": true,
+		"zstd uncompress failed with error code 10":           true,
+		"FATAL ERROR: Out of memory":                          false,
+		"":                                                    false,
+	} {
+		if got := corruptImage(output); got != corrupt {
+			t.Errorf("corruptImage(%q) = %v, want %v", output, got, corrupt)
+		}
+	}
+
+	c := openFailures(t.TempDir())
+	c.failed(WatcherConfig{}, "/apps/Locked.AppImage", "locked", &os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission})
+	c.failed(WatcherConfig{}, "/apps/Broken.AppImage", "broken", errNotType2AppImage)
+	if f, ok := c.backingOff("locked"); !ok || !f.RetryAt.After(time.Now()) {
+		t.Errorf("permission failure %+v, want it retried later", f)
+	}
+	if f, ok := c.backingOff("broken"); !ok || !f.RetryAt.IsZero() {
+		t.Errorf("invalid AppImage %+v, want it not retried", f)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultDataDir        = "/var/lib/desktopimage"
+	defaultMaxExtractions = 2
+	defaultMaxExtractMB   = 16
+	defaultExtractTimeout = 30 * time.Second
+)
+
+var iconExtensions = []string{".png", ".svg", ".xpm"}
+
+type extractionOptions struct {
+	enabled     bool
+	iconDir     string
+	metainfoDir string
+	// cred, when set, is who unsquashfs runs as, so a malformed AppImage
+	// can't make use of the daemon's privileges.
+	cred *syscall.Credential
+	// credMissing is set when extract_user couldn't be looked up, so
+	// nothing may run unsquashfs in its place.
+	credMissing bool
+	// sandbox confines unsquashfs to reading the AppImage and writing the
+	// extraction directory.
+	sandbox bool
+	// maxSize bounds the total size of the members extracted from one
+	// AppImage, timeout how long unsquashfs may run.
+	maxSize int64
+	timeout time.Duration
+}
+
+func (c Config) maxExtractSize() int64 {
+	if c.MaxExtractMB > 0 {
+		return c.MaxExtractMB << 20
+	}
+	return defaultMaxExtractMB << 20
+}
+
+func (c Config) extractTimeout() time.Duration {
+	if c.ExtractTimeout > 0 {
+		return c.ExtractTimeout
+	}
+	return defaultExtractTimeout
+}
+
+var (
+	extractMu   sync.Mutex
+	extractOpts extractionOptions
+	// extractSem bounds the number of unsquashfs processes running at once
+	// across all watchers and scan workers.
+	extractSem = make(chan struct{}, defaultMaxExtractions)
+)
+
+// configureExtraction applies the extraction settings of cfg. Extraction is
+// silently disabled when unsquashfs is not installed.
+func configureExtraction(cfg Config) {
+	enabled := cfg.ExtractIcons == nil || *cfg.ExtractIcons
+	if enabled {
+		if _, err := exec.LookPath("unsquashfs"); err != nil {
+			log.Warn("unsquashfs is not installed or not in PATH, icons will not be extracted from AppImages.")
+			enabled = false
+		}
+	}
+
+	var cred *syscall.Credential
+	credMissing := false
+	if cfg.ExtractUser != "" {
+		if os.Geteuid() != 0 {
+			// Once privileges were dropped to user, extraction simply runs
+			// as that user.
+			if cfg.User == "" {
+				log.Warnf("Not running as root, ignoring extract_user = %q.", cfg.ExtractUser)
+			}
+		} else if c, err := lookupCredential(cfg.ExtractUser); err != nil {
+			log.Errorf("Error looking up extract_user %s, icons will not be extracted: %v", cfg.ExtractUser, err)
+			enabled = false
+			credMissing = true
+		} else {
+			cred = c
+		}
+	}
+
+	max := cfg.MaxExtractions
+	if max <= 0 {
+		max = defaultMaxExtractions
+	}
+
+	extractMu.Lock()
+	defer extractMu.Unlock()
+	extractOpts = extractionOptions{
+		enabled:     enabled,
+		iconDir:     cfg.iconDir(),
+		metainfoDir: cfg.metainfoDir(),
+		cred:        cred,
+		credMissing: credMissing,
+		sandbox:     cfg.SandboxExtraction == nil || *cfg.SandboxExtraction,
+		maxSize:     cfg.maxExtractSize(),
+		timeout:     cfg.extractTimeout(),
+	}
+	if cap(extractSem) != max {
+		extractSem = make(chan struct{}, max)
+	}
+}
+
+func currentExtraction() (extractionOptions, chan struct{}) {
+	extractMu.Lock()
+	defer extractMu.Unlock()
+	return extractOpts, extractSem
+}
+
+// extractIcon copies the icon embedded in the AppImage at path into the icon
+// directory and returns its location, or "" if extraction is disabled or the
+// AppImage has no icon. An icon extracted earlier is reused unless force is
+// set. Cancelling ctx stops the extraction.
+func extractIcon(ctx context.Context, path string, force bool) (string, error) {
+	opts, sem := currentExtraction()
+	if !opts.enabled {
+		return "", nil
+	}
+
+	appName := appNameFromPath(path)
+	cached := findExtractedIcon(opts.iconDir, appName)
+	payloadKnown := isRegularFile(filepath.Join(opts.metainfoDir, appName+payloadSuffix))
+	if (cached != "" && payloadKnown && !force) || auditMode() {
+		// Extracting writes into the icon directory, so audit mode sticks
+		// to what is already there.
+		return cached, nil
+	}
+
+	offset, err := squashfsOffset(path)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-sem }()
+
+	tmpDir, err := os.MkdirTemp("", "desktopimage-extract-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	if opts.cred != nil {
+		if err := os.Chown(tmpDir, int(opts.cred.Uid), int(opts.cred.Gid)); err != nil {
+			return "", err
+		}
+	}
+
+	// unsquashfs streams the requested members straight to disk, so the
+	// payload is never held in memory regardless of the AppImage size.
+	root := filepath.Join(tmpDir, "root")
+	members := extractedMembers()
+	base := []string{"-no-progress", "-o", fmt.Sprint(offset), "-d", root}
+
+	var payload payloadInfo
+	if names, err := listPayload(ctx, opts, path, tmpDir, base); err != nil {
+		log.Debugf("Could not list the payload of %s: %v", path, err)
+	} else {
+		payload.Toolkit = classifyToolkit(names)
+	}
+	split := appQuirk(appName).SplitEntries
+	if payload.Toolkit == toolkitElectron || split {
+		// For the icons the root links to, or those of the bundled apps.
+		members = append(members, hicolorMembers...)
+	}
+
+	// List the members first and refuse images whose names or links would
+	// place files outside root, in case unsquashfs doesn't catch them.
+	if err := checkListing(ctx, opts, path, tmpDir, base, members); err != nil {
+		return "", err
+	}
+	if _, err := runUnsquashfs(ctx, opts, path, tmpDir, append(append(base, path), members...)); err != nil {
+		return "", err
+	}
+
+	if err := installMetainfo(root, opts.metainfoDir, appName); err != nil {
+		log.Warnf("Could not store AppStream metadata of %s: %v", path, err)
+	}
+	payload.StartupWMClass = guessWMClass(root, payload.Toolkit)
+	payload.Name, payload.Categories = rootDesktopValue(root, "Name"), rootDesktopValue(root, "Categories")
+	payload.MimeTypes, payload.FieldCode = rootMimeTypes(root)
+	payload.RequiresRoot = payloadNeedsRoot(root)
+	payload.Entries = embeddedEntries(root, opts.iconDir, appName, split)
+	if err := installPayloadInfo(opts.metainfoDir, appName, payload); err != nil {
+		log.Warnf("Could not store what the payload of %s says: %v", path, err)
+	}
+	src, ext := findEmbeddedIcon(root)
+	if src == "" {
+		return "", nil
+	}
+	return installIcon(src, opts.iconDir, appName, ext)
+}
+
+// extractedMembers returns the patterns of the members read from an
+// AppImage: its desktop files, those of the apps it bundles, icons and
+// AppStream metadata.
+func extractedMembers() []string {
+	members := append(append([]string{"*.desktop", ".DirIcon"}, metainfoMembers...), embeddedEntryMembers...)
+	for _, ext := range iconExtensions {
+		members = append(members, "*"+ext)
+	}
+	return members
+}
+
+// checkListing lists the members of the AppImage at path that extracting it
+// with the unsquashfs options base would write, and refuses it with
+// errRejected when checkMembers does.
+func checkListing(ctx context.Context, opts extractionOptions, path, tmpDir string, base, members []string) error {
+	listing, err := runUnsquashfs(ctx, opts, path, tmpDir, append(append(append([]string{}, base...), "-ll", path), members...))
+	if err != nil {
+		return err
+	}
+	if err := checkMembers(filepath.Join(tmpDir, "root"), listing, opts.maxSize); err != nil {
+		return fmt.Errorf("%w: %w", errRejected, err)
+	}
+	return nil
+}
+
+// validateAppImage runs the checks an integrated AppImage goes through
+// before anything is extracted from it on the file at path, which isn't in
+// a watched directory yet, such as a downloaded update. Unlike integration
+// it also refuses files that aren't type 2 AppImages, and it runs even with
+// extract_icons = false; without unsquashfs nothing passes.
+func validateAppImage(ctx context.Context, path string) error {
+	offset, err := squashfsOffset(path)
+	if err != nil {
+		return err
+	}
+	opts, sem := currentExtraction()
+	if opts.credMissing {
+		return fmt.Errorf("extract_user could not be looked up, %s is not checked as root", path)
+	}
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-sem }()
+
+	tmpDir, err := os.MkdirTemp("", "desktopimage-extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if opts.cred != nil {
+		if err := os.Chown(tmpDir, int(opts.cred.Uid), int(opts.cred.Gid)); err != nil {
+			return err
+		}
+	}
+	base := []string{"-no-progress", "-o", fmt.Sprint(offset), "-d", filepath.Join(tmpDir, "root")}
+	return checkListing(ctx, opts, path, tmpDir, base, extractedMembers())
+}
+
+// runUnsquashfs runs unsquashfs on the AppImage at path with args and returns
+// its standard output. tmpDir is the only directory it may write to.
+func runUnsquashfs(ctx context.Context, opts extractionOptions, path, tmpDir string, args []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "unsquashfs", args...)
+	// Don't wait for the output of leftover children once it was killed.
+	cmd.WaitDelay = time.Second
+	if opts.cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: opts.cred}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	var err error
+	run := func() { err = cmd.Run() }
+	if opts.sandbox {
+		isolateNetwork(cmd)
+		readOnly := []string{path}
+		if bin, lookErr := filepath.EvalSymlinks(cmd.Path); lookErr == nil {
+			readOnly = append(readOnly, filepath.Dir(bin))
+		}
+		if sandboxErr := runSandboxed(readOnly, tmpDir, run); sandboxErr != nil {
+			return "", fmt.Errorf("failed to sandbox unsquashfs: %w", sandboxErr)
+		}
+	} else {
+		runLowPriority(run)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("unsquashfs did not finish within extract_timeout (%s)", opts.timeout)
+	}
+	if err != nil {
+		output := strings.TrimSpace(stderr.String() + stdout.String())
+		err = fmt.Errorf("unsquashfs failed: %w: %s", err, output)
+		if strings.Contains(output, "Permission denied") {
+			// It is extract_user that may not read the image.
+			err = classify(fs.ErrPermission, err)
+		} else if corruptImage(output) {
+			err = classify(errCorruptImage, err)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// checkMembers validates the "unsquashfs -ll" listing of an extraction into
+// root. Every member has to stay inside root, symlinks must point inside it
+// too, device nodes are rejected outright and the regular files may not add
+// up to more than maxSize bytes.
+func checkMembers(root, listing string, maxSize int64) error {
+	var total int64
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || len(fields[0]) != 10 || !strings.ContainsRune("-dlcbps", rune(fields[0][0])) {
+			// Headers and summaries.
+			continue
+		}
+
+		// The name follows the time, which is the fifth field.
+		rest := line[strings.Index(line, " "+fields[4]+" ")+len(fields[4])+2:]
+		name, target, isLink := strings.Cut(strings.TrimLeft(rest, " "), " -> ")
+		if fields[0][0] != 'l' {
+			name, isLink = strings.TrimLeft(rest, " "), false
+		}
+
+		if name != root && !strings.HasPrefix(name, root+"/") {
+			return fmt.Errorf("unexpected member %q", name)
+		}
+		if !withinDir(root, name) {
+			return fmt.Errorf("member %q escapes the extraction directory", name)
+		}
+		switch fields[0][0] {
+		case 'c', 'b':
+			return fmt.Errorf("member %q is a device node", name)
+		case 'l':
+			if !isLink || filepath.IsAbs(target) || !withinDir(root, filepath.Join(filepath.Dir(name), target)) {
+				return fmt.Errorf("symlink %q points outside the extraction directory", name)
+			}
+		case '-':
+			size, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected size %q of member %q", fields[2], name)
+			}
+			if total += size; total > maxSize {
+				return fmt.Errorf("members exceed max_extract_mb (%s)", formatSize(maxSize))
+			}
+		}
+	}
+	return nil
+}
+
+// withinDir reports whether path, once cleaned, is dir or below it. Callers
+// deal with unresolved names, so ".." components are what is checked for.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// findEmbeddedIcon returns the icon named by the embedded desktop entry in
+// the AppImage root or its icon theme directories, falling back to
+// .DirIcon. Only regular files are
+// considered so symlinks can't point outside the extraction directory.
+func findEmbeddedIcon(root string) (string, string) {
+	if info, err := os.Lstat(root); err != nil || !info.IsDir() {
+		return "", ""
+	}
+	desktopFiles, _ := filepath.Glob(filepath.Join(root, "*.desktop"))
+	for _, desktopFile := range desktopFiles {
+		if icon, ext := embeddedIcon(root, desktopEntryValue(desktopFile, "Icon")); icon != "" {
+			return icon, ext
+		}
+	}
+
+	dirIcon := filepath.Join(root, ".DirIcon")
+	if !isRegularFile(dirIcon) {
+		return "", ""
+	}
+	if ext := sniffIconType(dirIcon); ext != "" {
+		return dirIcon, ext
+	}
+	return "", ""
+}
+
+// embeddedIcon returns the icon called name in the AppImage root or its icon
+// theme directories, or "".
+func embeddedIcon(root, name string) (string, string) {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return "", ""
+	}
+	for _, ext := range iconExtensions {
+		candidate := filepath.Join(root, strings.TrimSuffix(name, ext)+ext)
+		if isRegularFile(candidate) {
+			return candidate, ext
+		}
+	}
+	return hicolorIcon(root, name)
+}
+
+func sniffIconType(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case bytes.Contains(head, []byte("<svg")):
+		return ".svg"
+	case bytes.HasPrefix(head, []byte("/* XPM */")):
+		return ".xpm"
+	default:
+		return ""
+	}
+}
+
+// installIcon copies src into iconDir as appName+ext, replacing any icon
+// previously extracted for appName.
+func installIcon(src, iconDir, appName, ext string) (string, error) {
+	if err := os.MkdirAll(iconDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create icon directory: %w", err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(iconDir, "."+appName+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	removeExtractedIcon(iconDir, appName)
+	dest := filepath.Join(iconDir, appName+ext)
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+func findExtractedIcon(iconDir, appName string) string {
+	for _, ext := range iconExtensions {
+		path := filepath.Join(iconDir, appName+ext)
+		if isRegularFile(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+func removeExtractedIcon(iconDir, appName string) {
+	for _, ext := range iconExtensions {
+		path := filepath.Join(iconDir, appName+ext)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error removing icon %s: %v", path, err)
+		}
+	}
+}
+
+func isRegularFile(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+var errNotType2AppImage = errors.New("not a type 2 AppImage")
+
+// errCorruptImage marks unsquashfs failures whose output says the image
+// can't be read, unlike failures of the system such as running out of
+// memory or being killed.
+var errCorruptImage = errors.New("corrupt squashfs image")
+
+// corruptImageOutput are what unsquashfs prints for images that aren't
+// squashfs or are damaged.
+var corruptImageOutput = []string{"SQUASHFS superblock", "not a squashfs", "read_filesystem_tables", "uncompress failed", "corrupt"}
+
+// corruptImage reports whether the output of a failed unsquashfs says the
+// image is not a squashfs or corrupt.
+func corruptImage(output string) bool {
+	output = strings.ToLower(output)
+	for _, s := range corruptImageOutput {
+		if strings.Contains(output, strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// squashfsOffset returns where the squashfs image of a type 2 AppImage
+// starts: right after the section header table of the ELF runtime. Only the
+// ELF header and the squashfs magic are read.
+func squashfsOffset(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 64)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, errNotType2AppImage
+	}
+	if !bytes.HasPrefix(header, []byte("\x7fELF")) || !bytes.Equal(header[8:11], []byte("AI\x02")) {
+		return 0, errNotType2AppImage
+	}
+
+	var order binary.ByteOrder
+	switch header[5] {
+	case 1:
+		order = binary.LittleEndian
+	case 2:
+		order = binary.BigEndian
+	default:
+		return 0, errNotType2AppImage
+	}
+
+	var shoff, shentsize, shnum uint64
+	switch header[4] {
+	case 1:
+		shoff = uint64(order.Uint32(header[0x20:]))
+		shentsize = uint64(order.Uint16(header[0x2e:]))
+		shnum = uint64(order.Uint16(header[0x30:]))
+	case 2:
+		shoff = order.Uint64(header[0x28:])
+		shentsize = uint64(order.Uint16(header[0x3a:]))
+		shnum = uint64(order.Uint16(header[0x3c:]))
+	default:
+		return 0, errNotType2AppImage
+	}
+
+	offset := int64(shoff + shentsize*shnum)
+	magic := make([]byte, 4)
+	if offset <= 0 {
+		return 0, errNotType2AppImage
+	}
+	if _, err := f.ReadAt(magic, offset); err != nil || string(magic) != "hsqs" {
+		return 0, fmt.Errorf("%w: no squashfs image at offset %d", errNotType2AppImage, offset)
+	}
+	return offset, nil
+}
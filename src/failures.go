@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const failuresFileName = "failures.json"
+
+// An AppImage whose icon could not be extracted is not tried again until
+// failureRetryDelay passed, doubled with every further failure up to
+// maxFailureRetryDelay.
+const (
+	failureRetryDelay    = time.Minute
+	maxFailureRetryDelay = 24 * time.Hour
+)
+
+// failureClass tells why extraction failed, and with that whether trying
+// again can help.
+type failureClass string
+
+// The classes of extraction failures. Only invalid AppImages fail the same
+// way every time; the others depend on the system, which can be fixed
+// without touching the AppImage.
+const (
+	// failureTransient is for anything else, such as timeouts or I/O errors.
+	failureTransient   failureClass = "transient"
+	failurePermission  failureClass = "permission"
+	failureMissingTool failureClass = "missing_tool"
+	failureInvalid     failureClass = "invalid"
+)
+
+// classifyFailure returns the class of the extraction failure err. An
+// unsquashfs that failed is only taken for an invalid AppImage when its
+// output says so, as it also fails when killed or out of memory.
+func classifyFailure(err error) failureClass {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return failurePermission
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, errEnvironment):
+		return failureMissingTool
+	case errors.Is(err, errNotType2AppImage), errors.Is(err, errRejected), errors.Is(err, errCorruptImage):
+		return failureInvalid
+	default:
+		return failureTransient
+	}
+}
+
+// permanent reports whether failures of class c are not retried.
+func (c failureClass) permanent() bool {
+	return c == failureInvalid
+}
+
+// reason explains failures of class c in list --failed.
+func (c failureClass) reason() string {
+	switch c {
+	case failurePermission:
+		return "permission denied, retried"
+	case failureMissingTool:
+		return "a tool is missing, retried"
+	case failureInvalid:
+		return "not a valid AppImage, not retried until it changes"
+	default:
+		return "transient error, retried"
+	}
+}
+
+// failedAppImage is an AppImage content that extraction failed on.
+type failedAppImage struct {
+	// Path is where it was last seen.
+	Path    string `json:"path"`
+	Watcher string `json:"watcher"`
+	Error   string `json:"error"`
+	// Class is empty in lists written before failures were classified,
+	// which are retried like transient ones.
+	Class      failureClass `json:"class"`
+	Failures   int          `json:"failures"`
+	LastFailed time.Time    `json:"last_failed"`
+	// RetryAt is zero for permanent failures.
+	RetryAt time.Time `json:"retry_at"`
+}
+
+// failureCache remembers the AppImages extraction failed on by content, so
+// a corrupt AppImage isn't extracted again on every rescan, and neither are
+// identical copies of it. It is kept in the data directory next to the
+// journal and is safe for concurrent use.
+type failureCache struct {
+	mu        sync.Mutex
+	path      string
+	AppImages map[string]*failedAppImage `json:"appimages"`
+}
+
+var (
+	failCacheMu sync.Mutex
+	failCache   *failureCache
+)
+
+func openFailures(dataDir string) *failureCache {
+	c := &failureCache{path: filepath.Join(dataDir, failuresFileName), AppImages: make(map[string]*failedAppImage)}
+	content, err := os.ReadFile(c.path)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(content, c); err != nil {
+		log.Warnf("Ignoring unreadable failure list %s: %v", c.path, err)
+	}
+	if c.AppImages == nil {
+		c.AppImages = make(map[string]*failedAppImage)
+	}
+	return c
+}
+
+func configureFailures(cfg Config) {
+	failCacheMu.Lock()
+	defer failCacheMu.Unlock()
+	if failCache == nil || failCache.path != filepath.Join(cfg.dataDir(), failuresFileName) {
+		failCache = openFailures(cfg.dataDir())
+	}
+}
+
+func currentFailures() *failureCache {
+	failCacheMu.Lock()
+	defer failCacheMu.Unlock()
+	if failCache == nil {
+		failCache = &failureCache{AppImages: make(map[string]*failedAppImage)}
+	}
+	return failCache
+}
+
+// contentKey identifies the content of the AppImage at path by its SHA-256
+// sum, or, when it is too large to be hashed, by its path, size and
+// modification time.
+func contentKey(path, sum string) string {
+	if sum != "" {
+		return "sha256:" + sum
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("file:%s:%d:%d", path, info.Size(), info.ModTime().UnixNano())
+}
+
+// backingOff returns the failure recorded for key when it is permanent or
+// not due for another try yet.
+func (c *failureCache) backingOff(key string) (failedAppImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.AppImages[key]
+	if !ok || (!f.Class.permanent() && !time.Now().Before(f.RetryAt)) {
+		return failedAppImage{}, false
+	}
+	return *f, true
+}
+
+// failed records that extracting the AppImage at path, with the content
+// key, failed with err, and returns its class and how long to wait before
+// trying again, which is 0 for permanent failures.
+func (c *failureCache) failed(w WatcherConfig, path, key string, err error) (failureClass, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.AppImages[key]
+	if !ok {
+		f = &failedAppImage{}
+		c.AppImages[key] = f
+	}
+	c.dropPath(path, key)
+	f.Path = path
+	f.Watcher = w.label()
+	f.Error = err.Error()
+	f.Class = classifyFailure(err)
+	f.Failures++
+	f.LastFailed = time.Now()
+	if f.Class.permanent() {
+		f.RetryAt = time.Time{}
+		c.save()
+		return f.Class, 0
+	}
+	delay := failureRetryDelay
+	for i := 1; i < f.Failures && delay < maxFailureRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxFailureRetryDelay {
+		delay = maxFailureRetryDelay
+	}
+	f.RetryAt = f.LastFailed.Add(delay)
+	c.save()
+	return f.Class, delay
+}
+
+// succeeded forgets the failures of the AppImage at path, which was
+// extracted with the content key.
+func (c *failureCache) succeeded(path, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.AppImages[key]
+	delete(c.AppImages, key)
+	if c.dropPath(path, "") || ok {
+		c.save()
+	}
+}
+
+// forget drops the failures recorded for path, which was removed.
+func (c *failureCache) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dropPath(path, "") {
+		c.save()
+	}
+}
+
+// prune drops the failures of AppImages that no longer exist.
+func (c *failureCache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pruned := false
+	for key, f := range c.AppImages {
+		if _, err := os.Stat(f.Path); os.IsNotExist(err) {
+			delete(c.AppImages, key)
+			pruned = true
+		}
+	}
+	if pruned {
+		c.save()
+	}
+}
+
+// dropPath removes the failures last seen at path other than the one for
+// key, and reports whether there were any; it is called with c.mu held.
+func (c *failureCache) dropPath(path, key string) bool {
+	dropped := false
+	for k, f := range c.AppImages {
+		if f.Path == path && k != key {
+			delete(c.AppImages, k)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// list returns the failures recorded, sorted by path.
+func (c *failureCache) list() []failedAppImage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failed := make([]failedAppImage, 0, len(c.AppImages))
+	for _, f := range c.AppImages {
+		failed = append(failed, *f)
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+	return failed
+}
+
+// save writes the cache out, logging errors; it is called with c.mu held.
+func (c *failureCache) save() {
+	if auditMode() {
+		return
+	}
+	if err := c.write(); err != nil {
+		log.Errorf("Error saving failure list: %v", err)
+	}
+}
+
+// write replaces the failure list atomically.
+func (c *failureCache) write() error {
+	if c.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write failure list: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to write failure list: %w", err)
+	}
+	return nil
+}
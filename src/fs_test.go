@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFS is an in-memory fileSystem. Glob only supports patterns in the last
+// path element, which is all the daemon uses.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+type memInfo struct {
+	name string
+	f    memFile
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return int64(len(i.f.data)) }
+func (i memInfo) Mode() os.FileMode  { return i.f.mode }
+func (i memInfo) ModTime() time.Time { return i.f.modTime }
+func (i memInfo) IsDir() bool        { return i.f.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+// useMemFS replaces the file system with an empty memFS for the duration
+// of the test.
+func useMemFS(tb testing.TB) *memFS {
+	tb.Helper()
+	m := &memFS{files: map[string]*memFile{"/": {mode: fs.ModeDir | 0755}}}
+	prev := fsys
+	fsys = m
+	tb.Cleanup(func() { fsys = prev })
+	return m
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// parent returns the directory holding name, which has to exist.
+func (m *memFS) parent(op, name string) error {
+	if dir, ok := m.files[filepath.Dir(name)]; !ok || !dir.mode.IsDir() {
+		return pathError(op, name, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[filepath.Clean(name)]
+	switch {
+	case !ok:
+		return nil, pathError("open", name, fs.ErrNotExist)
+	case f.mode.IsDir():
+		return nil, pathError("read", name, errors.New("is a directory"))
+	}
+	return bytes.Clone(f.data), nil
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if err := m.parent("open", name); err != nil {
+		return err
+	}
+	if f, ok := m.files[name]; ok {
+		if f.mode.IsDir() {
+			return pathError("open", name, errors.New("is a directory"))
+		}
+		perm = f.mode
+	}
+	m.files[name] = &memFile{data: bytes.Clone(data), mode: perm &^ 022, modTime: time.Now()}
+	return nil
+}
+
+func (m *memFS) WriteNewFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if err := m.parent("open", name); err != nil {
+		return err
+	}
+	if _, ok := m.files[name]; ok {
+		return pathError("open", name, fs.ErrExist)
+	}
+	m.files[name] = &memFile{data: bytes.Clone(data), mode: perm, modTime: time.Now()}
+	return nil
+}
+
+// SyncDir has nothing to do, memFS not surviving a crash anyway.
+func (m *memFS) SyncDir(string) error { return nil }
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, pathError("stat", name, fs.ErrNotExist)
+	}
+	return memInfo{name: filepath.Base(name), f: *f}, nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if dir, ok := m.files[name]; !ok {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	} else if !dir.mode.IsDir() {
+		return nil, pathError("readdirent", name, errors.New("not a directory"))
+	}
+	var entries []os.DirEntry
+	for path, f := range m.files {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memInfo{name: filepath.Base(path), f: *f}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *memFS) Glob(pattern string) ([]string, error) {
+	dir, base := filepath.Split(pattern)
+	if _, err := filepath.Match(base, ""); err != nil {
+		return nil, err
+	}
+	entries, err := m.ReadDir(dir)
+	if err != nil {
+		return nil, nil
+	}
+	var matches []string
+	for _, entry := range entries {
+		if ok, _ := filepath.Match(base, entry.Name()); ok {
+			matches = append(matches, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return matches, nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if f, ok := m.files[dir]; ok {
+			if !f.mode.IsDir() {
+				return pathError("mkdir", dir, errors.New("not a directory"))
+			}
+			break
+		}
+		m.files[dir] = &memFile{mode: fs.ModeDir | perm, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *memFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return pathError("chmod", name, fs.ErrNotExist)
+	}
+	f.mode = f.mode&fs.ModeType | mode.Perm()
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	f, ok := m.files[oldpath]
+	if !ok {
+		return pathError("rename", oldpath, fs.ErrNotExist)
+	}
+	if f.mode.IsDir() {
+		return pathError("rename", oldpath, errors.New("renaming directories is not supported"))
+	}
+	if err := m.parent("rename", newpath); err != nil {
+		return err
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = f
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	f, ok := m.files[name]
+	if !ok {
+		return pathError("remove", name, fs.ErrNotExist)
+	}
+	if f.mode.IsDir() {
+		for path := range m.files {
+			if path != name && filepath.Dir(path) == name {
+				return pathError("remove", name, errors.New("directory not empty"))
+			}
+		}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// writeMemFile creates path in m along with its directory.
+func writeMemFile(tb testing.TB, m *memFS, path, content string) {
+	tb.Helper()
+	if err := m.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := m.WriteFile(path, []byte(content), 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestReadConfigDropIns(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", `
+[[Watcher]]
+name = "main"
+`)
+	writeMemFile(t, m, "/etc/desktopimage/conf.d/b.toml", `
+[[Watcher]]
+name = "b"
+`)
+	writeMemFile(t, m, "/etc/desktopimage/conf.d/a.toml", `
+[[Watcher]]
+name = "a"
+[[Watcher]]
+name = "a2"
+`)
+	writeMemFile(t, m, "/etc/desktopimage/conf.d/notes.txt", "[[Watcher]]\nname = \"ignored\"\n")
+
+	cfg, err := readConfig("/etc/desktopimage/config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, w := range cfg.Watchers {
+		names = append(names, w.Name)
+	}
+	if got, want := strings.Join(names, " "), "main a a2 b"; got != want {
+		t.Errorf("watchers = %q, want %q", got, want)
+	}
+}
+
+func TestReadConfigBrokenDropIn(t *testing.T) {
+	m := useMemFS(t)
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", "")
+	writeMemFile(t, m, "/etc/desktopimage/conf.d/broken.toml", "[[Watcher]\n")
+
+	_, err := readConfig("/etc/desktopimage/config.toml")
+	if err == nil || !strings.Contains(err.Error(), "broken.toml") {
+		t.Errorf("readConfig() error = %v, want one naming broken.toml", err)
+	}
+}
+
+func TestWatcherHomes(t *testing.T) {
+	m := useMemFS(t)
+	t.Setenv("HOME", "/home/daemon")
+	root, err := homeOf("root")
+	if err != nil {
+		t.Skipf("no root user: %v", err)
+	}
+	writeMemFile(t, m, "/etc/desktopimage/config.toml", `
+[[Watcher]]
+name = "for-root"
+user = "root"
+app_path = "~/Apps"
+desktop_path = "~/.local/share/applications"
+[[Watcher]]
+name = "named"
+app_path = "~root/Apps"
+[[Watcher]]
+name = "daemon"
+app_path = "~/Apps"
+[[Watcher]]
+name = "absolute"
+app_path = "/srv/apps/~"
+`)
+	cfg, err := readConfig("/etc/desktopimage/config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateHomes(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"for-root": filepath.Join(root, "Apps"),
+		"named":    filepath.Join(root, "Apps"),
+		"daemon":   "/home/daemon/Apps",
+		"absolute": "/srv/apps/~",
+	}
+	for _, w := range cfg.watchers() {
+		if w.AppPath != want[w.Name] {
+			t.Errorf("app_path of %s = %q, want %q", w.Name, w.AppPath, want[w.Name])
+		}
+	}
+	if got := cfg.watchers()[0].DesktopPath; got != filepath.Join(root, ".local/share/applications") {
+		t.Errorf("desktop_path of for-root = %q", got)
+	}
+
+	cfg.Watchers[0].User = "no-such-user-here"
+	if err := validateHomes(cfg); err == nil {
+		t.Error("a watcher of an unknown user validated")
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	useMemFS(t)
+	if err := ensureConfigDirectoryExists("/etc/desktopimage"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createDefaultConfig("/etc/desktopimage/config.toml"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig("/etc/desktopimage/config.toml")
+	if err != nil {
+		t.Fatalf("the default configuration doesn't parse: %v", err)
+	}
+	if isConfigValid(cfg) {
+		t.Error("the default configuration is valid before it was edited")
+	}
+}
+
+func TestWriteDesktopFile(t *testing.T) {
+	m := useMemFS(t)
+	path := "/home/user/.local/share/applications/Hello.desktop"
+
+	changed, err := writeDesktopFile(path, "[Desktop Entry]\nName=Hello\n")
+	if err != nil || !changed {
+		t.Fatalf("writeDesktopFile() = %v, %v, want true, nil", changed, err)
+	}
+	info, err := m.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("mode = %v, want 0644", info.Mode().Perm())
+	}
+	if changed, err := writeDesktopFile(path, "[Desktop Entry]\nName=Hello\n"); err != nil || changed {
+		t.Errorf("rewriting the same entry = %v, %v, want false, nil", changed, err)
+	}
+	if changed, err := writeDesktopFile(path, "[Desktop Entry]\nName=Hello 2\n"); err != nil || !changed {
+		t.Errorf("writing a new entry = %v, %v, want true, nil", changed, err)
+	}
+	if got := desktopEntryValue(path, "Name"); got != "Hello 2" {
+		t.Errorf("Name = %q, want %q", got, "Hello 2")
+	}
+
+	entries, err := m.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
+
+func TestRemoveOrphanedEntries(t *testing.T) {
+	useTestConfig(t, Config{})
+	m := useMemFS(t)
+	w := WatcherConfig{Name: "test", AppPath: "/apps", DesktopPath: "/applications", Categories: "Utility"}
+	entry := func(appName string) string {
+		content, err := renderDesktopEntry(context.Background(), w, appName, "", "", appStreamInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	writeMemFile(t, m, "/apps/Present.AppImage", "")
+	writeMemFile(t, m, "/applications/Present.desktop", entry("Present"))
+	writeMemFile(t, m, "/applications/Gone.desktop", entry("Gone"))
+	writeMemFile(t, m, "/applications/other.desktop", "[Desktop Entry]\nExec=/usr/bin/other\n")
+
+	if removed := removeOrphanedEntries(w); removed != 1 {
+		t.Errorf("removeOrphanedEntries() = %d, want 1", removed)
+	}
+	for path, want := range map[string]bool{
+		"/applications/Present.desktop": true,
+		"/applications/Gone.desktop":    false,
+		"/applications/other.desktop":   true,
+	} {
+		if _, err := m.Stat(path); (err == nil) != want {
+			t.Errorf("%s exists: %t, want %t", path, err == nil, want)
+		}
+	}
+}
+
+func TestLoggedIn(t *testing.T) {
+	m := useMemFS(t)
+	if !loggedIn("1000") {
+		t.Error("without logind, users should count as logged in")
+	}
+	writeMemFile(t, m, "/run/systemd/users/1000", "# This is private data. Do not parse.\nNAME=alice\nSTATE=active\n")
+	writeMemFile(t, m, "/run/systemd/users/1001", "NAME=bob\nSTATE=online\n")
+	writeMemFile(t, m, "/run/systemd/users/1002", "NAME=carol\nSTATE=lingering\n")
+	want := map[string]bool{"1000": true, "1001": true, "1002": false, "1003": false}
+	for uid, in := range want {
+		if got := loggedIn(uid); got != in {
+			t.Errorf("loggedIn(%s) = %v, want %v", uid, got, in)
+		}
+	}
+}
+
+func TestWriteNewFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, ".Hello.desktop-1-1")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := (osFS{}).WriteNewFile(link, []byte("x"), 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("WriteNewFile over a symlink = %v, want it to exist", err)
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Errorf("symlink target was created: %v", err)
+	}
+	path := filepath.Join(dir, "Hello.desktop")
+	if err := (osFS{}).WriteNewFile(path, []byte("x"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("file has mode %v, %v, want 0640", info.Mode(), err)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "github.com/fsnotify/fsnotify"
+
+// dirWatcher reports changes to the entries of watched directories. Linux
+// uses inotify through fsnotify; other systems poll, since kqueue would need
+// an open descriptor for every AppImage.
+type dirWatcher interface {
+	Add(path string) error
+	Close() error
+	events() <-chan fsnotify.Event
+	errs() <-chan error
+}
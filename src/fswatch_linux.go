@@ -0,0 +1,25 @@
+//go:build linux
+
+package main
+
+import "github.com/fsnotify/fsnotify"
+
+type inotifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func newDirWatcher() (dirWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return inotifyWatcher{w}, nil
+}
+
+func (w inotifyWatcher) events() <-chan fsnotify.Event {
+	return w.Events
+}
+
+func (w inotifyWatcher) errs() <-chan error {
+	return w.Errors
+}
@@ -0,0 +1,165 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const pollInterval = 2 * time.Second
+
+type fileSnapshot struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// pollWatcher emulates fsnotify by listing the watched directories every
+// pollInterval and reporting what changed between two listings.
+type pollWatcher struct {
+	mu     sync.Mutex
+	dirs   map[string]map[string]fileSnapshot
+	eventC chan fsnotify.Event
+	errC   chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newDirWatcher() (dirWatcher, error) {
+	w := &pollWatcher{
+		dirs:   make(map[string]map[string]fileSnapshot),
+		eventC: make(chan fsnotify.Event),
+		errC:   make(chan error),
+		done:   make(chan struct{}),
+	}
+	go w.loop()
+	return w, nil
+}
+
+func (w *pollWatcher) Add(path string) error {
+	snapshot, err := snapshotDir(path)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirs[filepath.Clean(path)] = snapshot
+	return nil
+}
+
+func (w *pollWatcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *pollWatcher) events() <-chan fsnotify.Event {
+	return w.eventC
+}
+
+func (w *pollWatcher) errs() <-chan error {
+	return w.errC
+}
+
+func (w *pollWatcher) loop() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		dirs := make([]string, 0, len(w.dirs))
+		for dir := range w.dirs {
+			dirs = append(dirs, dir)
+		}
+		w.mu.Unlock()
+
+		for _, dir := range dirs {
+			if !w.poll(dir) {
+				return
+			}
+		}
+	}
+}
+
+// poll compares dir with its previous listing and sends the differences. It
+// returns false once the watcher is closed.
+func (w *pollWatcher) poll(dir string) bool {
+	current, err := snapshotDir(dir)
+	if err != nil {
+		return w.send(nil, err)
+	}
+
+	w.mu.Lock()
+	previous := w.dirs[dir]
+	w.dirs[dir] = current
+	w.mu.Unlock()
+
+	for name, now := range current {
+		path := filepath.Join(dir, name)
+		before, existed := previous[name]
+		switch {
+		case !existed:
+			if !w.send(&fsnotify.Event{Name: path, Op: fsnotify.Create}, nil) {
+				return false
+			}
+		case before.size != now.size || !before.modTime.Equal(now.modTime):
+			if !w.send(&fsnotify.Event{Name: path, Op: fsnotify.Write}, nil) {
+				return false
+			}
+		case before.mode != now.mode:
+			if !w.send(&fsnotify.Event{Name: path, Op: fsnotify.Chmod}, nil) {
+				return false
+			}
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			if !w.send(&fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove}, nil) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (w *pollWatcher) send(event *fsnotify.Event, err error) bool {
+	if event != nil {
+		select {
+		case w.eventC <- *event:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+	select {
+	case w.errC <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func snapshotDir(dir string) (map[string]fileSnapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]fileSnapshot, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshot[entry.Name()] = fileSnapshot{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// The fuzz targets feed the parsers of AppImage contents malformed input.
+// Without -fuzz only the seeds and testdata/fuzz run; to fuzz one target:
+//
+//	go test -run '^$' -fuzz FuzzCheckMembers -fuzztime 1m
+
+func FuzzSquashfsOffset(f *testing.F) {
+	fixture, err := os.ReadFile(fixtureAppImage)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(fixture)
+	f.Add(fixture[:64])
+	f.Add([]byte("\x7fELF\x02\x01\x01\x00AI\x02"))
+	f.Add([]byte("#!/bin/sh\necho not an AppImage\n"))
+	path := filepath.Join(f.TempDir(), "Fuzz.AppImage")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		offset, err := squashfsOffset(path)
+		if err != nil {
+			return
+		}
+		if offset <= 0 || offset+4 > int64(len(data)) || string(data[offset:offset+4]) != "hsqs" {
+			t.Errorf("squashfsOffset() = %d, which isn't where a squashfs image starts", offset)
+		}
+	})
+}
+
+func FuzzCheckMembers(f *testing.F) {
+	f.Add(`Parallel unsquashfs: Using 1 processor
+drwxr-xr-x root/root                49 2024-01-01 00:00 squashfs-root
+-rw-r--r-- root/root               123 2024-01-01 00:00 squashfs-root/hello.desktop
+lrwxrwxrwx root/root                 9 2024-01-01 00:00 squashfs-root/.DirIcon -> hello.png
+`)
+	f.Add("lrwxrwxrwx root/root 9 2024-01-01 00:00 squashfs-root/x -> ../../etc/passwd\n")
+	f.Add("crw-r--r-- root/root 1,3 2024-01-01 00:00 squashfs-root/null\n")
+	f.Add("-rw-r--r-- root/root 99999999999999999999 2024-01-01 00:00 squashfs-root/big\n")
+	f.Add("-rw-r--r--\troot/root\t1\t2024-01-01\t00:00\tsquashfs-root/tabs\n")
+	f.Add("-rw-r--r-- a b c 00:00 00:00 squashfs-root/../escape\n")
+
+	f.Fuzz(func(t *testing.T, listing string) {
+		if err := checkMembers("squashfs-root", listing, 1<<20); err != nil {
+			return
+		}
+		// Every member accepted has to stay below the root.
+		for _, line := range strings.Split(listing, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 6 || len(fields[0]) != 10 || !strings.ContainsRune("-dcbps", rune(fields[0][0])) {
+				continue
+			}
+			if name := fields[len(fields)-1]; strings.HasPrefix(name, "squashfs-root") && !withinDir("squashfs-root", name) {
+				t.Errorf("member %q escaping the root was accepted", name)
+			}
+		}
+	})
+}
+
+func FuzzExecFields(f *testing.F) {
+	f.Add("/apps/Hello.AppImage", "--flag")
+	f.Add("/apps/My App 100%.AppImage", `"quoted" $HOME`)
+	f.Add(`/apps/back\slash.AppImage`, "line\nbreak\ttab")
+	f.Add("/apps/%%u", "`cmd`")
+
+	f.Fuzz(func(t *testing.T, a, b string) {
+		if a == "" || b == "" || !utf8.ValidString(a) || !utf8.ValidString(b) {
+			// execLine never writes empty arguments, and the entries are
+			// UTF-8.
+			return
+		}
+		value := execArg(a) + " " + execArg(b)
+		if got := execFields(value); !reflect.DeepEqual(got, []string{a, b}) {
+			t.Errorf("execFields(%q) = %q, want %q", value, got, []string{a, b})
+		}
+		if got := execProgram(value); got != a && filepath.Base(a) != "distrobox-enter" && filepath.Base(a) != "flatpak-spawn" {
+			t.Errorf("execProgram(%q) = %q, want %q", value, got, a)
+		}
+	})
+}
+
+func FuzzHideEntry(f *testing.F) {
+	f.Add("[Desktop Entry]\nType=Application\nName=Hello\nExec=/apps/Hello.AppImage\n")
+	f.Add("[Desktop Entry]\nNoDisplay=false\nName=Hello\n[Desktop Action New]\nNoDisplay=false\n")
+	f.Add("# comment\n[Desktop Entry]")
+	f.Add("Name=no group\r\n[Desktop Entry]\r\nNoDisplay = false\r\n")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, content string) {
+		if len(content) > 4096 {
+			return
+		}
+		m := useMemFS(t)
+		path := "/applications/Fuzz.desktop"
+		writeMemFile(t, m, path, content)
+		if _, err := hideEntry(path); err != nil {
+			t.Fatal(err)
+		}
+		hasEntry := false
+		for _, line := range strings.Split(content, "\n") {
+			hasEntry = hasEntry || strings.TrimSpace(line) == "[Desktop Entry]"
+		}
+		if got := desktopEntryValue(path, "NoDisplay"); hasEntry && got != "true" {
+			t.Errorf("NoDisplay = %q after hiding, want true", got)
+		}
+		if changed, err := hideEntry(path); err != nil || changed {
+			t.Errorf("hiding a hidden entry again = %v, %v, want false, nil", changed, err)
+		}
+	})
+}
+
+func FuzzParseAppStream(f *testing.F) {
+	f.Add(`<?xml version="1.0" encoding="UTF-8"?>
+<component type="desktop-application">
+  <id>org.example.Hello</id>
+  <name>Hello</name>
+  <name xml:lang="de">Hallo</name>
+  <summary>Says hello</summary>
+  <summary xml:lang="pt-BR">Diz olá</summary>
+</component>`)
+	f.Add(`<component><name xml:lang="x]y">Bad</name><summary>multi
+line</summary></component>`)
+	f.Add(`<component><name>`)
+	f.Add(`<!DOCTYPE x [<!ENTITY a "aaaa">]><component><name>&a;</name></component>`)
+	path := filepath.Join(f.TempDir(), "fuzz.appdata.xml")
+
+	f.Fuzz(func(t *testing.T, content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := parseAppStream(path)
+		if err != nil {
+			return
+		}
+		// Whatever makes it into an entry has to stay a single key.
+		for _, translations := range []map[string]string{info.names, info.summaries} {
+			for lang, value := range translations {
+				if strings.ContainsAny(lang, "[]=\n") || strings.ContainsAny(value, "\n\r") {
+					t.Errorf("translation %q = %q would break the entry", lang, value)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The fixtures in testdata/appimages are type 2 AppImage headers without a
+// real squashfs image. testdata/bin/unsquashfs "extracts" them by copying
+// the NAME.AppImage.contents directory next to each one.
+const fixtureAppImage = "testdata/appimages/Hello.AppImage"
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestWatcher returns a watcher on fresh temporary directories.
+func newTestWatcher(tb testing.TB) WatcherConfig {
+	tb.Helper()
+	dir := tb.TempDir()
+	w := WatcherConfig{
+		Name:        "test",
+		AppPath:     filepath.Join(dir, "apps"),
+		DesktopPath: filepath.Join(dir, "applications"),
+		Categories:  "Utility",
+	}
+	for _, d := range []string{w.AppPath, w.DesktopPath} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return w
+}
+
+// addAppImage copies the fixture AppImage into dir as name.AppImage and
+// returns its path.
+func addAppImage(tb testing.TB, dir, name string) string {
+	tb.Helper()
+	path := filepath.Join(dir, name+".AppImage")
+	copyFile(tb, fixtureAppImage, path, 0755)
+	contents := fixtureAppImage + ".contents"
+	entries, err := os.ReadDir(contents)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Mkdir(path+".contents", 0755); err != nil {
+		tb.Fatal(err)
+	}
+	for _, entry := range entries {
+		src := filepath.Join(contents, entry.Name())
+		dest := filepath.Join(path+".contents", entry.Name())
+		if entry.Type()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(src)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			if err := os.Symlink(target, dest); err != nil {
+				tb.Fatal(err)
+			}
+			continue
+		}
+		copyFile(tb, src, dest, 0644)
+	}
+	return path
+}
+
+// fakeRunner records the desktop utilities the daemon runs.
+type fakeRunner struct {
+	mu    sync.Mutex
+	calls []string
+	err   error
+}
+
+func (f *fakeRunner) Run(name string, args ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, strings.Join(append([]string{name}, args...), " "))
+	return f.err
+}
+
+// ran returns how often the command line cmd was run.
+func (f *fakeRunner) ran(cmd string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, call := range f.calls {
+		if call == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeRunner) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+// useFakeCommands replaces the desktop utilities with a fakeRunner for the
+// duration of the test.
+func useFakeCommands(tb testing.TB) *fakeRunner {
+	tb.Helper()
+	f := &fakeRunner{}
+	prev := desktopUtils
+	desktopUtils = f
+	tb.Cleanup(func() { desktopUtils = prev })
+	return f
+}
+
+// fakeNotifier records the notifications shown and answers each with
+// action. The command lines launched are recorded in launched.
+type fakeNotifier struct {
+	mu       sync.Mutex
+	shown    []notification
+	launched [][]string
+	action   string
+}
+
+func (f *fakeNotifier) Notify(n notification) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shown = append(f.shown, n)
+	return f.action, nil
+}
+
+func (f *fakeNotifier) start(args []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.launched = append(f.launched, args)
+	return nil
+}
+
+func (f *fakeNotifier) notifications() []notification {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]notification(nil), f.shown...)
+}
+
+func (f *fakeNotifier) launches() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.launched...)
+}
+
+// useFakeNotifications replaces the notifications and the launching of
+// AppImages with a fakeNotifier answering with action for the duration of the
+// test.
+func useFakeNotifications(tb testing.TB, action string) *fakeNotifier {
+	tb.Helper()
+	f := &fakeNotifier{action: action}
+	prevNotifier, prevStart := notifications, startApp
+	notifications, startApp = f, f.start
+	tb.Cleanup(func() { notifications, startApp = prevNotifier, prevStart })
+	return f
+}
+
+// logRecorder collects the messages logged during a test.
+type logRecorder struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *logRecorder) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (r *logRecorder) Fire(e *logrus.Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, e.Message)
+	return nil
+}
+
+// count returns how many messages containing s were logged.
+func (r *logRecorder) count(s string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, m := range r.messages {
+		if strings.Contains(m, s) {
+			n++
+		}
+	}
+	return n
+}
+
+func recordLogs(tb testing.TB) *logRecorder {
+	tb.Helper()
+	r := &logRecorder{}
+	log.AddHook(r)
+	tb.Cleanup(func() { log.ReplaceHooks(make(logrus.LevelHooks)) })
+	return r
+}
+
+func copyFile(tb testing.TB, src, dest string, perm os.FileMode) {
+	tb.Helper()
+	content, err := os.ReadFile(src)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(dest, content, perm); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// useTestConfig resets the global settings to cfg for the duration of the
+// test. Extraction uses the fake unsquashfs from testdata/bin, outside the
+// sandbox, which wouldn't let it read the .contents directories.
+func useTestConfig(tb testing.TB, cfg Config) {
+	tb.Helper()
+	bin, err := filepath.Abs("testdata/bin")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if cfg.DataDir == "" {
+		cfg.DataDir = tb.TempDir()
+	}
+	off := false
+	if cfg.SandboxExtraction == nil {
+		cfg.SandboxExtraction = &off
+	}
+
+	stateMu.Lock()
+	state = nil
+	stateMu.Unlock()
+	journalMu.Lock()
+	journal = nil
+	journalMu.Unlock()
+	failCacheMu.Lock()
+	failCache = nil
+	failCacheMu.Unlock()
+	configureReconcileReports(cfg)
+	configureExtraction(cfg)
+	configureAudit(cfg)
+	configureMaintenance(cfg)
+	configureContainer(cfg)
+	configureQuarantine(cfg)
+	configureNotify(cfg)
+	configureDuplicates(cfg)
+	configureApps(cfg)
+	// Entries don't depend on the kernel of the machine running the tests.
+	prevSysctls := usernsSysctls
+	usernsSysctls = nil
+	tb.Cleanup(func() { usernsSysctls = prevSysctls })
+	configureQuirks(cfg)
+	configureResolvers(cfg)
+	configureRefreshCommands(cfg)
+	configureRootApps(cfg)
+	configureElevation(cfg)
+	configureThrottle(cfg)
+	if err := configureTemplates(cfg); err != nil {
+		tb.Fatal(err)
+	}
+}
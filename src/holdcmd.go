@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// runHold handles "hold <app>" and, with held false, "unhold <app>". A held
+// AppImage is still checked for updates, but they are only reported, not
+// installed by auto_update. The hold is kept in its state record, through
+// the daemon when it is running.
+func runHold(args []string, held bool) int {
+	command := "hold"
+	if !held {
+		command = "unhold"
+	}
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s: expected the name of a managed AppImage\n", command)
+		return exitUsage
+	}
+	_, path, err := findManagedAppImage(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		return exitCode(err)
+	}
+
+	_, err = sendControl(controlSocketPath(), controlRequest{Command: command, Source: path})
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		// No daemon running, so the state can be changed directly.
+		err = holdOffline(path, held)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		return exitCode(err)
+	}
+	if held {
+		fmt.Printf("Holding %s, its updates are not installed until \"desktopimage unhold %s\".\n", path, args[0])
+	} else {
+		fmt.Printf("No longer holding %s.\n", path)
+	}
+	return 0
+}
+
+func holdOffline(path string, held bool) error {
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		return err
+	}
+	st, err := openState(cfg.dataDir())
+	if err != nil {
+		return err
+	}
+	if err := st.setHeld(path, held); err != nil {
+		return err
+	}
+	return st.flush()
+}
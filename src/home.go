@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// withHome returns w with a leading ~ of its paths resolved: ~ stands for
+// the home directory of the watcher's user, or of the user running the
+// daemon when it has none, and ~name for the one of name. Paths that can't
+// be resolved are left as they are, validateHomes reports them.
+func (w WatcherConfig) withHome() WatcherConfig {
+	for _, path := range []*string{&w.AppPath, &w.DesktopPath, &w.IconPath, &w.IconDir, &w.MountPattern} {
+		if expanded, err := expandHome(*path, w.User); err == nil {
+			*path = expanded
+		}
+	}
+	return w
+}
+
+// expandHome resolves a leading ~ or ~name of path, with ~ standing for the
+// home directory of userName, or of the current user when it is "".
+func expandHome(path, userName string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	name, rest, _ := strings.Cut(path[1:], "/")
+	if name == "" {
+		name = userName
+	}
+	home, err := homeOf(name)
+	if err != nil {
+		return path, err
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// homeOf returns the home directory of the user called name, or of the
+// current user for "".
+func homeOf(name string) (string, error) {
+	if name == "" {
+		return os.UserHomeDir()
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if u.HomeDir == "" {
+		return "", fmt.Errorf("user %s has no home directory", name)
+	}
+	return u.HomeDir, nil
+}
+
+// validateHomes checks that the users of the watcher blocks exist and that
+// the ~ of their paths resolve.
+func validateHomes(cfg Config) error {
+	blocks := cfg.Watchers
+	if cfg.AppPath != "" || cfg.DesktopPath != "" {
+		blocks = append([]WatcherConfig{cfg.WatcherConfig}, blocks...)
+	}
+	for _, w := range blocks {
+		if w.User != "" {
+			if _, err := user.Lookup(w.User); err != nil {
+				return fmt.Errorf("user of watcher %s: %w", w.label(), err)
+			}
+		}
+		for _, path := range []string{w.AppPath, w.DesktopPath, w.IconPath, w.IconDir, w.MountPattern} {
+			if _, err := expandHome(path, w.User); err != nil {
+				return fmt.Errorf("failed to resolve %s of watcher %s: %w", path, w.label(), err)
+			}
+		}
+	}
+	return nil
+}
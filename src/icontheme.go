@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// icon_scope values, see WatcherConfig.IconScope.
+const (
+	iconScopeUser   = "user"
+	iconScopeSystem = "system"
+)
+
+const (
+	userIconsDir   = "~/.local/share/icons"
+	systemIconsDir = "/usr/local/share/icons"
+	// themeIconPrefix keeps the icons installed into a theme from replacing
+	// those of the theme or of packaged apps named alike.
+	themeIconPrefix = "desktopimage-"
+)
+
+// themeIconSizes are the sizes of the apps directories of hicolor that
+// PNG icons are sorted into.
+var themeIconSizes = []int{16, 22, 24, 32, 48, 64, 96, 128, 256, 512}
+
+// iconsDir returns the icons directory the icon_theme of w is installed
+// into: icon_dir, or the one of icon_scope.
+func (w WatcherConfig) iconsDir() string {
+	switch {
+	case w.IconDir != "":
+		return w.IconDir
+	case w.IconScope == iconScopeSystem:
+		return systemIconsDir
+	default:
+		dir, _ := expandHome(userIconsDir, w.User)
+		return dir
+	}
+}
+
+// themeIndex returns the index.theme of the icon_theme of w, looked up in
+// iconsDir and in the icons directories of XDG_DATA_DIRS, where hicolor is
+// usually installed, or "". Themes are merged across those directories, so
+// the icons may go into one that has no index of its own.
+func themeIndex(w WatcherConfig) string {
+	dirs := []string{w.iconsDir()}
+	dataDirs := os.Getenv("XDG_DATA_DIRS")
+	if dataDirs == "" {
+		dataDirs = "/usr/local/share:/usr/share"
+	}
+	for _, dir := range filepath.SplitList(dataDirs) {
+		dirs = append(dirs, filepath.Join(dir, "icons"))
+	}
+	for _, dir := range dirs {
+		if index := filepath.Join(dir, w.IconTheme, "index.theme"); isRegularFile(index) {
+			return index
+		}
+	}
+	return ""
+}
+
+func validateIconThemes(cfg Config) error {
+	for _, w := range cfg.watchers() {
+		switch w.IconScope {
+		case "", iconScopeUser, iconScopeSystem:
+		default:
+			return fmt.Errorf("icon_scope of watcher %s must be %q or %q, got %q", w.label(), iconScopeUser, iconScopeSystem, w.IconScope)
+		}
+		if w.IconTheme == "" {
+			continue
+		}
+		if strings.ContainsAny(w.IconTheme, "/\x00") || w.IconTheme == "." || w.IconTheme == ".." {
+			return fmt.Errorf("icon_theme of watcher %s must be the name of a theme, got %q", w.label(), w.IconTheme)
+		}
+		if themeIndex(w) == "" {
+			return fmt.Errorf("icon_theme %q of watcher %s has no index.theme in %s or the icons directories of XDG_DATA_DIRS", w.IconTheme, w.label(), w.iconsDir())
+		}
+	}
+	return nil
+}
+
+// themeIconName returns the name the entry at desktopFilePath refers to
+// its icon by when it is installed into an icon theme.
+func themeIconName(desktopFilePath string) string {
+	return themeIconPrefix + strings.TrimSuffix(filepath.Base(desktopFilePath), ".desktop")
+}
+
+// themeIcons returns the icons of the entry at desktopFilePath installed
+// into the icon_theme of w.
+func themeIcons(w WatcherConfig, desktopFilePath string) []string {
+	if w.IconTheme == "" {
+		return nil
+	}
+	themeDir := filepath.Join(w.iconsDir(), w.IconTheme)
+	name := themeIconName(desktopFilePath)
+	var icons []string
+	for _, size := range themeIconSizes {
+		if path := filepath.Join(themeDir, fmt.Sprintf("%dx%d", size, size), "apps", name+".png"); isRegularFile(path) {
+			icons = append(icons, path)
+		}
+	}
+	if path := filepath.Join(themeDir, "scalable", "apps", name+".svg"); isRegularFile(path) {
+		icons = append(icons, path)
+	}
+	return icons
+}
+
+// installThemeIcon copies the extracted icon of the entry at
+// desktopFilePath into the apps directory of its size in the icon_theme of
+// w, and returns the name the entry refers to it by. XPM icons, which
+// themes don't hold, are referred to by their path as before.
+func installThemeIcon(w WatcherConfig, icon, desktopFilePath string) (string, error) {
+	name := themeIconName(desktopFilePath)
+	if auditMode() {
+		if len(themeIcons(w, desktopFilePath)) > 0 {
+			return name, nil
+		}
+		return icon, nil
+	}
+	var sizeDir string
+	switch ext := filepath.Ext(icon); ext {
+	case ".svg":
+		sizeDir = "scalable"
+	case ".png":
+		width, err := pngWidth(icon)
+		if err != nil {
+			return "", err
+		}
+		size := themeIconSizes[0]
+		for _, s := range themeIconSizes {
+			if s <= width {
+				size = s
+			}
+		}
+		sizeDir = fmt.Sprintf("%dx%d", size, size)
+	default:
+		return icon, nil
+	}
+
+	themeDir := filepath.Join(w.iconsDir(), w.IconTheme)
+	dest, err := installIcon(icon, filepath.Join(themeDir, sizeDir, "apps"), name, filepath.Ext(icon))
+	if err != nil {
+		return "", err
+	}
+	// One of another size from before would be picked up as well.
+	for _, old := range themeIcons(w, desktopFilePath) {
+		if old != dest {
+			removeArtifacts([]string{old})
+		}
+	}
+	// Icon caches are ignored where the theme directory is newer.
+	now := time.Now()
+	if err := os.Chtimes(themeDir, now, now); err != nil {
+		w.logger().Debugf("Error touching icon theme %s: %v", themeDir, err)
+	}
+	return name, nil
+}
+
+// pngWidth returns the width the IHDR chunk of the PNG at path gives.
+func pngWidth(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[12:16]) != "IHDR" {
+		return 0, fmt.Errorf("%s has no PNG header", path)
+	}
+	return int(binary.BigEndian.Uint32(header[16:20])), nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// importWatcherName labels the records of imported AppImages.
+const importWatcherName = "import"
+
+// runImport handles "import-dir", which integrates the AppImages of a
+// directory once, the way a watcher's startup scan does, but without
+// watching it afterwards. The entries stay until "desktopimage remove".
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import-dir", flag.ContinueOnError)
+	recursive := fs.Bool("recursive", false, "import the AppImages of subdirectories too")
+	desktopPath := fs.String("desktop-path", "", "directory to write the entries to (default ~/.local/share/applications)")
+	categories := fs.String("categories", "", "categories of the entries (default from [defaults], or Application)")
+	workers := fs.Int("workers", 0, "AppImages integrated at once (default scan_workers)")
+	verbose := fs.Bool("verbose", false, "log every AppImage integrated")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "import-dir: expected a directory")
+		return exitUsage
+	}
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import-dir: %v\n", err)
+		return exitCode(err)
+	}
+	if *desktopPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import-dir: %v, pass --desktop-path\n", err)
+			return exitUsage
+		}
+		*desktopPath = filepath.Join(home, ".local", "share", "applications")
+	}
+
+	// The state and journal are the daemon's, so they are only written
+	// while it is stopped.
+	lock, err := lockDataDir(startupDataDir(configFilePath))
+	if errors.Is(err, errLockHeld) {
+		fmt.Fprintf(os.Stderr, "import-dir: the daemon is running (%v); stop it to import, or add %s as a watcher\n", err, dir)
+		return exitCode(err)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import-dir: %v\n", err)
+		return exitCode(err)
+	}
+	defer lock.Close()
+
+	if !*verbose {
+		log.SetLevel(logrus.WarnLevel)
+	}
+	if err := loadConfig(configFilePath); err != nil {
+		fmt.Fprintf(os.Stderr, "import-dir: %v\n", err)
+		return exitCode(err)
+	}
+	paths, err := findImportable(dir, *recursive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import-dir: %v\n", err)
+		return exitCode(err)
+	}
+	if *workers <= 0 {
+		*workers = scanWorkers(config)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	template := WatcherConfig{Name: importWatcherName, DesktopPath: *desktopPath, Categories: *categories}.withDefaults(config.Defaults)
+	if template.Categories == "" {
+		template.Categories = "Application"
+	}
+	bar := newProgressBar(os.Stderr, len(paths))
+	log.SetOutput(bar)
+	refresher := newDBRefresher(config.refreshDelay(), config.refreshMaxDelay())
+	result := importAppImages(ctx, template, paths, *workers, refresher, bar.advance)
+	bar.finish()
+	log.SetOutput(os.Stderr)
+
+	fmt.Printf("Imported %d AppImage(s) from %s in %s: %d integrated, %d already up to date, %d not integrated.\n",
+		len(paths), dir, result.duration.Round(time.Millisecond), result.written, result.unchanged, len(result.skipped))
+	for _, path := range result.skipped {
+		fmt.Printf("  not integrated: %s\n", path)
+	}
+	if len(result.skipped) > 0 {
+		fmt.Println("Run again with --verbose to see why.")
+	}
+	if ctx.Err() != nil {
+		fmt.Println("Interrupted, the remaining AppImages were not imported.")
+		return exitFailure
+	}
+	return 0
+}
+
+// findImportable returns the AppImages in dir, or with recursive in dir and
+// below it, sorted.
+func findImportable(dir string, recursive bool) ([]string, error) {
+	if !recursive {
+		return listAppImages(dir)
+	}
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			log.Warnf("Skipping %s: %v", path, err)
+			return nil
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".AppImage") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read app directory: %w", err)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+type importResult struct {
+	written, unchanged int
+	// skipped are the AppImages that have no record afterwards.
+	skipped  []string
+	duration time.Duration
+}
+
+// importAppImages integrates paths with workers in parallel, each with a
+// watcher like template for its directory, and calls done from the worker
+// after every one.
+// The database of the desktop directory is refreshed with refresher once at
+// the end.
+func importAppImages(ctx context.Context, template WatcherConfig, paths []string, workers int, refresher *dbRefresher, done func()) importResult {
+	start := time.Now()
+	jobs := make(chan string)
+	var written int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer reportPanics()
+			runLowPriority(func() {
+				for path := range jobs {
+					w := template
+					w.AppPath = filepath.Dir(path)
+					if integrateAppImage(ctx, w, path, refresher) {
+						atomic.AddInt64(&written, 1)
+						refresher.request(w.DesktopPath)
+					}
+					done()
+				}
+			})
+		}()
+	}
+
+feed:
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- path:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	refresher.flush()
+	flushState(currentState())
+
+	result := importResult{written: int(written), duration: time.Since(start)}
+	for _, path := range paths {
+		if _, ok := currentState().get(path); !ok {
+			result.skipped = append(result.skipped, path)
+		}
+	}
+	result.unchanged = len(paths) - result.written - len(result.skipped)
+	return result
+}
+
+// progressBar draws the progress of an import on the last line of a
+// terminal. It is also the log output meanwhile, so that log lines are
+// written above the bar instead of through it. On other outputs it only
+// passes the log lines on.
+type progressBar struct {
+	mu       sync.Mutex
+	out      io.Writer
+	terminal bool
+	total    int
+	done     int
+}
+
+const progressBarWidth = 40
+
+func newProgressBar(out *os.File, total int) *progressBar {
+	info, err := out.Stat()
+	b := &progressBar{out: out, total: total, terminal: err == nil && info.Mode()&os.ModeCharDevice != 0}
+	b.mu.Lock()
+	b.draw()
+	b.mu.Unlock()
+	return b
+}
+
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.terminal {
+		fmt.Fprint(b.out, "\r\x1b[K")
+	}
+	n, err := b.out.Write(p)
+	b.draw()
+	return n, err
+}
+
+func (b *progressBar) advance() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done++
+	b.draw()
+}
+
+// finish ends the line of the bar.
+func (b *progressBar) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.terminal {
+		fmt.Fprintln(b.out)
+	}
+}
+
+// draw redraws the bar; it is called with b.mu held.
+func (b *progressBar) draw() {
+	if !b.terminal || b.total == 0 {
+		return
+	}
+	filled := b.done * progressBarWidth / b.total
+	fmt.Fprintf(b.out, "\r[%s%s] %d/%d", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), b.done, b.total)
+}
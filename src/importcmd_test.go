@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestImportAppImages(t *testing.T) {
+	useTestConfig(t, Config{})
+	commands := useFakeCommands(t)
+	w := newTestWatcher(t)
+	nested := filepath.Join(w.AppPath, "games", "retro")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hello := addAppImage(t, w.AppPath, "Hello")
+	game := addAppImage(t, nested, "Game")
+	broken := filepath.Join(w.AppPath, "Broken.AppImage")
+	if err := os.WriteFile(broken, []byte("not an AppImage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	top, err := findImportable(w.AppPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{broken, hello}; !reflect.DeepEqual(top, want) {
+		t.Errorf("found %v without --recursive, want %v", top, want)
+	}
+	paths, err := findImportable(w.AppPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{broken, hello, game}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("found %v with --recursive, want %v", paths, want)
+	}
+
+	template := WatcherConfig{Name: importWatcherName, DesktopPath: w.DesktopPath, Categories: "Utility"}
+	var done int64
+	result := importAppImages(context.Background(), template, paths, 2, newDBRefresher(time.Hour, time.Hour), func() { atomic.AddInt64(&done, 1) })
+	if done != int64(len(paths)) {
+		t.Errorf("progress advanced %d times, want %d", done, len(paths))
+	}
+	if result.written != 2 || result.unchanged != 0 || !reflect.DeepEqual(result.skipped, []string{broken}) {
+		t.Errorf("first import: %d written, %d unchanged, skipped %v; want 2, 0 and %s", result.written, result.unchanged, result.skipped, broken)
+	}
+	for _, name := range []string{"Hello", "Game"} {
+		if !exists(filepath.Join(w.DesktopPath, name+".desktop")) {
+			t.Errorf("no entry for %s", name)
+		}
+	}
+	if app, ok := currentState().get(game); !ok || app.Watcher != importWatcherName {
+		t.Errorf("the record of %s is %+v, want one by %s", game, app, importWatcherName)
+	}
+	if n := commands.ran("update-desktop-database " + w.DesktopPath); n != 1 {
+		t.Errorf("the desktop database was refreshed %d times, want once", n)
+	}
+
+	result = importAppImages(context.Background(), template, paths, 2, newDBRefresher(time.Hour, time.Hour), func() {})
+	if result.written != 0 || result.unchanged != 2 {
+		t.Errorf("second import: %d written, %d unchanged; want 0 and 2", result.written, result.unchanged)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const journalFileName = "journal.json"
+
+// journalSlack is subtracted from a mark before comparing it with file
+// times, which some file systems only keep to the second or two.
+const journalSlack = 2 * time.Second
+
+// watcherJournal is what the journal knows about one watcher.
+type watcherJournal struct {
+	// Mark is a time by which every change to app_path had been seen,
+	// either by a scan or as an event.
+	Mark time.Time `json:"mark"`
+	// Fingerprint identifies the settings the entries were written with.
+	Fingerprint string `json:"fingerprint"`
+	// Pending lists the AppImages with events that were not handled yet.
+	Pending []string `json:"pending,omitempty"`
+}
+
+// eventJournal lets a restarted daemon tell which watchers missed activity
+// while it was down, so only those rescan. It is kept next to the state in
+// the data directory and is safe for concurrent use.
+type eventJournal struct {
+	mu       sync.Mutex
+	path     string
+	Watchers map[string]*watcherJournal `json:"watchers"`
+}
+
+var (
+	journalMu sync.Mutex
+	journal   *eventJournal
+)
+
+func openJournal(dataDir string) *eventJournal {
+	j := &eventJournal{path: filepath.Join(dataDir, journalFileName), Watchers: make(map[string]*watcherJournal)}
+	content, err := os.ReadFile(j.path)
+	if err != nil {
+		return j
+	}
+	if err := json.Unmarshal(content, j); err != nil {
+		log.Warnf("Ignoring unreadable journal %s: %v", j.path, err)
+		j.Watchers = make(map[string]*watcherJournal)
+	}
+	if j.Watchers == nil {
+		j.Watchers = make(map[string]*watcherJournal)
+	}
+	return j
+}
+
+func configureJournal(cfg Config) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if journal == nil || journal.path != filepath.Join(cfg.dataDir(), journalFileName) {
+		journal = openJournal(cfg.dataDir())
+	}
+}
+
+func currentJournal() *eventJournal {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if journal == nil {
+		journal = &eventJournal{Watchers: make(map[string]*watcherJournal)}
+	}
+	return journal
+}
+
+// watcherFingerprint hashes everything an entry of w depends on besides
+// the AppImage itself: the configuration, the files it refers to and
+// entryFormatVersion. The
+// other watcher blocks and the active profile are left out, so changing
+// them doesn't rescan w.
+func watcherFingerprint(cfg Config, w WatcherConfig) string {
+	cfg.Watchers = nil
+	cfg.Profile = ""
+	h := sha256.New()
+	fmt.Fprintf(h, "entry format %d\n", entryFormatVersion)
+	content, _ := json.Marshal(struct {
+		Config  Config
+		Watcher WatcherConfig
+	}{cfg, w})
+	h.Write(content)
+	fmt.Fprintln(h, quirksFingerprint())
+	for _, path := range []string{w.IconPath, w.Template} {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scanNeeded reports why w has to be rescanned when it starts, or "" when
+// the journal shows nothing happened since it last stopped.
+func (j *eventJournal) scanNeeded(w WatcherConfig, fingerprint string) string {
+	if auditMode() {
+		return "audit mode"
+	}
+	j.mu.Lock()
+	wj, ok := j.Watchers[w.label()]
+	var entry watcherJournal
+	if ok {
+		entry = *wj
+	}
+	j.mu.Unlock()
+
+	switch {
+	case !ok:
+		return "no earlier run recorded"
+	case entry.Fingerprint != fingerprint:
+		return "the configuration changed"
+	case len(entry.Pending) > 0:
+		return fmt.Sprintf("%d event(s) were not handled", len(entry.Pending))
+	}
+	since := entry.Mark.Add(-journalSlack)
+	if changedSince(w.appDir(), since, true) || changedSince(w.DesktopPath, since, false) {
+		return fmt.Sprintf("files changed since %s", entry.Mark.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// changedSince reports whether dir or, with entries, one of the AppImages
+// in it was modified or had its permissions changed after t.
+func changedSince(dir string, t time.Time, entries bool) bool {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	if touchedAfter(info, t) {
+		return true
+	}
+	if !entries {
+		return false
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return true
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".AppImage") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, file.Name()))
+		if err == nil && touchedAfter(info, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func touchedAfter(info os.FileInfo, t time.Time) bool {
+	return info.ModTime().After(t) || changeTime(info).After(t)
+}
+
+// synced records that a scan handled every change to w's app_path until
+// mark, leaving only the events for pending to be handled.
+func (j *eventJournal) synced(w WatcherConfig, fingerprint string, mark time.Time, pending []string) {
+	j.update(w, func(wj *watcherJournal) {
+		wj.Mark = mark
+		wj.Fingerprint = fingerprint
+		wj.Pending = pending
+	})
+}
+
+// stopped moves the mark of a watcher that stops watching to now.
+func (j *eventJournal) stopped(w WatcherConfig) {
+	j.update(w, func(wj *watcherJournal) {
+		wj.Mark = time.Now()
+	})
+}
+
+// forget drops what is known about the watcher labelled label, so it is
+// rescanned when it starts next. It is used when entries were changed
+// behind the journal's back.
+func (j *eventJournal) forget(label string) {
+	if auditMode() {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.Watchers[label]; !ok {
+		return
+	}
+	delete(j.Watchers, label)
+	if err := j.write(); err != nil {
+		log.Errorf("Error saving journal: %v", err)
+	}
+}
+
+// eventPending records an event for path that is about to be handled.
+func (j *eventJournal) eventPending(w WatcherConfig, path string) {
+	j.update(w, func(wj *watcherJournal) {
+		for _, p := range wj.Pending {
+			if p == path {
+				return
+			}
+		}
+		wj.Pending = append(wj.Pending, path)
+	})
+}
+
+// eventHandled records that the events for path were handled, which moves
+// the mark forward.
+func (j *eventJournal) eventHandled(w WatcherConfig, path string) {
+	j.update(w, func(wj *watcherJournal) {
+		kept := wj.Pending[:0]
+		for _, p := range wj.Pending {
+			if p != path {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			kept = nil
+		}
+		wj.Pending = kept
+		wj.Mark = time.Now()
+	})
+}
+
+// update applies fn to the journal of w and writes the journal out.
+func (j *eventJournal) update(w WatcherConfig, fn func(*watcherJournal)) {
+	if auditMode() {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	wj, ok := j.Watchers[w.label()]
+	if !ok {
+		wj = &watcherJournal{}
+		j.Watchers[w.label()] = wj
+	}
+	fn(wj)
+	if err := j.write(); err != nil {
+		log.Errorf("Error saving journal: %v", err)
+	}
+}
+
+// write replaces the journal file atomically; it is called with j.mu held.
+func (j *eventJournal) write() error {
+	if j.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
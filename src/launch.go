@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// launchCommand is the subcommand entries run through when the AppImage
+// needs a prepared environment, since Exec lines can't set variables.
+const launchCommand = "launch"
+
+// isolatedDataDir is where an AppImage launched with --isolate keeps its
+// state, relative to the real home directory.
+var isolatedDataDir = filepath.Join(".local", "share", "desktopimage", "apps")
+
+// displayEnv is what makes the common toolkits use the display server
+// --display asks for. Electron reads ELECTRON_OZONE_PLATFORM_HINT.
+var displayEnv = map[string][]string{
+	displayWayland: {"GDK_BACKEND=wayland", "QT_QPA_PLATFORM=wayland", "SDL_VIDEODRIVER=wayland",
+		"CLUTTER_BACKEND=wayland", "MOZ_ENABLE_WAYLAND=1", "ELECTRON_OZONE_PLATFORM_HINT=wayland"},
+	displayX11: {"GDK_BACKEND=x11", "QT_QPA_PLATFORM=xcb", "SDL_VIDEODRIVER=x11",
+		"CLUTTER_BACKEND=x11", "MOZ_ENABLE_WAYLAND=0", "ELECTRON_OZONE_PLATFORM_HINT=x11"},
+}
+
+// launchFlags returns the flags the launch command needs to start the
+// AppImage named appName as configured, or nil when it can run directly.
+func launchFlags(w WatcherConfig, appName string) []string {
+	var flags []string
+	if w.IsolateData {
+		flags = append(flags, "--isolate")
+	}
+	if display := appConfig(appName).Display; display != displayAuto {
+		flags = append(flags, "--display="+display)
+	}
+	return flags
+}
+
+// execLine returns the Exec value launching the AppImage at path for w.
+func execLine(w WatcherConfig, path string) string {
+	target := execPath(w, path)
+	args := []string{target}
+	if rootHandling(w, appNameFromPath(path)) == rootAppsPkexec {
+		// The polkit policy is for the AppImage itself, so it is started
+		// without the launch command.
+		args = []string{"pkexec", target}
+	} else if flags := launchFlags(w, appNameFromPath(path)); len(flags) > 0 {
+		args = append(append([]string{launcherPath(), launchCommand}, flags...), target)
+	}
+	configured := append(append([]string{}, w.ExecArgs...), appConfig(appNameFromPath(path)).ExecArgs...)
+	// An option and its values are left out as a whole when they are there
+	// already, as in --enable-features X, never just the option.
+	present := append(argGroups(args), argGroups(configured)...)
+	for _, group := range append(argGroups(toolkitArgs(appNameFromPath(path))), argGroups(appQuirk(appNameFromPath(path)).Args)...) {
+		if !containsGroup(present, group) {
+			args = append(args, group...)
+			present = append(present, group)
+		}
+	}
+	// Configured arguments may repeat, as in --flag x --other x.
+	args = append(args, configured...)
+
+	opts := currentContainer()
+	switch opts.wrapper {
+	case containerExecDistrobox:
+		args = append([]string{"distrobox-enter", "-n", opts.name, "--"}, args...)
+	case containerExecFlatpakSpawn:
+		args = append([]string{"flatpak-spawn", "--host"}, args...)
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = execArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// argGroups splits args into the options they hold: an argument starting
+// with "-" and the values following it, which don't.
+func argGroups(args []string) [][]string {
+	var groups [][]string
+	for _, arg := range args {
+		if len(groups) == 0 || strings.HasPrefix(arg, "-") {
+			groups = append(groups, []string{arg})
+		} else {
+			groups[len(groups)-1] = append(groups[len(groups)-1], arg)
+		}
+	}
+	return groups
+}
+
+func containsGroup(groups [][]string, group []string) bool {
+	for _, g := range groups {
+		if equalStrings(g, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// execArg quotes arg for an Exec key as the desktop entry specification
+// asks: arguments with reserved characters go in double quotes with '"',
+// '`', '$' and '\' escaped, '%' is doubled, and the backslashes are escaped
+// once more as the key is a string.
+func execArg(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	if !strings.ContainsAny(arg, " \t\n\"'\\><~|&;$*?#()`") {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range arg {
+		if strings.ContainsRune("\"`$\\", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return desktopString(b.String())
+}
+
+// execFields splits an Exec value into its arguments, undoing execArg.
+func execFields(value string) []string {
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+			switch value[i] {
+			case 's':
+				unescaped.WriteByte(' ')
+			case 'n':
+				unescaped.WriteByte('\n')
+			case 't':
+				unescaped.WriteByte('\t')
+			case 'r':
+				unescaped.WriteByte('\r')
+			default:
+				// \\ and, in quoted arguments, the escapes execArg adds.
+				if value[i] != '\\' {
+					unescaped.WriteByte('\\')
+				}
+				unescaped.WriteByte(value[i])
+			}
+			continue
+		}
+		unescaped.WriteByte(value[i])
+	}
+
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	s := unescaped.String()
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s):
+			i++
+			field.WriteByte(s[i])
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (c == ' ' || c == '\t' || c == '\n'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	for i, f := range fields {
+		fields[i] = strings.ReplaceAll(f, "%%", "%")
+	}
+	return fields
+}
+
+// execProgram returns the program an Exec value launches, looking through
+// the container wrappers and launch command written by execLine.
+func execProgram(value string) string {
+	return programOf(execFields(value))
+}
+
+func programOf(fields []string) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	switch base := filepath.Base(fields[0]); {
+	case base == "distrobox-enter":
+		for i, field := range fields {
+			if field == "--" {
+				return programOf(fields[i+1:])
+			}
+		}
+		return ""
+	case base == "pkexec":
+		return programOf(fields[1:])
+	case base == "flatpak-spawn":
+		for i, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				return programOf(fields[i+1:])
+			}
+		}
+		return ""
+	case len(fields) > 1 && fields[1] == launchCommand && base == filepath.Base(launcherPath()):
+		for _, field := range fields[2:] {
+			if !strings.HasPrefix(field, "-") {
+				return field
+			}
+		}
+		return ""
+	default:
+		return fields[0]
+	}
+}
+
+func launcherPath() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "desktopimage"
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		return resolved
+	}
+	return exe
+}
+
+// runLaunch prepares the environment requested by its flags and replaces
+// the process with the AppImage.
+func runLaunch(args []string) int {
+	fs := flag.NewFlagSet(launchCommand, flag.ContinueOnError)
+	isolate := fs.Bool("isolate", false, "give the AppImage its own home and XDG data directories")
+	display := fs.String("display", displayAuto, "run the AppImage on \""+displayWayland+"\" or \""+displayX11+"\"")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "launch: expected the AppImage to run")
+		return exitUsage
+	}
+	path := fs.Arg(0)
+
+	if *display != displayAuto {
+		env, ok := displayEnv[*display]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "launch: unknown display %q\n", *display)
+			return exitUsage
+		}
+		for _, kv := range env {
+			k, v, _ := strings.Cut(kv, "=")
+			os.Setenv(k, v)
+		}
+		if *display == displayX11 {
+			// Without it, toolkits ignoring the variables above still
+			// find the compositor.
+			os.Unsetenv("WAYLAND_DISPLAY")
+		}
+	}
+	if *isolate {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "launch: %v\n", err)
+			return exitCode(err)
+		}
+		dir := filepath.Join(home, isolatedDataDir, appNameFromPath(path))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			fmt.Fprintf(os.Stderr, "launch: %v\n", err)
+			return exitCode(err)
+		}
+		// The XDG variables are set as well, since a user's own settings
+		// would otherwise point the AppImage back into the real home.
+		os.Setenv("HOME", dir)
+		os.Setenv("XDG_DATA_HOME", filepath.Join(dir, ".local", "share"))
+		os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, ".config"))
+		os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, ".cache"))
+		os.Setenv("XDG_STATE_HOME", filepath.Join(dir, ".local", "state"))
+	}
+
+	if err := syscall.Exec(path, fs.Args(), os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "launch: %v\n", err)
+		return exitCode(err)
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// lintConfig returns warnings about setups that are valid but work against
+// themselves: entries written where AppImages are watched, which makes the
+// daemon see its own writes, watchers seeing the same AppImages twice, and
+// entries written where no menu looks for them, and categories that aren't
+// freedesktop ones. "config check --strict"
+// refuses such configurations.
+func lintConfig(cfg Config) []string {
+	var warnings []string
+	var watchers []WatcherConfig
+	for _, w := range cfg.watchers() {
+		if isWatcherValid(w) {
+			watchers = append(watchers, w)
+		}
+	}
+	for i, w := range watchers {
+		appDir, desktopDir := resolvedPath(w.appDir()), resolvedPath(w.DesktopPath)
+		if appDir == desktopDir {
+			warnings = append(warnings, fmt.Sprintf("watcher %s writes its entries into app_path %s, which it watches", w.label(), w.appDir()))
+		}
+		if normalized, notes := normalizeCategories(w.Categories); len(notes) > 0 {
+			warnings = append(warnings, fmt.Sprintf("categories %q of watcher %s: %s; its entries get %q", w.Categories, w.label(), strings.Join(notes, ", "), normalized))
+		}
+		if filepath.Base(desktopDir) != "applications" {
+			warnings = append(warnings, fmt.Sprintf("desktop_path %s of watcher %s isn't an applications directory such as ~/.local/share/applications, menus won't show its entries", w.DesktopPath, w.label()))
+		}
+		for j, other := range watchers {
+			otherDir := resolvedPath(other.appDir())
+			if pathWithin(desktopDir, otherDir) && (j != i || desktopDir != appDir) {
+				warnings = append(warnings, fmt.Sprintf("desktop_path %s of watcher %s is inside app_path %s of watcher %s, which sees every entry written", w.DesktopPath, w.label(), other.appDir(), other.label()))
+			}
+			if j == i || (appDir == otherDir && j < i) {
+				continue
+			}
+			switch {
+			case appDir == otherDir:
+				if w.appFile() != "" && other.appFile() != "" && w.appFile() != other.appFile() {
+					// Two single AppImages in one directory.
+					continue
+				}
+				warnings = append(warnings, fmt.Sprintf("watchers %s and %s both watch %s, its AppImages get events and entries from both", w.label(), other.label(), w.appDir()))
+			case appDir != otherDir && pathWithin(appDir, otherDir):
+				warnings = append(warnings, fmt.Sprintf("app_path %s of watcher %s is inside app_path %s of watcher %s", w.appDir(), w.label(), other.appDir(), other.label()))
+			}
+		}
+	}
+	return warnings
+}
+
+// resolvedPath returns path cleaned and, as far as it exists, with its
+// symlinks resolved, so that two spellings of a directory compare equal.
+func resolvedPath(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// pathWithin reports whether path is dir or below it.
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
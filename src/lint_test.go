@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintConfig(t *testing.T) {
+	dir := t.TempDir()
+	apps := filepath.Join(dir, "Apps")
+	entries := filepath.Join(dir, "share", "applications")
+	for _, d := range []string{apps, entries} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(apps, link); err != nil {
+		t.Fatal(err)
+	}
+	watcher := func(name, appPath, desktopPath string) WatcherConfig {
+		return WatcherConfig{Name: name, AppPath: appPath, DesktopPath: desktopPath, Categories: "Utility"}
+	}
+
+	for _, c := range []struct {
+		name     string
+		watchers []WatcherConfig
+		want     []string
+	}{
+		{"fine", []WatcherConfig{watcher("a", apps, entries)}, nil},
+		{"same directory", []WatcherConfig{watcher("a", entries, entries)}, []string{"writes its entries into app_path"}},
+		{"not applications", []WatcherConfig{watcher("a", apps, filepath.Join(dir, "menu"))}, []string{"isn't an applications directory"}},
+		{"entries inside app_path", []WatcherConfig{watcher("a", dir, entries)}, []string{"desktop_path " + entries + " of watcher a is inside app_path"}},
+		{"entries in another watcher", []WatcherConfig{watcher("a", apps, entries), watcher("b", filepath.Dir(entries), entries)}, []string{
+			"desktop_path " + entries + " of watcher a is inside app_path " + filepath.Dir(entries) + " of watcher b",
+			"desktop_path " + entries + " of watcher b is inside app_path " + filepath.Dir(entries) + " of watcher b",
+		}},
+		{"watched twice", []WatcherConfig{watcher("a", apps, entries), watcher("b", link, entries)}, []string{"watchers a and b both watch"}},
+		{"nested", []WatcherConfig{watcher("a", apps, entries), watcher("b", filepath.Join(apps, "More"), entries)}, []string{"app_path " + filepath.Join(apps, "More") + " of watcher b is inside app_path " + apps}},
+		{"single files", []WatcherConfig{watcher("a", filepath.Join(apps, "A.AppImage"), entries), watcher("b", filepath.Join(apps, "B.AppImage"), entries)}, nil},
+		{"freeform categories", []WatcherConfig{{Name: "a", AppPath: apps, DesktopPath: entries, Categories: "Graphics/Photo"}}, []string{`its entries get "Graphics;Photography;"`}},
+	} {
+		warnings := lintConfig(Config{Watchers: c.watchers})
+		if len(warnings) != len(c.want) {
+			t.Errorf("%s: lintConfig() = %q, want %d warning(s)", c.name, warnings, len(c.want))
+			continue
+		}
+		for i, want := range c.want {
+			if !strings.Contains(warnings[i], want) {
+				t.Errorf("%s: warning %q doesn't mention %q", c.name, warnings[i], want)
+			}
+		}
+	}
+}
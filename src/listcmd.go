@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// runList prints the AppImages the daemon has integrated, with --quarantined
+// the ones it moved to quarantine_dir, or with --failed the ones extraction
+// keeps failing on, or with --updates where updates of each are looked for.
+func runList(args []string) int {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	quarantined := fs.Bool("quarantined", false, "list quarantined AppImages instead")
+	failed := fs.Bool("failed", false, "list AppImages extraction failed on instead")
+	updates := fs.Bool("updates", false, "list the update channel of each AppImage instead")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list: %v\n", err)
+		return exitCode(err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	if *quarantined {
+		if cfg.QuarantineDir == "" {
+			fmt.Fprintln(os.Stderr, "list: quarantine_dir is not configured")
+			return exitConfig
+		}
+		files, err := listQuarantined(cfg.QuarantineDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "list: %v\n", err)
+			return exitCode(err)
+		}
+		fmt.Fprintln(tw, "FILE\tSOURCE\tQUARANTINED\tREASON")
+		for _, f := range files {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.path, f.fields["source"], f.fields["quarantined"], f.fields["reason"])
+		}
+		return 0
+	}
+
+	if *failed {
+		fmt.Fprintln(tw, "APPIMAGE\tWATCHER\tFAILURES\tRETRY AT\tREASON\tERROR")
+		for _, f := range openFailures(cfg.dataDir()).list() {
+			retry := "never"
+			if !f.Class.permanent() {
+				retry = f.RetryAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", f.Path, f.Watcher, f.Failures, retry, f.Class.reason(), f.Error)
+		}
+		return 0
+	}
+
+	st, err := openState(cfg.dataDir())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list: %v\n", err)
+		return exitCode(err)
+	}
+	var apps []appState
+	for _, w := range cfg.watchers() {
+		apps = append(apps, st.watchedBy(w)...)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Path < apps[j].Path })
+
+	if *updates {
+		fmt.Fprintln(tw, "APPIMAGE\tTYPE\tCHANNEL\tPIN")
+		for _, app := range apps {
+			u, pin, _, err := updatesFor(app, cfg.Apps[appNameFromPath(app.Path)])
+			switch {
+			case err != nil:
+				fmt.Fprintf(tw, "%s\t%s\t\t%s\n", app.Path, err, pin)
+			case u.Type == "":
+				fmt.Fprintf(tw, "%s\t-\t\t\n", app.Path)
+			default:
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", app.Path, u.Type, u.channel(), pin)
+			}
+		}
+		return 0
+	}
+
+	fmt.Fprintln(tw, "NAME\tWATCHER\tAPPIMAGE\tDESKTOP FILE")
+	for _, app := range apps {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", appNameFromPath(app.Path), app.Watcher, app.Path, app.DesktopFile)
+	}
+	return 0
+}
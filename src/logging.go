@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// log_format values, see Config.LogFormat.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+func validateLogging(cfg Config) error {
+	if cfg.LogLevel != "" {
+		// Panic and fatal would hide the errors of the daemon.
+		if level, err := logrus.ParseLevel(cfg.LogLevel); err != nil || level < logrus.ErrorLevel {
+			return fmt.Errorf("log_level must be one of trace, debug, info, warn or error, got %q", cfg.LogLevel)
+		}
+	}
+	switch cfg.LogFormat {
+	case "", logFormatText, logFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("log_format must be %q or %q, got %q", logFormatText, logFormatJSON, cfg.LogFormat)
+	}
+}
+
+// logLevel returns the level of log_level, info by default.
+func (c Config) logLevel() logrus.Level {
+	if level, err := logrus.ParseLevel(c.LogLevel); err == nil {
+		return level
+	}
+	return logrus.InfoLevel
+}
+
+// logFormat returns log_format, text by default.
+func (c Config) logFormat() string {
+	if c.LogFormat == "" {
+		return logFormatText
+	}
+	return c.LogFormat
+}
+
+// configureLogging applies log_level, log_format and trace_events. Unlike
+// the other settings they are applied without restarting the watchers, so
+// the daemon can be switched to debug logging for a while and back.
+func configureLogging(cfg Config) {
+	if cfg.logFormat() == logFormatJSON {
+		log.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		log.SetFormatter(&logrus.TextFormatter{DisableColors: false, FullTimestamp: true})
+	}
+	log.SetLevel(cfg.logLevel())
+	configureEventTrace(cfg)
+}
+
+// applyLogging is the configuration callback applying logging changes.
+func applyLogging(change ConfigChange) {
+	if !change.Logging {
+		return
+	}
+	configureLogging(change.New)
+	log.Infof("Logging at level %s in the %s format, tracing events: %t.", change.New.logLevel(), change.New.logFormat(), change.New.TraceEvents)
+}
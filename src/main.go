@@ -2,29 +2,303 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/pelletier/go-toml"
 	"github.com/sirupsen/logrus"
+	"io/fs"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
+	"time"
 )
 
 const (
 	configFilePath = "/etc/desktopimage/config.toml"
 )
 
-type Config struct {
+const (
+	defaultRefreshDelay    = 500 * time.Millisecond
+	defaultRefreshMaxDelay = 30 * time.Second
+	defaultSettleDelay     = time.Second
+)
+
+// WatcherConfig describes one monitored directory and where its entries go.
+type WatcherConfig struct {
+	Name        string `toml:"name,omitempty"`
+	Enabled     *bool  `toml:"enabled"`
 	AppPath     string `toml:"app_path"`
 	DesktopPath string `toml:"desktop_path"`
-	IconPath    string `toml:"icon_path"`
+	IconPath    string `toml:"icon_path,omitempty"`
 	Categories  string `toml:"categories"`
+	// AutoGrantExecutable sets the execute bit on AppImages that lack it
+	// instead of waiting for the user to do so.
+	AutoGrantExecutable bool `toml:"auto_grant_executable,omitempty"`
+	// IsolateData launches the AppImages with their own home directory
+	// below ~/.local/share/desktopimage/apps.
+	IsolateData bool `toml:"isolate_data,omitempty"`
+	// Terminal, Template, NameTemplate, Naming and NamePrefix shape the
+	// entries; see EntryDefaults for setting them for all watchers.
+	Terminal     *bool  `toml:"terminal,omitempty"`
+	Template     string `toml:"template,omitempty"`
+	NameTemplate string `toml:"name_template,omitempty"`
+	Naming       string `toml:"naming,omitempty"`
+	NamePrefix   string `toml:"name_prefix,omitempty"`
+	// Profiles restricts the watcher to running when one of these
+	// profiles is active.
+	Profiles []string `toml:"profiles,omitempty"`
+	// RequireMount makes the watcher wait for app_path to be mounted and
+	// pause while it isn't, for removable and network storage.
+	RequireMount bool `toml:"require_mount,omitempty"`
+	// OnUnmount is what happens to the entries of a require_mount watcher
+	// while app_path is unmounted: "hide" (the default), "remove" or "keep".
+	OnUnmount string `toml:"on_unmount,omitempty"`
+	// MountPattern replaces app_path with a glob such as /media/*/*/Apps.
+	// Every mounted directory matching it gets a require_mount watcher of
+	// its own, see mountedWatchers.
+	MountPattern string `toml:"mount_pattern,omitempty"`
+	// Symlinks is how symlinked AppImages are handled: "link" and "target"
+	// check that the link leads to an AppImage and point Exec at the link
+	// or its target, "ignore" skips them.
+	Symlinks string `toml:"symlinks,omitempty"`
+	// User is whose home directory a leading ~ of the paths stands for,
+	// for a daemon running as root on behalf of several users. For the
+	// top-level watcher it is the user the daemon switches to.
+	User string `toml:"user,omitempty"`
+	// MimeDefaults makes the entries the default applications for the
+	// MIME types they declare when they are written, see
+	// claimMimeDefaults.
+	MimeDefaults bool `toml:"mime_defaults,omitempty"`
+	// SchemeDefaults does so only for their x-scheme-handler types, so that
+	// links such as discord:// open in the AppImage.
+	SchemeDefaults bool `toml:"scheme_defaults,omitempty"`
+	// RequireSession makes the watcher run only while its user has a
+	// session, so that the homes of users who aren't logged in are left
+	// alone.
+	RequireSession bool `toml:"require_session,omitempty"`
+	// RefreshCommand replaces update-desktop-database for desktop_path,
+	// with %d standing for the directory, or is "none" to not refresh it.
+	RefreshCommand string `toml:"refresh_command,omitempty"`
+	// IconTheme installs the extracted icons into this icon theme, such as
+	// hicolor, so that entries refer to them by name. Its index.theme has
+	// to exist. IconScope picks the icons directory: "user" for
+	// ~/.local/share/icons (the default) or "system" for
+	// /usr/local/share/icons, unless IconDir names one.
+	IconTheme string `toml:"icon_theme,omitempty"`
+	IconScope string `toml:"icon_scope,omitempty"`
+	IconDir   string `toml:"icon_dir,omitempty"`
+	// RootApps is what the entries of AppImages that only work as root do,
+	// see needsRoot: "hide" sets NoDisplay (the default), "pkexec" runs
+	// them through pkexec with a polkit policy, "show" leaves them alone.
+	RootApps string `toml:"root_apps,omitempty"`
+	// ExecArgs are appended to the Exec line of every entry, quoted as
+	// needed; a % stands for itself rather than a field code.
+	ExecArgs []string `toml:"exec_args,omitempty"`
+}
+
+// label identifies the watcher in logs and state; it defaults to app_path.
+func (w WatcherConfig) label() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	return w.AppPath
+}
+
+// appFile returns the AppImage watched by a watcher whose app_path names a
+// single file, ending in .AppImage, rather than a directory, or "".
+func (w WatcherConfig) appFile() string {
+	if strings.HasSuffix(w.AppPath, ".AppImage") {
+		return filepath.Clean(w.AppPath)
+	}
+	return ""
+}
+
+// appDir returns the directory w watches: app_path, or the one holding it
+// when it is a single AppImage.
+func (w WatcherConfig) appDir() string {
+	if file := w.appFile(); file != "" {
+		return filepath.Dir(file)
+	}
+	return w.AppPath
+}
+
+// watches reports whether the AppImage at path belongs to w.
+func (w WatcherConfig) watches(path string) bool {
+	if file := w.appFile(); file != "" {
+		return filepath.Clean(path) == file
+	}
+	return strings.HasSuffix(path, ".AppImage") && filepath.Dir(path) == filepath.Clean(w.AppPath)
+}
+
+func (w WatcherConfig) enabled() bool {
+	return w.Enabled == nil || *w.Enabled
+}
+
+func (w WatcherConfig) logger() *logrus.Entry {
+	return log.WithField("watcher", w.label())
+}
+
+type Config struct {
+	// The top-level watcher keys predate [[Watcher]] blocks and are still
+	// honoured as an additional watcher.
+	WatcherConfig
+	ScanWorkers        int                  `toml:"scan_workers"`
+	RefreshDelay       time.Duration        `toml:"refresh_delay"`
+	RefreshMaxDelay    time.Duration        `toml:"refresh_max_delay"`
+	MaxIntegrationRate float64              `toml:"max_integration_rate"`
+	IntegrationBurst   int                  `toml:"integration_burst"`
+	SettleDelay        time.Duration        `toml:"settle_delay"`
+	RemovalGrace       time.Duration        `toml:"removal_grace"`
+	PausePolicy        string               `toml:"pause_policy"`
+	Nice               int                  `toml:"nice"`
+	IOClass            string               `toml:"io_class"`
+	DataDir            string               `toml:"data_dir"`
+	ExtractIcons       *bool                `toml:"extract_icons"`
+	MaxExtractions     int                  `toml:"max_extractions"`
+	MaxExtractMB       int64                `toml:"max_extract_mb"`
+	ExtractTimeout     time.Duration        `toml:"extract_timeout"`
+	MaxHashMB          int64                `toml:"max_hash_mb"`
+	ChangeDetection    string               `toml:"change_detection"`
+	ControlSocket      string               `toml:"control_socket"`
+	SentryDSN          string               `toml:"sentry_dsn"`
+	StatusFile         string               `toml:"status_file"`
+	StatusInterval     time.Duration        `toml:"status_interval"`
+	ContainerExec      string               `toml:"container_exec"`
+	ContainerName      string               `toml:"container_name"`
+	User               string               `toml:"user"`
+	ExtractUser        string               `toml:"extract_user"`
+	SandboxExtraction  *bool                `toml:"sandbox_extraction"`
+	QuarantineDir      string               `toml:"quarantine_dir"`
+	PolkitDir          string               `toml:"polkit_dir"`
+	Elevate            string               `toml:"elevate"`
+	LogLevel           string               `toml:"log_level"`
+	LogFormat          string               `toml:"log_format"`
+	TraceEvents        bool                 `toml:"trace_events"`
+	DetectDuplicates   bool                 `toml:"detect_duplicates"`
+	DuplicateOrder     []string             `toml:"duplicate_order"`
+	Notify             bool                 `toml:"notify"`
+	UpdateSchedule     string               `toml:"update_schedule"`
+	UpdateJitter       time.Duration        `toml:"update_jitter"`
+	UpdateOnMetered    bool                 `toml:"update_on_metered"`
+	AutoUpdate         bool                 `toml:"auto_update"`
+	UseDefaultWatchers bool                 `toml:"use_default_watchers"`
+	AuditMode          bool                 `toml:"audit_mode"`
+	Profile            string               `toml:"profile"`
+	Apps               map[string]AppConfig `toml:"App"`
+	Quirks             []Quirk              `toml:"Quirk"`
+	Defaults           EntryDefaults        `toml:"defaults"`
+	Resolvers          ResolverConfig       `toml:"resolvers"`
+	Watchers           []WatcherConfig      `toml:"Watcher"`
+}
+
+// watchers returns every watcher configured, including the top-level one.
+func (c Config) watchers() []WatcherConfig {
+	var watchers []WatcherConfig
+	if c.AppPath != "" || c.DesktopPath != "" {
+		watchers = append(watchers, c.WatcherConfig.withDefaults(c.Defaults).withHome())
+	}
+	for _, w := range c.Watchers {
+		if w.MountPattern != "" {
+			watchers = append(watchers, w.withDefaults(c.Defaults).withHome().mountedWatchers()...)
+			continue
+		}
+		watchers = append(watchers, w.withDefaults(c.Defaults).withHome())
+	}
+	if !c.UseDefaultWatchers {
+		return watchers
+	}
+
+	// A configured watcher takes precedence over a default one for the same
+	// directory or name.
+	taken := make(map[string]bool)
+	for _, w := range watchers {
+		taken[filepath.Clean(w.AppPath)] = true
+		taken[w.label()] = true
+	}
+	for _, w := range defaultWatchers() {
+		if !taken[w.AppPath] && !taken[w.Name] {
+			watchers = append(watchers, w)
+		}
+	}
+	return watchers
+}
+
+// defaultWatchers returns the built-in profile enabled by
+// use_default_watchers: ~/Applications and ~/Downloads of the user running
+// the daemon, and /opt/appimages system-wide. Directories that don't exist
+// are left out.
+func defaultWatchers() []WatcherConfig {
+	var watchers []WatcherConfig
+	if home, err := os.UserHomeDir(); err == nil {
+		userEntries := filepath.Join(home, ".local", "share", "applications")
+		watchers = append(watchers,
+			WatcherConfig{Name: "applications", AppPath: filepath.Join(home, "Applications"), DesktopPath: userEntries, Categories: "Application"},
+			WatcherConfig{Name: "downloads", AppPath: filepath.Join(home, "Downloads"), DesktopPath: userEntries, Categories: "Application"},
+		)
+	}
+	watchers = append(watchers,
+		WatcherConfig{Name: "opt", AppPath: "/opt/appimages", DesktopPath: "/usr/local/share/applications", Categories: "Application"},
+	)
+
+	var existing []WatcherConfig
+	for _, w := range watchers {
+		if info, err := os.Stat(w.AppPath); err == nil && info.IsDir() {
+			existing = append(existing, w)
+		}
+	}
+	return existing
+}
+
+func (c Config) settleDelay() time.Duration {
+	if c.SettleDelay > 0 {
+		return c.SettleDelay
+	}
+	return defaultSettleDelay
+}
+
+func (c Config) dataDir() string {
+	if c.DataDir != "" {
+		return c.DataDir
+	}
+	return defaultDataDir
+}
+
+func (c Config) iconDir() string {
+	return filepath.Join(c.dataDir(), "icons")
+}
+
+func (c Config) metainfoDir() string {
+	return filepath.Join(c.dataDir(), "metainfo")
+}
+
+func (c Config) controlSocket() string {
+	if c.ControlSocket != "" {
+		return c.ControlSocket
+	}
+	return defaultControlSocket
+}
+
+func (c Config) refreshDelay() time.Duration {
+	if c.RefreshDelay > 0 {
+		return c.RefreshDelay
+	}
+	return defaultRefreshDelay
+}
+
+func (c Config) refreshMaxDelay() time.Duration {
+	if c.RefreshMaxDelay > 0 {
+		return c.RefreshMaxDelay
+	}
+	return defaultRefreshMaxDelay
 }
 
 var (
@@ -33,9 +307,9 @@ var (
 )
 
 func ensureConfigDirectoryExists(configDirPath string) error {
-	if _, err := os.Stat(configDirPath); os.IsNotExist(err) {
+	if _, err := fsys.Stat(configDirPath); os.IsNotExist(err) {
 		log.Warnf("Configuration directory %s does not exist. Creating it.", configDirPath)
-		if err := os.MkdirAll(configDirPath, 0755); err != nil {
+		if err := fsys.MkdirAll(configDirPath, 0755); err != nil {
 			return fmt.Errorf("failed to create configuration directory: %w", err)
 		}
 		log.Infof("Configuration directory created at %s.", configDirPath)
@@ -48,12 +322,232 @@ func createDefaultConfig(configFilePath string) error {
 # desktop_path = "/path/to/desktop_directory"
 # icon_path = "/path/to/icon.png"
 # categories = "Application"
+# auto_grant_executable = false # make AppImages executable instead of waiting for chmod +x
+# scan_workers = 4 # defaults to the number of CPUs
+# refresh_delay = "500ms" # the database of a desktop_path is updated once it had no changes for this long
+# refresh_max_delay = "30s" # but no later than this after the first change
+# max_integration_rate = 10 # AppImages extracted per second once a burst is used up
+# integration_burst = 30 # AppImages extracted without delay
+# settle_delay = "1s" # AppImages are integrated once no writes happened for this long
+# removal_grace = "0s" # keep the entries of vanished AppImages this long in case they come back
+# pause_policy = "queue" # what "watcher pause" does with events: "queue" handles them on resume, "drop" rescans instead
+# nice = 10 # scans and external commands run with this CPU niceness (0-19)
+# io_class = "idle" # and this IO scheduling class ("best-effort" or "idle")
+# data_dir = "/var/lib/desktopimage" # extracted icons are stored here
+# extract_icons = true # use the icon embedded in each AppImage (requires unsquashfs)
+# max_extractions = 2 # AppImages extracted at the same time
+# max_extract_mb = 16 # AppImages whose icon and desktop files add up to more are not extracted
+# extract_timeout = "30s" # extractions taking longer are aborted
+# change_detection = "mtime" # how rescans notice replaced AppImages: "mtime", "hash" or "off"
+# max_hash_mb = 4096 # larger AppImages are compared by mtime in hash mode
+# control_socket = "/run/desktopimage/control.sock" # used by the desktopimage CLI
+# profile = "home" # only run the watchers without profiles and those listing this one
+# use_default_watchers = false # also watch ~/Applications, ~/Downloads and /opt/appimages
+# audit_mode = false # only log what would be integrated or removed, never write anything
+# log_level = "info" # "trace", "debug", "warn" or "error", applied on reload without restarting the watchers
+# log_format = "text" # or "json" for one JSON object per line
+# trace_events = false # log every file system event the watchers get and keep the latest for "desktopimage watcher trace"
+# sentry_dsn = "https://key@sentry.example.com/1" # report panics and AppImages that repeatedly fail to integrate
+# status_file = "/run/desktopimage/status.json" # watcher states for monitoring agents
+# status_interval = "30s" # how often status_file is rewritten
+# container_exec = "off" # "auto", "distrobox" or "flatpak-spawn" to launch entries from the host when running in a container
+# container_name = "" # distrobox container to launch AppImages in, detected when running inside it
+# user = "desktopimage" # when started as root, switch to this user once the control socket is open
+# extract_user = "nobody" # when running as root, unpack AppImages as this user
+# sandbox_extraction = true # confine unsquashfs with Landlock to the AppImage and a scratch directory
+# quarantine_dir = "/var/lib/desktopimage/quarantine" # move AppImages failing validation here instead of integrating them
+# polkit_dir = "/usr/share/polkit-1/actions" # where the policies of root_apps = "pkexec" are written
+# elevate = "off" # "pkexec" to ask for permission to change entries in /usr/share/applications, or "writer" to keep a process as root for it
+# detect_duplicates = false # integrate AppImages with the same SHA-256 in several places only once
+# duplicate_order = ["opt", "applications"] # watchers whose copy is preferred, in order
+# notify = false # show a notification with a "Launch now" action when an AppImage is added
+# update_schedule = "" # check AppImages for updates when this crontab schedule matches, such as "0 9 * * *" or "@daily"
+# update_jitter = "30m" # delay each check by a random time up to this, so machines don't all check at once
+# update_on_metered = false # also check when NetworkManager says the connection is metered
+# auto_update = false # download the updates found and replace the AppImages with them
+#
+# Further directories can be watched with additional blocks:
+# [[Watcher]]
+# name = "downloads" # label used in logs and by "desktopimage watcher", defaults to app_path
+# enabled = true # set to false to keep the block but not watch it
+# app_path = "/path/to/other_app_directory"
+# desktop_path = "/path/to/desktop_directory"
+# categories = "Application"
+# isolate_data = false # give each AppImage its own home in ~/.local/share/desktopimage/apps/<name>
+# user = "alice" # whose home a leading ~ in the paths of this block stands for, such as "~/Applications"
+# require_session = false # only watch while that user is logged in
+# refresh_command = "xdg-desktop-menu forceupdate" # run instead of "update-desktop-database %d", or "none"
+# icon_theme = "hicolor" # install the extracted icons into this icon theme instead of referring to them by path
+# icon_scope = "user" # into ~/.local/share/icons, or "system" for /usr/local/share/icons
+# icon_dir = "/usr/share/icons" # or into this icons directory
+# exec_args = ["--ozone-platform-hint=auto"] # appended to the Exec line of the entries
+# root_apps = "hide" # entries of AppImages that need root: "hide", "pkexec" to ask for a password, or "show"
+# mime_defaults = false # make new entries the default applications for the file types they declare
+# scheme_defaults = false # make them the default handlers of the URL schemes they declare, such as discord://
+# symlinks = "link" # check symlinked AppImages and start the "link" or its "target", or "ignore" them
+# profiles = ["work"] # only run when one of these profiles is active
+# require_mount = false # wait for app_path to be mounted and pause while it isn't
+# on_unmount = "hide" # what to do with the entries while it isn't: "hide", "remove" or "keep"
+#
+# A block with mount_pattern instead of app_path attaches a watcher to every
+# drive mounted at a matching directory:
+#
+# [[Watcher]]
+# name = "usb"
+# mount_pattern = "/media/*/*/Apps"
+# desktop_path = "/home/user/.local/share/applications"
+# categories = "Application"
+#
+# Blocks can also be put into conf.d/*.toml next to this file, which is where
+# "desktopimage watcher add" writes them.
+#
+# Settings shared by all watchers can be put into [defaults] instead of
+# repeating them in every block, which can still override them:
+# [defaults]
+# categories = "Application"
+# icon_path = "/path/to/icon.png"
+# terminal = false # set Terminal=true in the entries
+# template = "/etc/desktopimage/entry.tmpl" # text/template rendering the entries instead of the built-in format
+# name_template = "{{.Name}} (AppImage)" # the name shown in the menu, {{.Version}} is the AppImage's version
+# naming = "transliterate" # or "lowercase" for lower-case .desktop file names without spaces
+# name_prefix = "appimage-" # prepended to the .desktop file names
+# refresh_command = "update-desktop-database %d" # how desktop directories are refreshed, %d is the directory
+# icon_theme = "hicolor" # the icon theme, icon_scope and icon_dir of every watcher
+#
+# Single AppImages can be configured by their name without .AppImage:
+# [App.Example]
+# display = "x11" # launch on XWayland, or "wayland" for native Wayland
+# updates = "none" # never update it, or a release channel such as "latest-pre" to follow instead
+# quirks = false # leave out the fixes known for it
+# mime_defaults = true # make it the default application for its file types, overriding the watcher
+# scheme_defaults = true # make it the default handler of its URL schemes, overriding the watcher
+# exec_args = ["--disable-gpu"] # appended to its Exec line, after those of the watcher
+# requires_root = true # it only works as root, whether its desktop file says so or not
+#
+# Known fixes for some apps are applied to their entries automatically, and
+# more can be added, matching the AppImage names:
+# [[Quirk]]
+# match = "myapp*" # glob against the name without .AppImage, ignoring case
+# args = ["--no-sandbox"] # appended to the Exec line
+# startup_wm_class = "MyApp" # the window class, so that docks group the windows with the entry
+# when = "userns_restricted" # only where unprivileged user namespaces are restricted
+# split_entries = true # an entry for each app it bundles, as for LibreOffice
+#
+# Where entries take their Name, Icon and Categories from, first stage
+# first: "filename", the embedded "desktop" file, its "appstream" metadata,
+# the online "catalog" of AppImageHub, the "snapshot" of it built in, or the
+# watcher's "config", and a "stock" icon for their category. Stages left
+# out are not asked.
+# [resolvers]
+# name = ["filename"]
+# icon = ["desktop", "config", "stock"]
+# categories = ["config"]
+# catalog_url = "https://appimage.github.io/feed.json"
 `
-	return os.WriteFile(configFilePath, []byte(defaultConfig), 0644)
+	return fsys.WriteFile(configFilePath, []byte(defaultConfig), 0644)
+}
+
+func isWatcherValid(w WatcherConfig) bool {
+	return w.AppPath != "" && w.DesktopPath != "" && w.Categories != ""
 }
 
 func isConfigValid(cfg Config) bool {
-	return cfg.AppPath != "" && cfg.DesktopPath != "" && cfg.Categories != ""
+	watchers := cfg.watchers()
+	if len(watchers) == 0 && len(cfg.mountTemplates()) == 0 {
+		return false
+	}
+	labels := make(map[string]bool)
+	for _, w := range watchers {
+		if !isWatcherValid(w) {
+			return false
+		}
+		if labels[w.label()] {
+			log.Warnf("Several watchers are labelled %q, give them distinct names.", w.label())
+		}
+		labels[w.label()] = true
+	}
+	return true
+}
+
+// configDropInDir returns the directory holding drop-in files next to
+// configFilePath. Each *.toml file in it may add [[Watcher]] blocks; other
+// settings are only read from the main file.
+func configDropInDir(configFilePath string) string {
+	return filepath.Join(filepath.Dir(configFilePath), "conf.d")
+}
+
+type dropInConfig struct {
+	Watchers []WatcherConfig `toml:"Watcher"`
+}
+
+func readConfig(configFilePath string) (Config, error) {
+	var cfg Config
+	content, err := fsys.ReadFile(configFilePath)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := toml.Unmarshal(content, &cfg); err != nil {
+		return cfg, classify(errInvalidConfig, fmt.Errorf("failed to parse config file: %w", err))
+	}
+
+	dropIns, err := fsys.Glob(filepath.Join(configDropInDir(configFilePath), "*.toml"))
+	if err != nil {
+		return cfg, err
+	}
+	sort.Strings(dropIns)
+	for _, path := range dropIns {
+		dropIn, err := readDropIn(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Watchers = append(cfg.Watchers, dropIn.Watchers...)
+	}
+	return cfg, nil
+}
+
+func readDropIn(path string) (dropInConfig, error) {
+	var dropIn dropInConfig
+	content, err := fsys.ReadFile(path)
+	if err != nil {
+		return dropIn, fmt.Errorf("failed to read drop-in config file: %w", err)
+	}
+	if err := toml.Unmarshal(content, &dropIn); err != nil {
+		return dropIn, classify(errInvalidConfig, fmt.Errorf("failed to parse drop-in config file %s: %w", path, err))
+	}
+	return dropIn, nil
+}
+
+// validateConfig checks the settings of cfg without applying them.
+func validateConfig(cfg Config) error {
+	for _, validate := range []func(Config) error{
+		validatePriority,
+		validateErrorReporting,
+		validateContainerExec,
+		validateApps,
+		validateQuirks,
+		validateResolvers,
+		validateNaming,
+		validateRefreshCommands,
+		validateIconThemes,
+		validateRootApps,
+		validateElevation,
+		validateLogging,
+		validateMountPatterns,
+		validateOnUnmount,
+		validateHomes,
+		validateSessions,
+		validatePausePolicy,
+		validateSymlinks,
+		validateDuplicates,
+		validateTemplates,
+		validateUpdates,
+	} {
+		if err := validate(cfg); err != nil {
+			return err
+		}
+	}
+	return validateProfile(cfg, activeProfile(cfg))
 }
 
 func loadConfig(configFilePath string) error {
@@ -62,7 +556,7 @@ func loadConfig(configFilePath string) error {
 		return err
 	}
 
-	if _, err := os.Stat(configFilePath); os.IsNotExist(err) {
+	if _, err := fsys.Stat(configFilePath); os.IsNotExist(err) {
 		log.Warnf("Configuration file %s does not exist. Creating default template.", configFilePath)
 		if err := createDefaultConfig(configFilePath); err != nil {
 			return fmt.Errorf("failed to create default config file: %w", err)
@@ -70,173 +564,503 @@ func loadConfig(configFilePath string) error {
 		log.Infof("Default configuration template created at %s. Please edit and uncomment required fields.", configFilePath)
 	}
 
-	content, err := os.ReadFile(configFilePath)
+	cfg, err := readConfig(configFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+		return err
 	}
-
-	err = toml.Unmarshal(content, &config)
-	if err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+	if err := validateConfig(cfg); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidConfig, err)
 	}
+	if err := configureErrorReporting(cfg); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+	if err := configureTemplates(cfg); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidConfig, err)
+	}
+	config = cfg
+	if err := configureState(cfg); err != nil {
+		return err
+	}
+	configureJournal(cfg)
+	configureFailures(cfg)
+	configureReconcileReports(cfg)
+	configureThrottle(cfg)
+	setPriority(priority{nice: cfg.Nice, ioClass: cfg.IOClass})
+	configureExtraction(cfg)
+	configureAudit(cfg)
+	configureMaintenance(cfg)
+	configureContainer(cfg)
+	configureQuarantine(cfg)
+	configureNotify(cfg)
+	configureDuplicates(cfg)
+	configureApps(cfg)
+	configureQuirks(cfg)
+	configureResolvers(cfg)
+	configureRefreshCommands(cfg)
+	configureRootApps(cfg)
+	configureElevation(cfg)
 
 	if !isConfigValid(config) {
 		log.Warn("Configuration file is incomplete or invalid. Waiting for user to update it.")
 		return nil
 	}
+	for _, warning := range lintConfig(config) {
+		log.Warnf("Configuration: %s.", warning)
+	}
 
-	log.Infof("Configuration successfully loaded from %s. with config content = %+v", configFilePath, config)
+	log.Infof("Configuration successfully loaded from %s.", configFilePath)
 	return nil
 }
 
-func watchConfigFile(ctx context.Context, configFilePath string, reloadConfig chan bool) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatalf("Error initializing config file watcher: %v", err)
+// checkEnvironment makes sure the XDG desktop utilities are available. Any
+// system providing them is supported, and update-desktop-database isn't
+// needed when every watcher of cfg sets a refresh_command.
+func checkEnvironment(cfg Config) {
+	if !usesDefaultRefresh(cfg) {
+		log.Infof("Environment check passed: %s system, desktop databases are refreshed with refresh_command.", runtime.GOOS)
+		return
 	}
-	defer watcher.Close()
-
-	if err := watcher.Add(filepath.Dir(configFilePath)); err != nil {
-		log.Fatalf("Error adding config directory to watcher: %v", err)
-	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Info("Stopping config file watcher.")
+	if _, err := exec.LookPath("update-desktop-database"); err != nil {
+		if kind, _ := detectContainer(); kind != "" {
+			// With container_exec the host's copy is used instead.
+			log.Warnf("update-desktop-database is not installed in this %s container, set container_exec to run it on the host.", kind)
 			return
-		case event := <-watcher.Events:
-			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 && filepath.Base(event.Name) == filepath.Base(configFilePath) {
-				log.Infof("Configuration file %s changed, reloading...", configFilePath)
-				reloadConfig <- true
-			}
-		case err := <-watcher.Errors:
-			log.Errorf("Config watcher error: %v", err)
 		}
+		exitWith(errEnvironment, "Required desktop utility 'update-desktop-database' is not installed or not in PATH.")
 	}
-}
 
-func checkEnvironment() {
-	if runtime.GOOS != "linux" {
-		log.Fatalf("Unsupported operating system: %s. This program can only run on Linux.", runtime.GOOS)
-	}
-
-	if _, err := exec.LookPath("update-desktop-database"); err != nil {
-		log.Fatalf("Required desktop utility 'update-desktop-database' is not installed or not in PATH.")
-	}
-
-	log.Info("Environment check passed: Linux system with desktop utilities available.")
+	log.Infof("Environment check passed: %s system with desktop utilities available.", runtime.GOOS)
 }
 
 func main() {
 	log.Out = os.Stdout
 	log.SetFormatter(&logrus.TextFormatter{DisableColors: false, FullTimestamp: true})
 
-	checkEnvironment()
+	if profile, ok := daemonProfileArg(os.Args[1:]); ok {
+		setProfileOverride(profile)
+	} else if len(os.Args) > 1 {
+		log.Out = os.Stderr
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	startupConfig, _ := readConfig(configFilePath)
+	checkEnvironment(startupConfig)
+	defer reportPanics()
+	log.AddHook(errorTracker{})
 
-	reloadConfig := make(chan bool)
 	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+		<-sigs
+		log.Info("Shutdown signal received.")
+		cancel()
+	}()
+	if err := runDaemon(ctx, configFilePath); err != nil {
+		exitWith(err, "Error starting daemon: %v", err)
+	}
+	log.Info("All tasks stopped. Exiting.")
+}
+
+// runDaemon loads the configuration at configFilePath and runs the watchers
+// it describes, reloading it as it changes, until ctx is done.
+func runDaemon(ctx context.Context, configFilePath string) error {
+	// The lock is taken before loading the configuration opens the state and
+	// journal in the data directory. A reload moving data_dir keeps it on
+	// the first one.
+	lock, err := lockDataDir(startupDataDir(configFilePath))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	reloadConfig := make(chan bool)
+	ctx, cancel := context.WithCancel(ctx)
 	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
 
 	// Start watching config file
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer reportPanics()
 		watchConfigFile(ctx, configFilePath, reloadConfig)
 	}()
 
 	if err := loadConfig(configFilePath); err != nil {
-		log.Fatalf("Error loading configuration: %v", err)
+		return fmt.Errorf("failed to load configuration: %w", err)
 	}
+	// Later changes are applied by applyLogging.
+	configureLogging(config)
+	printStartupBanner(config)
 
-	log.Info("Starting AppImage watcher...")
+	log.Info("Starting AppImage watchers...")
 
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatalf("Error initializing file watcher: %v", err)
+	controlCalls := make(chan controlCall)
+	if listener, err := listenControl(config.controlSocket()); err != nil {
+		log.Errorf("Error listening on control socket %s: %v", config.controlSocket(), err)
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer reportPanics()
+			serveControl(ctx, listener, controlCalls)
+		}()
 	}
-	defer watcher.Close()
 
-	if config.AppPath != "" {
-		if err := watcher.Add(config.AppPath); err != nil {
-			log.Fatalf("Error adding app directory to watcher: %v", err)
-		}
+	// Before dropping privileges, as it keeps them.
+	if err := startPrivilegedWriter(config); err != nil {
+		log.Errorf("Error starting privileged writer, entries in system directories won't be elevated: %v", err)
+	}
+	if err := dropPrivileges(config); err != nil {
+		return fmt.Errorf("failed to drop privileges: %w", err)
 	}
 
+	refresher := newDBRefresher(config.refreshDelay(), config.refreshMaxDelay())
+	recoverIntegrations(refresher)
+	confs := newConfManager(configFilePath)
+	confs.Reloaded(config)
+	confs.AddSyncCallbacks(applyLogging)
+	confs.AddSyncCallbacks(func(change ConfigChange) {
+		refresher.setDelay(change.New.refreshDelay(), change.New.refreshMaxDelay())
+	})
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer reportPanics()
+		watchers := startWatchers(ctx, config, refresher)
+		// Called by Reloaded below, in this goroutine.
+		confs.AddSyncCallbacks(watchers.apply)
+		statusTicker := time.NewTicker(config.statusInterval())
+		defer statusTicker.Stop()
+		mountTicker := time.NewTicker(mountPollInterval)
+		defer mountTicker.Stop()
+		updateTimer := time.NewTimer(0)
+		defer updateTimer.Stop()
+		scheduleUpdates := func() {
+			if !updateTimer.Stop() {
+				select {
+				case <-updateTimer.C:
+				default:
+				}
+			}
+			if d, ok := nextUpdateCheck(config, time.Now()); ok {
+				updateTimer.Reset(d)
+			}
+		}
+		scheduleUpdates()
+		updateStatus := func() {
+			if err := writeStatus(config.statusFile(), watchers); err != nil {
+				log.Errorf("Error writing status file: %v", err)
+			}
+		}
+		updateStatus()
+		reload := func() error {
+			if err := loadConfig(configFilePath); err != nil {
+				return err
+			}
+			log.Info("Configuration reloaded successfully.")
+			confs.Reloaded(config)
+			statusTicker.Reset(config.statusInterval())
+			scheduleUpdates()
+			return nil
+		}
 		for {
 			select {
 			case <-ctx.Done():
-				log.Info("Stopping AppImage watcher.")
+				watchers.close()
 				return
-			case event := <-watcher.Events:
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					if strings.HasSuffix(event.Name, ".AppImage") {
-						appName := strings.TrimSuffix(filepath.Base(event.Name), ".AppImage")
-						desktopFilePath := filepath.Join(config.DesktopPath, appName+".desktop")
-						if err := createDesktopFile(appName, desktopFilePath); err != nil {
-							log.Errorf("Error creating .desktop file for %s: %v", appName, err)
-						} else {
-							log.Infof("Created .desktop file for %s", appName)
-							updateDesktopDatabase()
-						}
-					}
-				} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
-					if strings.HasSuffix(event.Name, ".AppImage") {
-						appName := strings.TrimSuffix(filepath.Base(event.Name), ".AppImage")
-						desktopFilePath := filepath.Join(config.DesktopPath, appName+".desktop")
-						if err := os.Remove(desktopFilePath); err != nil {
-							log.Errorf("Error removing .desktop file for %s: %v", appName, err)
-						} else {
-							log.Infof("Removed .desktop file for %s", appName)
-							updateDesktopDatabase()
-						}
-					}
-				}
 			case <-reloadConfig:
-				if err := loadConfig(configFilePath); err != nil {
+				if err := reload(); err != nil {
 					log.Errorf("Error reloading configuration: %v", err)
-				} else {
-					log.Info("Configuration reloaded successfully.")
-					if err := watcher.Add(config.AppPath); err != nil {
-						log.Errorf("Error adding new app directory to watcher: %v", err)
-					}
 				}
+			case call := <-controlCalls:
+				call.reply <- handleControl(call.req, watchers, configFilePath, reload)
+			case <-statusTicker.C:
+				updateStatus()
+			case <-mountTicker.C:
+				watchers.attachMounts()
+			case <-updateTimer.C:
+				wg.Add(1)
+				go func(cfg Config) {
+					defer wg.Done()
+					defer reportPanics()
+					runUpdateChecks(ctx, cfg)
+				}(config)
+				scheduleUpdates()
 			}
 		}
 	}()
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
-	<-sigs
-	log.Info("Shutdown signal received.")
-	cancel()
+	<-ctx.Done()
 	wg.Wait()
-	log.Info("All tasks stopped. Exiting.")
+	confs.WaitCallbacks()
+	refresher.flush()
+	flushState(currentState())
+	return nil
+}
+
+// startupDataDir returns the data directory configured in configFilePath,
+// or the default one when it can't be read, in which case loading it fails
+// anyway or writes the default template.
+func startupDataDir(configFilePath string) string {
+	cfg, _ := readConfig(configFilePath)
+	return cfg.dataDir()
 }
 
-func createDesktopFile(appName, desktopFilePath string) error {
+// createDesktopFile renders the entry for the AppImage at appImagePath and
+// writes it to desktopFilePath, reporting whether the file on disk changed.
+// The icon embedded in the AppImage is preferred over the configured one and
+// extracted again when sourceChanged is set.
+func createDesktopFile(ctx context.Context, w WatcherConfig, appImagePath, desktopFilePath, sum string, sourceChanged bool) (bool, error) {
+	icon := ""
+	failures := currentFailures()
+	key := contentKey(appImagePath, sum)
+	if f, ok := failures.backingOff(key); ok && f.Class.permanent() {
+		w.logger().Debugf("Not extracting the icon of %s, it is %s: %s", appImagePath, f.Class.reason(), f.Error)
+	} else if ok {
+		w.logger().Debugf("Not extracting the icon of %s before %s, it failed %d time(s) (%s): %s", appImagePath, f.RetryAt.Format(time.RFC3339), f.Failures, f.Class, f.Error)
+	} else if extracted, err := extractIcon(ctx, appImagePath, sourceChanged); ctx.Err() != nil {
+		return false, ctx.Err()
+	} else if errors.Is(err, errRejected) && currentQuarantine() != "" {
+		return false, err
+	} else if err != nil {
+		if class, retry := failures.failed(w, appImagePath, key, err); class.permanent() {
+			w.logger().Warnf("Could not extract icon from %s (%s), not trying again until it changes: %v", appImagePath, class, err)
+		} else {
+			w.logger().Warnf("Could not extract icon from %s (%s), trying again in %s: %v", appImagePath, class, retry, err)
+		}
+	} else {
+		failures.succeeded(appImagePath, key)
+		icon = extracted
+	}
+	switch rootHandling(w, appNameFromPath(appImagePath)) {
+	case rootAppsHide:
+		w.logger().Debugf("Hiding the entry of %s, which only works as root; root_apps = %q launches it through pkexec", appImagePath, rootAppsPkexec)
+	case rootAppsPkexec:
+		if !auditMode() {
+			if err := installPolkitPolicy(execPath(w, appImagePath)); err != nil {
+				w.logger().Warnf("Could not install the polkit policy of %s, pkexec may not keep its display: %v", appImagePath, err)
+			}
+		}
+	}
+	if icon != "" && w.IconTheme != "" {
+		if themed, err := installThemeIcon(w, icon, desktopFilePath); err != nil {
+			w.logger().Warnf("Could not install the icon of %s into icon theme %s, referring to it by path: %v", appImagePath, w.IconTheme, err)
+		} else {
+			icon = themed
+		}
+	}
+	opts, _ := currentExtraction()
+	appName := appNameFromPath(appImagePath)
+	content, err := renderDesktopEntry(ctx, w, appName, icon, sum, extractedAppStream(opts.metainfoDir, appName))
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	if auditMode() {
+		changed = !desktopFileCurrent(desktopFilePath, content)
+	} else if changed, err = writeDesktopFile(desktopFilePath, content); err != nil {
+		return false, err
+	}
+	splitChanged, err := writeSplitEntries(ctx, w, appImagePath, desktopFilePath, icon, sum)
+	return changed || splitChanged, err
+}
+
+// renderDesktopEntry returns the entry for the AppImage named appName, whose
+// SHA-256 is sum, using the watcher's template when it has one. Cancelling
+// ctx stops the downloads of the catalog stage.
+func renderDesktopEntry(ctx context.Context, w WatcherConfig, appName, icon, sum string, info appStreamInfo) (string, error) {
+	data, err := desktopEntryData(ctx, w, appName, icon, sum, info)
+	if err != nil {
+		return "", err
+	}
+	return renderEntry(data, entryTemplate(w.Template))
+}
+
+// desktopEntryData returns what the entry for the AppImage named appName is
+// rendered from, with icon the one extracted from it. Its Name, Icon and
+// Categories come from the stages of the [resolvers] chains.
+func desktopEntryData(ctx context.Context, w WatcherConfig, appName, icon, sum string, info appStreamInfo) (entryTemplateData, error) {
+	appImagePath := w.appDir() + "/" + appName + ".AppImage"
+	payload := extractedPayload(appName)
+	meta := resolveMetadata(resolverInput{ctx: ctx, w: w, appName: appName, icon: icon, info: info, payload: payload})
+	name, err := entryName(w, meta.Name, info.version)
+	if err != nil {
+		return entryTemplateData{}, err
+	}
+	names := make(map[string]string, len(info.names))
+	for lang, translated := range info.names {
+		if names[lang], err = entryName(w, translated, info.version); err != nil {
+			return entryTemplateData{}, err
+		}
+	}
+	info.names = names
+	// A quirk knows better than the guess made from the payload.
+	wmClass := appQuirk(appName).StartupWMClass
+	if wmClass == "" && !quirksOff(appName) {
+		wmClass = payload.StartupWMClass
+	}
+	tryExec := ""
+	if currentContainer().wrapper == "" {
+		// Entries launched through a container wrapper are checked by the
+		// host, where the AppImage may be elsewhere or not exist.
+		tryExec = desktopString(execPath(w, appImagePath))
+	}
+	return entryTemplateData{
+		Name:           name,
+		Exec:           withFieldCode(execLine(w, appImagePath), payload.MimeTypes, payload.FieldCode),
+		TryExec:        tryExec,
+		Icon:           meta.Icon,
+		Categories:     meta.Categories,
+		Terminal:       w.Terminal != nil && *w.Terminal,
+		Localized:      info.localizedKeys(),
+		AppImage:       appImagePath,
+		Version:        info.version,
+		Hash:           sum,
+		StartupWMClass: desktopString(wmClass),
+		MimeType:       mimeTypeValue(payload.MimeTypes),
+		NoDisplay:      rootHandling(w, appName) == rootAppsHide,
+	}, nil
+}
+
+// entryFormatVersion is part of the fingerprint of every watcher. Bump it
+// whenever renderEntry or the data it gets changes what entries hold, so
+// that entries written by an older version are rewritten at startup even
+// though the journal shows nothing changed.
+const entryFormatVersion = 1
+
+// renderEntry renders data, whose values are escaped already, with t or in
+// the built-in format when t is nil. It depends on nothing else, so the
+// same AppImage and settings always give the same entry, byte for byte.
+func renderEntry(data entryTemplateData, t *template.Template) (string, error) {
+	if t != nil {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("failed to render entry template: %w", err)
+		}
+		return b.String(), nil
+	}
+
 	content := fmt.Sprintf(`[Desktop Entry]
 Type=Application
 Name=%s
-Exec=%s/%s
-Terminal=false
-Categories=%s
-`, appName, config.AppPath, appName+".AppImage", config.Categories)
+%sExec=%s
+`, data.Name, data.Localized, data.Exec)
+	if data.TryExec != "" {
+		// Desktops hide the entry while the AppImage is unavailable, for
+		// example on a network mount that is down.
+		content += fmt.Sprintf("TryExec=%s\n", data.TryExec)
+	}
+	content += fmt.Sprintf("Terminal=%t\nCategories=%s\n", data.Terminal, data.Categories)
+	if data.NoDisplay {
+		content += "NoDisplay=true\n"
+	}
+
+	if data.Icon != "" {
+		content += fmt.Sprintf("Icon=%s\n", data.Icon)
+	}
+	if data.StartupWMClass != "" {
+		content += fmt.Sprintf("StartupWMClass=%s\n", data.StartupWMClass)
+	}
+	if data.MimeType != "" {
+		content += fmt.Sprintf("MimeType=%s\n", data.MimeType)
+	}
+	// For other tools, which can tell from these what an entry was made for
+	// without the daemon's state.
+	if data.Version != "" {
+		content += fmt.Sprintf("X-AppImage-Version=%s\n", data.Version)
+	}
+	content += fmt.Sprintf("X-AppImage-Path=%s\n", desktopString(data.AppImage))
+	if data.Hash != "" {
+		content += fmt.Sprintf("X-DesktopImage-Hash=sha256:%s\n", data.Hash)
+	}
 
-	if config.IconPath != "" {
-		content += fmt.Sprintf("Icon=%s\n", config.IconPath)
+	return content, nil
+}
+
+// writeDesktopFile leaves desktopFilePath untouched when it already holds
+// content, so rescans don't churn mtimes and wake up other watchers.
+func writeDesktopFile(desktopFilePath, content string) (bool, error) {
+	if desktopFileCurrent(desktopFilePath, content) {
+		return false, nil
+	}
+	if err := fsys.MkdirAll(filepath.Dir(desktopFilePath), 0755); err != nil {
+		return false, fmt.Errorf("failed to create desktop directory: %w", err)
 	}
+	if err := replaceFile(desktopFilePath, []byte(content)); err != nil {
+		if !errors.Is(err, fs.ErrPermission) || !elevated(desktopFilePath) {
+			return false, err
+		}
+		if err := writeElevated(desktopFilePath, []byte(content), err); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
 
-	return os.WriteFile(desktopFilePath, []byte(content), 0644)
+// replaceFile writes content to a hidden temporary file next to path and
+// renames it over path, so a crash never leaves a truncated file behind. The
+// file is synced before the rename and its directory after it, so the
+// rename can't reach the disk before the content does.
+func replaceFile(path string, content []byte) error {
+	return replaceFileMode(path, content, 0644)
 }
 
-func updateDesktopDatabase() {
-	if err := exec.Command("update-desktop-database", config.DesktopPath).Run(); err != nil {
+// replaceFileMode is replaceFile creating the file with permissions perm.
+func replaceFileMode(path string, content []byte, perm os.FileMode) error {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s-%d-%d", filepath.Base(path), os.Getpid(), tmpSeq.Add(1)))
+	defer fsys.Remove(tmp)
+	// In case path is in a watched directory.
+	ownWrites.note(tmp, allOps)
+	ownWrites.note(path, fsnotify.Create|fsnotify.Write|fsnotify.Chmod)
+	// The name is predictable, so a symlink planted there must not be
+	// followed.
+	if err := fsys.WriteNewFile(tmp, content, perm); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		return err
+	}
+	return fsys.SyncDir(filepath.Dir(path))
+}
+
+// tmpSeq tells apart the temporary files of concurrent replaceFile calls.
+var tmpSeq atomic.Int64
+
+func desktopFileCurrent(desktopFilePath, content string) bool {
+	existing, err := fsys.ReadFile(desktopFilePath)
+	return err == nil && string(existing) == content
+}
+
+func updateDesktopDatabase(desktopPath string) {
+	if auditMode() {
+		log.Infof("Audit mode: would update the desktop database in %s", desktopPath)
+		return
+	}
+	args := refreshCommandFor(desktopPath)
+	if len(args) == 0 {
+		log.Debugf("Not refreshing the desktop database in %s, refresh_command is %q", desktopPath, refreshNone)
+		currentState().refreshed(desktopPath)
+		return
+	}
+	var err error
+	if refreshElevated(desktopPath) {
+		err = runElevated(nil, "refresh", filepath.Clean(desktopPath))
+	} else {
+		runLowPriority(func() {
+			err = desktopUtils.Run(args[0], args[1:]...)
+		})
+	}
+	if err != nil {
 		log.Errorf("Error updating desktop database: %v", err)
 	} else {
 		log.Info("Desktop database updated.")
 	}
+	// Retrying a failed run wouldn't help, so the integrations waiting for
+	// it are finished either way.
+	currentState().refreshed(desktopPath)
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maintenanceFileName marks the data directory while maintenance mode is on,
+// so that a daemon restarted during maintenance keeps it on.
+const maintenanceFileName = "maintenance"
+
+var (
+	maintenanceMu sync.Mutex
+	// maintenancePath is the marker in the data directory in use, and
+	// maintenanceSince when maintenance mode was switched on, zero while
+	// it is off.
+	maintenancePath  string
+	maintenanceSince time.Time
+)
+
+type maintenanceStatus struct {
+	Active bool      `json:"active"`
+	Since  time.Time `json:"since"`
+}
+
+// configureMaintenance picks up the maintenance marker of the data directory
+// of cfg when it changed.
+func configureMaintenance(cfg Config) {
+	path := filepath.Join(cfg.dataDir(), maintenanceFileName)
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	if path == maintenancePath {
+		return
+	}
+	maintenancePath = path
+	maintenanceSince = time.Time{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		maintenanceEnabled.Store(false)
+		return
+	}
+	since, err := time.Parse(time.RFC3339, string(content))
+	if err != nil {
+		since = time.Now()
+	}
+	maintenanceSince = since
+	maintenanceEnabled.Store(true)
+	log.Warnf("Maintenance mode is on since %s, changes are only logged until it ends.", since.Format(time.RFC3339))
+}
+
+// setMaintenance switches maintenance mode on or off, and reports whether
+// it changed. While it is on, nothing is written, as in audit mode.
+func setMaintenance(on bool) (bool, error) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	if on == maintenanceEnabled.Load() {
+		return false, nil
+	}
+	if on {
+		since := time.Now()
+		if maintenancePath != "" {
+			if err := os.MkdirAll(filepath.Dir(maintenancePath), 0755); err != nil {
+				return false, fmt.Errorf("failed to create data directory: %w", err)
+			}
+			if err := os.WriteFile(maintenancePath, []byte(since.Format(time.RFC3339)), 0644); err != nil {
+				return false, fmt.Errorf("failed to mark maintenance mode: %w", err)
+			}
+		}
+		maintenanceSince = since
+		maintenanceEnabled.Store(true)
+		log.Warn("Maintenance mode is on, changes are only logged until it ends.")
+		return true, nil
+	}
+	if maintenancePath != "" {
+		if err := os.Remove(maintenancePath); err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to end maintenance mode: %w", err)
+		}
+	}
+	log.Infof("Maintenance mode ended after %s.", time.Since(maintenanceSince).Round(time.Second))
+	maintenanceSince = time.Time{}
+	maintenanceEnabled.Store(false)
+	return true, nil
+}
+
+func currentMaintenance() maintenanceStatus {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	return maintenanceStatus{Active: maintenanceEnabled.Load(), Since: maintenanceSince}
+}
+
+// rescan asks every running watcher for a scan, which catches up with what
+// only was logged during maintenance.
+func (s *watcherSet) rescan(reason string) {
+	for _, rw := range s.running {
+		rw.aw.requestRescan(reason)
+	}
+}
+
+// requestRescan asks the watch to reconcile app_path once, giving reason.
+func (aw *appWatcher) requestRescan(reason string) {
+	aw.rescanMu.Lock()
+	aw.rescanReason = reason
+	aw.rescanMu.Unlock()
+	select {
+	case aw.rescanRequested <- struct{}{}:
+	default:
+		// Requested already.
+	}
+}
+
+func (aw *appWatcher) takeRescanReason() string {
+	aw.rescanMu.Lock()
+	defer aw.rescanMu.Unlock()
+	return aw.rescanReason
+}
+
+// runMaintenance handles "maintenance on|off", or shows whether it is on.
+func runMaintenance(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "maintenance: expected on, off or nothing")
+		return exitUsage
+	}
+	command := "get-maintenance"
+	if len(args) == 1 {
+		switch args[0] {
+		case "on":
+			command = "start-maintenance"
+		case "off":
+			command = "end-maintenance"
+		default:
+			fmt.Fprintf(os.Stderr, "maintenance: unknown argument %q, expected on or off\n", args[0])
+			return exitUsage
+		}
+	}
+	resp, err := sendControl(controlSocketPath(), controlRequest{Command: command})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "maintenance: %v\n", err)
+		return exitCode(err)
+	}
+	var status maintenanceStatus
+	if err := json.Unmarshal(resp.Data, &status); err != nil {
+		fmt.Fprintf(os.Stderr, "maintenance: %v\n", err)
+		return exitCode(err)
+	}
+	switch {
+	case status.Active:
+		fmt.Printf("Maintenance mode is on since %s; changes are only logged.\n", status.Since.Format(time.RFC3339))
+	case command == "end-maintenance":
+		fmt.Println("Maintenance mode is off, the watchers are rescanning.")
+	default:
+		fmt.Println("Maintenance mode is off.")
+	}
+	return 0
+}
+
+// handleMaintenance serves the maintenance commands of the control socket.
+// Ending maintenance rescans every watcher once.
+func handleMaintenance(command string, watchers *watcherSet) controlResponse {
+	var err error
+	switch command {
+	case "start-maintenance":
+		_, err = setMaintenance(true)
+	case "end-maintenance":
+		var changed bool
+		if changed, err = setMaintenance(false); changed {
+			watchers.rescan("maintenance ended")
+		}
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	return okResponse(currentMaintenance())
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fieldCodes are the Exec field codes through which apps receive the files
+// and URLs of the MIME types they declare.
+var fieldCodes = []string{"%U", "%u", "%F", "%f"}
+
+// schemeHandlerPrefix starts the MIME types of URL schemes, such as
+// x-scheme-handler/discord.
+const schemeHandlerPrefix = "x-scheme-handler/"
+
+// embeddedMimeTypes returns the MIME types desktopFile declares and the
+// field code its Exec line passes them with, "" when it has none. An entry
+// handling URL schemes without one gets %u, or it would never see the URL
+// it is opened for.
+func embeddedMimeTypes(desktopFile string) ([]string, string) {
+	var types []string
+	for _, t := range strings.Split(desktopEntryValue(desktopFile, "MimeType"), ";") {
+		if t = strings.TrimSpace(t); t != "" && !containsString(types, t) {
+			types = append(types, t)
+		}
+	}
+	code := ""
+	for _, field := range execFields(desktopEntryValue(desktopFile, "Exec")) {
+		if containsString(fieldCodes, field) {
+			code = field
+			break
+		}
+	}
+	if code == "" {
+		for _, t := range types {
+			if strings.HasPrefix(t, schemeHandlerPrefix) {
+				code = "%u"
+				break
+			}
+		}
+	}
+	return types, code
+}
+
+// rootMimeTypes returns the MIME types of the desktop file in the AppImage
+// root that declares some.
+func rootMimeTypes(root string) ([]string, string) {
+	desktopFiles, _ := filepath.Glob(filepath.Join(root, "*.desktop"))
+	for _, desktopFile := range desktopFiles {
+		if types, code := embeddedMimeTypes(desktopFile); len(types) > 0 {
+			return types, code
+		}
+	}
+	return nil, ""
+}
+
+// mimeTypeValue returns the MimeType value for types, escaped for a desktop
+// entry.
+func mimeTypeValue(types []string) string {
+	if len(types) == 0 {
+		return ""
+	}
+	return desktopString(strings.Join(types, ";") + ";")
+}
+
+// withFieldCode appends code to exec when the entry declares MIME types, so
+// that the files and URLs it is opened with reach the AppImage.
+func withFieldCode(exec string, types []string, code string) string {
+	if len(types) == 0 || code == "" {
+		return exec
+	}
+	return exec + " " + code
+}
+
+// setsMimeDefaults reports whether the entries of the AppImage named
+// appName are made the default applications for the MIME type t: as its
+// [App.<name>] table says, or else as the watcher's mime_defaults does.
+// For URL schemes, scheme_defaults does the same.
+func (w WatcherConfig) setsMimeDefaults(appName, t string) bool {
+	app := appConfig(appName)
+	all, schemes := w.MimeDefaults, w.SchemeDefaults
+	if app.MimeDefaults != nil {
+		all = *app.MimeDefaults
+	}
+	if app.SchemeDefaults != nil {
+		schemes = *app.SchemeDefaults
+	}
+	return all || (schemes && strings.HasPrefix(t, schemeHandlerPrefix))
+}
+
+// claimMimeDefaults makes the entries of the AppImage at path, whose main
+// entry is desktopFilePath, the default applications for the MIME types they
+// declare that w.setsMimeDefaults for. claimed maps the types it was made the
+// default for before to the entry, which is left alone, so that a default
+// the user picked since is kept. It returns the types it is the default for
+// now.
+func claimMimeDefaults(w WatcherConfig, path, desktopFilePath string, claimed map[string]string) map[string]string {
+	appName := appNameFromPath(path)
+	wanted := make(map[string]string)
+	for _, t := range extractedPayload(appName).MimeTypes {
+		if w.setsMimeDefaults(appName, t) {
+			wanted[t] = filepath.Base(desktopFilePath)
+		}
+	}
+	for _, e := range splitEntries(appName) {
+		for _, t := range e.MimeTypes {
+			if _, ok := wanted[t]; !ok && w.setsMimeDefaults(appName, t) {
+				wanted[t] = filepath.Base(splitEntryFile(desktopFilePath, e))
+			}
+		}
+	}
+
+	now := make(map[string]string)
+	pending := make(map[string][]string)
+	for t, entry := range wanted {
+		if claimed[t] == entry {
+			now[t] = entry
+		} else {
+			pending[entry] = append(pending[entry], t)
+		}
+	}
+	entries := make([]string, 0, len(pending))
+	for entry := range pending {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	for _, entry := range entries {
+		types := pending[entry]
+		sort.Strings(types)
+		if err := desktopUtils.Run("xdg-mime", append([]string{"default", entry}, types...)...); err != nil {
+			w.logger().Warnf("Error making %s the default application for %s: %v", entry, strings.Join(types, ", "), err)
+			continue
+		}
+		w.logger().Infof("Made %s the default application for %s.", entry, strings.Join(types, ", "))
+		for _, t := range types {
+			now[t] = entry
+		}
+	}
+	if len(now) == 0 {
+		return nil
+	}
+	return now
+}
+
+func equalMimeDefaults(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for t, entry := range a {
+		if b[t] != entry {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// mountPollInterval is how often watchers with require_mount check whether
+// their app_path is mounted.
+const mountPollInterval = 5 * time.Second
+
+// on_unmount values.
+const (
+	onUnmountHide   = "hide"
+	onUnmountRemove = "remove"
+	onUnmountKeep   = "keep"
+)
+
+func validateOnUnmount(cfg Config) error {
+	for _, w := range cfg.watchers() {
+		switch w.OnUnmount {
+		case "", onUnmountHide, onUnmountRemove, onUnmountKeep:
+		default:
+			return fmt.Errorf("on_unmount of watcher %s must be %q, %q or %q, got %q", w.label(), onUnmountHide, onUnmountRemove, onUnmountKeep, w.OnUnmount)
+		}
+		if w.OnUnmount != "" && !w.RequireMount {
+			return fmt.Errorf("on_unmount of watcher %s needs require_mount = true", w.label())
+		}
+	}
+	return nil
+}
+
+// isMounted reports whether path exists on a file system other than the
+// root one, which is what an unmounted mount point falls back to.
+func isMounted(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	root, err := os.Stat("/")
+	if err != nil {
+		return true
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	rootSt, rootOK := root.Sys().(*syscall.Stat_t)
+	return !ok || !rootOK || st.Dev != rootSt.Dev
+}
+
+// mountTemplates returns the watcher blocks with a mount_pattern.
+func (c Config) mountTemplates() []WatcherConfig {
+	var templates []WatcherConfig
+	for _, w := range c.Watchers {
+		if w.MountPattern != "" {
+			templates = append(templates, w.withDefaults(c.Defaults).withHome())
+		}
+	}
+	return templates
+}
+
+// mountedWatchers expands a mount_pattern block into one require_mount
+// watcher per mounted directory matching the pattern. They are labelled
+// NAME:DIR, or DIR when the block has no name.
+func (w WatcherConfig) mountedWatchers() []WatcherConfig {
+	matches, _ := filepath.Glob(w.MountPattern)
+	var watchers []WatcherConfig
+	for _, dir := range matches {
+		if !isMounted(dir) {
+			continue
+		}
+		mw := w
+		mw.AppPath = dir
+		mw.RequireMount = true
+		if w.Name != "" {
+			mw.Name = w.Name + ":" + dir
+		}
+		watchers = append(watchers, mw)
+	}
+	return watchers
+}
+
+func validateMountPatterns(cfg Config) error {
+	if cfg.MountPattern != "" {
+		return fmt.Errorf("mount_pattern is only supported in [[Watcher]] blocks")
+	}
+	for _, w := range cfg.mountTemplates() {
+		if w.AppPath != "" {
+			return fmt.Errorf("watcher %s sets both app_path and mount_pattern", w.Name)
+		}
+		if !filepath.IsAbs(w.MountPattern) {
+			return fmt.Errorf("mount_pattern %q must be an absolute path", w.MountPattern)
+		}
+		if _, err := filepath.Match(w.MountPattern, ""); err != nil {
+			return fmt.Errorf("invalid mount_pattern %q: %w", w.MountPattern, err)
+		}
+		if w.DesktopPath == "" || w.Categories == "" {
+			return fmt.Errorf("watcher with mount_pattern %q needs desktop_path and categories", w.MountPattern)
+		}
+	}
+	return nil
+}
+
+// attachMounts starts watchers for drives that were mounted at a directory
+// matching a mount_pattern since the set was started. Watchers disabled
+// with "watcher disable" stay off.
+func (s *watcherSet) attachMounts() {
+	profile := activeProfile(s.cfg)
+	for _, w := range s.cfg.watchers() {
+		if w.MountPattern == "" || s.isRunning(w.label()) || s.disabled[w.label()] {
+			continue
+		}
+		if !w.enabled() || !w.inProfile(profile) {
+			continue
+		}
+		w.logger().Infof("Attaching watcher to %s, which matches %s.", w.AppPath, w.MountPattern)
+		s.start(w)
+	}
+}
+
+// runWhenMounted runs watch while w's app_path is mounted: it is started
+// when the file system shows up and cancelled when it goes away, after which
+// the entries are handled as on_unmount says. The rescan at the next mount
+// brings them back. A watch that ends on its own is retried after the next
+// remount.
+func (aw *appWatcher) runWhenMounted(ctx context.Context, watch func(context.Context)) {
+	ticker := time.NewTicker(mountPollInterval)
+	defer ticker.Stop()
+
+	var cancel context.CancelFunc
+	var done chan struct{}
+	stop := func() {
+		if cancel != nil {
+			cancel()
+			<-done
+			cancel = nil
+		}
+	}
+	defer stop()
+
+	mounted := false
+	if !isMounted(aw.w.appDir()) {
+		aw.log.Infof("Waiting for %s to be mounted.", aw.w.AppPath)
+		aw.unmounted()
+	}
+	for {
+		now := isMounted(aw.w.appDir())
+		switch {
+		case now && !mounted:
+			aw.log.Infof("%s is mounted.", aw.w.AppPath)
+			watchCtx, watchCancel := context.WithCancel(ctx)
+			cancel, done = watchCancel, make(chan struct{})
+			go func() {
+				defer close(done)
+				defer reportPanics()
+				watch(watchCtx)
+			}()
+		case !now && mounted:
+			aw.log.Infof("%s was unmounted, pausing the watcher.", aw.w.AppPath)
+			stop()
+			aw.unmounted()
+		}
+		mounted = now
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// unmounted hides or removes the entries of the AppImages on the unmounted
+// app_path. Their records are kept, so they come back under the same names.
+func (aw *appWatcher) unmounted() {
+	w := aw.w
+	if w.OnUnmount == onUnmountKeep {
+		return
+	}
+	remove := w.OnUnmount == onUnmountRemove
+	action, done := "hide", "hidden"
+	if remove {
+		action, done = "remove", "removed"
+	}
+	st := currentState()
+	changed := 0
+	for _, app := range st.watchedBy(w) {
+		if app.Watcher != w.label() || app.DesktopFile == "" {
+			continue
+		}
+		if auditMode() {
+			aw.log.Infof("Audit mode: would %s %s", action, app.DesktopFile)
+			continue
+		}
+		var err error
+		var ok bool
+		if remove {
+			err = os.Remove(app.DesktopFile)
+			ok = err == nil
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			ok, err = hideEntry(app.DesktopFile)
+		}
+		if err != nil {
+			aw.log.Errorf("Error handling %s after unmount: %v", app.DesktopFile, err)
+		} else if ok {
+			changed++
+		}
+	}
+	if changed > 0 {
+		// Rewriting entries in place leaves no trace the journal sees.
+		currentJournal().forget(w.label())
+		aw.log.Infof("%d entr(ies) %s while %s is unmounted.", changed, done, w.AppPath)
+		aw.refresher.request(w.DesktopPath)
+	}
+}
+
+// hideEntry sets NoDisplay=true in the [Desktop Entry] group of the entry at
+// path and reports whether the file changed.
+func hideEntry(path string) (bool, error) {
+	data, err := fsys.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var b strings.Builder
+	inEntry := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			inEntry = trimmed == "[Desktop Entry]"
+			b.WriteString(line)
+			if inEntry {
+				if !strings.HasSuffix(line, "\n") {
+					b.WriteString("\n")
+				}
+				b.WriteString("NoDisplay=true\n")
+			}
+			continue
+		}
+		if inEntry && strings.HasPrefix(trimmed, "NoDisplay") {
+			if k, _, ok := strings.Cut(trimmed, "="); ok && strings.TrimSpace(k) == "NoDisplay" {
+				continue
+			}
+		}
+		b.WriteString(line)
+	}
+	return writeDesktopFile(path, b.String())
+}
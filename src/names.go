@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// decompositions is compositions the other way round.
+var decompositions = func() map[rune][2]rune {
+	m := make(map[rune][2]rune, len(compositions))
+	for pair, composed := range compositions {
+		m[composed] = pair
+	}
+	return m
+}()
+
+// transliterations covers the letters without a decomposition that
+// transliterateName would otherwise drop.
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "Th", 'ı': "i",
+}
+
+// isBidiControl reports whether r is one of the explicit directional
+// formatting characters, which can make a name display differently from
+// how it sorts and compares.
+func isBidiControl(r rune) bool {
+	return r == '\u061c' || r == '\u200e' || r == '\u200f' ||
+		(r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// normalizeName composes the combining marks in name, as file names created
+// on macOS use decomposed letters, and drops control and directional
+// formatting characters. Right-to-left text and emoji are kept as they are.
+func normalizeName(name string) string {
+	var b strings.Builder
+	var last rune = -1
+	for _, r := range name {
+		if unicode.IsControl(r) || isBidiControl(r) || r == utf8.RuneError {
+			continue
+		}
+		if composed, ok := compositions[[2]rune{last, r}]; ok {
+			// Replace the letter written last.
+			s := b.String()
+			b.Reset()
+			b.WriteString(s[:len(s)-utf8.RuneLen(last)])
+			b.WriteRune(composed)
+			last = composed
+			continue
+		}
+		b.WriteRune(r)
+		last = r
+	}
+	return b.String()
+}
+
+// displayName is how the AppImage named appName is shown in menus, escaped
+// for a desktop entry value.
+func displayName(appName string) string {
+	return desktopString(normalizeName(appName))
+}
+
+// desktopString escapes s for use as a desktop entry value of type string.
+func desktopString(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\t", "\\t", "\r", "\\r").Replace(s)
+}
+
+// transliterateName returns an ASCII version of name for use in file names
+// and whether nothing but accents was lost on the way.
+func transliterateName(name string) (string, bool) {
+	var b strings.Builder
+	exact := true
+	for _, r := range normalizeName(name) {
+		for {
+			pair, ok := decompositions[r]
+			if !ok {
+				break
+			}
+			r = pair[0]
+		}
+		switch {
+		case r < utf8.RuneSelf && r != '/':
+			b.WriteRune(r)
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+		case unicode.Is(unicode.Mn, r):
+		default:
+			exact = false
+		}
+	}
+	return b.String(), exact
+}
+
+// desktopFileName returns the name of the entry for the AppImage named
+// appName, following the naming settings of w. Names that aren't plain ASCII
+// are transliterated so the file stays easy to handle in shells and tools
+// assuming ASCII, which leaves the displayed Name unaffected. When letters
+// had to be dropped, a hash of the name keeps apart AppImages that only
+// differ in them.
+func desktopFileName(w WatcherConfig, appName string) string {
+	stem, exact := transliterateName(appName)
+	stem = strings.Trim(stem, " .-")
+	if !exact || stem == "" {
+		sum := sha256.Sum256([]byte(normalizeName(appName)))
+		suffix := hex.EncodeToString(sum[:4])
+		if stem == "" {
+			stem = "app-" + suffix
+		} else {
+			stem += "-" + suffix
+		}
+	}
+	if w.Naming == namingLowercase {
+		stem = strings.ReplaceAll(strings.ToLower(stem), " ", "-")
+	}
+	return w.NamePrefix + stem + ".desktop"
+}
+
+// assignDesktopFile returns the entry file for the AppImage at path. Two
+// AppImages can map to the same desktopFileName, being named alike in
+// different app_paths sharing a desktop_path or differing only in accents;
+// the one integrated later gets a hash of its path added to the name. Which
+// file an AppImage got is kept in the state, so it stays stable and removals
+// find it.
+func assignDesktopFile(st *stateStore, w WatcherConfig, path string) string {
+	preferred := filepath.Join(w.DesktopPath, desktopFileName(w, appNameFromPath(path)))
+	taken := false
+	if target := entryExecTarget(preferred); target != "" && !launchesAppImage(w, path, target) {
+		_, err := os.Stat(target)
+		taken = err == nil
+	}
+	sum := sha256.Sum256([]byte(path))
+	alternative := strings.TrimSuffix(preferred, ".desktop") + "-" + hex.EncodeToString(sum[:4]) + ".desktop"
+	return st.claimDesktopFile(path, preferred, alternative, taken)
+}
+
+// entryFile returns the entry file of the AppImage at path: the one recorded
+// in st, or the default name when it has no record.
+func entryFile(st *stateStore, w WatcherConfig, path string) string {
+	if desktopFile, ok := st.desktopFile(w.DesktopPath, path); ok {
+		return desktopFile
+	}
+	return filepath.Join(w.DesktopPath, desktopFileName(w, appNameFromPath(path)))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The keys of the actions offered on notifications: "Launch now" for an
+// added AppImage and "Undo" for one moved to the trash.
+const (
+	launchAction = "launch"
+	undoAction   = "undo"
+)
+
+// notifyEnabled is set from notify.
+var notifyEnabled atomic.Bool
+
+func configureNotify(cfg Config) {
+	notifyEnabled.Store(cfg.Notify)
+}
+
+// notification is a desktop notification with the actions offered on it.
+type notification struct {
+	summary string
+	body    string
+	icon    string
+	actions []notificationAction
+}
+
+type notificationAction struct {
+	key   string
+	label string
+}
+
+// notifier shows notifications. Notify returns once the notification is
+// closed, with the key of the action chosen on it, if any.
+type notifier interface {
+	Notify(n notification) (string, error)
+}
+
+// hostNotifier shows notifications with notify-send, on the host when
+// entries are created for it.
+type hostNotifier struct{}
+
+func (hostNotifier) Notify(n notification) (string, error) {
+	args := []string{"--app-name=DesktopImage"}
+	if n.icon != "" {
+		args = append(args, "--icon="+n.icon)
+	}
+	if len(n.actions) > 0 {
+		args = append(args, "--wait")
+	}
+	for _, a := range n.actions {
+		args = append(args, "--action="+a.key+"="+a.label)
+	}
+	args = append(args, n.summary, n.body)
+	out, err := hostCommand("notify-send", args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+var notifications notifier = hostNotifier{}
+
+// startApp starts the command line args without waiting for it. Tests swap
+// in one that records it instead.
+var startApp = startDetached
+
+// startDetached starts args in a session of its own, so that it outlives the
+// daemon, and reaps it when it exits.
+func startDetached(args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// notifyAdded tells the user that the AppImage at path was integrated, and
+// launches it when they pick "Launch now". The notification stays up until
+// it is closed, so it is shown in the background.
+func notifyAdded(w WatcherConfig, path string) {
+	if !notifyEnabled.Load() || auditMode() {
+		return
+	}
+	name, icon := entryAppearance(w, path)
+	n := notification{
+		summary: name + " was added",
+		body:    "It is now in the applications menu.",
+		icon:    icon,
+		actions: []notificationAction{{key: launchAction, label: "Launch now"}},
+	}
+	go func() {
+		action, err := notifications.Notify(n)
+		if err != nil {
+			w.logger().Warnf("Error showing notification for %s: %v", path, err)
+			return
+		}
+		if action == launchAction {
+			launchAppImage(w, path)
+		}
+	}()
+}
+
+// notifyRemoved offers to undo the deletion of the AppImage at path while its
+// entry stays for grace. Only AppImages moved to the trash can be brought
+// back, so nothing is shown for others.
+func notifyRemoved(w WatcherConfig, path string, grace time.Duration) {
+	if !notifyEnabled.Load() || auditMode() {
+		return
+	}
+	trash := homeTrash()
+	trashed, ok := trashedFile(trash, path)
+	if !ok {
+		return
+	}
+	name, icon := entryAppearance(w, path)
+	n := notification{
+		summary: name + " was moved to the trash",
+		body:    fmt.Sprintf("It leaves the applications menu in %s.", grace),
+		icon:    icon,
+		actions: []notificationAction{{key: undoAction, label: "Undo"}},
+	}
+	go func() {
+		action, err := notifications.Notify(n)
+		if err != nil {
+			w.logger().Warnf("Error showing notification for %s: %v", path, err)
+			return
+		}
+		if action != undoAction {
+			return
+		}
+		if err := restoreFromTrash(trash, trashed, path); err != nil {
+			w.logger().Errorf("Error restoring %s from the trash: %v", path, err)
+			return
+		}
+		w.logger().Infof("Restored %s from the trash.", path)
+	}()
+}
+
+// notifyUpdate tells the user that update, a newer build of the AppImage at
+// path, was published, with the start of its release notes.
+func notifyUpdate(w WatcherConfig, path string, update *availableUpdate) {
+	if !notifyEnabled.Load() || auditMode() {
+		return
+	}
+	name, icon := entryAppearance(w, path)
+	n := notification{
+		summary: "An update of " + name + " is available",
+		body:    update.file + " was published.",
+		icon:    icon,
+	}
+	if update.version != "" {
+		n.summary = fmt.Sprintf("%s %s is available", name, update.version)
+	}
+	if summary := summarizeNotes(update.notes); summary != "" {
+		n.body += "\n\n" + summary
+	}
+	go func() {
+		if _, err := notifications.Notify(n); err != nil {
+			w.logger().Warnf("Error showing notification for %s: %v", path, err)
+		}
+	}()
+}
+
+// entryAppearance returns the name and icon the entry of the AppImage at path
+// shows in the menu.
+func entryAppearance(w WatcherConfig, path string) (name, icon string) {
+	entry := entryFile(currentState(), w, path)
+	name = desktopEntryValue(entry, "Name")
+	if name == "" {
+		name = appNameFromPath(path)
+	}
+	return name, desktopEntryValue(entry, "Icon")
+}
+
+// launchAppImage starts the AppImage at path the way its entry does, in the
+// container and with the launch options configured for it.
+func launchAppImage(w WatcherConfig, path string) {
+	args := execFields(execLine(w, path))
+	if len(args) == 0 {
+		return
+	}
+	w.logger().Infof("Launching %s.", path)
+	if err := startApp(args); err != nil {
+		w.logger().Errorf("Error launching %s: %v", path, err)
+	}
+}
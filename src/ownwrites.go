@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ownWriteWindow is how long after the daemon changed a file the events for
+// it are taken to be the echo of that change.
+const ownWriteWindow = 2 * time.Second
+
+// allOps are all the kinds of events a watcher gets.
+const allOps = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod
+
+// ownWrite is a change the daemon made to a file: the events it causes and
+// until when they are expected.
+type ownWrite struct {
+	ops   fsnotify.Op
+	until time.Time
+}
+
+// ownWriteLog remembers the files the daemon changed itself. When entries
+// are written into a watched directory, or auto_grant_executable changes
+// the mode of an AppImage, the watcher sees the daemon's own changes, and
+// handling them as the user's would integrate the same AppImage again, or
+// worse keep doing so. It is safe for concurrent use.
+type ownWriteLog struct {
+	mu     sync.Mutex
+	writes map[string]ownWrite
+}
+
+var ownWrites = &ownWriteLog{writes: make(map[string]ownWrite)}
+
+// note records that the daemon is about to change path in a way causing the
+// events ops.
+func (l *ownWriteLog) note(path string, ops fsnotify.Op) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for p, w := range l.writes {
+		if now.After(w.until) {
+			delete(l.writes, p)
+		}
+	}
+	w := l.writes[path]
+	if now.After(w.until) {
+		w.ops = 0
+	}
+	l.writes[path] = ownWrite{ops: w.ops | ops, until: now.Add(ownWriteWindow)}
+}
+
+// echo reports whether event is one of the daemon's own changes.
+func (l *ownWriteLog) echo(event fsnotify.Event) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w, ok := l.writes[event.Name]
+	return ok && time.Now().Before(w.until) && event.Op&^w.ops == 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestOwnWritesIgnored(t *testing.T) {
+	useTestConfig(t, Config{})
+	w := newTestWatcher(t)
+	w.AutoGrantExecutable = true
+	w.DesktopPath = w.AppPath
+	aw := newAppWatcher(w, Config{}, newDBRefresher(time.Hour, time.Hour))
+	defer aw.cancelPending()
+	ctx := context.Background()
+
+	path := addAppImage(t, w.AppPath, "Hello")
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if executable, err := ensureExecutable(w, path); err != nil || !executable {
+		t.Fatalf("ensureExecutable() = %t, %v", executable, err)
+	}
+	aw.handleEvent(ctx, fsnotify.Event{Name: path, Op: fsnotify.Chmod})
+	if len(aw.pending) != 0 {
+		t.Error("granting the execute bit scheduled the AppImage again")
+	}
+	aw.handleEvent(ctx, fsnotify.Event{Name: path, Op: fsnotify.Write})
+	if _, ok := aw.pending[path]; !ok {
+		t.Error("a write after granting the execute bit was ignored")
+	}
+
+	entry := filepath.Join(w.DesktopPath, "Hello.desktop")
+	if err := replaceFile(entry, []byte("[Desktop Entry]\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Chmod} {
+		if !ownWrites.echo(fsnotify.Event{Name: entry, Op: op}) {
+			t.Errorf("the %s event of writing the entry isn't recognized as the daemon's own", op)
+		}
+	}
+	if ownWrites.echo(fsnotify.Event{Name: entry, Op: fsnotify.Remove}) {
+		t.Error("removing the written entry is taken for the daemon's own change")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// pause_policy values: what a paused watcher does with the events it gets.
+const (
+	pauseQueue = "queue"
+	pauseDrop  = "drop"
+)
+
+func (c Config) pausePolicy() string {
+	if c.PausePolicy != "" {
+		return c.PausePolicy
+	}
+	return pauseQueue
+}
+
+func validatePausePolicy(cfg Config) error {
+	return checkPausePolicy("pause_policy", cfg.PausePolicy)
+}
+
+func checkPausePolicy(what, policy string) error {
+	switch policy {
+	case "", pauseQueue, pauseDrop:
+		return nil
+	default:
+		return fmt.Errorf("%s must be %q or %q, got %q", what, pauseQueue, pauseDrop, policy)
+	}
+}
+
+// setPaused pauses the running watcher labelled label with policy, or with
+// pause_policy when it is "", or resumes it for resume. Like toggles, a
+// pause lasts until the watcher is restarted.
+func (s *watcherSet) setPaused(label string, pause bool, policy string) error {
+	if err := checkPausePolicy("policy", policy); err != nil {
+		return err
+	}
+	if policy == "" {
+		policy = s.cfg.pausePolicy()
+	}
+	for _, rw := range s.running {
+		if rw.label != label {
+			continue
+		}
+		if !pause {
+			policy = ""
+		}
+		rw.aw.setPaused(policy)
+		return nil
+	}
+	return fmt.Errorf("watcher %q is not running", label)
+}
+
+// setPaused asks the watch to pause with policy, or to resume for "".
+func (aw *appWatcher) setPaused(policy string) {
+	aw.pauseMu.Lock()
+	aw.pauseRequest = policy
+	aw.pauseMu.Unlock()
+	select {
+	case aw.pauseChanged <- struct{}{}:
+	default:
+		// Signalled already.
+	}
+}
+
+// pausedWith returns the policy the watcher was last asked to pause with,
+// or "" when it runs.
+func (aw *appWatcher) pausedWith() string {
+	aw.pauseMu.Lock()
+	defer aw.pauseMu.Unlock()
+	return aw.pauseRequest
+}
+
+// applyPause switches the watch to the pause last asked for. It is called
+// by the watch before it handles anything, so nothing slips through once
+// setPaused returned.
+func (aw *appWatcher) applyPause(ctx context.Context) {
+	policy := aw.pausedWith()
+	if policy == aw.paused {
+		return
+	}
+	aw.paused = policy
+	switch policy {
+	case pauseQueue:
+		aw.log.Info("Watcher paused, its events are queued until it is resumed.")
+	case pauseDrop:
+		aw.log.Info("Watcher paused, its events are dropped and it rescans when it is resumed.")
+		// A restart in the meantime must rescan too.
+		aw.rescan = true
+		currentJournal().forget(aw.w.label())
+	default:
+		aw.resume(ctx)
+	}
+}
+
+// hold keeps the event for path of a paused watch for when it resumes.
+func (aw *appWatcher) hold(path string) {
+	if aw.paused != pauseQueue || aw.queued[path] {
+		return
+	}
+	aw.queued[path] = true
+	currentJournal().eventPending(aw.w, path)
+}
+
+// resume handles what happened while the watch was paused: the queued
+// events once they settle, or everything through a scan after events were
+// dropped or lost.
+func (aw *appWatcher) resume(ctx context.Context) {
+	queued := aw.queued
+	aw.queued = make(map[string]bool)
+	if aw.rescan {
+		aw.rescan = false
+		aw.log.Infof("Watcher resumed, rescanning %s.", aw.w.AppPath)
+		started := time.Now()
+		reconcile(ctx, aw.w, aw.workers, aw.refresher)
+		currentJournal().synced(aw.w, aw.fingerprint, started, aw.pendingPaths())
+		return
+	}
+	aw.log.Infof("Watcher resumed, handling the events of %d file(s).", len(queued))
+	for path := range queued {
+		aw.schedule(path)
+	}
+}
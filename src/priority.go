@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// priority is the CPU and IO priority heavy operations run with.
+type priority struct {
+	nice    int
+	ioClass string
+}
+
+var (
+	priorityMu      sync.Mutex
+	heavyOpPriority priority
+)
+
+func setPriority(p priority) {
+	priorityMu.Lock()
+	defer priorityMu.Unlock()
+	heavyOpPriority = p
+}
+
+func currentPriority() priority {
+	priorityMu.Lock()
+	defer priorityMu.Unlock()
+	return heavyOpPriority
+}
+
+func validatePriority(cfg Config) error {
+	if cfg.Nice < 0 || cfg.Nice > 19 {
+		return fmt.Errorf("nice must be between 0 and 19, got %d", cfg.Nice)
+	}
+	switch cfg.IOClass {
+	case "", "best-effort", "idle":
+		return nil
+	default:
+		return fmt.Errorf("io_class must be \"best-effort\" or \"idle\", got %q", cfg.IOClass)
+	}
+}
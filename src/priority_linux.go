@@ -0,0 +1,57 @@
+//go:build linux
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioClasses = map[string]int{
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// runLowPriority runs fn on a dedicated OS thread whose CPU and IO priority
+// have been lowered according to the configured nice and io_class. Commands
+// started by fn inherit that priority. The thread is never unlocked, so the
+// runtime discards it instead of reusing it for other goroutines.
+func runLowPriority(fn func()) {
+	p := currentPriority()
+	if p.nice == 0 && p.ioClass == "" {
+		fn()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		lowerThreadPriority(p)
+		fn()
+	}()
+	<-done
+}
+
+// lowerThreadPriority applies p to the calling OS thread, which must be
+// locked and never be handed back to the runtime.
+func lowerThreadPriority(p priority) {
+	tid := syscall.Gettid()
+	if p.nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, p.nice); err != nil {
+			log.Debugf("Failed to set nice %d: %v", p.nice, err)
+		}
+	}
+	if class, ok := ioClasses[p.ioClass]; ok {
+		// Lowest level within the class; ignored for idle.
+		prio := class<<ioprioClassShift | 7
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+			log.Debugf("Failed to set IO class %s: %v", p.ioClass, errno)
+		}
+	}
+}
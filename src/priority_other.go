@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// runLowPriority runs fn directly; per-thread priorities are only adjusted
+// on Linux.
+func runLowPriority(fn func()) {
+	fn()
+}
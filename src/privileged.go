@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// elevate values, see Config.Elevate.
+const (
+	elevateOff    = "off"
+	elevatePkexec = "pkexec"
+	elevateWriter = "writer"
+)
+
+// privilegedCommand is the subcommand pkexec runs for single operations the
+// daemon may not do itself. Its polkit action is
+// io.github.lrx0014.desktopimage.privileged, installed with the package.
+const privilegedCommand = "privileged"
+
+// maxPrivilegedWrite bounds what the helper writes, entries being small.
+const maxPrivilegedWrite = 1 << 20
+
+// accessWriteOK is W_OK of access(2).
+const accessWriteOK = 2
+
+// privilegedDirs are the system directories the helper changes entries in.
+// It refuses any other path, so the polkit action can't be used to write
+// elsewhere.
+var privilegedDirs = []string{"/usr/share/applications", "/usr/local/share/applications"}
+
+// privilegedConfig reads the configuration the helper checks entry names
+// against, as root from configFilePath rather than from the daemon. Tests
+// swap it.
+var privilegedConfig = func() (Config, error) {
+	return readConfig(configFilePath)
+}
+
+var (
+	elevateMu sync.Mutex
+	elevation string
+)
+
+// runElevated has the helper do the operation args as root, passing it
+// stdin: the privileged writer when it runs, or else pkexec. Tests swap it
+// for one that runs the operation in process.
+var runElevated = func(stdin []byte, args ...string) error {
+	if writer := currentWriter(); writer != nil {
+		return writer.call(privilegedRequest{Op: args[0], Path: args[1], Content: stdin})
+	}
+	cmd := exec.Command("pkexec", append([]string{launcherPath(), privilegedCommand}, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pkexec %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func validateElevation(cfg Config) error {
+	switch cfg.Elevate {
+	case "", elevateOff, elevatePkexec:
+		return nil
+	case elevateWriter:
+		if cfg.User == "" {
+			return fmt.Errorf("elevate = %q needs user, the daemon would keep running as root otherwise", elevateWriter)
+		}
+		return nil
+	default:
+		return fmt.Errorf("elevate must be %q, %q or %q, got %q", elevateOff, elevatePkexec, elevateWriter, cfg.Elevate)
+	}
+}
+
+func configureElevation(cfg Config) {
+	elevateMu.Lock()
+	defer elevateMu.Unlock()
+	elevation = cfg.Elevate
+}
+
+// elevating reports whether operations that failed for lack of permission
+// are done again through the helper: through pkexec, or the privileged
+// writer when it runs.
+func elevating() bool {
+	elevateMu.Lock()
+	mode := elevation
+	elevateMu.Unlock()
+	return mode == elevatePkexec || (mode == elevateWriter && currentWriter() != nil)
+}
+
+// elevated reports whether operations on path that failed for lack of
+// permission are done again through the helper.
+func elevated(path string) bool {
+	return elevating() && privilegedPath(path) == nil
+}
+
+// privilegedPath checks that path is one the helper may change, a desktop
+// file directly in one of privilegedDirs.
+func privilegedPath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("%s is not a clean absolute path", path)
+	}
+	name := filepath.Base(path)
+	if !containsString(privilegedDirs, filepath.Dir(path)) || !strings.HasSuffix(name, ".desktop") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%s is not a desktop file in %s", path, strings.Join(privilegedDirs, " or "))
+	}
+	return nil
+}
+
+// writeElevated writes content to path through the helper, after writing
+// it as the daemon failed with err.
+func writeElevated(path string, content []byte, err error) error {
+	log.Infof("Asking for permission to write %s: %v", path, err)
+	ownWrites.note(path, fsnotify.Create|fsnotify.Write|fsnotify.Chmod|fsnotify.Rename)
+	return runElevated(content, "write", path)
+}
+
+// removeElevated removes path through the helper, after removing it as the
+// daemon failed with err.
+func removeElevated(path string, err error) error {
+	log.Infof("Asking for permission to remove %s: %v", path, err)
+	ownWrites.note(path, fsnotify.Remove|fsnotify.Rename)
+	return runElevated(nil, "remove", path)
+}
+
+// refreshElevated reports whether the desktop database of desktopPath has
+// to be refreshed through the helper, because the daemon may not write it.
+// A refresh_command of its own is always run as the daemon.
+func refreshElevated(desktopPath string) bool {
+	desktopPath = filepath.Clean(desktopPath)
+	refreshMu.Lock()
+	_, custom := refreshCommands[desktopPath]
+	refreshMu.Unlock()
+	return elevating() && !custom && containsString(privilegedDirs, desktopPath) &&
+		syscall.Access(desktopPath, accessWriteOK) != nil
+}
+
+// runPrivileged is the helper run as root: "write <path>" replaces path
+// with standard input, "remove <path>" removes it and "refresh <dir>"
+// updates the desktop database of dir. "serve" runs the privileged writer.
+func runPrivileged(args []string) int {
+	if len(args) == 1 && args[0] == "serve" {
+		return runPrivilegedWriter()
+	}
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "%s: expected write, remove or refresh and a path\n", privilegedCommand)
+		return exitUsage
+	}
+	if args[0] != "write" && args[0] != "remove" && args[0] != "refresh" {
+		fmt.Fprintf(os.Stderr, "%s: unknown operation %q\n", privilegedCommand, args[0])
+		return exitUsage
+	}
+	if err := privilegedOp(args[0], args[1], os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", privilegedCommand, err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// privilegedOp does the operation op of the helper on path, writing what
+// in holds for "write".
+func privilegedOp(op, path string, in io.Reader) error {
+	switch op {
+	case "write":
+		if err := privilegedPath(path); err != nil {
+			return err
+		}
+		if err := generatedName(path); err != nil {
+			return err
+		}
+		return privilegedWrite(path, in)
+	case "remove":
+		if err := privilegedPath(path); err != nil {
+			return err
+		}
+		if err := generatedName(path); err != nil {
+			return err
+		}
+		if err := ownedEntry(path); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case "refresh":
+		if !containsString(privilegedDirs, path) {
+			return fmt.Errorf("%s is not one of %s", path, strings.Join(privilegedDirs, ", "))
+		}
+		return exec.Command("update-desktop-database", path).Run()
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+}
+
+// generatedName checks that path is named like the entries desktopFileName
+// gives a watcher with its directory as desktop_path: starting with its
+// name_prefix, in printable ASCII and, for naming = "lowercase", without
+// upper case letters or spaces.
+func generatedName(path string) error {
+	cfg, err := privilegedConfig()
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Dir(path), strings.TrimSuffix(filepath.Base(path), ".desktop")
+	for _, w := range cfg.watchers() {
+		if filepath.Clean(w.DesktopPath) != dir || !strings.HasPrefix(name, w.NamePrefix) {
+			continue
+		}
+		stem := strings.TrimPrefix(name, w.NamePrefix)
+		if stem == "" || strings.IndexFunc(stem, func(r rune) bool { return r < ' ' || r > '~' }) >= 0 {
+			continue
+		}
+		if w.Naming == namingLowercase && (stem != strings.ToLower(stem) || strings.Contains(stem, " ")) {
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not named like an entry of a watcher writing to %s", path, dir)
+}
+
+// markedEntry reports whether the desktop file content is an entry
+// DesktopImage wrote, which always names its AppImage in X-AppImage-Path.
+func markedEntry(content []byte) bool {
+	return entryValue(content, "X-AppImage-Path") != "" || entryValue(content, "X-DesktopImage-Hash") != ""
+}
+
+// ownedEntry checks that path is either missing or a regular file that is
+// a marked entry, so the helper can't be used to replace or remove the
+// entries installed by packages.
+func ownedEntry(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !markedEntry(content) {
+		return fmt.Errorf("refusing to change %s, DesktopImage didn't write it", path)
+	}
+	return nil
+}
+
+// privilegedWrite replaces path with what in holds, refusing to follow a
+// symlink at path or to replace an entry DesktopImage didn't write.
+func privilegedWrite(path string, in io.Reader) error {
+	content, err := io.ReadAll(io.LimitReader(in, maxPrivilegedWrite+1))
+	if err != nil {
+		return err
+	}
+	if len(content) > maxPrivilegedWrite {
+		return fmt.Errorf("refusing to write more than %s to %s", formatSize(maxPrivilegedWrite), path)
+	}
+	if !markedEntry(content) {
+		return fmt.Errorf("refusing to write %s, it isn't an entry of an AppImage", path)
+	}
+	if err := ownedEntry(path); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return osFS{}.SyncDir(filepath.Dir(path))
+}
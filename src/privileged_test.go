@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readOnlyFS is a fileSystem refusing to change anything, like the system
+// desktop directories are to a daemon that isn't root.
+type readOnlyFS struct{ fileSystem }
+
+func (readOnlyFS) WriteFile(name string, _ []byte, _ os.FileMode) error {
+	return pathError("open", name, fs.ErrPermission)
+}
+func (readOnlyFS) WriteNewFile(name string, _ []byte, _ os.FileMode) error {
+	return pathError("open", name, fs.ErrPermission)
+}
+func (readOnlyFS) Remove(name string) error { return pathError("remove", name, fs.ErrPermission) }
+
+// markedContent is an entry as DesktopImage writes it.
+const markedContent = "[Desktop Entry]\nX-AppImage-Path=/opt/Hello.AppImage\n"
+
+// useElevation makes the helper run in process through runElevated,
+// recording the operations asked for.
+func useElevation(t *testing.T) *[]string {
+	t.Helper()
+	var ops []string
+	prev := runElevated
+	runElevated = func(stdin []byte, args ...string) error {
+		ops = append(ops, strings.Join(args, " "))
+		if args[0] == "refresh" {
+			return nil
+		}
+		return privilegedOp(args[0], args[1], bytes.NewReader(stdin))
+	}
+	t.Cleanup(func() { runElevated = prev })
+	return &ops
+}
+
+// usePrivilegedDir makes dir the only directory the helper changes entries
+// in, as the desktop_path of w in the configuration it checks names against.
+func usePrivilegedDir(t *testing.T, dir string, w WatcherConfig) {
+	t.Helper()
+	prevDirs, prevConfig := privilegedDirs, privilegedConfig
+	privilegedDirs = []string{dir}
+	w.DesktopPath = dir
+	privilegedConfig = func() (Config, error) { return Config{WatcherConfig: w}, nil }
+	t.Cleanup(func() { privilegedDirs, privilegedConfig = prevDirs, prevConfig })
+}
+
+func TestPrivilegedPath(t *testing.T) {
+	for path, ok := range map[string]bool{
+		"/usr/share/applications/Hello.desktop":          true,
+		"/usr/local/share/applications/Hello.desktop":    true,
+		"/usr/share/applications/sub/Hello.desktop":      false,
+		"/usr/share/applications/../Hello.desktop":       false,
+		"/usr/share/applications/.Hello.desktop":         false,
+		"/usr/share/applications/Hello.sh":               false,
+		"/usr/share/polkit-1/actions/x.desktop":          false,
+		"usr/share/applications/Hello.desktop":           false,
+		"/home/user/.local/share/applications/a.desktop": false,
+	} {
+		if err := privilegedPath(path); (err == nil) != ok {
+			t.Errorf("privilegedPath(%q) = %v, want allowed %v", path, err, ok)
+		}
+	}
+	if err := validateElevation(Config{Elevate: "sudo"}); err == nil {
+		t.Error("elevate = \"sudo\" was accepted")
+	}
+}
+
+func TestGeneratedName(t *testing.T) {
+	dir := t.TempDir()
+	usePrivilegedDir(t, dir, WatcherConfig{AppPath: "/opt/apps", NamePrefix: "di-", Naming: namingLowercase})
+	for name, ok := range map[string]bool{
+		"di-hello.desktop":          true,
+		"di-hello-1a2b3c4d.desktop": true,
+		"hello.desktop":             false,
+		"di-Hello.desktop":          false,
+		"di-hello world.desktop":    false,
+		"di-héllo.desktop":          false,
+		"di-.desktop":               false,
+	} {
+		if err := generatedName(filepath.Join(dir, name)); (err == nil) != ok {
+			t.Errorf("generatedName(%q) = %v, want allowed %v", name, err, ok)
+		}
+	}
+	if err := generatedName(filepath.Join(t.TempDir(), "di-hello.desktop")); err == nil {
+		t.Error("allowed a name in a directory no watcher writes to")
+	}
+}
+
+func TestElevatedDesktopFile(t *testing.T) {
+	dir := t.TempDir()
+	usePrivilegedDir(t, dir, WatcherConfig{AppPath: "/opt/apps"})
+	ops := useElevation(t)
+	prevFS := fsys
+	fsys = readOnlyFS{osFS{}}
+	t.Cleanup(func() { fsys = prevFS })
+	path := filepath.Join(dir, "Hello.desktop")
+
+	useTestConfig(t, Config{})
+	if _, err := writeDesktopFile(path, markedContent); err == nil || len(*ops) != 0 {
+		t.Fatalf("writing without elevate gave %v and ran %v, want a permission error", err, *ops)
+	}
+
+	useTestConfig(t, Config{Elevate: elevatePkexec})
+	if changed, err := writeDesktopFile(path, markedContent); err != nil || !changed {
+		t.Fatalf("writeDesktopFile = %v, %v", changed, err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != markedContent {
+		t.Errorf("entry holds %q", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("entry has mode %v, %v", info.Mode(), err)
+	}
+	if changed, _ := writeDesktopFile(path, markedContent); changed || len(*ops) != 1 {
+		t.Errorf("rewriting the same entry ran %v", *ops)
+	}
+
+	w := WatcherConfig{AppPath: t.TempDir(), DesktopPath: dir}
+	appImage := filepath.Join(w.AppPath, "Hello.AppImage")
+	useTestConfig(t, Config{WatcherConfig: w})
+	currentState().put(appState{Path: appImage, Watcher: w.label(), DesktopFile: path})
+	if removeDesktopFile(w, appImage) {
+		t.Error("removed the entry without elevate")
+	}
+	if app, ok := currentState().get(appImage); !ok || app.DesktopFile != path {
+		t.Errorf("the record of the entry that couldn't be removed is %+v, %v", app, ok)
+	}
+
+	useTestConfig(t, Config{Elevate: elevatePkexec, WatcherConfig: w})
+	if !removeDesktopFile(w, appImage) {
+		t.Error("the entry wasn't removed")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("entry still there: %v", err)
+	}
+	if want := []string{"write " + path, "remove " + path}; strings.Join(*ops, ",") != strings.Join(want, ",") {
+		t.Errorf("elevated %v, want %v", *ops, want)
+	}
+}
+
+func TestPrivilegedWrite(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "Hello.desktop")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := privilegedWrite(link, strings.NewReader(markedContent)); err == nil {
+		t.Error("wrote through a symlink")
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Errorf("symlink target was created: %v", err)
+	}
+	packaged := filepath.Join(dir, "Packaged.desktop")
+	if err := os.WriteFile(packaged, []byte("[Desktop Entry]\nExec=packaged\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := privilegedWrite(packaged, strings.NewReader(markedContent)); err == nil {
+		t.Error("replaced an entry DesktopImage didn't write")
+	}
+	if err := privilegedWrite(filepath.Join(dir, "New.desktop"), strings.NewReader("[Desktop Entry]\n")); err == nil {
+		t.Error("wrote an entry without X-AppImage-Path")
+	}
+	usePrivilegedDir(t, dir, WatcherConfig{AppPath: "/opt/apps"})
+	if err := privilegedOp("remove", packaged, nil); err == nil {
+		t.Error("removed an entry DesktopImage didn't write")
+	}
+	if got, _ := os.ReadFile(packaged); string(got) != "[Desktop Entry]\nExec=packaged\n" {
+		t.Errorf("packaged entry holds %q", got)
+	}
+	big := bytes.NewReader(make([]byte, maxPrivilegedWrite+1))
+	if err := privilegedWrite(filepath.Join(dir, "Big.desktop"), big); err == nil {
+		t.Error("wrote more than maxPrivilegedWrite")
+	}
+}
+
+func TestPrivilegedWriter(t *testing.T) {
+	dir := t.TempDir()
+	usePrivilegedDir(t, dir, WatcherConfig{AppPath: "/opt/apps"})
+	daemon, helper := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- serveWriter(helper) }()
+	w := newPrivilegedWriter(daemon)
+
+	path := filepath.Join(dir, "Hello.desktop")
+	if err := w.call(privilegedRequest{Op: "write", Path: path, Content: []byte(markedContent)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != markedContent {
+		t.Errorf("entry holds %q", got)
+	}
+	outside := filepath.Join(t.TempDir(), "Hello.desktop")
+	if err := w.call(privilegedRequest{Op: "write", Path: outside}); err == nil {
+		t.Error("the writer wrote outside the system desktop directories")
+	}
+	if err := w.call(privilegedRequest{Op: "remove", Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("entry still there: %v", err)
+	}
+	daemon.Close()
+	if err := <-done; err != nil {
+		t.Errorf("serveWriter = %v after the daemon closed the socket", err)
+	}
+
+	// A writer that stops answering is cut off instead of blocking the
+	// watcher.
+	prevTimeout := privilegedCallTimeout
+	privilegedCallTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { privilegedCallTimeout = prevTimeout })
+	daemon, helper = net.Pipe()
+	defer helper.Close()
+	if err := newPrivilegedWriter(daemon).call(privilegedRequest{Op: "remove", Path: path}); err == nil {
+		t.Error("call returned without an answer from the writer")
+	}
+	if err := validateElevation(Config{Elevate: elevateWriter}); err == nil {
+		t.Error("elevate = \"writer\" was accepted without user")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// lookupCredential resolves a user name into the credential processes run
+// as that user get.
+func lookupCredential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected uid %q for user %s", u.Uid, name)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected gid %q for user %s", u.Gid, name)
+	}
+
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groupIDs, _ := u.GroupIds()
+	for _, id := range groupIDs {
+		if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(g))
+		}
+	}
+	return cred, nil
+}
+
+// dropPrivileges switches the daemon to cfg.User once the privileged setup
+// is done. The data directory is handed over to that user first, and the
+// status file directory when it doesn't exist yet, so both stay writable.
+func dropPrivileges(cfg Config) error {
+	if cfg.User == "" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		log.Warnf("Not running as root, ignoring user = %q.", cfg.User)
+		return nil
+	}
+
+	cred, err := lookupCredential(cfg.User)
+	if err != nil {
+		return err
+	}
+	if err := chownTree(cfg.dataDir(), cred); err != nil {
+		return fmt.Errorf("failed to hand over data directory: %w", err)
+	}
+	statusDir := filepath.Dir(cfg.statusFile())
+	if _, err := os.Stat(statusDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(statusDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Chown(statusDir, int(cred.Uid), int(cred.Gid)); err != nil {
+			return err
+		}
+	}
+
+	groups := make([]int, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("failed to set gid: %w", err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("failed to set uid: %w", err)
+	}
+	log.Infof("Dropped privileges to user %s.", cfg.User)
+	// Changing credentials for extraction is no longer possible.
+	configureExtraction(cfg)
+	return nil
+}
+
+func chownTree(root string, cred *syscall.Credential) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	return filepath.WalkDir(root, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(cred.Uid), int(cred.Gid))
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// privilegedWriterFD is the descriptor the privileged writer gets its end
+// of the socket as, the first of ExtraFiles.
+const privilegedWriterFD = 3
+
+// privilegedCallTimeout bounds how long the daemon waits for the privileged
+// writer to answer. Tests shorten it.
+var privilegedCallTimeout = 30 * time.Second
+
+// privilegedRequest is one operation sent to the privileged writer, as a
+// single JSON line answered by a controlResponse.
+type privilegedRequest struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	Content []byte `json:"content,omitempty"`
+}
+
+// privilegedWriter is the daemon's end of the socket to the privileged
+// writer, a process started as root before the daemon drops privileges
+// that does nothing but the operations of the helper. AppImages and
+// whatever they contain are only ever parsed by the unprivileged daemon.
+type privilegedWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+var (
+	writerMu sync.Mutex
+	writer   *privilegedWriter
+)
+
+func currentWriter() *privilegedWriter {
+	writerMu.Lock()
+	defer writerMu.Unlock()
+	return writer
+}
+
+func newPrivilegedWriter(conn net.Conn) *privilegedWriter {
+	return &privilegedWriter{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// startPrivilegedWriter starts the privileged writer for elevate =
+// "writer". It has to be called while the daemon still runs as root.
+func startPrivilegedWriter(cfg Config) error {
+	if cfg.Elevate != elevateWriter {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		log.Warnf("Not running as root, elevate = %q can't start the privileged writer.", elevateWriter)
+		return nil
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create writer socket: %w", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	ours := os.NewFile(uintptr(fds[0]), "privileged writer")
+	theirs := os.NewFile(uintptr(fds[1]), "privileged writer")
+	defer theirs.Close()
+
+	cmd := exec.Command(launcherPath(), privilegedCommand, "serve")
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		ours.Close()
+		return fmt.Errorf("failed to start privileged writer: %w", err)
+	}
+	conn, err := net.FileConn(ours)
+	ours.Close()
+	if err != nil {
+		return fmt.Errorf("failed to connect to privileged writer: %w", err)
+	}
+	started := newPrivilegedWriter(conn)
+	writerMu.Lock()
+	writer = started
+	writerMu.Unlock()
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Errorf("Error running privileged writer: %v", err)
+		}
+		conn.Close()
+		writerMu.Lock()
+		if writer == started {
+			writer = nil
+		}
+		writerMu.Unlock()
+	}()
+	log.Infof("Started privileged writer (pid %d).", cmd.Process.Pid)
+	return nil
+}
+
+// call has the privileged writer do req and returns the error it reports.
+// A writer that doesn't answer within privilegedCallTimeout is cut off, as
+// a late answer would be taken for that of the next request.
+func (w *privilegedWriter) call(req privilegedRequest) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := w.conn.SetDeadline(time.Now().Add(privilegedCallTimeout)); err != nil {
+		return fmt.Errorf("failed to reach privileged writer: %w", err)
+	}
+	if _, err := w.conn.Write(append(line, '\n')); err != nil {
+		w.conn.Close()
+		return fmt.Errorf("failed to reach privileged writer: %w", err)
+	}
+	reply, err := w.r.ReadBytes('\n')
+	if err != nil {
+		w.conn.Close()
+		return fmt.Errorf("failed to read from privileged writer: %w", err)
+	}
+	var resp controlResponse
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		return fmt.Errorf("invalid response from privileged writer: %w", err)
+	}
+	if !resp.OK {
+		return fmt.Errorf("privileged writer: %s", resp.Error)
+	}
+	return nil
+}
+
+// runPrivilegedWriter is "privileged serve", the privileged writer. It
+// serves the socket it inherited until the daemon closes it.
+func runPrivilegedWriter() int {
+	conn, err := net.FileConn(os.NewFile(privilegedWriterFD, "privileged writer"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: not started by the daemon: %v\n", privilegedCommand, err)
+		return exitUsage
+	}
+	defer conn.Close()
+	if err := serveWriter(conn); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", privilegedCommand, err)
+		return exitFailure
+	}
+	return 0
+}
+
+// serveWriter does the operations read from rw, one request line at a
+// time, until it is closed.
+func serveWriter(rw io.ReadWriter) error {
+	scanner := bufio.NewScanner(rw)
+	// Content is base64, a third longer than what is written.
+	scanner.Buffer(nil, 2*maxPrivilegedWrite)
+	enc := json.NewEncoder(rw)
+	for scanner.Scan() {
+		var req privilegedRequest
+		resp := okResponse(nil)
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp = errorResponse(fmt.Errorf("invalid request: %w", err))
+		} else if err := privilegedOp(req.Op, req.Path, bytes.NewReader(req.Content)); err != nil {
+			resp = errorResponse(err)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
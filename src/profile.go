@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	profileMu sync.Mutex
+	// profileOverride is the profile picked with --profile or "desktopimage
+	// profile", which takes precedence over profile = ... until the daemon
+	// exits. overrideSet distinguishes clearing the profile from not
+	// having picked one.
+	profileOverride string
+	overrideSet     bool
+)
+
+func setProfileOverride(profile string) {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	profileOverride, overrideSet = profile, true
+}
+
+// activeProfile returns the profile the watchers of cfg run with, or "" when
+// none is selected and all of them run.
+func activeProfile(cfg Config) string {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	if overrideSet {
+		return profileOverride
+	}
+	return cfg.Profile
+}
+
+// inProfile reports whether w runs with profile active. Watchers that don't
+// list any profiles always run.
+func (w WatcherConfig) inProfile(profile string) bool {
+	if profile == "" || len(w.Profiles) == 0 {
+		return true
+	}
+	for _, p := range w.Profiles {
+		if p == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// knownProfiles returns the profiles named by the watchers of cfg.
+func knownProfiles(cfg Config) []string {
+	seen := make(map[string]bool)
+	var profiles []string
+	for _, w := range append(cfg.watchers(), cfg.mountTemplates()...) {
+		for _, p := range w.Profiles {
+			if !seen[p] {
+				seen[p] = true
+				profiles = append(profiles, p)
+			}
+		}
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+func validateProfile(cfg Config, profile string) error {
+	if profile == "" {
+		return nil
+	}
+	for _, p := range knownProfiles(cfg) {
+		if p == profile {
+			return nil
+		}
+	}
+	return fmt.Errorf("no watcher belongs to profile %q", profile)
+}
+
+// daemonProfileArg recognizes "--profile NAME" and "--profile=NAME", which
+// start the daemon with that profile.
+func daemonProfileArg(args []string) (string, bool) {
+	switch {
+	case len(args) == 2 && args[0] == "--profile":
+		return args[1], true
+	case len(args) == 1 && strings.HasPrefix(args[0], "--profile="):
+		return strings.TrimPrefix(args[0], "--profile="), true
+	default:
+		return "", false
+	}
+}
+
+type profileStatus struct {
+	Active   string   `json:"active"`
+	Profiles []string `json:"profiles"`
+}
+
+// runProfile shows or switches the profile of the running daemon.
+func runProfile(args []string) int {
+	fs := flag.NewFlagSet("profile", flag.ContinueOnError)
+	clearProfile := fs.Bool("clear", false, "run all watchers regardless of their profiles")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 || (*clearProfile && fs.NArg() != 0) {
+		fmt.Fprintln(os.Stderr, "profile: expected a profile name or --clear")
+		return exitUsage
+	}
+
+	if fs.NArg() == 1 || *clearProfile {
+		req := controlRequest{Command: "set-profile", Profile: fs.Arg(0)}
+		if _, err := sendControl(controlSocketPath(), req); err != nil {
+			fmt.Fprintf(os.Stderr, "profile: %v\n", err)
+			return exitCode(err)
+		}
+		if *clearProfile {
+			fmt.Println("Running all watchers.")
+		} else {
+			fmt.Printf("Switched to profile %s.\n", fs.Arg(0))
+		}
+		return 0
+	}
+
+	resp, err := sendControl(controlSocketPath(), controlRequest{Command: "get-profile"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "profile: %v\n", err)
+		return exitCode(err)
+	}
+	var status profileStatus
+	if err := json.Unmarshal(resp.Data, &status); err != nil {
+		fmt.Fprintf(os.Stderr, "profile: %v\n", err)
+		return exitCode(err)
+	}
+	for _, p := range status.Profiles {
+		marker := " "
+		if p == status.Active {
+			marker = "*"
+		}
+		fmt.Printf("%s %s\n", marker, p)
+	}
+	if status.Active == "" {
+		fmt.Println("No profile is active, all watchers run.")
+	}
+	return 0
+}
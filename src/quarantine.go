@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const quarantineReasonSuffix = ".reason"
+
+// errRejected marks AppImages that failed validation. They are moved to the
+// quarantine directory when one is configured.
+var errRejected = errors.New("unsafe AppImage")
+
+var (
+	quarantineMu  sync.Mutex
+	quarantineDir string
+)
+
+func configureQuarantine(cfg Config) {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	quarantineDir = cfg.QuarantineDir
+}
+
+func currentQuarantine() string {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	return quarantineDir
+}
+
+// quarantineAppImage moves the rejected AppImage at path into the quarantine
+// directory, next to a reason file describing why. The watcher then sees it
+// disappear and removes its entry.
+func quarantineAppImage(w WatcherConfig, path string, reason error) error {
+	dir := currentQuarantine()
+	if auditMode() {
+		w.logger().Infof("Audit mode: would quarantine %s: %v", path, reason)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	dest := filepath.Join(dir, filepath.Base(path))
+	if _, err := os.Lstat(dest); err == nil {
+		dest = filepath.Join(dir, fmt.Sprintf("%s.%d", filepath.Base(path), time.Now().Unix()))
+	}
+	if err := moveFile(path, dest); err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf("source: %s\nwatcher: %s\nquarantined: %s\nreason: %v\n", path, w.label(), time.Now().Format(time.RFC3339), reason)
+	if err := os.WriteFile(dest+quarantineReasonSuffix, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to write quarantine reason: %w", err)
+	}
+	w.logger().Warnf("Quarantined %s in %s: %v", path, dest, reason)
+	return nil
+}
+
+// moveFile renames src to dest, copying when they are on different file
+// systems.
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Remove(src)
+}
+
+type quarantinedFile struct {
+	path   string
+	fields map[string]string
+}
+
+// listQuarantined returns the files in the quarantine directory together with
+// what their reason files say.
+func listQuarantined(dir string) ([]quarantinedFile, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []quarantinedFile
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), quarantineReasonSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		files = append(files, quarantinedFile{path: path, fields: readReason(path + quarantineReasonSuffix)})
+	}
+	return files, nil
+}
+
+func readReason(path string) map[string]string {
+	fields := make(map[string]string)
+	f, err := os.Open(path)
+	if err != nil {
+		return fields
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), ": "); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// when values, see Quirk.When.
+const (
+	quirkAlways           = ""
+	quirkUsernsRestricted = "userns_restricted"
+)
+
+// Quirk is a known fix for the entries of some AppImages, applied when they
+// are generated. Built-in ones are listed in builtinQuirks, more can be
+// added with [[Quirk]] blocks.
+type Quirk struct {
+	// Match is a glob matched against the AppImage name without
+	// .AppImage, ignoring case, such as "obsidian*".
+	Match string `toml:"match"`
+	// Args are appended to the Exec line.
+	Args []string `toml:"args,omitempty"`
+	// StartupWMClass is the window class the app's windows have, so that
+	// docks group them with the entry.
+	StartupWMClass string `toml:"startup_wm_class,omitempty"`
+	// When limits the quirk to hosts where unprivileged user namespaces
+	// are restricted ("userns_restricted"), which breaks the sandbox of
+	// Electron apps.
+	When string `toml:"when,omitempty"`
+	// SplitEntries gives each app the AppImage bundles an entry of its
+	// own, see embeddedEntries.
+	SplitEntries bool `toml:"split_entries,omitempty"`
+}
+
+// builtinQuirks are the fixes shipped for popular AppImages. Those of the
+// configuration are applied after them, so their StartupWMClass wins.
+var builtinQuirks = []Quirk{
+	{Match: "obsidian*", StartupWMClass: "obsidian"},
+	{Match: "obsidian*", Args: []string{"--no-sandbox"}, When: quirkUsernsRestricted},
+	{Match: "joplin*", StartupWMClass: "@joplin/app-desktop"},
+	{Match: "joplin*", Args: []string{"--no-sandbox"}, When: quirkUsernsRestricted},
+	{Match: "bitwarden*", StartupWMClass: "Bitwarden"},
+	{Match: "bitwarden*", Args: []string{"--no-sandbox"}, When: quirkUsernsRestricted},
+	{Match: "logseq*", StartupWMClass: "Logseq"},
+	{Match: "logseq*", Args: []string{"--no-sandbox"}, When: quirkUsernsRestricted},
+	{Match: "balenaetcher*", StartupWMClass: "balenaEtcher"},
+	{Match: "balenaetcher*", Args: []string{"--no-sandbox"}, When: quirkUsernsRestricted},
+	{Match: "libreoffice*", SplitEntries: true},
+}
+
+// usernsSysctls are the kernel settings restricting unprivileged user
+// namespaces, with the value that restricts them: Ubuntu's AppArmor
+// restriction and the Debian patch.
+var usernsSysctls = map[string]string{
+	"/proc/sys/kernel/apparmor_restrict_unprivileged_userns": "1",
+	"/proc/sys/kernel/unprivileged_userns_clone":             "0",
+}
+
+var (
+	quirksMu sync.Mutex
+	// quirks holds the quirks that apply on this host, built-in ones
+	// first.
+	quirks []Quirk
+	// usernsRestricted is whether the host restricted user namespaces
+	// when the configuration was loaded.
+	usernsRestricted bool
+)
+
+func validateQuirks(cfg Config) error {
+	for _, q := range cfg.Quirks {
+		if q.Match == "" {
+			return fmt.Errorf("quirk without match")
+		}
+		if _, err := filepath.Match(q.Match, ""); err != nil {
+			return fmt.Errorf("invalid match %q of quirk: %w", q.Match, err)
+		}
+		switch q.When {
+		case quirkAlways, quirkUsernsRestricted:
+		default:
+			return fmt.Errorf("when of quirk %s must be %q, got %q", q.Match, quirkUsernsRestricted, q.When)
+		}
+		if strings.ContainsAny(q.StartupWMClass, "\n\r") {
+			return fmt.Errorf("startup_wm_class of quirk %s may not span lines", q.Match)
+		}
+	}
+	return nil
+}
+
+// configureQuirks picks the quirks of cfg and the built-in ones that apply
+// to this host.
+func configureQuirks(cfg Config) {
+	restricted := false
+	for path, value := range usernsSysctls {
+		if content, err := fsys.ReadFile(path); err == nil && strings.TrimSpace(string(content)) == value {
+			restricted = true
+		}
+	}
+	var active []Quirk
+	for _, q := range append(append([]Quirk(nil), builtinQuirks...), cfg.Quirks...) {
+		if q.When == quirkUsernsRestricted && !restricted {
+			continue
+		}
+		active = append(active, q)
+	}
+	quirksMu.Lock()
+	defer quirksMu.Unlock()
+	quirks = active
+	usernsRestricted = restricted
+}
+
+// quirksOff reports whether the [App.<name>] table of the AppImage named
+// appName sets quirks = false.
+func quirksOff(appName string) bool {
+	q := appConfig(appName).Quirks
+	return q != nil && !*q
+}
+
+// appQuirk merges the quirks matching the AppImage named appName, nothing
+// when quirksOff.
+func appQuirk(appName string) Quirk {
+	var merged Quirk
+	if quirksOff(appName) {
+		return merged
+	}
+	name := strings.ToLower(appName)
+	quirksMu.Lock()
+	defer quirksMu.Unlock()
+	for _, q := range quirks {
+		if ok, _ := filepath.Match(strings.ToLower(q.Match), name); !ok {
+			continue
+		}
+		for _, group := range argGroups(q.Args) {
+			if !containsGroup(argGroups(merged.Args), group) {
+				merged.Args = append(merged.Args, group...)
+			}
+		}
+		if q.StartupWMClass != "" {
+			merged.StartupWMClass = q.StartupWMClass
+		}
+		merged.SplitEntries = merged.SplitEntries || q.SplitEntries
+	}
+	return merged
+}
+
+// quirksFingerprint describes the host conditions the quirks depend on, so
+// that entries are rewritten when they change.
+func quirksFingerprint() string {
+	quirksMu.Lock()
+	defer quirksMu.Unlock()
+	return fmt.Sprintf("userns restricted: %t", usernsRestricted)
+}
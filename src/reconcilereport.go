@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const reconcileReportFileName = "reconcile.json"
+
+// reconcileReport lists what the last reconciliation of a watcher changed,
+// for configuration management tools checking that a machine converged.
+type reconcileReport struct {
+	Watcher     string    `json:"watcher"`
+	AppPath     string    `json:"app_path"`
+	DesktopPath string    `json:"desktop_path"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	AppImages   int       `json:"appimages"`
+	// Added, Updated and Removed are AppImages whose entry was written for
+	// the first time, rewritten, or removed.
+	Added   []string           `json:"added"`
+	Updated []string           `json:"updated"`
+	Removed []string           `json:"removed"`
+	Failed  []reconcileFailure `json:"failed"`
+	// Interrupted is set when the daemon stopped before all AppImages were
+	// handled.
+	Interrupted bool `json:"interrupted,omitempty"`
+	// Converged is set when no AppImage failed and none was left out.
+	Converged bool `json:"converged"`
+}
+
+type reconcileFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// reconcileCollector gathers the report of a reconciliation from its
+// workers.
+type reconcileCollector struct {
+	mu     sync.Mutex
+	report reconcileReport
+}
+
+func newReconcileCollector(w WatcherConfig, start time.Time) *reconcileCollector {
+	return &reconcileCollector{report: reconcileReport{
+		Watcher:     w.label(),
+		AppPath:     w.AppPath,
+		DesktopPath: w.DesktopPath,
+		StartedAt:   start,
+		Added:       []string{},
+		Updated:     []string{},
+		Removed:     []string{},
+		Failed:      []reconcileFailure{},
+	}}
+}
+
+// integrated records the outcome of integrating path: whether it was
+// recorded before and after, and whether its entry changed.
+func (c *reconcileCollector) integrated(path string, known, recorded, changed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch msg := integrationError(path); {
+	case msg != "" && !changed:
+		c.report.Failed = append(c.report.Failed, reconcileFailure{Path: path, Error: msg})
+	case !changed:
+	case !recorded:
+		c.report.Removed = append(c.report.Removed, path)
+	case known:
+		c.report.Updated = append(c.report.Updated, path)
+	default:
+		c.report.Added = append(c.report.Added, path)
+	}
+}
+
+func (c *reconcileCollector) removed(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.report.Removed = append(c.report.Removed, path)
+}
+
+func (c *reconcileCollector) failed(path string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.report.Failed = append(c.report.Failed, reconcileFailure{Path: path, Error: err.Error()})
+}
+
+// finish completes the report, sorting its lists.
+func (c *reconcileCollector) finish(appImages int, interrupted bool) reconcileReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.report
+	r.FinishedAt = time.Now()
+	r.AppImages = appImages
+	r.Interrupted = interrupted
+	r.Converged = !interrupted && len(r.Failed) == 0
+	for _, list := range [][]string{r.Added, r.Updated, r.Removed} {
+		sort.Strings(list)
+	}
+	sort.Slice(r.Failed, func(i, j int) bool { return r.Failed[i].Path < r.Failed[j].Path })
+	return r
+}
+
+var (
+	reconcileMu sync.Mutex
+	// reconcileReports holds the latest report per watcher label, and is
+	// kept in reconcilePath in the data directory.
+	reconcileReports = make(map[string]reconcileReport)
+	reconcilePath    string
+)
+
+// configureReconcileReports keeps the reports in the data directory of cfg,
+// loading those of the last run when it changed.
+func configureReconcileReports(cfg Config) {
+	path := filepath.Join(cfg.dataDir(), reconcileReportFileName)
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+	if path == reconcilePath {
+		return
+	}
+	reconcilePath = path
+	reconcileReports = make(map[string]reconcileReport)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var reports []reconcileReport
+	if err := json.Unmarshal(content, &reports); err != nil {
+		log.Warnf("Ignoring unreadable reconciliation report %s: %v", path, err)
+		return
+	}
+	for _, r := range reports {
+		reconcileReports[r.Watcher] = r
+	}
+}
+
+// recordReconcile makes r the latest report of its watcher and saves the
+// reports.
+func recordReconcile(r reconcileReport) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+	reconcileReports[r.Watcher] = r
+	if reconcilePath == "" || auditMode() {
+		return
+	}
+	if err := writeReconcileReports(reconcilePath, latestReconciles()); err != nil {
+		log.Errorf("Error saving the reconciliation report: %v", err)
+	}
+}
+
+// latestReconciles returns the latest report of every watcher, sorted by
+// watcher; it is called with reconcileMu held.
+func latestReconciles() []reconcileReport {
+	reports := make([]reconcileReport, 0, len(reconcileReports))
+	for _, r := range reconcileReports {
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Watcher < reports[j].Watcher })
+	return reports
+}
+
+// reconcileReportsOf returns the latest report of the watcher labelled
+// label, or of every watcher when label is "".
+func reconcileReportsOf(label string) ([]reconcileReport, error) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+	if label == "" {
+		return latestReconciles(), nil
+	}
+	r, ok := reconcileReports[label]
+	if !ok {
+		return nil, fmt.Errorf("watcher %q was not reconciled yet", label)
+	}
+	return []reconcileReport{r}, nil
+}
+
+// writeReconcileReports replaces the report file at path atomically.
+func writeReconcileReports(path string, reports []reconcileReport) error {
+	content, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write reconciliation report: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write reconciliation report: %w", err)
+	}
+	return nil
+}
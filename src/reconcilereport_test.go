@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReconcileReport(t *testing.T) {
+	dataDir := t.TempDir()
+	useTestConfig(t, Config{DataDir: dataDir})
+	useFakeCommands(t)
+	w := newTestWatcher(t)
+	hello := addAppImage(t, w.AppPath, "Hello")
+	gone := addAppImage(t, w.AppPath, "Gone")
+	refresher := newDBRefresher(time.Hour, time.Hour)
+
+	reconcile(context.Background(), w, 2, refresher)
+	reports, err := reconcileReportsOf(w.label())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := reports[0]; !reflect.DeepEqual(r.Added, []string{gone, hello}) || !r.Converged || r.AppImages != 2 {
+		t.Errorf("first report = %+v, want Gone and Hello added", r)
+	}
+
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	w.Categories = "Development;"
+	reconcile(context.Background(), w, 2, refresher)
+	reports, _ = reconcileReportsOf(w.label())
+	if r := reports[0]; !reflect.DeepEqual(r.Updated, []string{hello}) || !reflect.DeepEqual(r.Removed, []string{gone}) || len(r.Added) != 0 {
+		t.Errorf("second report = %+v, want Hello updated and Gone removed", r)
+	}
+
+	// Entries can't be written into a desktop_path that is a file.
+	broken := newTestWatcher(t)
+	broken.Name = "broken"
+	if err := os.Remove(broken.DesktopPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(broken.DesktopPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	failing := addAppImage(t, broken.AppPath, "Hello")
+	reconcile(context.Background(), broken, 1, refresher)
+	reports, _ = reconcileReportsOf(broken.label())
+	if r := reports[0]; len(r.Failed) != 1 || r.Failed[0].Path != failing || r.Failed[0].Error == "" || r.Converged {
+		t.Errorf("report = %+v, want %s failed and not converged", r, failing)
+	}
+	if all, _ := reconcileReportsOf(""); len(all) != 2 {
+		t.Errorf("%d reports, want one per watcher", len(all))
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, reconcileReportFileName)); err != nil {
+		t.Errorf("the reports were not saved: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshNone as refresh_command leaves the desktop database alone, for
+// desktops that pick up new entries without it.
+const refreshNone = "none"
+
+// defaultRefreshCommand refreshes the desktop directories whose watchers
+// don't set a refresh_command.
+const defaultRefreshCommand = "update-desktop-database %d"
+
+var (
+	refreshMu       sync.Mutex
+	refreshCommands map[string]string
+)
+
+// desktopRefreshCommands returns the refresh_command of each desktop
+// directory of cfg that sets one. Watchers sharing a directory have to
+// agree on it, as it is refreshed once for all of them, and one leaving it
+// out stands for defaultRefreshCommand.
+func desktopRefreshCommands(cfg Config) (map[string]string, error) {
+	commands := make(map[string]string)
+	effective := make(map[string]string)
+	for _, w := range cfg.watchers() {
+		command := w.RefreshCommand
+		if command == "" {
+			command = defaultRefreshCommand
+		} else if strings.TrimSpace(command) == "" {
+			return nil, fmt.Errorf("refresh_command of watcher %s is blank, leave it out or set it to %q", w.label(), refreshNone)
+		}
+		dir := filepath.Clean(w.DesktopPath)
+		if other, ok := effective[dir]; ok && other != command {
+			return nil, fmt.Errorf("refresh_command of watcher %s is %q, but another watcher of desktop_path %s runs %q", w.label(), command, dir, other)
+		}
+		effective[dir] = command
+		if w.RefreshCommand != "" {
+			commands[dir] = w.RefreshCommand
+		}
+	}
+	return commands, nil
+}
+
+func validateRefreshCommands(cfg Config) error {
+	_, err := desktopRefreshCommands(cfg)
+	return err
+}
+
+func configureRefreshCommands(cfg Config) {
+	commands, err := desktopRefreshCommands(cfg)
+	if err != nil {
+		log.Errorf("Error reading refresh_command, running %q everywhere: %v", defaultRefreshCommand, err)
+	}
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	refreshCommands = commands
+}
+
+// usesDefaultRefresh reports whether defaultRefreshCommand refreshes any
+// desktop directory of cfg, or whether it has no watchers yet.
+func usesDefaultRefresh(cfg Config) bool {
+	watchers := cfg.watchers()
+	for _, w := range watchers {
+		if w.RefreshCommand == "" {
+			return true
+		}
+	}
+	return len(watchers) == 0
+}
+
+// refreshCommandFor returns the command line refreshing desktopPath, split
+// at spaces with %d replaced by the directory, or nil for refreshNone.
+func refreshCommandFor(desktopPath string) []string {
+	desktopPath = filepath.Clean(desktopPath)
+	refreshMu.Lock()
+	command, ok := refreshCommands[desktopPath]
+	refreshMu.Unlock()
+	if !ok {
+		command = defaultRefreshCommand
+	}
+	if command == refreshNone {
+		return nil
+	}
+	args := strings.Fields(command)
+	for i, arg := range args {
+		args[i] = strings.ReplaceAll(arg, "%d", desktopPath)
+	}
+	return args
+}
+
+// dbRefresher batches update-desktop-database runs, or those of the
+// refresh_command, per desktop directory.
+// A run happens once a directory had no further requests for the delay,
+// but at most maxDelay after the first one, so watchers sharing a
+// desktop_path and whole batches of copied AppImages only invoke the
+// external tool once.
+type dbRefresher struct {
+	mu       sync.Mutex
+	delay    time.Duration
+	maxDelay time.Duration
+	pending  map[string]*pendingRefresh
+	// scheduled counts the updates that were requested and haven't
+	// finished yet, so flush can wait for those already running.
+	scheduled sync.WaitGroup
+}
+
+type pendingRefresh struct {
+	timer *time.Timer
+	first time.Time
+}
+
+func newDBRefresher(delay, maxDelay time.Duration) *dbRefresher {
+	return &dbRefresher{
+		delay:    delay,
+		maxDelay: maxDelay,
+		pending:  make(map[string]*pendingRefresh),
+	}
+}
+
+func (r *dbRefresher) setDelay(delay, maxDelay time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay = delay
+	r.maxDelay = maxDelay
+}
+
+// request schedules a database update for desktopPath, postponing one
+// that is already pending.
+func (r *dbRefresher) request(desktopPath string) {
+	desktopPath = filepath.Clean(desktopPath)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.pending[desktopPath]; ok {
+		delay := r.delay
+		if left := r.maxDelay - time.Since(p.first); left < delay {
+			delay = left
+		}
+		if delay < 0 {
+			delay = 0
+		}
+		if p.timer.Stop() {
+			p.timer.Reset(delay)
+		}
+		return
+	}
+	r.scheduled.Add(1)
+	r.pending[desktopPath] = &pendingRefresh{
+		first: time.Now(),
+		timer: time.AfterFunc(r.delay, func() {
+			defer r.scheduled.Done()
+			r.mu.Lock()
+			delete(r.pending, desktopPath)
+			r.mu.Unlock()
+			updateDesktopDatabase(desktopPath)
+		}),
+	}
+}
+
+// flush runs every pending update immediately and waits for those that
+// are running already.
+func (r *dbRefresher) flush() {
+	r.mu.Lock()
+	var paths []string
+	for desktopPath, p := range r.pending {
+		if p.timer.Stop() {
+			paths = append(paths, desktopPath)
+		}
+		delete(r.pending, desktopPath)
+	}
+	r.mu.Unlock()
+
+	for _, desktopPath := range paths {
+		updateDesktopDatabase(desktopPath)
+		r.scheduled.Done()
+	}
+	r.scheduled.Wait()
+}
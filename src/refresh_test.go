@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDBRefresherBatches(t *testing.T) {
+	useTestConfig(t, Config{})
+	commands := useFakeCommands(t)
+	r := newDBRefresher(time.Hour, time.Hour)
+	r.request("/home/user/.local/share/applications")
+	r.request("/home/user/.local/share/applications/")
+	r.request("/usr/share/applications")
+	r.flush()
+
+	if n := commands.count(); n != 2 {
+		t.Errorf("%d commands ran, want 2: %v", n, commands.calls)
+	}
+	for _, cmd := range []string{
+		"update-desktop-database /home/user/.local/share/applications",
+		"update-desktop-database /usr/share/applications",
+	} {
+		if commands.ran(cmd) != 1 {
+			t.Errorf("%q ran %d times, want once", cmd, commands.ran(cmd))
+		}
+	}
+}
+
+func TestDBRefresherDebounces(t *testing.T) {
+	useTestConfig(t, Config{})
+	commands := useFakeCommands(t)
+	r := newDBRefresher(50*time.Millisecond, time.Hour)
+	for i := 0; i < 5; i++ {
+		r.request("/applications")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := commands.count(); n != 0 {
+		t.Errorf("%d commands ran while requests kept coming in, want none", n)
+	}
+	waitFor(t, "the refresh", func() bool { return commands.count() > 0 })
+	r.flush()
+	if n := commands.count(); n != 1 {
+		t.Errorf("%d commands ran, want 1: %v", n, commands.calls)
+	}
+}
+
+func TestDBRefresherMaxDelay(t *testing.T) {
+	useTestConfig(t, Config{})
+	commands := useFakeCommands(t)
+	r := newDBRefresher(time.Hour, 50*time.Millisecond)
+	r.request("/applications")
+	r.request("/applications")
+	waitFor(t, "the refresh due after max_delay", func() bool { return commands.count() > 0 })
+	r.flush()
+}
+
+func TestUpdateDesktopDatabaseAuditMode(t *testing.T) {
+	useTestConfig(t, Config{AuditMode: true})
+	commands := useFakeCommands(t)
+	updateDesktopDatabase("/applications")
+	if n := commands.count(); n != 0 {
+		t.Errorf("%d commands ran in audit mode: %v", n, commands.calls)
+	}
+}
+
+func TestRefreshCommand(t *testing.T) {
+	cfg := Config{
+		Defaults: EntryDefaults{RefreshCommand: "xdg-desktop-menu forceupdate --dir %d"},
+		Watchers: []WatcherConfig{
+			{Name: "menu", AppPath: "/apps/menu", DesktopPath: "/menu", Categories: "Utility"},
+			{Name: "none", AppPath: "/apps/none", DesktopPath: "/none", Categories: "Utility", RefreshCommand: refreshNone},
+		},
+	}
+	useTestConfig(t, cfg)
+	commands := useFakeCommands(t)
+	r := newDBRefresher(time.Hour, time.Hour)
+	for _, dir := range []string{"/menu", "/none", "/other"} {
+		r.request(dir)
+	}
+	r.flush()
+	for _, cmd := range []string{"xdg-desktop-menu forceupdate --dir /menu", "update-desktop-database /other"} {
+		if commands.ran(cmd) != 1 {
+			t.Errorf("%q ran %d times, want once: %v", cmd, commands.ran(cmd), commands.calls)
+		}
+	}
+	if n := commands.count(); n != 2 {
+		t.Errorf("%d commands ran, want none for refresh_command = %q: %v", n, refreshNone, commands.calls)
+	}
+	if usesDefaultRefresh(cfg) {
+		t.Error("update-desktop-database is required although every watcher sets refresh_command")
+	}
+
+	cfg.Watchers = append(cfg.Watchers, WatcherConfig{Name: "shared", AppPath: "/apps/shared", DesktopPath: "/menu/", Categories: "Utility", RefreshCommand: refreshNone})
+	if err := validateRefreshCommands(cfg); err == nil {
+		t.Error("watchers sharing a desktop_path with different refresh_command values are valid")
+	}
+	cfg.Defaults.RefreshCommand = ""
+	cfg.Watchers = []WatcherConfig{
+		{Name: "set", AppPath: "/apps/set", DesktopPath: "/menu", Categories: "Utility", RefreshCommand: "xdg-desktop-menu forceupdate"},
+		{Name: "unset", AppPath: "/apps/unset", DesktopPath: "/menu", Categories: "Utility"},
+	}
+	if err := validateRefreshCommands(cfg); err == nil {
+		t.Error("a refresh_command is valid although another watcher of its desktop_path runs the default")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Notifications show at most this much of the release notes.
+const (
+	maxSummaryLines = 3
+	maxSummaryRunes = 200
+)
+
+// externalReleases is the reference an AppStream component can make to its
+// release history published separately, <releases type="external" url=.../>.
+type externalReleases struct {
+	Releases []struct {
+		Type string `xml:"type,attr"`
+		URL  string `xml:"url,attr"`
+	} `xml:"releases"`
+}
+
+// appStreamReleases is a release history, the <releases> of a component or
+// of an external releases file; releases are listed newest first.
+type appStreamReleases struct {
+	Releases []struct {
+		Version     string `xml:"version,attr"`
+		Description struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"description"`
+	} `xml:"release"`
+}
+
+// appStreamReleaseNotes fetches the external release history the AppStream
+// metadata extracted for appName refers to, and returns the version and
+// notes of the newest release. Both are "" when it refers to none.
+func appStreamReleaseNotes(ctx context.Context, metainfoDir, appName string) (string, string, error) {
+	content, err := os.ReadFile(filepath.Join(metainfoDir, appName+".xml"))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var component externalReleases
+	if err := xml.Unmarshal(content, &component); err != nil {
+		return "", "", fmt.Errorf("failed to parse AppStream metadata: %w", err)
+	}
+	for _, releases := range component.Releases {
+		if releases.Type != "external" || releases.URL == "" {
+			continue
+		}
+		body, err := fetch(ctx, releases.URL)
+		if err != nil {
+			return "", "", err
+		}
+		defer body.Close()
+		var history appStreamReleases
+		if err := xml.NewDecoder(io.LimitReader(body, 1<<20)).Decode(&history); err != nil {
+			return "", "", fmt.Errorf("failed to parse %s: %w", releases.URL, err)
+		}
+		if len(history.Releases) == 0 {
+			return "", "", nil
+		}
+		newest := history.Releases[0]
+		notes, err := descriptionText(newest.Description.Inner)
+		return strings.TrimSpace(newest.Version), notes, err
+	}
+	return "", "", nil
+}
+
+// descriptionText renders the markup of an AppStream description, which is
+// made of <p>, <ul> and <ol> with <li>, as plain text: a line per paragraph
+// and "- " before every item.
+func descriptionText(markup string) (string, error) {
+	var b strings.Builder
+	line := ""
+	flush := func() {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			fmt.Fprintln(&b, line)
+		}
+		line = ""
+	}
+	decoder := xml.NewDecoder(strings.NewReader(markup))
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse release notes: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				flush()
+			case "li":
+				flush()
+				line = "- "
+			}
+		case xml.EndElement:
+			if t.Name.Local == "p" || t.Name.Local == "li" {
+				flush()
+			}
+		case xml.CharData:
+			line += " " + string(t)
+		}
+	}
+	flush()
+	return strings.TrimSpace(b.String()), nil
+}
+
+// summarizeNotes returns the start of the release notes notes for a
+// notification: the first lines with text, without Markdown headings and
+// emphasis, shortened to maxSummaryRunes.
+func summarizeNotes(notes string) string {
+	var lines []string
+	for _, line := range strings.Split(notes, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(line, "#"))
+		line = strings.NewReplacer("**", "", "__", "", "`", "").Replace(line)
+		if strings.HasPrefix(line, "* ") {
+			line = "- " + line[2:]
+		}
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) == maxSummaryLines {
+			break
+		}
+	}
+	summary := strings.Join(lines, "\n")
+	if runes := []rune(summary); len(runes) > maxSummaryRunes {
+		summary = strings.TrimSpace(string(runes[:maxSummaryRunes-1])) + "…"
+	}
+	return summary
+}
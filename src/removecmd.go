@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runRemove removes what was generated for an AppImage, asking the daemon
+// to do it when it is running so its state stays in sync.
+func runRemove(args []string) int {
+	fs := flag.NewFlagSet("remove", flag.ContinueOnError)
+	source := fs.String("source", "", "AppImage whose generated files are removed (required)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *source == "" || fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "remove: expected --source <appimage>")
+		return exitUsage
+	}
+	path, err := filepath.Abs(*source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "remove: %v\n", err)
+		return exitCode(err)
+	}
+
+	var removed []string
+	resp, err := sendControl(controlSocketPath(), controlRequest{Command: "remove-source", Source: path})
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		err = json.Unmarshal(resp.Data, &removed)
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		// No daemon running, so the state can be changed directly.
+		removed, err = removeOffline(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "remove: %v\n", err)
+		return exitCode(err)
+	}
+
+	for _, file := range removed {
+		fmt.Printf("Removed %s.\n", file)
+	}
+	if _, err := os.Stat(path); err == nil {
+		fmt.Printf("%s still exists; it is integrated again on the next scan unless it is removed too.\n", path)
+	}
+	return 0
+}
+
+func removeOffline(path string) ([]string, error) {
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := openState(cfg.dataDir())
+	if err != nil {
+		return nil, err
+	}
+	removed, err := removeSource(cfg, st, path)
+	if err != nil {
+		return nil, err
+	}
+	return removed, st.flush()
+}
+
+// removeSource deletes the entries, icon and metadata generated for the
+// AppImage at path and forgets about it. Besides the entry recorded in st,
+// every entry in a desktop_path whose Exec points at path is removed, which
+// finds entries left behind by renames and earlier naming schemes.
+func removeSource(cfg Config, st *stateStore, path string) ([]string, error) {
+	if cfg.AuditMode {
+		return nil, errors.New("audit mode is enabled, nothing is removed")
+	}
+
+	entries := make(map[string]bool)
+	app, known := st.get(path)
+	if known && app.DesktopFile != "" {
+		entries[app.DesktopFile] = true
+	}
+	for _, w := range cfg.watchers() {
+		matches, _ := filepath.Glob(filepath.Join(w.DesktopPath, "*.desktop"))
+		for _, match := range matches {
+			if entryExecTarget(match) == path {
+				entries[match] = true
+			}
+		}
+	}
+
+	var removed []string
+	desktopPaths := make(map[string]bool)
+	for entry := range entries {
+		if err := os.Remove(entry); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+		removed = append(removed, entry)
+		desktopPaths[filepath.Dir(entry)] = true
+	}
+	removed = append(removed, removeArtifacts(st.artifactsOf(path, cfg.iconDir(), cfg.metainfoDir()))...)
+	if !known && len(removed) == 0 {
+		return nil, fmt.Errorf("nothing was generated for %s", path)
+	}
+	st.remove(path)
+	sort.Strings(removed)
+
+	for desktopPath := range desktopPaths {
+		updateDesktopDatabase(desktopPath)
+	}
+	log.Infof("Removed the files generated for %s: %s.", path, strings.Join(removed, ", "))
+	return removed, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func runReport(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "report: missing report name\n\n%s", usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "unused":
+		return reportUnused(args[1:])
+	case "size":
+		return reportSize(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "report: unknown report %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+}
+
+type appImageUsage struct {
+	path     string
+	name     string
+	w        WatcherConfig
+	lastUsed time.Time
+}
+
+func reportUnused(args []string) int {
+	fs := flag.NewFlagSet("report unused", flag.ContinueOnError)
+	olderThan := fs.String("older-than", "90d", "report AppImages not launched within this age (e.g. 90d, 2w, 36h)")
+	listOnly := fs.Bool("list", false, "only list unused AppImages, do not prompt for removal")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report unused: %v\n", err)
+		return exitUsage
+	}
+
+	var cfg Config
+	if *listOnly {
+		if cfg, err = readConfig(configFilePath); err != nil {
+			fmt.Fprintf(os.Stderr, "report unused: %v\n", err)
+			return exitCode(err)
+		}
+	} else {
+		// AppImages are removed the way the daemon removes them, through
+		// its state, so only while it is stopped.
+		lock, err := lockDataDir(startupDataDir(configFilePath))
+		if errors.Is(err, errLockHeld) {
+			fmt.Fprintf(os.Stderr, "report unused: the daemon is running (%v); stop it to remove AppImages, or pass --list\n", err)
+			return exitCode(err)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "report unused: %v\n", err)
+			return exitCode(err)
+		}
+		defer lock.Close()
+
+		log.SetLevel(logrus.WarnLevel)
+		if err := loadConfig(configFilePath); err != nil {
+			fmt.Fprintf(os.Stderr, "report unused: %v\n", err)
+			return exitCode(err)
+		}
+		cfg = config
+	}
+	if !isConfigValid(cfg) {
+		fmt.Fprintln(os.Stderr, "report unused: configuration is incomplete, nothing to report")
+		return exitConfig
+	}
+
+	var unused []appImageUsage
+	cutoff := time.Now().Add(-age)
+	for _, w := range cfg.watchers() {
+		found, err := findUnusedAppImages(w, cutoff)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "report unused: %v\n", err)
+			return exitCode(err)
+		}
+		unused = append(unused, found...)
+	}
+	sort.Slice(unused, func(i, j int) bool { return unused[i].lastUsed.Before(unused[j].lastUsed) })
+
+	if len(unused) == 0 {
+		fmt.Printf("No AppImages unused for more than %s.\n", *olderThan)
+		return 0
+	}
+
+	for _, u := range unused {
+		fmt.Printf("%-40s last used %s (%d days ago)\n", u.name, u.lastUsed.Format("2006-01-02"), int(time.Since(u.lastUsed).Hours()/24))
+	}
+
+	if *listOnly {
+		return 0
+	}
+
+	refresher := newDBRefresher(cfg.refreshDelay(), cfg.refreshMaxDelay())
+	removed := 0
+	reader := bufio.NewReader(os.Stdin)
+	for _, u := range unused {
+		fmt.Printf("Remove %s and its .desktop entry? [y/N] ", u.name)
+		answer, err := reader.ReadString('\n')
+		if err != nil && answer == "" {
+			fmt.Println()
+			break
+		}
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			continue
+		}
+
+		if err := removeAppImage(u); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing %s: %v\n", u.name, err)
+			continue
+		}
+		refresher.request(u.w.DesktopPath)
+		removed++
+	}
+
+	refresher.flush()
+	flushState(currentState())
+	if removed > 0 {
+		fmt.Printf("Removed %d AppImage(s).\n", removed)
+	}
+	return 0
+}
+
+// findUnusedAppImages returns the AppImages watched by w whose last use is
+// before cutoff. A binary's last use is the later of its access and
+// modification times, so the result is only as accurate as the atime
+// updates of the underlying mount (relatime updates at most daily, noatime
+// never).
+func findUnusedAppImages(w WatcherConfig, cutoff time.Time) ([]appImageUsage, error) {
+	paths, err := w.appImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var unused []appImageUsage
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Warnf("Skipping %s: %v", path, err)
+			continue
+		}
+
+		lastUsed := info.ModTime()
+		if atime := accessTime(info); atime.After(lastUsed) {
+			lastUsed = atime
+		}
+		if lastUsed.Before(cutoff) {
+			unused = append(unused, appImageUsage{
+				path:     path,
+				name:     appNameFromPath(path),
+				w:        w,
+				lastUsed: lastUsed,
+			})
+		}
+	}
+	return unused, nil
+}
+
+type appDiskUsage struct {
+	name     string
+	appImage int64
+	entry    int64
+	// generated is what the other files generated for the AppImage take,
+	// the ones removed along with its entry.
+	generated int64
+}
+
+func (u appDiskUsage) total() int64 {
+	return u.appImage + u.entry + u.generated
+}
+
+func reportSize(args []string) int {
+	fs := flag.NewFlagSet("report size", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report size: %v\n", err)
+		return exitCode(err)
+	}
+	if !isConfigValid(cfg) {
+		fmt.Fprintln(os.Stderr, "report size: configuration is incomplete, nothing to report")
+		return exitConfig
+	}
+
+	usages, err := collectDiskUsage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report size: %v\n", err)
+		return exitCode(err)
+	}
+
+	var sum appDiskUsage
+	fmt.Printf("%-40s %10s %10s %10s %10s\n", "APP", "APPIMAGE", "ENTRY", "GENERATED", "TOTAL")
+	for _, u := range usages {
+		fmt.Printf("%-40s %10s %10s %10s %10s\n", u.name, formatSize(u.appImage), formatSize(u.entry), formatSize(u.generated), formatSize(u.total()))
+		sum.appImage += u.appImage
+		sum.entry += u.entry
+		sum.generated += u.generated
+	}
+	fmt.Printf("%-40s %10s %10s %10s %10s\n", fmt.Sprintf("%d app(s)", len(usages)), formatSize(sum.appImage), formatSize(sum.entry), formatSize(sum.generated), formatSize(sum.total()))
+	return 0
+}
+
+// collectDiskUsage returns the space taken by every managed AppImage and the
+// files generated for it, largest first.
+func collectDiskUsage(cfg Config) ([]appDiskUsage, error) {
+	st, err := openState(cfg.dataDir())
+	if err != nil {
+		return nil, err
+	}
+	var usages []appDiskUsage
+	for _, w := range cfg.watchers() {
+		paths, err := w.appImages()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				log.Warnf("Skipping %s: %v", path, err)
+				continue
+			}
+
+			u := appDiskUsage{name: appNameFromPath(path), appImage: info.Size()}
+			if info, err := os.Stat(entryFile(st, w, path)); err == nil {
+				u.entry = info.Size()
+			}
+			for _, file := range st.artifactsOf(path, cfg.iconDir(), cfg.metainfoDir()) {
+				if info, err := os.Stat(file); err == nil {
+					u.generated += info.Size()
+				}
+			}
+			usages = append(usages, u)
+		}
+	}
+
+	sort.Slice(usages, func(i, j int) bool { return usages[i].total() > usages[j].total() })
+	return usages, nil
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// removeAppImage deletes the AppImage of u, then its entry and the files
+// its record lists the way the daemon does when an AppImage goes.
+func removeAppImage(u appImageUsage) error {
+	if err := os.Remove(u.path); err != nil {
+		return err
+	}
+	removeDesktopFile(u.w, u.path)
+	return nil
+}
+
+// appImages returns the AppImages w watches: the ones in app_path, or
+// app_path itself when it is a single AppImage that exists.
+func (w WatcherConfig) appImages() ([]string, error) {
+	file := w.appFile()
+	if file == "" {
+		return listAppImages(w.AppPath)
+	}
+	if _, err := os.Stat(filepath.Dir(file)); err != nil {
+		return nil, fmt.Errorf("failed to read app directory: %w", err)
+	}
+	if _, err := os.Lstat(file); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return []string{file}, nil
+}
+
+// listAppImages returns the paths of the AppImages directly inside appPath.
+func listAppImages(appPath string) ([]string, error) {
+	entries, err := os.ReadDir(appPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read app directory: %w", err)
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".AppImage") {
+			continue
+		}
+		paths = append(paths, filepath.Join(appPath, entry.Name()))
+	}
+	return paths, nil
+}
+
+func appNameFromPath(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".AppImage")
+}
+
+// parseAge parses durations such as "90d" or "2w" in addition to the units
+// understood by time.ParseDuration.
+func parseAge(s string) (time.Duration, error) {
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return d, nil
+	}
+
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
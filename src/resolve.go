@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Stages of the resolver chains, see ResolverConfig.
+const (
+	resolveFilename  = "filename"
+	resolveDesktop   = "desktop"
+	resolveAppStream = "appstream"
+	resolveCatalog   = "catalog"
+	resolveSnapshot  = "snapshot"
+	resolveConfig    = "config"
+	resolveStock     = "stock"
+)
+
+const (
+	// defaultCatalogURL is the AppImageHub feed the catalog stage looks
+	// AppImages up in.
+	defaultCatalogURL = "https://appimage.github.io/feed.json"
+	// catalogMaxAge is how long a downloaded catalog is used before it is
+	// fetched again, and catalogRetry how long after a failed download.
+	catalogMaxAge = 7 * 24 * time.Hour
+	catalogRetry  = time.Hour
+	// catalogIconBase is where the icons the feed lists by relative paths
+	// are downloaded from.
+	catalogIconBase = "https://appimage.github.io/database/"
+	// maxDownloadSize bounds the catalog and its icons.
+	maxDownloadSize = 64 << 20
+)
+
+// ResolverConfig is the [resolvers] table, which orders the stages entries
+// take their Name, Icon and Categories from. The first stage that knows a
+// value wins; stages left out are not asked.
+type ResolverConfig struct {
+	Name       []string `toml:"name,omitempty"`
+	Icon       []string `toml:"icon,omitempty"`
+	Categories []string `toml:"categories,omitempty"`
+	// CatalogURL is the feed of the catalog stage, in the format of
+	// AppImageHub's.
+	CatalogURL string `toml:"catalog_url,omitempty"`
+}
+
+// defaultResolvers is how entries were always made: named after the file,
+// with the embedded icon or else icon_path, and the watcher's categories.
+// Entries with neither icon get the stock one of their categories.
+var defaultResolvers = ResolverConfig{
+	Name:       []string{resolveFilename},
+	Icon:       []string{resolveDesktop, resolveConfig, resolveStock},
+	Categories: []string{resolveConfig},
+}
+
+// resolverFields lists the stages each field can be taken from.
+var resolverFields = map[string][]string{
+	"name":       {resolveFilename, resolveDesktop, resolveAppStream, resolveCatalog, resolveSnapshot},
+	"icon":       {resolveDesktop, resolveCatalog, resolveConfig, resolveStock},
+	"categories": {resolveDesktop, resolveAppStream, resolveCatalog, resolveSnapshot, resolveConfig},
+}
+
+// entryMetadata is what a stage knows about an entry, escaped for a desktop
+// entry. Values it doesn't know are empty.
+type entryMetadata struct {
+	Name, Icon, Categories string
+	// iconFunc, when set, gives Icon instead, for stages that download it
+	// only when the icon chain gets to them.
+	iconFunc func() string
+}
+
+// icon returns the Icon of m, from iconFunc when it has one.
+func (m entryMetadata) icon() string {
+	if m.iconFunc != nil {
+		return m.iconFunc()
+	}
+	return m.Icon
+}
+
+// resolverInput is what the stages resolve the metadata of the AppImage
+// named appName from.
+type resolverInput struct {
+	// ctx is that of the integration, which stops downloads.
+	ctx     context.Context
+	w       WatcherConfig
+	appName string
+	// icon is the one extracted from the AppImage, if any.
+	icon    string
+	info    appStreamInfo
+	payload payloadInfo
+	// categories are the resolved ones, which the icon is resolved after.
+	categories string
+}
+
+// metadataResolver is one stage of the resolver chains.
+type metadataResolver interface {
+	resolve(in resolverInput) entryMetadata
+}
+
+type resolverFunc func(in resolverInput) entryMetadata
+
+func (f resolverFunc) resolve(in resolverInput) entryMetadata {
+	return f(in)
+}
+
+// metadataResolvers are the stages by name.
+var metadataResolvers = map[string]metadataResolver{
+	resolveFilename: resolverFunc(func(in resolverInput) entryMetadata {
+		return entryMetadata{Name: displayName(in.appName)}
+	}),
+	resolveDesktop: resolverFunc(func(in resolverInput) entryMetadata {
+		return entryMetadata{
+			Name:       desktopString(in.payload.Name),
+			Icon:       desktopString(in.icon),
+			Categories: categoriesValue(in.payload.Categories),
+		}
+	}),
+	resolveAppStream: resolverFunc(func(in resolverInput) entryMetadata {
+		return entryMetadata{Name: in.info.names[""], Categories: categoriesValue(categoryList(in.info.categories))}
+	}),
+	resolveCatalog: resolverFunc(func(in resolverInput) entryMetadata {
+		c := currentCatalog()
+		if c == nil {
+			return entryMetadata{}
+		}
+		app, ok := c.lookup(in.ctx, in.appName)
+		if !ok {
+			return entryMetadata{}
+		}
+		return catalogMetadata(in.ctx, app)
+	}),
+	resolveSnapshot: resolverFunc(func(in resolverInput) entryMetadata {
+		app, ok := snapshotApps()[catalogKey(appBaseName(in.appName))]
+		if !ok {
+			return entryMetadata{}
+		}
+		return catalogMetadata(in.ctx, app)
+	}),
+	resolveConfig: resolverFunc(func(in resolverInput) entryMetadata {
+		m := entryMetadata{Categories: categoriesValue(in.w.Categories)}
+		if _, err := fsys.Stat(in.w.IconPath); err == nil {
+			// Warned about by the watcher otherwise.
+			m.Icon = desktopString(in.w.IconPath)
+		}
+		return m
+	}),
+	resolveStock: resolverFunc(func(in resolverInput) entryMetadata {
+		return entryMetadata{Icon: desktopString(stockIcon(in.categories))}
+	}),
+}
+
+var (
+	resolversMu sync.Mutex
+	resolvers   = defaultResolvers
+	catalog     *appCatalog
+	// catalogIconDir is where the icons of catalog apps are kept, and
+	// catalogIconTried when each was last downloaded.
+	catalogIconDir   string
+	catalogIconTried = make(map[string]time.Time)
+)
+
+func validateResolvers(cfg Config) error {
+	for field, stages := range cfg.Resolvers.fields() {
+		for _, stage := range stages {
+			if !containsString(resolverFields[field], stage) {
+				return fmt.Errorf("%s of [resolvers] may list %s, got %q", field, strings.Join(resolverFields[field], ", "), stage)
+			}
+		}
+	}
+	return nil
+}
+
+// fields returns the stages of r by field.
+func (r ResolverConfig) fields() map[string][]string {
+	return map[string][]string{"name": r.Name, "icon": r.Icon, "categories": r.Categories}
+}
+
+// configureResolvers sets the chains of cfg, where the ones it leaves empty
+// are those of defaultResolvers.
+func configureResolvers(cfg Config) {
+	r := cfg.Resolvers
+	if r.Name == nil {
+		r.Name = defaultResolvers.Name
+	}
+	if r.Icon == nil {
+		r.Icon = defaultResolvers.Icon
+	}
+	if r.Categories == nil {
+		r.Categories = defaultResolvers.Categories
+	}
+	if r.CatalogURL == "" {
+		r.CatalogURL = defaultCatalogURL
+	}
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	resolvers = r
+	catalog = &appCatalog{url: r.CatalogURL, path: filepath.Join(cfg.dataDir(), "catalog.json")}
+	catalogIconDir = filepath.Join(cfg.iconDir(), "catalog")
+	stockIconDir = filepath.Join(cfg.iconDir(), "stock")
+}
+
+// resolveMetadata runs the chains for in. Each stage is asked once, and
+// only when a chain gets to it. The name falls back to the file name, so
+// that every entry has one.
+func resolveMetadata(in resolverInput) entryMetadata {
+	resolversMu.Lock()
+	r := resolvers
+	resolversMu.Unlock()
+	known := make(map[string]entryMetadata)
+	first := func(stages []string, value func(entryMetadata) string) string {
+		for _, stage := range stages {
+			m, ok := known[stage]
+			if !ok {
+				m = metadataResolvers[stage].resolve(in)
+				known[stage] = m
+			}
+			if v := value(m); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	m := entryMetadata{
+		Name:       first(r.Name, func(m entryMetadata) string { return m.Name }),
+		Categories: first(r.Categories, func(m entryMetadata) string { return m.Categories }),
+	}
+	in.categories = m.Categories
+	m.Icon = first(r.Icon, entryMetadata.icon)
+	if m.Name == "" {
+		m.Name = displayName(in.appName)
+	}
+	return m
+}
+
+// categoriesValue returns value made freedesktop categories by
+// normalizeCategories, escaped for a desktop entry. Tests of the escaping
+// swap it for one leaving the categories as they are.
+var categoriesValue = func(value string) string {
+	normalized, _ := normalizeCategories(value)
+	return desktopString(normalized)
+}
+
+// categoryList returns the Categories value listing categories.
+func categoryList(categories []string) string {
+	if len(categories) == 0 {
+		return ""
+	}
+	return strings.Join(categories, ";") + ";"
+}
+
+// catalogApp is an app of the catalog feed.
+type catalogApp struct {
+	Name       string   `json:"name"`
+	Categories []string `json:"categories,omitempty"`
+	// Icons are URLs, or paths relative to catalogIconBase.
+	Icons []string `json:"icons,omitempty"`
+}
+
+// catalogMetadata returns what the catalog says about app. Its icon is only
+// downloaded when the icon chain asks for it.
+func catalogMetadata(ctx context.Context, app catalogApp) entryMetadata {
+	return entryMetadata{
+		Name:       desktopString(app.Name),
+		Categories: categoriesValue(categoryList(app.Categories)),
+		iconFunc:   func() string { return desktopString(catalogIcon(ctx, app)) },
+	}
+}
+
+// parseCatalog returns the apps of a feed in the format of AppImageHub's by
+// catalogKey.
+func parseCatalog(content []byte) (map[string]catalogApp, error) {
+	var feed struct {
+		Items []catalogApp `json:"items"`
+	}
+	if err := json.Unmarshal(content, &feed); err != nil {
+		return nil, err
+	}
+	apps := make(map[string]catalogApp, len(feed.Items))
+	for _, app := range feed.Items {
+		if key := catalogKey(app.Name); key != "" {
+			apps[key] = app
+		}
+	}
+	return apps, nil
+}
+
+// catalogIcon returns the first icon of app in a format entries can use,
+// downloaded to catalogIconDir when it is first asked for. It is "" when
+// app has none, or it can't be downloaded, which is tried again after
+// catalogRetry. Other icons are resolved while it downloads.
+func catalogIcon(ctx context.Context, app catalogApp) string {
+	key := catalogKey(app.Name)
+	for _, icon := range app.Icons {
+		ext := strings.ToLower(filepath.Ext(icon))
+		if key == "" || !containsString(iconExtensions, ext) {
+			continue
+		}
+		link := icon
+		if !strings.Contains(link, "://") {
+			link = catalogIconBase + strings.TrimPrefix(link, "/")
+		}
+		resolversMu.Lock()
+		path := filepath.Join(catalogIconDir, key+ext)
+		have := isRegularFile(path)
+		due := !have && time.Since(catalogIconTried[link]) >= catalogRetry
+		if due {
+			catalogIconTried[link] = time.Now()
+		}
+		resolversMu.Unlock()
+		if have {
+			return path
+		}
+		if !due {
+			return ""
+		}
+		if err := downloadFile(ctx, link, path); err != nil {
+			log.Warnf("Could not download the icon of %s from %s: %v", app.Name, link, err)
+			return ""
+		}
+		return path
+	}
+	return ""
+}
+
+// appCatalog is the catalog the catalog stage looks apps up in, downloaded
+// from url to path on first use and when it is older than catalogMaxAge.
+type appCatalog struct {
+	url, path string
+
+	mu       sync.Mutex
+	apps     map[string]catalogApp
+	loadedAt time.Time
+	triedAt  time.Time
+}
+
+func currentCatalog() *appCatalog {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	return catalog
+}
+
+// lookup returns the app of the catalog the AppImage named appName is,
+// matched by its name without version and architecture. The catalog is
+// downloaded first when it is missing or stale; a catalog that can't be
+// downloaded is used as it is, and the download retried after
+// catalogRetry. Lookups meanwhile use the catalog loaded before.
+func (c *appCatalog) lookup(ctx context.Context, appName string) (catalogApp, bool) {
+	c.mu.Lock()
+	due := c.apps == nil || time.Since(c.loadedAt) > catalogMaxAge
+	download := due && c.downloadDue()
+	if download {
+		c.triedAt = time.Now()
+	}
+	c.mu.Unlock()
+	if download {
+		if err := downloadFile(ctx, c.url, c.path); err != nil {
+			log.Warnf("Could not download the app catalog %s: %v", c.url, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if due {
+		c.load()
+	}
+	app, ok := c.apps[catalogKey(appBaseName(appName))]
+	return app, ok
+}
+
+// downloadDue reports whether the catalog at c.path is missing or older than
+// catalogMaxAge and wasn't tried to be downloaded within catalogRetry; it
+// is called with c.mu held.
+func (c *appCatalog) downloadDue() bool {
+	info, err := os.Stat(c.path)
+	return (err != nil || time.Since(info.ModTime()) > catalogMaxAge) && time.Since(c.triedAt) > catalogRetry
+}
+
+// load reads the catalog from c.path; it is called with c.mu held.
+func (c *appCatalog) load() {
+	content, err := os.ReadFile(c.path)
+	if err == nil {
+		var apps map[string]catalogApp
+		if apps, err = parseCatalog(content); err == nil {
+			c.apps, c.loadedAt = apps, time.Now()
+			return
+		}
+		log.Warnf("Could not read the app catalog %s: %v", c.path, err)
+	}
+	if c.apps == nil {
+		c.apps = make(map[string]catalogApp)
+	}
+}
+
+// downloadFile replaces path with what link serves, up to maxDownloadSize.
+func downloadFile(ctx context.Context, link, path string) error {
+	body, err := fetch(ctx, link)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	content, err := io.ReadAll(io.LimitReader(body, maxDownloadSize+1))
+	if err != nil {
+		return err
+	}
+	if len(content) > maxDownloadSize {
+		return fmt.Errorf("larger than %d MB", maxDownloadSize>>20)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return replaceFile(path, content)
+}
+
+// appBaseName returns appName without the version and architecture that
+// AppImage names usually end in, such as "Krita" for
+// "krita-5.2.2-x86_64".
+func appBaseName(appName string) string {
+	fields := strings.FieldsFunc(appName, func(r rune) bool { return r == '-' || r == '_' || r == ' ' })
+	for i, field := range fields {
+		if i == 0 {
+			continue
+		}
+		version := strings.TrimLeft(field, "vV")
+		if (version != "" && unicode.IsDigit(rune(version[0]))) || containsString(appArchitectures, strings.ToLower(field)) {
+			return strings.Join(fields[:i], " ")
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// appArchitectures are the architecture suffixes of AppImage names.
+var appArchitectures = []string{"x86", "x64", "amd64", "aarch64", "arm64", "armhf", "i386", "i686"}
+
+// catalogKey is name lowercased without anything but letters and digits,
+// which is how AppImage names are matched with catalog entries.
+func catalogKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// root_apps values, see WatcherConfig.RootApps.
+const (
+	rootAppsHide   = "hide"
+	rootAppsPkexec = "pkexec"
+	rootAppsShow   = "show"
+)
+
+const (
+	defaultPolkitDir = "/usr/share/polkit-1/actions"
+	// polkitActionPrefix starts the polkit actions written for AppImages.
+	polkitActionPrefix = "io.github.lrx0014.desktopimage.run-"
+)
+
+// rootPrograms are what desktop files run programs as root with.
+var rootPrograms = []string{"pkexec", "sudo", "gksu", "gksudo", "kdesu", "kdesudo", "beesu", "su-to-root"}
+
+var (
+	rootAppsMu sync.Mutex
+	polkitDir  = defaultPolkitDir
+)
+
+func (c Config) polkitDir() string {
+	if c.PolkitDir != "" {
+		return c.PolkitDir
+	}
+	return defaultPolkitDir
+}
+
+func validateRootApps(cfg Config) error {
+	for _, w := range cfg.watchers() {
+		switch w.RootApps {
+		case "", rootAppsHide, rootAppsPkexec, rootAppsShow:
+		default:
+			return fmt.Errorf("root_apps of watcher %s must be %q, %q or %q, got %q", w.label(), rootAppsHide, rootAppsPkexec, rootAppsShow, w.RootApps)
+		}
+	}
+	return nil
+}
+
+func configureRootApps(cfg Config) {
+	rootAppsMu.Lock()
+	defer rootAppsMu.Unlock()
+	polkitDir = cfg.polkitDir()
+}
+
+// payloadNeedsRoot tells from the desktop file at the root of an extracted
+// payload whether the app only works as root: KDE marks such entries with
+// X-KDE-SubstituteUID, others start the program through one of
+// rootPrograms.
+func payloadNeedsRoot(root string) bool {
+	if strings.EqualFold(rootDesktopValue(root, "X-KDE-SubstituteUID"), "true") {
+		return true
+	}
+	fields := execFields(rootDesktopValue(root, "Exec"))
+	return len(fields) > 0 && containsString(rootPrograms, filepath.Base(fields[0]))
+}
+
+// needsRoot reports whether the AppImage named appName only works as root,
+// as its [App.<name>] table says or else its payload.
+func needsRoot(appName string) bool {
+	if requires := appConfig(appName).RequiresRoot; requires != nil {
+		return *requires
+	}
+	return extractedPayload(appName).RequiresRoot
+}
+
+// rootHandling returns how the entries of w launch the AppImage named
+// appName when it needs root: root_apps, which defaults to hiding them, or
+// "" when it doesn't need root.
+func rootHandling(w WatcherConfig, appName string) string {
+	if !needsRoot(appName) {
+		return ""
+	}
+	if w.RootApps == "" {
+		return rootAppsHide
+	}
+	return w.RootApps
+}
+
+// polkitAction returns the polkit action that lets target, the program the
+// entry of an AppImage runs, run through pkexec, named after it and its
+// path.
+func polkitAction(target string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(target)))
+	var b strings.Builder
+	for _, r := range strings.ToLower(appNameFromPath(target)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	return polkitActionPrefix + b.String() + "-" + hex.EncodeToString(sum[:4])
+}
+
+// polkitPolicyPath returns where the policy of polkitAction(target) is
+// written.
+func polkitPolicyPath(target string) string {
+	rootAppsMu.Lock()
+	defer rootAppsMu.Unlock()
+	return filepath.Join(polkitDir, polkitAction(target)+".policy")
+}
+
+// polkitPolicy returns the policy of polkitAction(target). It asks for an
+// administrator's password every time and lets the app keep the display,
+// which pkexec drops otherwise.
+func polkitPolicy(target string) string {
+	name := html.EscapeString(displayName(appNameFromPath(target)))
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE policyconfig PUBLIC "-//freedesktop//DTD PolicyKit Policy Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/PolicyKit/1/policyconfig.dtd">
+<policyconfig>
+  <action id="%s">
+    <description>Run %s as root</description>
+    <message>Authentication is required to run %s</message>
+    <defaults>
+      <allow_any>auth_admin</allow_any>
+      <allow_inactive>auth_admin</allow_inactive>
+      <allow_active>auth_admin</allow_active>
+    </defaults>
+    <annotate key="org.freedesktop.policykit.exec.path">%s</annotate>
+    <annotate key="org.freedesktop.policykit.exec.allow_gui">true</annotate>
+  </action>
+</policyconfig>
+`, polkitAction(target), name, name, html.EscapeString(filepath.Clean(target)))
+}
+
+// installPolkitPolicy writes the policy for target unless it is in place
+// already. Only a target nobody but root can replace gets one; the policy of
+// a target that stopped being one is removed.
+func installPolkitPolicy(target string) error {
+	policy := polkitPolicy(target)
+	dest := polkitPolicyPath(target)
+	if err := rootOnly(target); err != nil {
+		if err := fsys.Remove(dest); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove polkit policy: %w", err)
+		}
+		return err
+	}
+	if existing, err := fsys.ReadFile(dest); err == nil && string(existing) == policy {
+		return nil
+	}
+	if err := fsys.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create polkit directory: %w", err)
+	}
+	if err := replaceFile(dest, []byte(policy)); err != nil {
+		return fmt.Errorf("failed to write polkit policy: %w", err)
+	}
+	return nil
+}
+
+// rootOnly checks that nobody but root can replace target: it and every
+// directory above it, both as written and with symlinks resolved, are owned
+// by root and not writable by group or others.
+func rootOnly(target string) error {
+	resolved, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{filepath.Clean(target), resolved} {
+		for {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); !ok || st.Uid != 0 {
+				return fmt.Errorf("%s is not owned by root", path)
+			}
+			if info.Mode().Perm()&0022 != 0 {
+				return fmt.Errorf("%s is writable by group or others", path)
+			}
+			parent := filepath.Dir(path)
+			if parent == path {
+				break
+			}
+			path = parent
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock ABI, see linux/landlock.h.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	accessFSExecute    = 1 << 0
+	accessFSWriteFile  = 1 << 1
+	accessFSReadFile   = 1 << 2
+	accessFSReadDir    = 1 << 3
+	accessFSRemoveDir  = 1 << 4
+	accessFSRemoveFile = 1 << 5
+	accessFSMakeDir    = 1 << 7
+	accessFSMakeReg    = 1 << 8
+	accessFSMakeSym    = 1 << 12
+	accessFSTruncate   = 1 << 14
+
+	accessNetBindTCP    = 1 << 0
+	accessNetConnectTCP = 1 << 1
+
+	prSetNoNewPrivs = 38
+)
+
+const (
+	accessRead  = accessFSExecute | accessFSReadFile | accessFSReadDir
+	accessWrite = accessRead | accessFSWriteFile | accessFSMakeDir | accessFSMakeReg | accessFSMakeSym |
+		accessFSRemoveDir | accessFSRemoveFile | accessFSTruncate
+	// Rights that apply to files rather than directories.
+	accessFile = accessFSExecute | accessFSWriteFile | accessFSReadFile | accessFSTruncate
+)
+
+// systemReadPaths are what an unsquashfs binary needs to be loaded and run.
+var systemReadPaths = []string{"/usr", "/lib", "/lib64", "/bin", "/sbin", "/etc", "/proc", "/sys", "/nix/store"}
+
+type landlockRulesetAttr struct {
+	handledAccessFS  uint64
+	handledAccessNet uint64
+}
+
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+var (
+	landlockOnce sync.Once
+	landlockABI  int
+)
+
+func landlockVersion() int {
+	landlockOnce.Do(func() {
+		v, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+		if errno != 0 {
+			log.Infof("Landlock is not available (%v), icon extraction runs unconfined.", errno)
+			return
+		}
+		landlockABI = int(v)
+	})
+	return landlockABI
+}
+
+// runSandboxed runs fn like runLowPriority, but on a thread that may only
+// read system directories and the files in readOnly, write below writable
+// and not use TCP. Processes started by fn inherit the restrictions. On
+// kernels without Landlock fn runs unconfined.
+func runSandboxed(readOnly []string, writable string, fn func()) error {
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The thread is restricted for good, so it must not be reused.
+		runtime.LockOSThread()
+		lowerThreadPriority(currentPriority())
+		if err = restrictThread(readOnly, writable); err != nil {
+			return
+		}
+		fn()
+	}()
+	<-done
+	return err
+}
+
+func restrictThread(readOnly []string, writable string) error {
+	abi := landlockVersion()
+	if abi == 0 {
+		return nil
+	}
+
+	handledFS := uint64(1<<13 - 1)
+	if abi >= 2 {
+		handledFS = 1<<14 - 1
+	}
+	if abi >= 3 {
+		handledFS = 1<<15 - 1
+	}
+	attr := landlockRulesetAttr{handledAccessFS: handledFS}
+	size := unsafe.Sizeof(attr.handledAccessFS)
+	if abi >= 4 {
+		attr.handledAccessNet = accessNetBindTCP | accessNetConnectTCP
+		size = unsafe.Sizeof(attr)
+	}
+
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), size, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %w", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	allow := func(path string, access uint64, required bool) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			if required {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			access &= accessFile
+		}
+		access &= handledFS
+
+		pathFd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(pathFd)
+		rule := landlockPathBeneathAttr{allowedAccess: access, parentFd: int32(pathFd)}
+		if _, _, errno := syscall.Syscall6(sysLandlockAddRule, fd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("failed to allow %s: %w", path, errno)
+		}
+		return nil
+	}
+
+	for _, path := range systemReadPaths {
+		if err := allow(path, accessRead, false); err != nil {
+			return err
+		}
+	}
+	for _, path := range readOnly {
+		if err := allow(path, accessRead, true); err != nil {
+			return err
+		}
+	}
+	if err := allow(os.DevNull, accessFSReadFile|accessFSWriteFile, false); err != nil {
+		return err
+	}
+	if err := allow(writable, accessWrite, true); err != nil {
+		return err
+	}
+
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to restrict thread: %w", errno)
+	}
+	return nil
+}
+
+// isolateNetwork starts cmd in a network namespace of its own when the
+// daemon is allowed to create one.
+func isolateNetwork(cmd *exec.Cmd) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+}
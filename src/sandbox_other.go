@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// runSandboxed runs fn without further restrictions; Landlock is Linux only.
+func runSandboxed(readOnly []string, writable string, fn func()) error {
+	runLowPriority(fn)
+	return nil
+}
+
+func isolateNetwork(cmd *exec.Cmd) {}
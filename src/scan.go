@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const scanProgressInterval = 2 * time.Second
+
+// scanWorkers returns the number of files reconciled concurrently.
+func scanWorkers(cfg Config) int {
+	if cfg.ScanWorkers > 0 {
+		return cfg.ScanWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// reconcile brings desktop_path in line with the AppImages currently present
+// in app_path: missing or outdated entries are written and entries pointing
+// at AppImages that no longer exist are removed. It is run when a watcher
+// starts and the journal shows it may have missed events while it was not
+// watching, or when its settings changed. What it changed is recorded as
+// the latest reconcileReport of w.
+func reconcile(ctx context.Context, w WatcherConfig, workers int, refresher *dbRefresher) {
+	start := time.Now()
+	report := newReconcileCollector(w, start)
+	paths, err := w.appImages()
+	if err != nil {
+		w.logger().Errorf("Error scanning app directory %s: %v", w.AppPath, err)
+		report.failed(w.AppPath, err)
+		recordReconcile(report.finish(0, false))
+		return
+	}
+
+	w.logger().Infof("Scanning %d AppImage(s) in %s with %d worker(s)...", len(paths), w.AppPath, workers)
+
+	st := currentState()
+	jobs := make(chan string)
+	var processed, updated int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer reportPanics()
+			runLowPriority(func() {
+				for path := range jobs {
+					_, known := st.get(path)
+					changed := integrateAppImage(ctx, w, path, refresher)
+					if changed {
+						atomic.AddInt64(&updated, 1)
+					}
+					if ctx.Err() == nil {
+						_, recorded := st.get(path)
+						report.integrated(path, known, recorded, changed)
+					}
+					atomic.AddInt64(&processed, 1)
+				}
+			})
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(scanProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				w.logger().Infof("Scan progress: %d/%d AppImage(s) processed", atomic.LoadInt64(&processed), len(paths))
+			}
+		}
+	}()
+
+feed:
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- path:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(done)
+
+	recorded := st.watchedBy(w)
+	removed := removeVanishedApps(w) + removeOrphanedEntries(w)
+	for _, app := range recorded {
+		if _, ok := st.get(app.Path); !ok {
+			report.removed(app.Path)
+		}
+	}
+	currentFailures().prune()
+	flushState(st)
+	recordScan(w, scanResult{
+		FinishedAt: time.Now(),
+		Duration:   time.Since(start).Round(time.Millisecond).String(),
+		AppImages:  len(paths),
+		Written:    updated,
+		Removed:    removed,
+	})
+	recordReconcile(report.finish(len(paths), ctx.Err() != nil))
+	w.logger().Infof("Scan of %s finished in %s: %d entr(ies) written, %d removed", w.AppPath, time.Since(start).Round(time.Millisecond), updated, removed)
+	if updated > 0 || removed > 0 {
+		refresher.request(w.DesktopPath)
+	}
+}
+
+// integrateAppImage (re)writes the .desktop file for the AppImage at path,
+// or removes it if the AppImage is not executable, and reports whether the
+// entry changed. Once ctx is done it gives up, leaving things as they were.
+// With detect_duplicates, the entry of an identical copy it is preferred over
+// is removed, and the desktop database refreshed with refresher.
+func integrateAppImage(ctx context.Context, w WatcherConfig, path string, refresher *dbRefresher) bool {
+	appName := appNameFromPath(path)
+	countActivity(w, activitySeen)
+	if err := checkSymlink(w, path); err != nil {
+		countActivity(w, activitySkipped)
+		if removeDesktopFile(w, path) {
+			return true
+		}
+		w.logger().Infof("Not integrating %s: %v", path, err)
+		return false
+	}
+	executable, err := ensureExecutable(w, path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			w.logger().Errorf("Error checking permissions of %s: %v", path, err)
+			integrationFailed(w, path, err)
+		}
+		return false
+	}
+	if !executable {
+		// Either copied without the execute bit, in which case a later
+		// chmod integrates it, or the bit was just taken away.
+		countActivity(w, activitySkipped)
+		if removeDesktopFile(w, path) {
+			return true
+		}
+		w.logger().Infof("Ignoring %s until it is made executable", path)
+		return false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		w.logger().Errorf("Error reading %s: %v", path, err)
+		integrationFailed(w, path, err)
+		return false
+	}
+	st := currentState()
+	movedFrom := ""
+	if id, ok := fileIDOf(info); ok {
+		if from, ok := st.moved(w, path, id); ok {
+			w.logger().Infof("%s was moved from %s, updating its entry", path, from)
+			movedFrom = from
+		}
+		if other, dup := st.claimFile(path, id); dup {
+			countActivity(w, activitySkipped)
+			if removeDesktopFile(w, path) {
+				return true
+			}
+			w.logger().Infof("Not integrating %s, it is the same file as %s", path, other)
+			return false
+		}
+	}
+	prev, known := st.get(path)
+	record, srcChanged, err := sourceChanged(st.detectionFor(info.Size()), path, info, prev, known)
+	if err != nil {
+		w.logger().Errorf("Error checking %s for changes: %v", path, err)
+		integrationFailed(w, path, err)
+		return false
+	}
+	sum, err := st.hashFor(path, info, prev, record, known)
+	if err != nil {
+		w.logger().Errorf("Error hashing %s: %v", path, err)
+		integrationFailed(w, path, err)
+		return false
+	}
+	record.SHA256 = sum
+	if sum != "" {
+		switch other, dup := duplicates.claim(w, path, sum); {
+		case dup:
+			countActivity(w, activitySkipped)
+			w.logger().Warnf("Not integrating %s, it is identical to %s", path, other.path)
+			return removeDesktopFile(w, path)
+		case other.path != "":
+			other.w.logger().Infof("Replacing the entry of %s with the one of its preferred copy %s", other.path, path)
+			if removeDesktopFile(other.w, other.path) {
+				refresher.request(other.w.DesktopPath)
+			}
+		}
+	}
+
+	desktopFilePath := assignDesktopFile(st, w, path)
+	var txn *integrationTxn
+	if _, err := os.Stat(desktopFilePath); srcChanged || !known || err != nil {
+		// Icons and metadata are (re)extracted, so make sure they don't
+		// outlive a crash halfway through.
+		if limiter.wait(ctx) != nil {
+			return false
+		}
+		txn = st.beginIntegration(w, path, desktopFilePath, !known)
+	}
+	changed, err := createDesktopFile(ctx, w, path, desktopFilePath, sum, srcChanged)
+	artifacts := generatedArtifacts(w, path, desktopFilePath)
+	txn.generated(artifacts)
+	if ctx.Err() != nil {
+		// Stopped halfway; the next scan integrates it.
+		txn.rollback()
+		return false
+	}
+	if errors.Is(err, errRejected) {
+		txn.rollback()
+		countActivity(w, activityRejected)
+		if err := quarantineAppImage(w, path, err); err != nil {
+			w.logger().Errorf("Error quarantining %s: %v", path, err)
+		}
+		return false
+	}
+	if err != nil {
+		txn.rollback()
+		w.logger().Errorf("Error creating .desktop file for %s: %v", appName, err)
+		integrationFailed(w, path, err)
+		return false
+	}
+	integrationSucceeded(path)
+	if auditMode() {
+		if changed {
+			w.logger().Infof("Audit mode: would write .desktop file for %s", appName)
+		}
+		return changed
+	}
+	if changed {
+		w.logger().Infof("Updated .desktop file for %s", appName)
+	}
+	if known && prev.DesktopFile != "" && prev.DesktopFile != desktopFilePath &&
+		(movedFrom != "" || launchesAppImage(w, path, entryExecTarget(prev.DesktopFile))) {
+		// The naming settings changed since the entry was written, or it
+		// was moved from a watcher naming entries differently.
+		removeLegacyEntry(w, prev.DesktopFile)
+		changed = true
+	}
+	record.Artifacts = artifacts
+	if known && removeStaleArtifacts(w, prev.Artifacts, record.Artifacts) > 0 {
+		changed = true
+	}
+	if srcChanged || !known || record.UpdateInfo == "" {
+		if record.UpdateInfo, err = readUpdateInfo(path); err != nil {
+			w.logger().Debugf("Error reading the update information of %s: %v", path, err)
+		}
+	}
+	record.MimeDefaults = claimMimeDefaults(w, path, desktopFilePath, prev.MimeDefaults)
+	if changed || srcChanged || record.Inode != prev.Inode || record.SHA256 != prev.SHA256 || !equalStrings(record.Artifacts, prev.Artifacts) || record.UpdateInfo != prev.UpdateInfo ||
+		!equalMimeDefaults(record.MimeDefaults, prev.MimeDefaults) {
+		record.DesktopFile = desktopFilePath
+		record.Watcher = w.label()
+		record.IntegratedAt = time.Now()
+		st.put(record)
+	}
+	if sum != "" && !duplicates.owns(path, sum) && removeDesktopFile(w, path) {
+		// A preferred copy was claimed while the entry was being written.
+		changed = true
+	}
+	if !changed {
+		txn.done()
+		return false
+	}
+	if txn == nil {
+		txn = st.beginIntegration(w, path, desktopFilePath, !known)
+	}
+	countActivity(w, activityIntegrated)
+	// The caller requests the database refresh, which finishes txn.
+	txn.written()
+	return true
+}
+
+// removeVanishedApps cleans up after the AppImages recorded in the state of
+// w's app_path that no longer exist.
+func removeVanishedApps(w WatcherConfig) int {
+	removed := 0
+	for _, app := range currentState().watchedBy(w) {
+		if _, err := os.Stat(app.Path); !os.IsNotExist(err) {
+			continue
+		}
+		if removeDesktopFile(w, app.Path) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// removeOrphanedEntries deletes the .desktop files in desktop_path, and the
+// icons extracted for them, whose Exec points at an AppImage in app_path that
+// no longer exists, as well as entries still named the way they were before
+// desktopFileName transliterated them. Entries not generated for app_path
+// are left alone.
+func removeOrphanedEntries(w WatcherConfig) int {
+	entries, err := fsys.ReadDir(w.DesktopPath)
+	if os.IsNotExist(err) {
+		// Nothing was written yet; the directory is created with the first entry.
+		return 0
+	}
+	if err != nil {
+		w.logger().Errorf("Error reading desktop directory %s: %v", w.DesktopPath, err)
+		return 0
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".desktop") {
+			continue
+		}
+
+		desktopFilePath := filepath.Join(w.DesktopPath, entry.Name())
+		target := entryExecTarget(desktopFilePath)
+		if !w.watches(target) {
+			continue
+		}
+		if _, err := fsys.Stat(target); !os.IsNotExist(err) {
+			if legacyEntryName(w, entry.Name(), target) {
+				removed += removeLegacyEntry(w, desktopFilePath)
+			}
+			continue
+		}
+
+		if auditMode() {
+			w.logger().Infof("Audit mode: would remove orphaned .desktop file %s", desktopFilePath)
+			removed++
+			continue
+		}
+		if err := fsys.Remove(desktopFilePath); err != nil {
+			w.logger().Errorf("Error removing orphaned .desktop file %s: %v", desktopFilePath, err)
+			continue
+		}
+		w.logger().Infof("Removed orphaned .desktop file %s", desktopFilePath)
+		opts, _ := currentExtraction()
+		st := currentState()
+		removeArtifacts(st.artifactsOf(target, opts.iconDir, opts.metainfoDir))
+		st.remove(target)
+		removed++
+	}
+	return removed
+}
+
+// legacyEntryName reports whether name is what the entry for the AppImage at
+// target was called before file names were transliterated, and has been
+// replaced since.
+func legacyEntryName(w WatcherConfig, name, target string) bool {
+	appName := appNameFromPath(target)
+	return name == appName+".desktop" && name != desktopFileName(w, appName)
+}
+
+func removeLegacyEntry(w WatcherConfig, desktopFilePath string) int {
+	if auditMode() {
+		w.logger().Infof("Audit mode: would remove renamed .desktop file %s", desktopFilePath)
+		return 1
+	}
+	if err := fsys.Remove(desktopFilePath); err != nil {
+		w.logger().Errorf("Error removing renamed .desktop file %s: %v", desktopFilePath, err)
+		return 0
+	}
+	w.logger().Infof("Removed .desktop file %s, which has been renamed", desktopFilePath)
+	return 1
+}
+
+// entryExecTarget returns the program named by the Exec key of a desktop
+// entry, or "" if it has none.
+func entryExecTarget(desktopFilePath string) string {
+	return execProgram(desktopEntryValue(desktopFilePath, "Exec"))
+}
+
+// desktopEntryValue returns the value of key in the [Desktop Entry] group of
+// a desktop file, or "" if it is not set.
+func desktopEntryValue(desktopFilePath, key string) string {
+	content, err := fsys.ReadFile(desktopFilePath)
+	if err != nil {
+		return ""
+	}
+	return entryValue(content, key)
+}
+
+// entryValue returns the value of key in the [Desktop Entry] group of the
+// desktop file content, or "" if it is not set.
+func entryValue(content []byte, key string) string {
+	inEntry := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inEntry = line == "[Desktop Entry]"
+			continue
+		}
+		if !inEntry {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The self-test AppImage carries no squashfs image, so the self-test turns
+// icon extraction off and gives its watcher icon_path instead.
+var (
+	//go:embed selftest/SelfTest.AppImage
+	selfTestAppImage []byte
+	//go:embed selftest/selftest.png
+	selfTestIcon []byte
+)
+
+// selfTestTimeout is how long each step of the self-test may take.
+const selfTestTimeout = 10 * time.Second
+
+// runSelftest runs the daemon on a configuration of its own in a temporary
+// directory, drops the bundled AppImage into the watched directory and checks
+// that its entry is written and removed again. It leaves the configuration,
+// state and entries of the installed daemon alone.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	verbose := fs.Bool("verbose", false, "show the log of the daemon under test")
+	keep := fs.Bool("keep", false, "keep the temporary directory")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	dir, err := os.MkdirTemp("", "desktopimage-selftest-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "selftest: %v\n", err)
+		return exitCode(err)
+	}
+	if *keep {
+		fmt.Printf("Working in %s.\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	logs := &lockedBuffer{}
+	out := log.Out
+	log.Out = logs
+	defer func() { log.Out = out }()
+
+	ok := selftest(dir)
+	if !ok || *verbose {
+		fmt.Fprintf(os.Stderr, "\nLog of the daemon under test:\n%s", logs.String())
+	}
+	if !ok {
+		fmt.Println("Self-test failed.")
+		return exitFailure
+	}
+	fmt.Println("Self-test passed.")
+	return 0
+}
+
+// selftest runs the steps of the self-test in dir, printing the outcome of
+// each, and reports whether they all passed.
+func selftest(dir string) bool {
+	w := WatcherConfig{
+		Name:        "selftest",
+		AppPath:     filepath.Join(dir, "apps"),
+		DesktopPath: filepath.Join(dir, "applications"),
+		IconPath:    filepath.Join(dir, "selftest.png"),
+		Categories:  "Utility;",
+	}
+	dataDir := filepath.Join(dir, "data")
+	configFilePath := filepath.Join(dir, "config", "config.toml")
+	appImage := filepath.Join(w.AppPath, "SelfTest.AppImage")
+	entry := filepath.Join(w.DesktopPath, desktopFileName(w, "SelfTest"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	step := func(name string, run func() error) bool {
+		if err := run(); err != nil {
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			return false
+		}
+		fmt.Printf("ok    %s\n", name)
+		return true
+	}
+
+	started := false
+	passed := step("set up the watch and desktop directories", func() error {
+		for _, d := range []string{w.AppPath, w.DesktopPath, dataDir, filepath.Dir(configFilePath)} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return err
+			}
+		}
+		if err := os.WriteFile(w.IconPath, selfTestIcon, 0644); err != nil {
+			return err
+		}
+		return os.WriteFile(configFilePath, []byte(selfTestConfig(w, dataDir)), 0644)
+	}) && step("start the daemon", func() error {
+		go func() { done <- runDaemon(ctx, configFilePath) }()
+		started = true
+		socket := filepath.Join(dataDir, "control.sock")
+		return selfTestWait("the control socket", done, func() bool {
+			_, err := os.Stat(socket)
+			return err == nil
+		})
+	}) && step("integrate an added AppImage", func() error {
+		if err := os.WriteFile(appImage, selfTestAppImage, 0755); err != nil {
+			return err
+		}
+		if err := selfTestWait("the entry", done, func() bool {
+			_, err := os.Stat(entry)
+			return err == nil
+		}); err != nil {
+			return err
+		}
+		for key, want := range map[string]string{"Icon": w.IconPath, "Categories": w.Categories} {
+			if got := desktopEntryValue(entry, key); got != want {
+				return fmt.Errorf("%s=%s in %s, want %s", key, got, entry, want)
+			}
+		}
+		if got := entryExecTarget(entry); got != appImage {
+			return fmt.Errorf("the entry launches %q, want %s", got, appImage)
+		}
+		return nil
+	}) && step("remove the entry of a removed AppImage", func() error {
+		if err := os.Remove(appImage); err != nil {
+			return err
+		}
+		return selfTestWait("the entry to be removed", done, func() bool {
+			_, err := os.Stat(entry)
+			return os.IsNotExist(err)
+		})
+	})
+	if !started {
+		return passed
+	}
+	// Also after a failure, so that the daemon is done with the directory
+	// before it is removed.
+	return step("stop the daemon", func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(selfTestTimeout):
+			return fmt.Errorf("still running after %s", selfTestTimeout)
+		}
+	}) && passed
+}
+
+// selfTestConfig returns the configuration of the daemon under test, which
+// keeps everything it writes in dataDir.
+func selfTestConfig(w WatcherConfig, dataDir string) string {
+	return fmt.Sprintf(`settle_delay = "50ms"
+refresh_delay = "10ms"
+data_dir = %q
+control_socket = %q
+status_file = %q
+extract_icons = false
+
+[[Watcher]]
+name = %q
+app_path = %q
+desktop_path = %q
+icon_path = %q
+categories = %q
+`, dataDir, filepath.Join(dataDir, "control.sock"), filepath.Join(dataDir, "status.json"),
+		w.Name, w.AppPath, w.DesktopPath, w.IconPath, w.Categories)
+}
+
+// selfTestWait polls cond until it holds. It gives up after selfTestTimeout,
+// or as soon as the daemon returns, with the error it returned.
+func selfTestWait(what string, done chan error, cond func() bool) error {
+	deadline := time.Now().Add(selfTestTimeout)
+	for !cond() {
+		select {
+		case err := <-done:
+			done <- err
+			if err == nil {
+				err = fmt.Errorf("the daemon stopped")
+			}
+			return fmt.Errorf("waiting for %s: %w", what, err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %s", selfTestTimeout, what)
+		}
+	}
+	return nil
+}
+
+// lockedBuffer collects the log of the daemon under test, which is written
+// from many goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
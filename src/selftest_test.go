@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestSelftest(t *testing.T) {
+	useTestConfig(t, Config{})
+	commands := useFakeCommands(t)
+	if code := runSelftest(nil); code != 0 {
+		t.Fatalf("runSelftest() = %d, want 0", code)
+	}
+	if commands.count() == 0 {
+		t.Error("the desktop database of the self-test wasn't refreshed")
+	}
+}
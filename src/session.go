@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sessionPollInterval is how often watchers with require_session check
+// whether their user is logged in.
+const sessionPollInterval = 5 * time.Second
+
+// logindUsersDir is where systemd-logind keeps a state file per user with a
+// session, named by user ID.
+var logindUsersDir = "/run/systemd/users"
+
+// loggedIn reports whether the user with ID uid has a session, which is the
+// case while logind's state of the user is "active" or "online". Without
+// logind every user counts as logged in, so watchers aren't kept off for
+// good on systems that don't track sessions.
+func loggedIn(uid string) bool {
+	if _, err := fsys.Stat(logindUsersDir); err != nil {
+		return true
+	}
+	content, err := fsys.ReadFile(filepath.Join(logindUsersDir, uid))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if state, ok := strings.CutPrefix(line, "STATE="); ok {
+			return state == "active" || state == "online"
+		}
+	}
+	return false
+}
+
+func validateSessions(cfg Config) error {
+	blocks := append([]WatcherConfig{cfg.WatcherConfig}, cfg.Watchers...)
+	for _, w := range blocks {
+		if w.RequireSession && w.User == "" {
+			return fmt.Errorf("watcher %s sets require_session without a user", w.label())
+		}
+	}
+	return nil
+}
+
+// runWhileLoggedIn runs watch while the user of the watcher has a session:
+// it is started at login and cancelled at logout, leaving the entries in
+// the user's home directory alone. As after a restart, the journal tells
+// the next watch whether anything changed in between.
+func (aw *appWatcher) runWhileLoggedIn(ctx context.Context, watch func(context.Context)) {
+	u, err := user.Lookup(aw.w.User)
+	if err != nil {
+		aw.log.Errorf("Error looking up user %s: %v", aw.w.User, err)
+		return
+	}
+	ticker := time.NewTicker(sessionPollInterval)
+	defer ticker.Stop()
+
+	var cancel context.CancelFunc
+	var done chan struct{}
+	stop := func() {
+		if cancel != nil {
+			cancel()
+			<-done
+			cancel = nil
+		}
+	}
+	defer stop()
+
+	active := false
+	if !loggedIn(u.Uid) {
+		aw.log.Infof("Waiting for %s to log in.", aw.w.User)
+	}
+	for {
+		now := loggedIn(u.Uid)
+		switch {
+		case now && !active:
+			aw.log.Infof("%s logged in.", aw.w.User)
+			watchCtx, watchCancel := context.WithCancel(ctx)
+			cancel, done = watchCancel, make(chan struct{})
+			go func() {
+				defer close(done)
+				defer reportPanics()
+				watch(watchCtx)
+			}()
+		case !now && active:
+			aw.log.Infof("%s logged out, pausing the watcher.", aw.w.User)
+			stop()
+		}
+		active = now
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	_ "embed"
+	"sync"
+)
+
+// catalogSnapshot is a snapshot of the AppImageHub feed cut down to the
+// names and categories of well-known apps, for the snapshot stage, which
+// works offline. The icon URLs of the apps are still to be added, from a
+// copy of the feed they were checked against. Until then it lists no
+// icons, and the stage isn't one of the icon chain.
+//
+//go:embed catalog/appimagehub.json
+var catalogSnapshot []byte
+
+var (
+	snapshotOnce sync.Once
+	snapshot     map[string]catalogApp
+)
+
+// snapshotApps returns the apps of catalogSnapshot by catalogKey.
+func snapshotApps() map[string]catalogApp {
+	snapshotOnce.Do(func() {
+		var err error
+		if snapshot, err = parseCatalog(catalogSnapshot); err != nil {
+			log.Errorf("Error reading the built-in app catalog: %v", err)
+		}
+	})
+	return snapshot
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// embeddedEntryMembers are where AppImages bundling several apps, such as
+// LibreOffice, carry the desktop files of the apps besides the one in their
+// root.
+var embeddedEntryMembers = []string{"usr/share/applications/*.desktop", "opt/*/share/xdg/*.desktop"}
+
+// embeddedEntry is an app an AppImage bundles besides its main one, started
+// by passing Args to the AppImage.
+type embeddedEntry struct {
+	// ID is the name of its desktop file without .desktop.
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	Args           []string `json:"args"`
+	Icon           string   `json:"icon,omitempty"`
+	StartupWMClass string   `json:"startup_wm_class,omitempty"`
+	MimeTypes      []string `json:"mime_types,omitempty"`
+	FieldCode      string   `json:"field_code,omitempty"`
+}
+
+// embeddedEntries returns the apps the AppImage extracted into root bundles
+// besides the one its root desktop file starts. Hidden entries are left
+// out, as are those started without arguments, which is what the main entry
+// does. With icons, their icons are installed into iconDir, named after
+// appName and the entry.
+func embeddedEntries(root, iconDir, appName string, icons bool) []embeddedEntry {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil
+	}
+	mainArgs := map[string]bool{"": true}
+	rootFiles, _ := filepath.Glob(filepath.Join(root, "*.desktop"))
+	for _, desktopFile := range rootFiles {
+		mainArgs[strings.Join(entryArgs(desktopFile), " ")] = true
+	}
+
+	var entries []embeddedEntry
+	seen := make(map[string]bool)
+	for _, pattern := range embeddedEntryMembers {
+		matches, _ := filepath.Glob(filepath.Join(root, pattern))
+		for _, match := range matches {
+			// Only files, and links to them, inside the extraction.
+			resolved, err := filepath.EvalSymlinks(match)
+			if err != nil || !withinDir(realRoot, resolved) || !isRegularFile(resolved) || seen[resolved] {
+				continue
+			}
+			seen[resolved] = true
+			if desktopEntryValue(resolved, "NoDisplay") == "true" || desktopEntryValue(resolved, "Hidden") == "true" {
+				continue
+			}
+			args := entryArgs(resolved)
+			if mainArgs[strings.Join(args, " ")] {
+				continue
+			}
+			mainArgs[strings.Join(args, " ")] = true
+			e := embeddedEntry{
+				ID:             strings.TrimSuffix(filepath.Base(match), ".desktop"),
+				Name:           desktopEntryValue(resolved, "Name"),
+				Args:           args,
+				StartupWMClass: desktopEntryValue(resolved, "StartupWMClass"),
+			}
+			if e.Name == "" {
+				e.Name = e.ID
+			}
+			e.MimeTypes, e.FieldCode = embeddedMimeTypes(resolved)
+			if src, ext := embeddedIcon(root, desktopEntryValue(resolved, "Icon")); icons && src != "" {
+				if e.Icon, err = installIcon(src, iconDir, appName+"-"+e.ID, ext); err != nil {
+					log.Warnf("Could not store the icon of %s in %s: %v", e.ID, appName, err)
+				}
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// entryArgs returns the arguments the Exec line of desktopFile passes to
+// its program, without field codes such as %U.
+func entryArgs(desktopFile string) []string {
+	fields := execFields(desktopEntryValue(desktopFile, "Exec"))
+	args := []string{}
+	for i, field := range fields {
+		if i == 0 || (len(field) == 2 && field[0] == '%') {
+			continue
+		}
+		args = append(args, field)
+	}
+	return args
+}
+
+// splitEntryFile returns where the entry for the bundled app e of the
+// AppImage whose entry is desktopFilePath goes.
+func splitEntryFile(desktopFilePath string, e embeddedEntry) string {
+	return strings.TrimSuffix(desktopFilePath, ".desktop") + "-" + e.ID + ".desktop"
+}
+
+// splitEntries returns the bundled apps of the AppImage named appName that
+// get entries of their own, which only those with split_entries do.
+func splitEntries(appName string) []embeddedEntry {
+	if !appQuirk(appName).SplitEntries {
+		return nil
+	}
+	return extractedPayload(appName).Entries
+}
+
+// writeSplitEntries writes the entries of the bundled apps of the AppImage
+// at appImagePath next to its entry desktopFilePath, and reports whether
+// any of them changed.
+func writeSplitEntries(ctx context.Context, w WatcherConfig, appImagePath, desktopFilePath, icon, sum string) (bool, error) {
+	appName := appNameFromPath(appImagePath)
+	entries := splitEntries(appName)
+	if len(entries) == 0 {
+		return false, nil
+	}
+	opts, _ := currentExtraction()
+	data, err := desktopEntryData(ctx, w, appName, icon, sum, extractedAppStream(opts.metainfoDir, appName))
+	if err != nil {
+		return false, err
+	}
+	exec := execLine(w, appImagePath)
+	mainIcon := data.Icon
+	changed := false
+	for _, e := range entries {
+		if data.Name, err = entryName(w, e.Name, data.Version); err != nil {
+			return changed, err
+		}
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = execArg(arg)
+		}
+		data.Exec = withFieldCode(strings.Join(append([]string{exec}, args...), " "), e.MimeTypes, e.FieldCode)
+		data.MimeType = mimeTypeValue(e.MimeTypes)
+		data.Icon = mainIcon
+		if e.Icon != "" && isRegularFile(e.Icon) {
+			// It is removed while the entries aren't split off.
+			data.Icon = desktopString(e.Icon)
+		}
+		data.StartupWMClass = desktopString(e.StartupWMClass)
+		// The translations are the main app's.
+		data.Localized = ""
+		content, err := renderEntry(data, entryTemplate(w.Template))
+		if err != nil {
+			return changed, err
+		}
+		path := splitEntryFile(desktopFilePath, e)
+		if auditMode() {
+			changed = changed || !desktopFileCurrent(path, content)
+			continue
+		}
+		written, err := writeDesktopFile(path, content)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || written
+	}
+	return changed, nil
+}
+
+// splitArtifacts returns the entries and icons written for the bundled apps
+// of the AppImage named appName, whose entry is desktopFilePath.
+func splitArtifacts(appName, desktopFilePath string) []string {
+	var files []string
+	for _, e := range splitEntries(appName) {
+		if path := splitEntryFile(desktopFilePath, e); isRegularFile(path) {
+			files = append(files, path)
+		}
+		if e.Icon != "" && isRegularFile(e.Icon) {
+			files = append(files, e.Icon)
+		}
+	}
+	return files
+}
+
+// removeStaleArtifacts removes the files generated for an AppImage before
+// that are no longer, such as the entries of bundled apps that are gone or
+// aren't split off any more, and returns how many it removed.
+func removeStaleArtifacts(w WatcherConfig, before, now []string) int {
+	removed := 0
+	for _, file := range before {
+		if containsString(now, file) {
+			continue
+		}
+		ownWrites.note(file, fsnotify.Remove|fsnotify.Rename)
+		if err := os.Remove(file); err == nil {
+			w.logger().Infof("Removed %s, which is no longer generated", file)
+			removed++
+		} else if !os.IsNotExist(err) {
+			w.logger().Errorf("Error removing %s: %v", file, err)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	stateFileName    = "state.json"
+	defaultMaxHashMB = 4096
+)
+
+// appState is what the daemon remembers about an integrated AppImage.
+type appState struct {
+	Path         string    `json:"path"`
+	Watcher      string    `json:"watcher"`
+	DesktopFile  string    `json:"desktop_file"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Device       uint64    `json:"device,omitempty"`
+	Inode        uint64    `json:"inode,omitempty"`
+	IntegratedAt time.Time `json:"integrated_at"`
+	// Artifacts lists the other files generated for the AppImage, its
+	// extracted icon and AppStream metadata, which go with its entry.
+	Artifacts []string `json:"artifacts,omitempty"`
+	// UpdateInfo is the update information the AppImage embeds, which
+	// names the channel newer builds of it are published on.
+	UpdateInfo string `json:"update_info,omitempty"`
+	// Held keeps auto_update from installing updates of the AppImage, see
+	// "desktopimage hold".
+	Held bool `json:"held,omitempty"`
+	// MimeDefaults maps the MIME types its entries were made the default
+	// applications for to the entry, see claimMimeDefaults.
+	MimeDefaults map[string]string `json:"mime_defaults,omitempty"`
+}
+
+// stateStore persists appState records keyed by AppImage path as a JSON file
+// in the data directory. It is safe for concurrent use.
+type stateStore struct {
+	mu    sync.Mutex
+	path  string
+	apps  map[string]appState
+	dirty bool
+	// detection is the change_detection mode used to decide whether an
+	// AppImage changed since it was integrated.
+	detection string
+	// maxHashSize is the size above which AppImages aren't hashed, and hash
+	// mode falls back to mtime.
+	maxHashSize int64
+	// claims maps entry files picked by claimDesktopFile to their AppImage
+	// until a record for it is put.
+	claims map[string]string
+	// files maps device and inode numbers to the AppImage integrated as
+	// that file, so it gets one entry however many paths lead to it.
+	files map[fileID]string
+}
+
+// fileID identifies a file independent of the path it is reached by.
+type fileID struct {
+	device, inode uint64
+}
+
+func fileIDOf(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{device: uint64(st.Dev), inode: uint64(st.Ino)}, true
+}
+
+type stateFile struct {
+	Apps []appState `json:"apps"`
+}
+
+func openState(dataDir string) (*stateStore, error) {
+	s := &stateStore{
+		path:   filepath.Join(dataDir, stateFileName),
+		apps:   make(map[string]appState),
+		claims: make(map[string]string),
+		files:  make(map[fileID]string),
+	}
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var f stateFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", s.path, err)
+	}
+	for _, app := range f.Apps {
+		s.apps[app.Path] = app
+		if app.Inode != 0 {
+			s.files[fileID{device: app.Device, inode: app.Inode}] = app.Path
+		}
+	}
+	return s, nil
+}
+
+func (s *stateStore) setChangeDetection(mode string, maxHashSize int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detection = mode
+	s.maxHashSize = maxHashSize
+}
+
+// detectionFor returns the change detection mode used for an AppImage of
+// the given size. Hashing files above max_hash_mb would stall the scan, so
+// they are compared by mtime instead.
+func (s *stateStore) detectionFor(size int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.detection == changeDetectionHash && s.maxHashSize > 0 && size > s.maxHashSize {
+		return changeDetectionMtime
+	}
+	return s.detection
+}
+
+func (s *stateStore) get(path string) (appState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	app, ok := s.apps[path]
+	return app, ok
+}
+
+func (s *stateStore) put(app appState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apps[app.Path] = app
+	delete(s.claims, app.DesktopFile)
+	s.dirty = true
+}
+
+// setHeld holds or releases the updates of the AppImage at path, which has
+// to be recorded.
+func (s *stateStore) setHeld(path string, held bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	app, ok := s.apps[path]
+	if !ok {
+		return fmt.Errorf("%s is not integrated", path)
+	}
+	if app.Held != held {
+		app.Held = held
+		s.apps[path] = app
+		s.dirty = true
+	}
+	return nil
+}
+
+func (s *stateStore) remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.apps[path]; ok {
+		delete(s.apps, path)
+		s.dirty = true
+	}
+	for desktopFile, owner := range s.claims {
+		if owner == path {
+			delete(s.claims, desktopFile)
+		}
+	}
+	for id, owner := range s.files {
+		if owner == path {
+			delete(s.files, id)
+		}
+	}
+}
+
+// claimFile makes the AppImage at path the one integrated as the file id,
+// unless another path to the same file, through a bind mount or a
+// symlinked directory, claimed it first. That path is returned then.
+func (s *stateStore) claimFile(path string, id fileID) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.files[id]; ok && owner != path {
+		if info, err := os.Stat(owner); err == nil {
+			if ownerID, ok := fileIDOf(info); ok && ownerID == id {
+				return owner, true
+			}
+		}
+	}
+	s.files[id] = path
+	return "", false
+}
+
+// moved hands the record of the AppImage at path, the file id, over from
+// the path it was integrated at when it was moved there from another
+// watched directory, keeping its name. It returns that path. The entry has
+// to be one in the desktop_path of w, the watcher now finding it, for its
+// Exec to be updated in place rather than it being removed and written anew.
+func (s *stateStore) moved(w WatcherConfig, path string, id fileID) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, ok := s.files[id]
+	if !ok || from == path || filepath.Base(from) != filepath.Base(path) {
+		return "", false
+	}
+	app, ok := s.apps[from]
+	if _, recorded := s.apps[path]; !ok || recorded || filepath.Dir(app.DesktopFile) != filepath.Clean(w.DesktopPath) {
+		return "", false
+	}
+	if _, err := os.Lstat(from); !os.IsNotExist(err) {
+		return "", false
+	}
+	delete(s.apps, from)
+	app.Path, app.Watcher = path, w.label()
+	s.apps[path] = app
+	s.files[id] = path
+	s.dirty = true
+	return from, true
+}
+
+// invalidate makes the record of the AppImage at path look outdated, so it
+// is integrated again by the next scan.
+func (s *stateStore) invalidate(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if app, ok := s.apps[path]; ok {
+		app.Size = -1
+		app.SHA256 = ""
+		s.apps[path] = app
+		s.dirty = true
+	}
+}
+
+// desktopFile returns the entry file recorded for the AppImage at path, if
+// it is in desktopPath.
+func (s *stateStore) desktopFile(desktopPath, path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	app, ok := s.apps[path]
+	if !ok || app.DesktopFile == "" || filepath.Dir(app.DesktopFile) != filepath.Clean(desktopPath) {
+		return "", false
+	}
+	return app.DesktopFile, true
+}
+
+// claimDesktopFile returns the entry file for the AppImage at path: the one
+// recorded for it if that is still one of the two choices, preferred unless
+// it is taken or belongs to another AppImage, and alternative otherwise. The
+// choice is claimed right away so concurrent scan workers can't pick the
+// same file.
+func (s *stateStore) claimDesktopFile(path, preferred, alternative string, taken bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := func(desktopFile string) bool {
+		return desktopFile == preferred || desktopFile == alternative
+	}
+	if app, ok := s.apps[path]; ok && current(app.DesktopFile) {
+		return app.DesktopFile
+	}
+	for desktopFile, owner := range s.claims {
+		if owner == path && current(desktopFile) {
+			return desktopFile
+		}
+	}
+
+	owned := func(desktopFile string) bool {
+		if owner, ok := s.claims[desktopFile]; ok && owner != path {
+			return true
+		}
+		for _, app := range s.apps {
+			if app.DesktopFile == desktopFile && app.Path != path {
+				return true
+			}
+		}
+		return false
+	}
+	desktopFile := preferred
+	if taken || owned(preferred) {
+		desktopFile = alternative
+	}
+	s.claims[desktopFile] = path
+	return desktopFile
+}
+
+// watchedBy returns the records of the AppImages that belong to w.
+func (s *stateStore) watchedBy(w WatcherConfig) []appState {
+	var apps []appState
+	for _, app := range s.inDir(w.appDir()) {
+		if w.watches(app.Path) {
+			apps = append(apps, app)
+		}
+	}
+	return apps
+}
+
+// inDir returns the records of the AppImages directly inside dir.
+func (s *stateStore) inDir(dir string) []appState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	var apps []appState
+	for path, app := range s.apps {
+		if filepath.Dir(path) == dir {
+			apps = append(apps, app)
+		}
+	}
+	return apps
+}
+
+// flush writes the store to disk if it changed since the last flush. The
+// file is replaced atomically so a crash never leaves it truncated.
+func (s *stateStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+
+	f := stateFile{Apps: make([]appState, 0, len(s.apps))}
+	for _, app := range s.apps {
+		f.Apps = append(f.Apps, app)
+	}
+	sort.Slice(f.Apps, func(i, j int) bool { return f.Apps[i].Path < f.Apps[j].Path })
+	content, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+var (
+	stateMu sync.Mutex
+	state   *stateStore
+)
+
+// configureState opens the store in the data directory of cfg, unless it is
+// already in use, and applies its change detection mode.
+func configureState(cfg Config) error {
+	if err := validateChangeDetection(cfg); err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if state == nil || state.path != filepath.Join(cfg.dataDir(), stateFileName) {
+		s, err := openState(cfg.dataDir())
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			flushState(state)
+		}
+		state = s
+	}
+	state.setChangeDetection(cfg.ChangeDetection, cfg.maxHashSize())
+	return nil
+}
+
+// currentState returns the daemon's store, or an in-memory one when none
+// was opened, so callers never need to check for nil.
+func currentState() *stateStore {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if state == nil {
+		state = &stateStore{apps: make(map[string]appState), claims: make(map[string]string), files: make(map[fileID]string)}
+	}
+	return state
+}
+
+func flushState(s *stateStore) {
+	if s.path == "" || auditMode() {
+		return
+	}
+	if err := s.flush(); err != nil {
+		log.Errorf("Error saving state: %v", err)
+	}
+}
+
+func (c Config) maxHashSize() int64 {
+	if c.MaxHashMB > 0 {
+		return c.MaxHashMB << 20
+	}
+	return defaultMaxHashMB << 20
+}
+
+const (
+	changeDetectionMtime = "mtime"
+	changeDetectionHash  = "hash"
+	changeDetectionOff   = "off"
+)
+
+func validateChangeDetection(cfg Config) error {
+	switch cfg.ChangeDetection {
+	case "", changeDetectionMtime, changeDetectionHash, changeDetectionOff:
+		return nil
+	default:
+		return fmt.Errorf("change_detection must be %q, %q or %q, got %q", changeDetectionMtime, changeDetectionHash, changeDetectionOff, cfg.ChangeDetection)
+	}
+}
+
+// sourceChanged compares the AppImage described by info with what was
+// recorded when it was last integrated and returns the updated record. The
+// hash is only computed in hash mode.
+func sourceChanged(mode, path string, info os.FileInfo, prev appState, known bool) (appState, bool, error) {
+	current := prev
+	current.Path = path
+	current.Size = info.Size()
+	current.ModTime = info.ModTime()
+	if id, ok := fileIDOf(info); ok {
+		current.Device, current.Inode = id.device, id.inode
+	}
+
+	statChanged := !known || prev.Size != info.Size() || !prev.ModTime.Equal(info.ModTime())
+	switch mode {
+	case changeDetectionHash:
+		sum, err := hashFile(path)
+		if err != nil {
+			return current, false, err
+		}
+		current.SHA256 = sum
+		return current, !known || sum != prev.SHA256, nil
+	case changeDetectionOff:
+		return current, !known, nil
+	default:
+		return current, statChanged, nil
+	}
+}
+
+// hashFor returns the SHA-256 of the AppImage at path, computed by
+// sourceChanged into record in hash mode and otherwise kept from prev while
+// its size and mtime stay the same. AppImages above max_hash_mb aren't
+// hashed and get "".
+func (s *stateStore) hashFor(path string, info os.FileInfo, prev, record appState, known bool) (string, error) {
+	s.mu.Lock()
+	detection, maxHashSize := s.detection, s.maxHashSize
+	s.mu.Unlock()
+	switch {
+	case maxHashSize > 0 && info.Size() > maxHashSize:
+		return "", nil
+	case detection == changeDetectionHash:
+		return record.SHA256, nil
+	case known && prev.SHA256 != "" && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()):
+		return prev.SHA256, nil
+	default:
+		return hashFile(path)
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
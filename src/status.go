@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStatusFile     = "/run/desktopimage/status.json"
+	defaultStatusInterval = 30 * time.Second
+)
+
+// scanResult summarises the last reconciliation of a watcher.
+type scanResult struct {
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+	AppImages  int       `json:"appimages"`
+	Written    int64     `json:"written"`
+	Removed    int       `json:"removed"`
+}
+
+type errorRecord struct {
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// watcherHealth is what the daemon tracks per watcher label between status
+// file writes. It outlives reloads so a restarted watcher keeps its history.
+type watcherHealth struct {
+	LastScan  *scanResult  `json:"last_scan,omitempty"`
+	LastError *errorRecord `json:"last_error,omitempty"`
+	Errors    int          `json:"errors"`
+	// Activity counts what the watcher did with the files in app_path, set
+	// from activity when the status is written.
+	Activity activityReport `json:"activity"`
+	activity watcherActivity
+}
+
+// Kinds of watcher activity, see activityCounts.
+type activityKind int
+
+const (
+	activitySeen activityKind = iota
+	activityIntegrated
+	activitySkipped
+	activityFailed
+	activityRejected
+)
+
+// activityCounts are the files a watcher handled, counted once each time:
+// Seen every one, Integrated those whose entry was written or changed,
+// Skipped those left out by its rules, such as files that aren't AppImages,
+// AppImages that aren't executable, symlinks and duplicates, Failed those
+// that couldn't be read or integrated, and Rejected those that failed
+// validation as unsafe, which quarantine_dir moves away.
+type activityCounts struct {
+	Seen       int64 `json:"seen"`
+	Integrated int64 `json:"integrated"`
+	Skipped    int64 `json:"skipped"`
+	Failed     int64 `json:"failed"`
+	Rejected   int64 `json:"rejected"`
+}
+
+func (c *activityCounts) add(kind activityKind) {
+	switch kind {
+	case activitySeen:
+		c.Seen++
+	case activityIntegrated:
+		c.Integrated++
+	case activitySkipped:
+		c.Skipped++
+	case activityFailed:
+		c.Failed++
+	case activityRejected:
+		c.Rejected++
+	}
+}
+
+type activityReport struct {
+	SinceStart activityCounts `json:"since_start"`
+	LastHour   activityCounts `json:"last_hour"`
+}
+
+// watcherActivity keeps activityCounts since the daemon started and per
+// minute for the last hour.
+type watcherActivity struct {
+	total   activityCounts
+	minutes [60]activityCounts
+	// stamps are the minutes, since the epoch, minutes counts.
+	stamps [60]int64
+}
+
+func (a *watcherActivity) add(kind activityKind, now time.Time) {
+	minute := now.Unix() / 60
+	i := minute % int64(len(a.minutes))
+	if a.stamps[i] != minute {
+		a.minutes[i], a.stamps[i] = activityCounts{}, minute
+	}
+	a.minutes[i].add(kind)
+	a.total.add(kind)
+}
+
+func (a *watcherActivity) report(now time.Time) activityReport {
+	r := activityReport{SinceStart: a.total}
+	minute := now.Unix() / 60
+	for i, c := range a.minutes {
+		if minute-a.stamps[i] < int64(len(a.minutes)) {
+			r.LastHour.Seen += c.Seen
+			r.LastHour.Integrated += c.Integrated
+			r.LastHour.Skipped += c.Skipped
+			r.LastHour.Failed += c.Failed
+			r.LastHour.Rejected += c.Rejected
+		}
+	}
+	return r
+}
+
+var (
+	healthMu  sync.Mutex
+	health    = make(map[string]*watcherHealth)
+	lastError *errorRecord
+)
+
+func healthOf(label string) *watcherHealth {
+	h, ok := health[label]
+	if !ok {
+		h = &watcherHealth{}
+		health[label] = h
+	}
+	return h
+}
+
+// countActivity counts a file w handled as kind.
+func countActivity(w WatcherConfig, kind activityKind) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	healthOf(w.label()).activity.add(kind, time.Now())
+}
+
+func recordScan(w WatcherConfig, result scanResult) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	healthOf(w.label()).LastScan = &result
+}
+
+// errorTracker is a logrus hook remembering the last error logged overall
+// and per watcher.
+type errorTracker struct{}
+
+func (errorTracker) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (errorTracker) Fire(entry *logrus.Entry) error {
+	record := &errorRecord{Message: entry.Message, At: entry.Time}
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	lastError = record
+	if label, ok := entry.Data["watcher"].(string); ok {
+		h := healthOf(label)
+		h.LastError = record
+		h.Errors++
+	}
+	return nil
+}
+
+type watcherReport struct {
+	watcherStatus
+	watcherHealth
+	Integrated int `json:"integrated"`
+}
+
+type statusReport struct {
+	UpdatedAt time.Time       `json:"updated_at"`
+	PID       int             `json:"pid"`
+	AuditMode bool            `json:"audit_mode"`
+	LastError *errorRecord    `json:"last_error,omitempty"`
+	Watchers  []watcherReport `json:"watchers"`
+	// Failed lists the AppImages extraction keeps failing on.
+	Failed []failedAppImage `json:"failed,omitempty"`
+	// Maintenance is set while maintenance mode is on.
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+func (c Config) statusFile() string {
+	if c.StatusFile != "" {
+		return c.StatusFile
+	}
+	return defaultStatusFile
+}
+
+func (c Config) statusInterval() time.Duration {
+	if c.StatusInterval > 0 {
+		return c.StatusInterval
+	}
+	return defaultStatusInterval
+}
+
+// writeStatus atomically replaces the status file with the current state of
+// watchers, for monitoring agents that can only read files.
+func writeStatus(path string, watchers *watcherSet) error {
+	report := statusReport{
+		UpdatedAt:   time.Now(),
+		PID:         os.Getpid(),
+		AuditMode:   auditMode(),
+		Maintenance: currentMaintenance().Active,
+		Watchers:    []watcherReport{},
+		Failed:      currentFailures().list(),
+	}
+	st := currentState()
+
+	healthMu.Lock()
+	report.LastError = lastError
+	for _, s := range watchers.status() {
+		r := watcherReport{watcherStatus: s, Integrated: len(st.watchedBy(WatcherConfig{AppPath: s.AppPath}))}
+		if h, ok := health[s.Name]; ok {
+			r.watcherHealth = *h
+			r.Activity = h.activity.report(report.UpdatedAt)
+		}
+		report.Watchers = append(report.Watchers, r)
+	}
+	healthMu.Unlock()
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create status directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write status file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write status file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcherActivity(t *testing.T) {
+	var a watcherActivity
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	a.add(activitySeen, start)
+	a.add(activityFailed, start)
+	a.add(activitySeen, start.Add(30*time.Minute))
+	a.add(activityIntegrated, start.Add(30*time.Minute))
+	a.add(activityRejected, start)
+
+	r := a.report(start.Add(61 * time.Minute))
+	if want := (activityCounts{Seen: 2, Integrated: 1, Failed: 1, Rejected: 1}); r.SinceStart != want {
+		t.Errorf("since start %+v, want %+v", r.SinceStart, want)
+	}
+	if want := (activityCounts{Seen: 1, Integrated: 1}); r.LastHour != want {
+		t.Errorf("last hour %+v, want %+v", r.LastHour, want)
+	}
+	// A minute an hour later reuses the slot.
+	a.add(activitySkipped, start.Add(time.Hour))
+	if r := a.report(start.Add(time.Hour)); r.LastHour != (activityCounts{Seen: 1, Integrated: 1, Skipped: 1}) {
+		t.Errorf("last hour %+v after the slot was reused", r.LastHour)
+	}
+}
+
+func TestIntegrationActivity(t *testing.T) {
+	useTestConfig(t, Config{})
+	useFakeCommands(t)
+	healthMu.Lock()
+	health = make(map[string]*watcherHealth)
+	healthMu.Unlock()
+	w := newTestWatcher(t)
+	hello := addAppImage(t, w.AppPath, "Hello")
+	plain := filepath.Join(w.AppPath, "Plain.AppImage")
+	if err := os.WriteFile(plain, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	refresher := newDBRefresher(time.Hour, time.Hour)
+	// Integrating hello again leaves its entry as it is.
+	for _, path := range []string{hello, plain, hello} {
+		integrateAppImage(context.Background(), w, path, refresher)
+	}
+	healthMu.Lock()
+	got := healthOf(w.label()).activity.report(time.Now())
+	healthMu.Unlock()
+	if want := (activityCounts{Seen: 3, Integrated: 1, Skipped: 1}); got.SinceStart != want || got.LastHour != want {
+		t.Errorf("activity %+v, want %+v since the start and in the last hour", got, want)
+	}
+}
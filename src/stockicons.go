@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"path/filepath"
+	"strings"
+)
+
+// stockIcons are generic icons by kind of app, for the stock stage, which
+// gives entries whose AppImage has no icon one that fits their categories
+// rather than the placeholder of the menu.
+//
+//go:embed stockicons/*.svg
+var stockIcons embed.FS
+
+// stockIconDir is where the stock icons entries use are written.
+var stockIconDir string
+
+// stockIconNames maps the main categories to the stock icons.
+var stockIconNames = map[string]string{
+	"AudioVideo":  "multimedia",
+	"Audio":       "multimedia",
+	"Video":       "multimedia",
+	"Development": "development",
+	"Education":   "education",
+	"Game":        "game",
+	"Graphics":    "graphics",
+	"Network":     "network",
+	"Office":      "office",
+	"Science":     "science",
+	"Settings":    "system",
+	"System":      "system",
+	"Utility":     "utility",
+}
+
+// stockIconName returns the stock icon for the escaped Categories value
+// categories: the one of its first main category, or of the main category
+// of its first additional one, or the generic application icon.
+func stockIconName(categories string) string {
+	for _, category := range strings.Split(categories, ";") {
+		if parent := additionalParents[category]; parent != "" {
+			category = parent
+		}
+		if name, ok := stockIconNames[category]; ok {
+			return name
+		}
+	}
+	return "application"
+}
+
+// stockIcon returns the path of the stock icon for categories, writing it
+// into stockIconDir when it isn't there or is from another version.
+func stockIcon(categories string) string {
+	name := stockIconName(categories) + ".svg"
+	content, err := stockIcons.ReadFile("stockicons/" + name)
+	if err != nil {
+		log.Errorf("Error reading the built-in icon %s: %v", name, err)
+		return ""
+	}
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	if stockIconDir == "" {
+		return ""
+	}
+	path := filepath.Join(stockIconDir, name)
+	if existing, err := fsys.ReadFile(path); err == nil && bytes.Equal(existing, content) {
+		return path
+	}
+	if auditMode() {
+		return ""
+	}
+	if err := fsys.MkdirAll(stockIconDir, 0755); err != nil {
+		log.Errorf("Error creating icon directory %s: %v", stockIconDir, err)
+		return ""
+	}
+	if err := replaceFile(path, content); err != nil {
+		log.Errorf("Error writing the built-in icon %s: %v", path, err)
+		return ""
+	}
+	return path
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// symlinks values. Without the option symlinked AppImages are integrated
+// like any other file, with Exec pointing at the link.
+const (
+	symlinksLink   = "link"
+	symlinksTarget = "target"
+	symlinksIgnore = "ignore"
+)
+
+// errSkippedSymlink marks symlinks that are not integrated, either because
+// the watcher ignores them or because their target is not an AppImage.
+var errSkippedSymlink = errors.New("skipped symlink")
+
+func validateSymlinks(cfg Config) error {
+	for _, w := range append(cfg.watchers(), cfg.mountTemplates()...) {
+		switch w.Symlinks {
+		case "", symlinksLink, symlinksTarget, symlinksIgnore:
+		default:
+			return fmt.Errorf("symlinks of watcher %s must be %q, %q or %q, got %q", w.label(), symlinksLink, symlinksTarget, symlinksIgnore, w.Symlinks)
+		}
+	}
+	return nil
+}
+
+// checkSymlink returns an error wrapping errSkippedSymlink when path is a
+// symlink w doesn't integrate: one it ignores, a dangling one, one to
+// something other than a type 2 AppImage, or one to an AppImage in app_path
+// itself, which gets an entry of its own.
+func checkSymlink(w WatcherConfig, path string) error {
+	if w.Symlinks == "" {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if w.Symlinks == symlinksIgnore {
+		return fmt.Errorf("%w: symlinks are ignored", errSkippedSymlink)
+	}
+
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSkippedSymlink, err)
+	}
+	if !isRegularFile(target) {
+		return fmt.Errorf("%w: %s is not a regular file", errSkippedSymlink, target)
+	}
+	if _, err := squashfsOffset(target); err != nil {
+		return fmt.Errorf("%w: %s: %v", errSkippedSymlink, target, err)
+	}
+	if dir, err := filepath.EvalSymlinks(w.appDir()); err == nil && w.appFile() == "" && filepath.Dir(target) == dir {
+		return fmt.Errorf("%w: %s is watched itself", errSkippedSymlink, target)
+	}
+	return nil
+}
+
+// execPath returns the file Exec starts for the AppImage at path: the
+// symlink's target with symlinks = "target", path otherwise.
+func execPath(w WatcherConfig, path string) string {
+	if w.Symlinks != symlinksTarget {
+		return path
+	}
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		return target
+	}
+	return path
+}
+
+// launchesAppImage reports whether an entry whose Exec starts target
+// belongs to the AppImage at path.
+func launchesAppImage(w WatcherConfig, path, target string) bool {
+	return target == path || target == execPath(w, path)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIntegrationRate  = 10
+	defaultIntegrationBurst = 30
+)
+
+func (c Config) integrationRate() float64 {
+	if c.MaxIntegrationRate > 0 {
+		return c.MaxIntegrationRate
+	}
+	return defaultIntegrationRate
+}
+
+func (c Config) integrationBurst() int {
+	if c.IntegrationBurst > 0 {
+		return c.IntegrationBurst
+	}
+	return defaultIntegrationBurst
+}
+
+// integrationLimiter is a token bucket shared by all watchers. Integrations
+// that extract an AppImage take a token; once the burst is used up they
+// queue and proceed at the configured rate, so copying a whole library
+// doesn't run hundreds of extractions back to back.
+type integrationLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+var limiter = &integrationLimiter{rate: defaultIntegrationRate, burst: defaultIntegrationBurst, tokens: defaultIntegrationBurst}
+
+func configureThrottle(cfg Config) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.rate = cfg.integrationRate()
+	limiter.burst = float64(cfg.integrationBurst())
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+}
+
+// wait blocks until an integration may proceed, or until ctx is done.
+func (l *integrationLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+	}
+	l.last = now
+	if l.tokens >= l.burst {
+		l.tokens = l.burst
+		l.throttled = false
+	}
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		// The token is paid for ahead; later callers queue behind it.
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		if !l.throttled {
+			l.throttled = true
+			log.Infof("Many AppImages arrived at once, integrating at most %g per second.", l.rate)
+		}
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Toolkits told apart by classifyToolkit.
+const (
+	toolkitElectron = "electron"
+	toolkitQt       = "qt"
+	toolkitGTK      = "gtk"
+)
+
+// payloadSuffix names the file next to the AppStream metadata in which
+// extraction records what it learnt about the payload of an AppImage.
+const payloadSuffix = ".payload.json"
+
+// hicolorMembers are where electron-builder puts the icons its AppImages
+// link to from their root.
+var hicolorMembers = []string{"usr/share/icons/hicolor/*/apps/*"}
+
+// hicolorSizes are the icon theme directories searched for an icon that
+// isn't in the root of the AppImage, best first.
+var hicolorSizes = []string{"scalable", "512x512", "256x256", "0x0", "128x128"}
+
+// payloadInfo is what the payload of an AppImage says about how to start
+// it, beyond its desktop file and AppStream metadata.
+type payloadInfo struct {
+	Toolkit string `json:"toolkit,omitempty"`
+	// StartupWMClass is the one of the embedded desktop file or, for Qt
+	// and GTK apps, guessed from the program it starts.
+	StartupWMClass string `json:"startup_wm_class,omitempty"`
+	// Name and Categories are those of its desktop file.
+	Name       string `json:"name,omitempty"`
+	Categories string `json:"categories,omitempty"`
+	// MimeTypes are those its desktop file declares, and FieldCode how
+	// its Exec line passes files of them.
+	MimeTypes []string `json:"mime_types,omitempty"`
+	FieldCode string   `json:"field_code,omitempty"`
+	// Entries are the other apps the AppImage bundles.
+	Entries []embeddedEntry `json:"entries,omitempty"`
+	// RequiresRoot is set when its desktop file runs it as root.
+	RequiresRoot bool `json:"requires_root,omitempty"`
+}
+
+// classifyToolkit guesses the toolkit of an AppImage from the names of the
+// files in its payload. Electron bundles GTK, so it is checked for first.
+func classifyToolkit(names []string) string {
+	qt, gtk := false, false
+	for _, name := range names {
+		base := filepath.Base(name)
+		switch {
+		case base == "chrome-sandbox" || base == "v8_context_snapshot.bin" || strings.HasSuffix(name, "resources/app.asar"):
+			return toolkitElectron
+		case strings.HasPrefix(base, "libQt5Core.so") || strings.HasPrefix(base, "libQt6Core.so"):
+			qt = true
+		case strings.HasPrefix(base, "libgtk-3.so") || strings.HasPrefix(base, "libgtk-4.so"):
+			gtk = true
+		}
+	}
+	switch {
+	case qt:
+		return toolkitQt
+	case gtk:
+		return toolkitGTK
+	default:
+		return ""
+	}
+}
+
+// listPayload returns the names of every file in the AppImage at path,
+// relative to its root, running unsquashfs with the options base.
+func listPayload(ctx context.Context, opts extractionOptions, path, tmpDir string, base []string) ([]string, error) {
+	listing, err := runUnsquashfs(ctx, opts, path, tmpDir, append(append(append([]string{}, base...), "-l"), path))
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Join(tmpDir, "root")
+	var names []string
+	for _, line := range strings.Split(listing, "\n") {
+		if name, ok := strings.CutPrefix(line, root+"/"); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// guessWMClass returns the window class of the app extracted into root: the
+// StartupWMClass of its desktop file, or, as Qt uses the program name and
+// GTK capitalizes it, one derived from the program Exec starts.
+func guessWMClass(root, toolkit string) string {
+	desktopFiles, _ := filepath.Glob(filepath.Join(root, "*.desktop"))
+	for _, desktopFile := range desktopFiles {
+		if class := desktopEntryValue(desktopFile, "StartupWMClass"); class != "" {
+			return class
+		}
+	}
+	if toolkit != toolkitQt && toolkit != toolkitGTK {
+		return ""
+	}
+	for _, desktopFile := range desktopFiles {
+		fields := execFields(desktopEntryValue(desktopFile, "Exec"))
+		if len(fields) == 0 {
+			continue
+		}
+		program := filepath.Base(fields[0])
+		if program == "AppRun" || program == "." {
+			continue
+		}
+		if toolkit == toolkitGTK {
+			r, n := utf8.DecodeRuneInString(program)
+			program = string(unicode.ToUpper(r)) + program[n:]
+		}
+		return program
+	}
+	return ""
+}
+
+// rootDesktopValue returns the value of key in the first desktop file in the
+// AppImage root that has it.
+func rootDesktopValue(root, key string) string {
+	desktopFiles, _ := filepath.Glob(filepath.Join(root, "*.desktop"))
+	for _, desktopFile := range desktopFiles {
+		if value := desktopEntryValue(desktopFile, key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// installPayloadInfo records info for the AppImage named appName.
+func installPayloadInfo(metainfoDir, appName string, info payloadInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(metainfoDir, 0755); err != nil {
+		return fmt.Errorf("failed to create metainfo directory: %w", err)
+	}
+	return replaceFile(filepath.Join(metainfoDir, appName+payloadSuffix), content)
+}
+
+// extractedPayload returns what extraction recorded about the payload of
+// the AppImage named appName, nothing when it wasn't extracted.
+func extractedPayload(appName string) payloadInfo {
+	var info payloadInfo
+	opts, _ := currentExtraction()
+	content, err := os.ReadFile(filepath.Join(opts.metainfoDir, appName+payloadSuffix))
+	if err == nil {
+		json.Unmarshal(content, &info)
+	}
+	return info
+}
+
+// toolkitArgs returns the arguments the entry of the AppImage named appName
+// gets for its toolkit: Electron is asked to run on Wayland when the
+// session has it, unless a display was configured for the app or quirksOff.
+func toolkitArgs(appName string) []string {
+	if quirksOff(appName) || extractedPayload(appName).Toolkit != toolkitElectron || appConfig(appName).Display != displayAuto {
+		return nil
+	}
+	return []string{"--ozone-platform-hint=auto"}
+}
+
+// hicolorIcon returns the icon called name in the icon theme directories
+// of the AppImage extracted into root, or "".
+func hicolorIcon(root, name string) (string, string) {
+	for _, size := range hicolorSizes {
+		for _, ext := range iconExtensions {
+			candidate := filepath.Join(root, "usr/share/icons/hicolor", size, "apps", strings.TrimSuffix(name, ext)+ext)
+			if isRegularFile(candidate) {
+				return candidate, ext
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const trashInfoSuffix = ".trashinfo"
+
+// homeTrash returns the trash directory of the user running the daemon, as
+// laid out by the freedesktop.org trash specification.
+func homeTrash() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "Trash")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".local", "share", "Trash")
+}
+
+// trashedFile returns the name in trash of the file most recently moved
+// there from path.
+func trashedFile(trash, path string) (string, bool) {
+	if trash == "" {
+		return "", false
+	}
+	infos, err := os.ReadDir(filepath.Join(trash, "info"))
+	if err != nil {
+		return "", false
+	}
+	var name, deleted string
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), trashInfoSuffix) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(trash, "info", info.Name()))
+		if err != nil {
+			continue
+		}
+		origin, date := parseTrashInfo(content)
+		// The deletion dates are ISO 8601 in local time, so they sort
+		// as strings.
+		if origin == path && date >= deleted {
+			name, deleted = strings.TrimSuffix(info.Name(), trashInfoSuffix), date
+		}
+	}
+	return name, name != ""
+}
+
+// parseTrashInfo returns the original path and deletion date recorded in a
+// .trashinfo file.
+func parseTrashInfo(content []byte) (path, deleted string) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	inInfo := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inInfo = line == "[Trash Info]"
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !inInfo || !ok {
+			continue
+		}
+		switch key {
+		case "Path":
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				path = unescaped
+			}
+		case "DeletionDate":
+			deleted = value
+		}
+	}
+	return path, deleted
+}
+
+// restoreFromTrash moves the file named name in trash back to path, unless
+// something took its place in the meantime.
+func restoreFromTrash(trash, name, path string) error {
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%s exists again", path)
+	}
+	if err := os.Rename(filepath.Join(trash, "files", name), path); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	if err := os.Remove(filepath.Join(trash, "info", name+trashInfoSuffix)); err != nil {
+		return fmt.Errorf("failed to remove trash info of %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const transactionDirName = "transactions"
+
+// Integration phases. An AppImage is integrated in two phases: its icon,
+// metadata and entry are written and its record is put, then the desktop
+// database is refreshed. A transaction file in the data directory records
+// which phase an integration reached, so one interrupted by a crash can be
+// rolled back or finished when the daemon starts again.
+const (
+	phaseWriting = "writing"
+	phaseWritten = "written"
+)
+
+// integrationTxn describes one integration in progress.
+type integrationTxn struct {
+	Path        string `json:"path"`
+	Watcher     string `json:"watcher"`
+	DesktopFile string `json:"desktop_file"`
+	DesktopPath string `json:"desktop_path"`
+	// New is set when the AppImage had no record yet, so nothing written
+	// for it has to be kept when the integration is rolled back.
+	New     bool      `json:"new"`
+	Phase   string    `json:"phase"`
+	Started time.Time `json:"started"`
+	// Artifacts lists the files generated for a new AppImage besides its
+	// entry, once they are written. It is null while they are being
+	// written.
+	Artifacts []string `json:"artifacts"`
+
+	file string
+}
+
+func (s *stateStore) transactionDir() string {
+	if s.path == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(s.path), transactionDirName)
+}
+
+// beginIntegration records that the AppImage at path is about to be
+// integrated into desktopFile. It returns nil, which the other methods
+// accept, when there is nowhere to record it.
+func (s *stateStore) beginIntegration(w WatcherConfig, path, desktopFile string, isNew bool) *integrationTxn {
+	dir := s.transactionDir()
+	if dir == "" || auditMode() {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(path))
+	t := &integrationTxn{
+		Path:        path,
+		Watcher:     w.label(),
+		DesktopFile: desktopFile,
+		DesktopPath: filepath.Clean(w.DesktopPath),
+		New:         isNew,
+		Phase:       phaseWriting,
+		Started:     time.Now(),
+		file:        filepath.Join(dir, hex.EncodeToString(sum[:8])+".json"),
+	}
+	if err := t.save(); err != nil {
+		w.logger().Errorf("Error recording integration of %s: %v", path, err)
+		return nil
+	}
+	return t
+}
+
+func (t *integrationTxn) save() error {
+	content, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(filepath.Dir(t.file), 0755); err != nil {
+		return fmt.Errorf("failed to create transaction directory: %w", err)
+	}
+	return replaceFile(t.file, content)
+}
+
+// written moves t to the second phase, in which only the database refresh
+// of its desktop_path is missing.
+func (t *integrationTxn) written() {
+	if t == nil {
+		return
+	}
+	t.Phase = phaseWritten
+	if err := t.save(); err != nil {
+		log.Errorf("Error recording integration of %s: %v", t.Path, err)
+	}
+}
+
+// generated records the files written for the new AppImage of t besides
+// its entry, which a rollback removes with it.
+func (t *integrationTxn) generated(files []string) {
+	if t == nil || !t.New {
+		return
+	}
+	t.Artifacts = append([]string{}, files...)
+	if err := t.save(); err != nil {
+		log.Errorf("Error recording integration of %s: %v", t.Path, err)
+	}
+}
+
+// done drops t once nothing is left to recover.
+func (t *integrationTxn) done() {
+	if t == nil {
+		return
+	}
+	if err := fsys.Remove(t.file); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Error removing transaction %s: %v", t.file, err)
+	}
+}
+
+// rollback removes what an integration that failed or was interrupted
+// wrote for an AppImage without a record, then drops it.
+func (t *integrationTxn) rollback() {
+	if t == nil {
+		return
+	}
+	if t.New {
+		if entryExecTarget(t.DesktopFile) == t.Path {
+			if err := fsys.Remove(t.DesktopFile); err != nil && !os.IsNotExist(err) {
+				log.Errorf("Error removing .desktop file %s: %v", t.DesktopFile, err)
+			}
+		}
+		st := currentState()
+		files := st.ownArtifacts(t.Path, t.Artifacts)
+		if t.Artifacts == nil {
+			// Interrupted before they were recorded, so the files are
+			// found by name.
+			opts, _ := currentExtraction()
+			files = st.artifactsOf(t.Path, opts.iconDir, opts.metainfoDir)
+		}
+		removeArtifacts(files)
+	}
+	t.done()
+}
+
+// listIntegrations returns the transactions left in s's data directory.
+func (s *stateStore) listIntegrations() []*integrationTxn {
+	dir := s.transactionDir()
+	if dir == "" {
+		return nil
+	}
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var txns []*integrationTxn
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		content, err := fsys.ReadFile(file)
+		t := &integrationTxn{file: file}
+		if err != nil || json.Unmarshal(content, t) != nil {
+			log.Warnf("Removing unreadable transaction %s.", file)
+			t.done()
+			continue
+		}
+		txns = append(txns, t)
+	}
+	return txns
+}
+
+// refreshed drops the second phase transactions of desktopPath once its
+// database was refreshed.
+func (s *stateStore) refreshed(desktopPath string) {
+	desktopPath = filepath.Clean(desktopPath)
+	for _, t := range s.listIntegrations() {
+		if t.Phase == phaseWritten && t.DesktopPath == desktopPath {
+			t.done()
+		}
+	}
+}
+
+// recoverIntegrations finishes what integrations interrupted by a crash
+// left behind. Those which got as far as the database refresh only need
+// it rerun. Earlier on, an AppImage that no longer exists is rolled back,
+// and one that does is made to be integrated afresh by the next scan.
+func recoverIntegrations(refresher *dbRefresher) {
+	st := currentState()
+	for _, t := range st.listIntegrations() {
+		switch _, err := os.Stat(t.Path); {
+		case t.Phase == phaseWritten:
+			log.Infof("Refreshing the desktop database in %s after an interrupted integration of %s.", t.DesktopPath, t.Path)
+			refresher.request(t.DesktopPath)
+		case os.IsNotExist(err):
+			log.Infof("Rolling back the interrupted integration of %s, which no longer exists.", t.Path)
+			t.rollback()
+			if t.New {
+				st.remove(t.Path)
+			} else {
+				// The scan removes the entry along with the record.
+				currentJournal().forget(t.Watcher)
+			}
+			refresher.request(t.DesktopPath)
+		default:
+			log.Infof("Resuming the interrupted integration of %s.", t.Path)
+			opts, _ := currentExtraction()
+			removeExtractedIcon(opts.iconDir, appNameFromPath(t.Path))
+			st.invalidate(t.Path)
+			currentJournal().forget(t.Watcher)
+			flushState(st)
+			t.done()
+		}
+	}
+	flushState(st)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultUpdateJitter = 30 * time.Minute
+
+func (c Config) updateJitter() time.Duration {
+	if c.UpdateJitter > 0 {
+		return c.UpdateJitter
+	}
+	return defaultUpdateJitter
+}
+
+func validateUpdates(cfg Config) error {
+	if cfg.UpdateSchedule == "" {
+		return nil
+	}
+	if _, err := parseCron(cfg.UpdateSchedule); err != nil {
+		return fmt.Errorf("update_schedule: %w", err)
+	}
+	return nil
+}
+
+// nextUpdateCheck returns how long after now the next update check is due:
+// at the next time update_schedule matches, plus a random delay of up to
+// update_jitter so that machines sharing a configuration don't all ask at
+// once. ok is false when no checks are scheduled.
+func nextUpdateCheck(cfg Config, now time.Time) (time.Duration, bool) {
+	if cfg.UpdateSchedule == "" {
+		return 0, false
+	}
+	s, err := parseCron(cfg.UpdateSchedule)
+	if err != nil {
+		return 0, false
+	}
+	next := s.next(now)
+	if next.IsZero() {
+		return 0, false
+	}
+	return next.Sub(now) + time.Duration(rand.Int63n(int64(cfg.updateJitter()))), true
+}
+
+// connectionMetered reports whether the connection NetworkManager uses is
+// metered, such as a phone's hotspot. Tests swap in a fake.
+var connectionMetered = networkManagerMetered
+
+// networkManagerMetered reads the Metered property of NetworkManager over
+// D-Bus, which is 1 when the connection is metered and 3 when NetworkManager
+// guesses so.
+func networkManagerMetered() (bool, error) {
+	out, err := hostCommand("busctl", "--system", "get-property",
+		"org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager", "Metered").Output()
+	if err != nil {
+		return false, err
+	}
+	var value int
+	if _, err := fmt.Sscanf(string(out), "u %d", &value); err != nil {
+		return false, fmt.Errorf("unexpected Metered property %q", strings.TrimSpace(string(out)))
+	}
+	return value == 1 || value == 3, nil
+}
+
+// updateChecking is set while scheduled checks run, so that a slow check
+// isn't overlapped by the next one.
+var updateChecking atomic.Bool
+
+// runUpdateChecks checks every integrated AppImage of the watchers of cfg
+// that has update information and isn't pinned to "none", unless the
+// connection is metered and update_on_metered is off.
+func runUpdateChecks(ctx context.Context, cfg Config) {
+	if !updateChecking.CompareAndSwap(false, true) {
+		log.Info("Skipping the update check, the previous one is still running.")
+		return
+	}
+	defer updateChecking.Store(false)
+	if !cfg.UpdateOnMetered {
+		metered, err := connectionMetered()
+		if err != nil {
+			log.Debugf("Could not tell whether the connection is metered: %v", err)
+		}
+		if metered {
+			log.Info("Skipping the update check, the connection is metered.")
+			return
+		}
+	}
+
+	// The updates found replace those of the last check, except for the
+	// AppImages that couldn't be checked this time.
+	previous := make(map[string]pendingUpdate)
+	for _, p := range readPendingUpdates(cfg.dataDir()) {
+		previous[p.Path] = p
+	}
+	var pending []pendingUpdate
+	st := currentState()
+	for _, w := range cfg.watchers() {
+		for _, app := range st.watchedBy(w) {
+			if ctx.Err() != nil {
+				return
+			}
+			u, pin, ok, err := updatesFor(app, cfg.Apps[appNameFromPath(app.Path)])
+			if err != nil {
+				w.logger().Warnf("Not checking %s for updates: %v", app.Path, err)
+				continue
+			}
+			if !ok {
+				if pin == updatesNone {
+					w.logger().Debugf("Not checking %s for updates, it is pinned to none", app.Path)
+				}
+				continue
+			}
+			update, err := checkUpdate(ctx, u, app.Path)
+			switch {
+			case err != nil:
+				w.logger().Warnf("Error checking %s for updates: %v", app.Path, err)
+				if p, ok := previous[app.Path]; ok {
+					pending = append(pending, p)
+				}
+			case update == nil:
+				w.logger().Debugf("%s is up to date", app.Path)
+			case cfg.AutoUpdate && !app.Held:
+				if err := applyUpdate(ctx, w, app.Path, update); err != nil {
+					w.logger().Errorf("Error updating %s to %s: %v", app.Path, update.file, err)
+				}
+			default:
+				if cfg.AutoUpdate {
+					w.logger().Infof("An update of %s is available: %s, not installing it while it is held", app.Path, update.file)
+				} else {
+					w.logger().Infof("An update of %s is available: %s", app.Path, update.file)
+				}
+				p := pendingUpdate{Path: app.Path, Watcher: w.label(), File: update.file, Version: update.version, Notes: update.notes, FoundAt: time.Now()}
+				if prev, ok := previous[app.Path]; ok && prev.File == p.File {
+					p.FoundAt = prev.FoundAt
+				} else {
+					// Only shown once per build.
+					notifyUpdate(w, app.Path, update)
+				}
+				pending = append(pending, p)
+			}
+		}
+	}
+	if err := writePendingUpdates(cfg.dataDir(), pending); err != nil {
+		log.Errorf("Error saving the updates found: %v", err)
+	}
+}
+
+// updateClient makes the requests of update checks.
+var updateClient = &http.Client{Timeout: time.Minute}
+
+// githubAPI is the GitHub REST API gh-releases-zsync is resolved with.
+var githubAPI = "https://api.github.com"
+
+var errUpdateUnsupported = errors.New("update checks of this type are not supported")
+
+// availableUpdate is a build newer than an AppImage, as its zsync file
+// describes it.
+type availableUpdate struct {
+	// file is the name it is published under, url where it is downloaded.
+	file   string
+	url    string
+	sha1   string
+	length int64
+	// version and notes come from the release it belongs to, as far as
+	// they are published.
+	version string
+	notes   string
+}
+
+// checkUpdate returns the build the zsync file u points at describes when it
+// differs from the AppImage at appImage, or nil.
+func checkUpdate(ctx context.Context, u updateInfo, appImage string) (*availableUpdate, error) {
+	var zsyncURL string
+	var rel githubRelease
+	switch u.Type {
+	case "zsync":
+		zsyncURL = u.Fields[0]
+	case "gh-releases-zsync":
+		var err error
+		if zsyncURL, rel, err = githubReleaseAsset(ctx, u.Fields[0], u.Fields[1], u.Fields[2], u.Fields[3]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", errUpdateUnsupported, u.Type)
+	}
+
+	header, err := fetchZsyncHeader(ctx, zsyncURL)
+	if err != nil {
+		return nil, err
+	}
+	remote := strings.ToLower(header["SHA-1"])
+	if remote == "" {
+		return nil, fmt.Errorf("%s has no SHA-1", zsyncURL)
+	}
+	local, err := sha1File(appImage)
+	if err != nil || remote == local {
+		return nil, err
+	}
+	update := &availableUpdate{file: header["Filename"], sha1: remote, version: rel.TagName, notes: strings.TrimSpace(rel.Body)}
+	if update.file == "" {
+		update.file = strings.TrimSuffix(path.Base(zsyncURL), ".zsync")
+	}
+	// URL is relative to the zsync file, and names the build itself.
+	if base, err := url.Parse(zsyncURL); err == nil && header["URL"] != "" {
+		if ref, err := url.Parse(header["URL"]); err == nil {
+			update.url = base.ResolveReference(ref).String()
+		}
+	}
+	if n, err := strconv.ParseInt(header["Length"], 10, 64); err == nil {
+		update.length = n
+	}
+	if update.notes == "" {
+		opts, _ := currentExtraction()
+		version, notes, err := appStreamReleaseNotes(ctx, opts.metainfoDir, appNameFromPath(appImage))
+		if err != nil {
+			log.Debugf("Could not fetch the release notes of %s: %v", appImage, err)
+		}
+		if update.version == "" {
+			update.version = version
+		}
+		update.notes = notes
+	}
+	return update, nil
+}
+
+// githubRelease is the part of a release of the GitHub API update checks
+// use.
+type githubRelease struct {
+	TagName    string `json:"tag_name"`
+	Body       string `json:"body"`
+	Prerelease bool   `json:"prerelease"`
+	Assets     []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// githubReleaseAsset returns the download URL of the asset of owner/repo
+// matching the glob pattern, in the release named by channel: "latest",
+// "latest-pre" for the newest pre-release, "latest-all" for the newest
+// release of any kind, or a tag. The release is returned too.
+func githubReleaseAsset(ctx context.Context, owner, repo, channel, pattern string) (string, githubRelease, error) {
+	base := githubAPI + "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(repo) + "/releases"
+	var rel githubRelease
+	switch channel {
+	case "latest":
+		if err := getJSON(ctx, base+"/latest", &rel); err != nil {
+			return "", rel, err
+		}
+	case "latest-pre", "latest-all":
+		var releases []githubRelease
+		if err := getJSON(ctx, base, &releases); err != nil {
+			return "", rel, err
+		}
+		found := false
+		for _, r := range releases {
+			if channel == "latest-all" || r.Prerelease {
+				rel, found = r, true
+				break
+			}
+		}
+		if !found {
+			return "", rel, fmt.Errorf("%s/%s has no release on channel %s", owner, repo, channel)
+		}
+	default:
+		if err := getJSON(ctx, base+"/tags/"+url.PathEscape(channel), &rel); err != nil {
+			return "", rel, err
+		}
+	}
+	for _, asset := range rel.Assets {
+		if ok, _ := path.Match(pattern, asset.Name); ok {
+			return asset.URL, rel, nil
+		}
+	}
+	return "", rel, fmt.Errorf("no asset of %s/%s on channel %s matches %s", owner, repo, channel, pattern)
+}
+
+func getJSON(ctx context.Context, link string, v interface{}) error {
+	body, err := fetch(ctx, link)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", link, err)
+	}
+	return nil
+}
+
+// fetchZsyncHeader returns the header lines of the zsync file at link, which
+// describe the file it syncs.
+func fetchZsyncHeader(ctx context.Context, link string) (map[string]string, error) {
+	body, err := fetch(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	header := make(map[string]string)
+	scanner := bufio.NewScanner(io.LimitReader(body, 64<<10))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// The checksums of the blocks follow.
+			return header, nil
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			header[key] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", link, err)
+	}
+	return header, nil
+}
+
+func fetch(ctx context.Context, link string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "DesktopImage")
+	resp, err := updateClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %s: %s", link, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// sha1File returns the SHA-1 of the file at path, which is what zsync files
+// identify their target by.
+func sha1File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
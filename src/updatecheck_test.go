@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2026, time.March, 14, 10, 30, 0, 0, time.UTC) // a Saturday
+	for _, c := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, time.March, 14, 10, 31, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2026, time.March, 14, 10, 40, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2026, time.March, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2026, time.March, 15, 9, 0, 0, 0, time.UTC)},
+		{"15 4,22 * * *", time.Date(2026, time.March, 14, 22, 15, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day matching is enough when both are restricted.
+		{"0 0 20 * 1", time.Date(2026, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	} {
+		s, err := parseCron(c.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", c.spec, err)
+			continue
+		}
+		if got := s.next(from); !got.Equal(c.want) {
+			t.Errorf("next of %q = %v, want %v", c.spec, got, c.want)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestNextUpdateCheck(t *testing.T) {
+	now := time.Date(2026, time.March, 14, 10, 30, 0, 0, time.UTC)
+	if _, ok := nextUpdateCheck(Config{}, now); ok {
+		t.Error("a check was scheduled without update_schedule")
+	}
+	cfg := Config{UpdateSchedule: "0 11 * * *", UpdateJitter: 10 * time.Minute}
+	for i := 0; i < 100; i++ {
+		d, ok := nextUpdateCheck(cfg, now)
+		if !ok || d < 30*time.Minute || d >= 40*time.Minute {
+			t.Fatalf("next check in %v, want between 30 and 40 minutes", d)
+		}
+	}
+}
+
+func TestUpdateCheck(t *testing.T) {
+	dataDir := t.TempDir()
+	useTestConfig(t, Config{DataDir: dataDir, Notify: true})
+	logs := recordLogs(t)
+	notes := useFakeNotifications(t, "")
+	w := newTestWatcher(t)
+	current := addAppImage(t, w.AppPath, "Current")
+	outdated := addAppImage(t, w.AppPath, "Outdated")
+	pinned := addAppImage(t, w.AppPath, "Pinned")
+	streamed := addAppImage(t, w.AppPath, "Streamed")
+	sum, err := sha1File(fixtureAppImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/current.zsync":
+			fmt.Fprintf(rw, "zsync: 0.6.2\nFilename: Current-1.0.AppImage\nSHA-1: %s\n\nblocks", strings.ToUpper(sum))
+		case "/outdated.zsync":
+			fmt.Fprint(rw, "zsync: 0.6.2\nFilename: Outdated-2.0.AppImage\nSHA-1: 0123456789abcdef0123456789abcdef01234567\n\n")
+		case "/repos/owner/outdated/releases":
+			fmt.Fprintf(rw, `[{"tag_name": "v2.1-beta", "prerelease": true, "body": "## What's new\r\n\r\n* **Faster** startup\r\n* Dark mode\r\n* Fewer crashes\r\n* More", "assets": [{"name": "Outdated-2.1-beta.AppImage.zsync", "browser_download_url": %q}]}]`, server.URL+"/outdated.zsync")
+		case "/releases.xml":
+			fmt.Fprint(rw, `<releases><release version="3.0"><description><p>The third one.</p><ul><li>Plugins</li><li>Themes</li></ul></description></release><release version="2.0"/></releases>`)
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+	prevAPI := githubAPI
+	githubAPI = server.URL
+	t.Cleanup(func() { githubAPI = prevAPI })
+
+	st := currentState()
+	st.put(appState{Path: current, Watcher: w.label(), UpdateInfo: "zsync|" + server.URL + "/current.zsync"})
+	st.put(appState{Path: outdated, Watcher: w.label(), UpdateInfo: "gh-releases-zsync|owner|outdated|latest|Outdated-*.AppImage.zsync"})
+	st.put(appState{Path: pinned, Watcher: w.label(), UpdateInfo: "zsync|" + server.URL + "/pinned.zsync"})
+	st.put(appState{Path: streamed, Watcher: w.label(), UpdateInfo: "zsync|" + server.URL + "/outdated.zsync"})
+	opts, _ := currentExtraction()
+	if err := os.MkdirAll(opts.metainfoDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metainfo := fmt.Sprintf(`<component><name>Streamed</name><releases type="external" url="%s/releases.xml"/></component>`, server.URL)
+	if err := os.WriteFile(filepath.Join(opts.metainfoDir, "Streamed.xml"), []byte(metainfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{DataDir: dataDir, Watchers: []WatcherConfig{w}, Apps: map[string]AppConfig{
+		"Outdated": {Updates: "latest-pre"},
+		"Pinned":   {Updates: updatesNone},
+	}}
+
+	metered := true
+	prevMetered := connectionMetered
+	connectionMetered = func() (bool, error) { return metered, nil }
+	t.Cleanup(func() { connectionMetered = prevMetered })
+
+	runUpdateChecks(context.Background(), cfg)
+	if logs.count("the connection is metered") != 1 || logs.count("An update of") != 0 {
+		t.Errorf("checked on a metered connection: %q", logs.messages)
+	}
+
+	cfg.UpdateOnMetered = true
+	runUpdateChecks(context.Background(), cfg)
+	if n := logs.count("An update of " + outdated + " is available: Outdated-2.0.AppImage"); n != 1 {
+		t.Errorf("the update of %s was reported %d times: %q", filepath.Base(outdated), n, logs.messages)
+	}
+	if n := logs.count("An update of"); n != 2 {
+		t.Errorf("%d updates reported, want 2: %q", n, logs.messages)
+	}
+
+	updates := readPendingUpdates(dataDir)
+	if len(updates) != 2 {
+		t.Fatalf("recorded updates %+v, want 2", updates)
+	}
+	// Outdated comes first, in the order the records are listed.
+	if updates[0].Path != outdated {
+		updates[0], updates[1] = updates[1], updates[0]
+	}
+	if u := updates[0]; u.Version != "v2.1-beta" || !strings.Contains(u.Notes, "* **Faster** startup") {
+		t.Errorf("recorded %+v for the GitHub release", u)
+	}
+	if u := updates[1]; u.Path != streamed || u.Version != "3.0" || u.Notes != "The third one.\n- Plugins\n- Themes" {
+		t.Errorf("recorded %+v for the external AppStream releases", u)
+	}
+	waitFor(t, "the notifications", func() bool {
+		notes.mu.Lock()
+		defer notes.mu.Unlock()
+		return len(notes.shown) == 2
+	})
+	for _, n := range notes.shown {
+		if n.summary == "Outdated v2.1-beta is available" {
+			if want := "Outdated-2.0.AppImage was published.\n\nWhat's new\n- Faster startup\n- Dark mode"; n.body != want {
+				t.Errorf("notification body %q, want %q", n.body, want)
+			}
+		}
+	}
+
+	// Found again, they are neither shown nor dated again.
+	runUpdateChecks(context.Background(), cfg)
+	if again := readPendingUpdates(dataDir); len(again) != 2 || !again[0].FoundAt.Equal(updates[0].FoundAt) && !again[0].FoundAt.Equal(updates[1].FoundAt) {
+		t.Errorf("recorded %+v after checking again", again)
+	}
+	time.Sleep(50 * time.Millisecond)
+	notes.mu.Lock()
+	defer notes.mu.Unlock()
+	if len(notes.shown) != 2 {
+		t.Errorf("%d notifications shown, want 2", len(notes.shown))
+	}
+}
+
+// type2AppImage returns the smallest file that passes for a type 2 AppImage:
+// an ELF header without sections, followed by the squashfs magic and body.
+func type2AppImage(body string) []byte {
+	header := make([]byte, 64)
+	copy(header, "\x7fELF\x02\x01\x01\x00AI\x02")
+	binary.LittleEndian.PutUint64(header[0x28:], 64)
+	return append(header, "hsqs"+body...)
+}
+
+func TestAutoUpdate(t *testing.T) {
+	dataDir := t.TempDir()
+	useTestConfig(t, Config{DataDir: dataDir})
+	logs := recordLogs(t)
+	w := newTestWatcher(t)
+	app := addAppImage(t, w.AppPath, "Foo")
+	build := type2AppImage(strings.Repeat("version 2 ", 1000))
+	sum := fmt.Sprintf("%x", sha1.Sum(build))
+
+	var ranges []string
+	served := build
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/Foo.AppImage.zsync":
+			fmt.Fprintf(rw, "zsync: 0.6.2\nFilename: Foo-2.AppImage\nURL: Foo-2.AppImage\nLength: %d\nSHA-1: %s\n\n", len(build), sum)
+		case "/Foo-2.AppImage":
+			ranges = append(ranges, r.Header.Get("Range"))
+			http.ServeContent(rw, r, "Foo-2.AppImage", time.Time{}, bytes.NewReader(served))
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+	currentState().put(appState{Path: app, Watcher: w.label(), UpdateInfo: "zsync|" + server.URL + "/Foo.AppImage.zsync"})
+	cfg := Config{DataDir: dataDir, Watchers: []WatcherConfig{w}, UpdateOnMetered: true, AutoUpdate: true}
+	part := partialDownload(app, sum)
+
+	t.Run("corrupt", func(t *testing.T) {
+		served = append(append([]byte(nil), build[:len(build)-1]...), 'X')
+		defer func() { served = build }()
+		runUpdateChecks(context.Background(), cfg)
+		if logs.count("has SHA-1") != 1 {
+			t.Errorf("the corrupt download wasn't refused: %q", logs.messages)
+		}
+		if exists(part) {
+			t.Error("the corrupt download was kept")
+		}
+		if content, _ := os.ReadFile(app); bytes.Equal(content, build) {
+			t.Error("the AppImage was replaced")
+		}
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		served = append(append([]byte(nil), build...), strings.Repeat("x", 1<<16)...)
+		defer func() { served = build }()
+		runUpdateChecks(context.Background(), cfg)
+		if logs.count("more than the") != 1 {
+			t.Errorf("the overlong download wasn't refused: %q", logs.messages)
+		}
+		if info, err := os.Stat(part); err == nil && info.Size() > 0 {
+			t.Errorf("%d bytes of the overlong download were kept", info.Size())
+		}
+		if content, _ := os.ReadFile(app); bytes.Equal(content, build) {
+			t.Error("the AppImage was replaced")
+		}
+	})
+
+	t.Run("resumed", func(t *testing.T) {
+		// An earlier check got halfway, and left a download for an older
+		// build behind.
+		if err := os.WriteFile(part, build[:len(build)/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+		stale := partialDownload(app, strings.Repeat("0", 40))
+		if err := os.WriteFile(stale, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ranges = nil
+		runUpdateChecks(context.Background(), cfg)
+		if want := fmt.Sprintf("bytes=%d-", len(build)/2); len(ranges) != 1 || ranges[0] != want {
+			t.Errorf("requested ranges %q, want %q", ranges, want)
+		}
+		content, err := os.ReadFile(app)
+		if err != nil || !bytes.Equal(content, build) {
+			t.Fatalf("the AppImage wasn't replaced with the update (%v): %q", err, logs.messages)
+		}
+		if info, err := os.Stat(app); err != nil || info.Mode().Perm() != 0755 {
+			t.Errorf("the update lost the mode of the AppImage: %v", err)
+		}
+		if exists(part) || exists(stale) {
+			t.Error("partial downloads were left behind")
+		}
+	})
+
+	t.Run("held", func(t *testing.T) {
+		before, err := os.ReadFile(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		build = type2AppImage("version 3")
+		sum = fmt.Sprintf("%x", sha1.Sum(build))
+		served = build
+		if err := currentState().setHeld(app, true); err != nil {
+			t.Fatal(err)
+		}
+		defer currentState().setHeld(app, false)
+		runUpdateChecks(context.Background(), cfg)
+		if logs.count("not installing it while it is held") != 1 {
+			t.Errorf("the held update wasn't reported: %q", logs.messages)
+		}
+		if content, _ := os.ReadFile(app); !bytes.Equal(content, before) {
+			t.Error("the held AppImage was replaced")
+		}
+		if updates := readPendingUpdates(dataDir); len(updates) != 1 || updates[0].Path != app {
+			t.Errorf("recorded updates %+v, want the held one", updates)
+		}
+	})
+
+	t.Run("not an AppImage", func(t *testing.T) {
+		build = []byte("<html>Not found</html>")
+		sum = fmt.Sprintf("%x", sha1.Sum(build))
+		served = build
+		runUpdateChecks(context.Background(), cfg)
+		if logs.count("failed to validate the download") != 1 {
+			t.Errorf("the download wasn't validated: %q", logs.messages)
+		}
+		if content, _ := os.ReadFile(app); bytes.Equal(content, build) {
+			t.Error("the AppImage was replaced")
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Update information types of the AppImage specification, with the number of
+// fields following the type.
+var updateTypes = map[string]int{
+	"zsync":             1, // zsync|URL
+	"gh-releases-zsync": 4, // gh-releases-zsync|owner|repo|release|filename
+	"pling-v1-zsync":    2, // pling-v1-zsync|product|filename
+	"bintray-zsync":     4, // bintray-zsync|user|repo|package|filename, deprecated
+}
+
+// updatePinSuffix names the file next to an AppImage that pins its updates:
+// Foo.AppImage.updates holds "none" to never update it, or the release
+// channel to follow instead of the one it embeds. It takes precedence over
+// updates in the [App.<name>] table.
+const (
+	updatePinSuffix = ".updates"
+	updatesNone     = "none"
+)
+
+// updateInfo is the parsed update information an AppImage embeds, which says
+// where newer builds of it are published.
+type updateInfo struct {
+	Type   string
+	Fields []string
+}
+
+// readUpdateInfo returns the update information embedded in the .upd_info
+// section of the AppImage at path, or "" when it has none. Type 1 AppImages
+// and other files that aren't ELF have none either.
+func readUpdateInfo(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		var formatErr *elf.FormatError
+		if errors.As(err, &formatErr) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+	section := f.Section(".upd_info")
+	if section == nil {
+		return "", nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return "", fmt.Errorf("failed to read update information: %w", err)
+	}
+	// The section is a fixed-size buffer padded with NUL bytes.
+	if i := strings.IndexByte(string(data), 0); i >= 0 {
+		data = data[:i]
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// parseUpdateInfo parses update information such as
+// "gh-releases-zsync|owner|repo|latest|Foo-*-x86_64.AppImage.zsync".
+func parseUpdateInfo(s string) (updateInfo, error) {
+	fields := strings.Split(s, "|")
+	n, ok := updateTypes[fields[0]]
+	if !ok {
+		return updateInfo{}, fmt.Errorf("unknown update information type %q", fields[0])
+	}
+	if len(fields)-1 != n {
+		return updateInfo{}, fmt.Errorf("update information of type %s needs %d fields, not %d", fields[0], n, len(fields)-1)
+	}
+	for _, field := range fields[1:] {
+		if field == "" {
+			return updateInfo{}, fmt.Errorf("update information %q has an empty field", s)
+		}
+	}
+	return updateInfo{Type: fields[0], Fields: fields[1:]}, nil
+}
+
+func (u updateInfo) String() string {
+	return strings.Join(append([]string{u.Type}, u.Fields...), "|")
+}
+
+// channel returns the release channel u follows, such as "latest",
+// "latest-pre" or a release tag, or "" for types publishing a single file.
+func (u updateInfo) channel() string {
+	if u.Type == "gh-releases-zsync" {
+		return u.Fields[2]
+	}
+	return ""
+}
+
+// withChannel returns u following channel instead.
+func (u updateInfo) withChannel(channel string) (updateInfo, error) {
+	if u.Type != "gh-releases-zsync" {
+		return updateInfo{}, fmt.Errorf("update information of type %s has no channels", u.Type)
+	}
+	fields := append([]string(nil), u.Fields...)
+	fields[2] = channel
+	return updateInfo{Type: u.Type, Fields: fields}, nil
+}
+
+// readUpdatePin returns the pin set next to the AppImage at path, or "" when
+// there is none. Blank lines and lines starting with # are skipped.
+func readUpdatePin(path string) (string, error) {
+	f, err := os.Open(path + updatePinSuffix)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			return line, nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// updatesFor returns the update information to check the recorded AppImage
+// app with: the one it embeds, following the channel it is pinned to by its
+// sidecar file or settings, the [App.<name>] table. ok is false when it
+// embeds none or is pinned to "none". Every update check goes through it,
+// so that pins are honored.
+func updatesFor(app appState, settings AppConfig) (u updateInfo, pin string, ok bool, err error) {
+	if app.UpdateInfo == "" {
+		return updateInfo{}, "", false, nil
+	}
+	if u, err = parseUpdateInfo(app.UpdateInfo); err != nil {
+		return updateInfo{}, "", false, err
+	}
+	if pin, err = readUpdatePin(app.Path); err != nil {
+		return updateInfo{}, "", false, fmt.Errorf("failed to read update pin: %w", err)
+	}
+	if pin == "" {
+		pin = settings.Updates
+	}
+	switch pin {
+	case "":
+		return u, "", true, nil
+	case updatesNone:
+		return u, pin, false, nil
+	}
+	if u, err = u.withChannel(pin); err != nil {
+		return updateInfo{}, pin, false, err
+	}
+	return u, pin, true, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseUpdateInfo(t *testing.T) {
+	for _, c := range []struct {
+		info, channel, err string
+	}{
+		{"gh-releases-zsync|owner|repo|latest|Foo-*-x86_64.AppImage.zsync", "latest", ""},
+		{"zsync|https://example.com/Foo.AppImage.zsync", "", ""},
+		{"pling-v1-zsync|12345|Foo-*.AppImage.zsync", "", ""},
+		{"gh-releases-zsync|owner|repo|latest", "", "needs 4 fields"},
+		{"zsync|", "", "empty field"},
+		{"ftp|example.com", "", "unknown update information type"},
+	} {
+		u, err := parseUpdateInfo(c.info)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("parseUpdateInfo(%q) = %v, want an error containing %q", c.info, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseUpdateInfo(%q): %v", c.info, err)
+			continue
+		}
+		if u.String() != c.info || u.channel() != c.channel {
+			t.Errorf("parseUpdateInfo(%q) = %q on channel %q, want channel %q", c.info, u, u.channel(), c.channel)
+		}
+	}
+}
+
+func TestUpdatesFor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Foo.AppImage")
+	app := appState{Path: path, UpdateInfo: "gh-releases-zsync|owner|repo|latest|Foo-*.AppImage.zsync"}
+	var settings AppConfig
+	pin := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path+updatePinSuffix, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if u, _, ok, err := updatesFor(app, settings); err != nil || !ok || u.channel() != "latest" {
+		t.Errorf("unpinned: got channel %q, ok %v, err %v", u.channel(), ok, err)
+	}
+	pin("# stay on betas\nlatest-pre\n")
+	if u, p, ok, err := updatesFor(app, settings); err != nil || !ok || u.channel() != "latest-pre" || p != "latest-pre" {
+		t.Errorf("pinned to a channel: got channel %q, pin %q, ok %v, err %v", u.channel(), p, ok, err)
+	}
+	pin("none\n")
+	if _, _, ok, err := updatesFor(app, settings); err != nil || ok {
+		t.Errorf("pinned to none: got ok %v, err %v", ok, err)
+	}
+	if err := os.Remove(path + updatePinSuffix); err != nil {
+		t.Fatal(err)
+	}
+	settings.Updates = "v2.1"
+	if u, p, ok, err := updatesFor(app, settings); err != nil || !ok || u.channel() != "v2.1" || p != "v2.1" {
+		t.Errorf("pinned in [App]: got channel %q, pin %q, ok %v, err %v", u.channel(), p, ok, err)
+	}
+	pin("latest\n")
+	if u, _, _, _ := updatesFor(app, settings); u.channel() != "latest" {
+		t.Errorf("the sidecar file didn't take precedence over [App], got channel %q", u.channel())
+	}
+	settings.Updates = ""
+
+	app.UpdateInfo = "zsync|https://example.com/Foo.AppImage.zsync"
+	pin("latest\n")
+	if _, _, ok, err := updatesFor(app, settings); err == nil || ok {
+		t.Errorf("channel pin without channels: got ok %v, err %v", ok, err)
+	}
+	app.UpdateInfo = ""
+	if _, _, ok, err := updatesFor(app, settings); err != nil || ok {
+		t.Errorf("without update information: got ok %v, err %v", ok, err)
+	}
+}
+
+func TestReadUpdateInfo(t *testing.T) {
+	// Neither the fixture nor the test binary, an ELF file, embed any.
+	for _, path := range []string{fixtureAppImage, os.Args[0]} {
+		if info, err := readUpdateInfo(path); err != nil || info != "" {
+			t.Errorf("readUpdateInfo(%s) = %q, %v", path, info, err)
+		}
+	}
+	if _, err := readUpdateInfo(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readUpdateInfo of a missing file succeeded")
+	}
+}
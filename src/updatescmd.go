@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const updatesFileName = "updates.json"
+
+// pendingUpdate is an update the last check found and didn't apply.
+type pendingUpdate struct {
+	Path    string    `json:"path"`
+	Watcher string    `json:"watcher"`
+	File    string    `json:"file"`
+	Version string    `json:"version,omitempty"`
+	Notes   string    `json:"notes,omitempty"`
+	FoundAt time.Time `json:"found_at"`
+}
+
+// readPendingUpdates returns the updates recorded in dataDir, none when there
+// is no readable list.
+func readPendingUpdates(dataDir string) []pendingUpdate {
+	content, err := os.ReadFile(filepath.Join(dataDir, updatesFileName))
+	if err != nil {
+		return nil
+	}
+	var updates []pendingUpdate
+	if err := json.Unmarshal(content, &updates); err != nil {
+		log.Warnf("Ignoring unreadable update list: %v", err)
+		return nil
+	}
+	return updates
+}
+
+// writePendingUpdates replaces the update list in dataDir atomically.
+func writePendingUpdates(dataDir string, updates []pendingUpdate) error {
+	if auditMode() {
+		return nil
+	}
+	if updates == nil {
+		updates = []pendingUpdate{}
+	}
+	content, err := json.MarshalIndent(updates, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	path := filepath.Join(dataDir, updatesFileName)
+	if err := os.WriteFile(path+".tmp", content, 0644); err != nil {
+		return fmt.Errorf("failed to write update list: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write update list: %w", err)
+	}
+	return nil
+}
+
+// runUpdates prints the updates the last scheduled check found and whether
+// they are held, with --details followed by their release notes.
+func runUpdates(args []string) int {
+	fs := flag.NewFlagSet("updates", flag.ContinueOnError)
+	details := fs.Bool("details", false, "show the release notes of each update")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	cfg, err := readConfig(configFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "updates: %v\n", err)
+		return exitCode(err)
+	}
+	st, err := openState(cfg.dataDir())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "updates: %v\n", err)
+		return exitCode(err)
+	}
+	updates := readPendingUpdates(cfg.dataDir())
+	held := func(u pendingUpdate) bool {
+		app, _ := st.get(u.Path)
+		return app.Held
+	}
+	if !*details {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		defer tw.Flush()
+		fmt.Fprintln(tw, "APPIMAGE\tVERSION\tFILE\tFOUND\tHELD")
+		for _, u := range updates {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\n", u.Path, u.Version, u.File, u.FoundAt.Format(time.RFC3339), held(u))
+		}
+		return 0
+	}
+	for i, u := range updates {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s\n  Update: %s", u.Path, u.File)
+		if u.Version != "" {
+			fmt.Printf(" (%s)", u.Version)
+		}
+		fmt.Printf("\n  Found:  %s\n", u.FoundAt.Format(time.RFC3339))
+		if held(u) {
+			fmt.Println("  Held, it is not installed until \"desktopimage unhold\".")
+		}
+		if u.Notes == "" {
+			fmt.Println("  No release notes were published.")
+			continue
+		}
+		fmt.Println()
+		for _, line := range strings.Split(u.Notes, "\n") {
+			fmt.Println(strings.TrimRight("    "+line, " "))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// watcherSet runs the AppImage watchers of the configuration. Watchers can
+// be enabled and disabled individually while the set runs; such changes last
+// until apply restarts the watcher. All of them run below ctx, the daemon's,
+// so they stop with it even if close isn't called.
+type watcherSet struct {
+	ctx       context.Context
+	cfg       Config
+	refresher *dbRefresher
+	running   []*runningWatcher
+	// disabled holds the watchers disabled through the control socket.
+	disabled map[string]bool
+	// wg counts the goroutines of all watchers started, running or not.
+	wg sync.WaitGroup
+}
+
+type runningWatcher struct {
+	label  string
+	aw     *appWatcher
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startWatchers runs one AppImage watcher per valid and enabled watcher
+// block of cfg.
+func startWatchers(ctx context.Context, cfg Config, refresher *dbRefresher) *watcherSet {
+	s := &watcherSet{ctx: ctx, cfg: cfg, refresher: refresher, disabled: make(map[string]bool)}
+	for _, w := range cfg.watchers() {
+		s.startConfigured(w)
+	}
+	return s
+}
+
+// startConfigured starts w unless it is invalid, disabled or not part of
+// the active profile.
+func (s *watcherSet) startConfigured(w WatcherConfig) {
+	if !isWatcherValid(w) {
+		return
+	}
+	if !w.enabled() {
+		w.logger().Info("Watcher is disabled.")
+		return
+	}
+	if profile := activeProfile(s.cfg); !w.inProfile(profile) {
+		w.logger().Infof("Watcher is not part of profile %s.", profile)
+		return
+	}
+	s.start(w)
+}
+
+// apply changes the running watchers to those of change.New. Only the
+// watchers whose blocks were added, changed or removed are started or
+// stopped, unless the other settings changed too, which restarts all of
+// them. The others keep running, even if they were disabled through the
+// control socket.
+func (s *watcherSet) apply(change ConfigChange) {
+	if change.Settings {
+		s.stop("")
+		s.cfg = change.New
+		s.disabled = make(map[string]bool)
+		for _, w := range s.cfg.watchers() {
+			s.startConfigured(w)
+		}
+		return
+	}
+	s.cfg = change.New
+	for _, w := range change.Removed {
+		w.logger().Info("Watcher was removed from the configuration.")
+		s.stop(w.label())
+		delete(s.disabled, w.label())
+	}
+	for _, w := range change.Changed {
+		w.logger().Info("Watcher changed, restarting it.")
+		s.stop(w.label())
+		delete(s.disabled, w.label())
+		s.startConfigured(w)
+	}
+	for _, w := range change.Added {
+		s.startConfigured(w)
+	}
+}
+
+func (s *watcherSet) start(w WatcherConfig) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	aw := newAppWatcher(w, s.cfg, s.refresher)
+	rw := &runningWatcher{label: w.label(), aw: aw, cancel: cancel, done: make(chan struct{})}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(rw.done)
+		defer reportPanics()
+		aw.run(ctx)
+	}()
+	s.running = append(s.running, rw)
+}
+
+// stop stops the watchers whose label matches, or all of them for "", and
+// waits for them to exit.
+func (s *watcherSet) stop(label string) {
+	var kept, stopped []*runningWatcher
+	for _, rw := range s.running {
+		if label == "" || rw.label == label {
+			rw.cancel()
+			stopped = append(stopped, rw)
+		} else {
+			kept = append(kept, rw)
+		}
+	}
+	for _, rw := range stopped {
+		<-rw.done
+	}
+	s.running = kept
+}
+
+// close stops all watchers and waits until every goroutine they started has
+// returned.
+func (s *watcherSet) close() {
+	s.stop("")
+	s.wg.Wait()
+}
+
+func (s *watcherSet) isRunning(label string) bool {
+	return s.runningWatcher(label) != nil
+}
+
+func (s *watcherSet) runningWatcher(label string) *runningWatcher {
+	for _, rw := range s.running {
+		if rw.label == label {
+			return rw
+		}
+	}
+	return nil
+}
+
+// watcherStatus describes a configured watcher for "watcher list".
+type watcherStatus struct {
+	Name        string   `json:"name"`
+	AppPath     string   `json:"app_path"`
+	DesktopPath string   `json:"desktop_path"`
+	Enabled     bool     `json:"enabled"`
+	Running     bool     `json:"running"`
+	Profiles    []string `json:"profiles,omitempty"`
+	// Paused is the pause_policy of a watcher paused through the control
+	// socket.
+	Paused string `json:"paused,omitempty"`
+}
+
+func (s *watcherSet) status() []watcherStatus {
+	var statuses []watcherStatus
+	for _, w := range s.cfg.watchers() {
+		status := watcherStatus{
+			Name:        w.label(),
+			AppPath:     w.AppPath,
+			DesktopPath: w.DesktopPath,
+			Enabled:     w.enabled(),
+			Profiles:    w.Profiles,
+		}
+		if rw := s.runningWatcher(w.label()); rw != nil {
+			status.Running = true
+			status.Paused = rw.aw.pausedWith()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// effectiveConfig returns the configuration the set runs with, as resolved
+// by effectiveConfig, with the watchers toggled at runtime switched.
+func (s *watcherSet) effectiveConfig() Config {
+	eff := effectiveConfig(s.cfg, activeProfile(s.cfg))
+	for i, w := range eff.Watchers {
+		if disabled, ok := s.disabled[w.label()]; ok {
+			enabled := !disabled
+			eff.Watchers[i].Enabled = &enabled
+		}
+	}
+	return eff
+}
+
+// setEnabled starts or stops the watcher labelled label.
+func (s *watcherSet) setEnabled(label string, enabled bool) error {
+	for _, w := range s.cfg.watchers() {
+		if w.label() != label || !isWatcherValid(w) {
+			continue
+		}
+
+		s.disabled[label] = !enabled
+		switch running := s.isRunning(label); {
+		case enabled && !running:
+			w.logger().Info("Enabling watcher.")
+			s.start(w)
+		case !enabled && running:
+			w.logger().Info("Disabling watcher.")
+			s.stop(label)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown watcher %q", label)
+}
+
+// appWatcher keeps the entries of one watcher block in sync with its
+// app_path.
+type appWatcher struct {
+	w           WatcherConfig
+	log         *logrus.Entry
+	workers     int
+	settleDelay time.Duration
+	// removalGrace is how long the entry of a vanished AppImage stays, in
+	// case it comes back.
+	removalGrace time.Duration
+	refresher    *dbRefresher
+	// fingerprint identifies the settings for the journal.
+	fingerprint string
+
+	// pending holds a timer per AppImage that is still being written; the
+	// file is integrated once it has been quiet for settleDelay. Vanished
+	// AppImages wait there for removalGrace before their entry goes. The
+	// timers queue the file in settledPaths and signal settled without
+	// waiting for the watch to take it, so none is left behind when the
+	// watch ends.
+	pending      map[string]*time.Timer
+	settledMu    sync.Mutex
+	settledPaths []string
+	settled      chan struct{}
+
+	// pauseRequest is the pause_policy the watcher was paused with through
+	// the control socket, or "" while it runs; pauseChanged signals the
+	// watch when it changes. paused is the one the watch applied. While
+	// paused with pauseQueue, the files events arrived for collect in
+	// queued; rescan is set when a scan is due on resume instead.
+	pauseMu      sync.Mutex
+	pauseRequest string
+	pauseChanged chan struct{}
+	paused       string
+	queued       map[string]bool
+	rescan       bool
+
+	// rescanRequested asks the watch for a scan, see requestRescan.
+	rescanMu        sync.Mutex
+	rescanReason    string
+	rescanRequested chan struct{}
+}
+
+func newAppWatcher(w WatcherConfig, cfg Config, refresher *dbRefresher) *appWatcher {
+	return &appWatcher{
+		w:            w,
+		log:          w.logger(),
+		workers:      scanWorkers(cfg),
+		settleDelay:  cfg.settleDelay(),
+		removalGrace: cfg.RemovalGrace,
+		refresher:    refresher,
+		fingerprint:  watcherFingerprint(cfg, w),
+		pending:      make(map[string]*time.Timer),
+		settled:      make(chan struct{}, 1),
+		pauseChanged: make(chan struct{}, 1),
+		queued:       make(map[string]bool),
+
+		rescanRequested: make(chan struct{}, 1),
+	}
+}
+
+func (aw *appWatcher) run(ctx context.Context) {
+	watch := aw.watch
+	if aw.w.RequireMount {
+		watch = func(ctx context.Context) { aw.runWhenMounted(ctx, aw.watch) }
+	}
+	if aw.w.RequireSession {
+		aw.runWhileLoggedIn(ctx, watch)
+		return
+	}
+	watch(ctx)
+}
+
+func (aw *appWatcher) watch(ctx context.Context) {
+	w := aw.w
+	watcher, err := newDirWatcher()
+	if err != nil {
+		aw.log.Errorf("Error initializing file watcher for %s: %v", w.AppPath, err)
+		return
+	}
+	defer watcher.Close()
+	defer aw.cancelPending()
+
+	// A single AppImage is replaced by renaming another over it, too, so
+	// its directory is watched.
+	if err := watcher.Add(w.appDir()); err != nil {
+		aw.log.Errorf("Error adding app directory %s to watcher: %v", w.appDir(), err)
+		return
+	}
+	aw.log.Infof("Watching %s for AppImages.", w.AppPath)
+	if pathWithin(resolvedPath(w.DesktopPath), resolvedPath(w.appDir())) {
+		aw.log.Infof("Entries are written inside %s, the events of those writes are ignored.", w.appDir())
+	}
+	if w.IconPath != "" {
+		// Replacing a file usually means renaming another over it, so
+		// the directory is watched rather than the icon.
+		if dir := filepath.Dir(w.IconPath); dir != filepath.Clean(w.appDir()) {
+			if err := watcher.Add(dir); err != nil {
+				aw.log.Warnf("Error watching icon directory %s, changes to %s go unnoticed: %v", dir, w.IconPath, err)
+			}
+		}
+		aw.checkIcon()
+	}
+
+	started := time.Now()
+	if reason := currentJournal().scanNeeded(w, aw.fingerprint); reason != "" {
+		aw.log.Infof("Rescanning %s: %s.", w.AppPath, reason)
+		reconcile(ctx, w, aw.workers, aw.refresher)
+	} else {
+		aw.log.Infof("Nothing changed in %s since the last run, skipping the scan.", w.AppPath)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	currentJournal().synced(w, aw.fingerprint, started, aw.pendingPaths())
+
+	for {
+		select {
+		case <-ctx.Done():
+			aw.log.Infof("Stopping AppImage watcher for %s.", w.AppPath)
+			currentJournal().stopped(w)
+			return
+		case <-aw.pauseChanged:
+			aw.applyPause(ctx)
+		case <-aw.rescanRequested:
+			aw.applyPause(ctx)
+			if aw.paused != "" {
+				aw.rescan = true
+				continue
+			}
+			aw.log.Infof("Rescanning %s: %s.", w.AppPath, aw.takeRescanReason())
+			started := time.Now()
+			reconcile(ctx, w, aw.workers, aw.refresher)
+			currentJournal().synced(w, aw.fingerprint, started, aw.pendingPaths())
+		case event, ok := <-watcher.events():
+			if !ok {
+				return
+			}
+			rawEvents.record(w, event)
+			aw.applyPause(ctx)
+			aw.handleEvent(ctx, event)
+		case <-aw.settled:
+			aw.applyPause(ctx)
+			for _, path := range aw.takeSettled() {
+				delete(aw.pending, path)
+				if aw.paused != "" {
+					// Written before the pause, handled after it.
+					aw.hold(path)
+					continue
+				}
+				if path == aw.iconPath() {
+					aw.iconChanged(ctx)
+				} else if _, err := os.Stat(path); os.IsNotExist(err) {
+					// Its removal_grace ran out without it coming back.
+					aw.remove(ctx, path)
+				} else {
+					aw.integrate(ctx, path)
+				}
+				currentJournal().eventHandled(w, path)
+			}
+		case err, ok := <-watcher.errs():
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				aw.applyPause(ctx)
+				if aw.paused != "" {
+					aw.log.Warnf("Event queue for %s overflowed, rescanning once the watcher is resumed.", w.AppPath)
+					aw.rescan = true
+					currentJournal().forget(w.label())
+					continue
+				}
+				// The kernel dropped events while we were busy; rescan
+				// instead of guessing what was lost.
+				aw.log.Warnf("Event queue for %s overflowed, rescanning.", w.AppPath)
+				started := time.Now()
+				reconcile(ctx, w, aw.workers, aw.refresher)
+				currentJournal().synced(w, aw.fingerprint, started, aw.pendingPaths())
+				continue
+			}
+			aw.log.Errorf("AppImage watcher error for %s: %v", w.AppPath, err)
+		}
+	}
+}
+
+func (aw *appWatcher) handleEvent(ctx context.Context, event fsnotify.Event) {
+	if ownWrites.echo(event) {
+		return
+	}
+	if aw.paused != "" {
+		if event.Name == aw.iconPath() || aw.w.watches(event.Name) {
+			aw.hold(event.Name)
+		}
+		return
+	}
+	if event.Name == aw.iconPath() {
+		// Wait for the copy to finish, as for AppImages.
+		aw.schedule(event.Name)
+		return
+	}
+	if !aw.w.watches(event.Name) {
+		if event.Op&fsnotify.Create != 0 && aw.w.appFile() == "" && filepath.Dir(event.Name) == filepath.Clean(aw.w.AppPath) {
+			// Not an AppImage.
+			countActivity(aw.w, activitySeen)
+			countActivity(aw.w, activitySkipped)
+		}
+		return
+	}
+
+	if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) != 0 {
+		// Copies and in-place replacements arrive as a Create or Write
+		// followed by many more Writes; wait until they stop.
+		aw.schedule(event.Name)
+	} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if _, known := currentState().get(event.Name); known && aw.removalGrace > 0 {
+			// Moves through a temporary name and cut-and-paste bring it
+			// back shortly; a Create in the meantime integrates it again
+			// in place of the removal.
+			aw.scheduleAfter(event.Name, aw.removalGrace)
+			notifyRemoved(aw.w, event.Name, aw.removalGrace)
+			return
+		}
+		if timer, ok := aw.pending[event.Name]; ok {
+			timer.Stop()
+			delete(aw.pending, event.Name)
+		}
+		aw.remove(ctx, event.Name)
+		currentJournal().eventHandled(aw.w, event.Name)
+	}
+}
+
+// remove removes the entry of the AppImage at path, which no longer exists,
+// and integrates an identical copy left out for it instead.
+func (aw *appWatcher) remove(ctx context.Context, path string) {
+	if removeDesktopFile(aw.w, path) {
+		aw.refresher.request(aw.w.DesktopPath)
+	}
+	currentFailures().forget(path)
+	if next, ok := duplicates.released(path); ok {
+		next.w.logger().Infof("Integrating %s in place of its removed copy %s", next.path, path)
+		if integrateAppImage(ctx, next.w, next.path, aw.refresher) {
+			aw.refresher.request(next.w.DesktopPath)
+		}
+	}
+	flushState(currentState())
+}
+
+func (aw *appWatcher) schedule(path string) {
+	aw.scheduleAfter(path, aw.settleDelay)
+}
+
+// scheduleAfter queues path once delay passed without another event for it.
+func (aw *appWatcher) scheduleAfter(path string, delay time.Duration) {
+	if timer, ok := aw.pending[path]; ok {
+		timer.Reset(delay)
+		return
+	}
+	currentJournal().eventPending(aw.w, path)
+	aw.pending[path] = time.AfterFunc(delay, func() {
+		aw.settledMu.Lock()
+		aw.settledPaths = append(aw.settledPaths, path)
+		aw.settledMu.Unlock()
+		select {
+		case aw.settled <- struct{}{}:
+		default:
+			// Signalled already.
+		}
+	})
+}
+
+// takeSettled returns the files that settled since the last call.
+func (aw *appWatcher) takeSettled() []string {
+	aw.settledMu.Lock()
+	defer aw.settledMu.Unlock()
+	paths := aw.settledPaths
+	aw.settledPaths = nil
+	return paths
+}
+
+// pendingPaths returns the files waiting for their writes to settle.
+func (aw *appWatcher) pendingPaths() []string {
+	var paths []string
+	for path := range aw.pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (aw *appWatcher) cancelPending() {
+	for path, timer := range aw.pending {
+		timer.Stop()
+		delete(aw.pending, path)
+	}
+	aw.takeSettled()
+}
+
+func (aw *appWatcher) iconPath() string {
+	if aw.w.IconPath == "" {
+		return ""
+	}
+	return filepath.Clean(aw.w.IconPath)
+}
+
+// checkIcon warns when icon_path doesn't exist, in which case entries are
+// written without an icon rather than pointing at a file that isn't there.
+func (aw *appWatcher) checkIcon() bool {
+	if _, err := os.Stat(aw.w.IconPath); err != nil {
+		aw.log.Warnf("Icon %s is missing, entries without an embedded icon get none: %v", aw.w.IconPath, err)
+		return false
+	}
+	return true
+}
+
+// iconChanged re-renders the entries after icon_path was replaced or
+// removed. Entries still naming the same file are left as they are, but the
+// database refresh makes menus load the new icon.
+func (aw *appWatcher) iconChanged(ctx context.Context) {
+	if aw.checkIcon() {
+		aw.log.Infof("Icon %s changed, updating entries.", aw.w.IconPath)
+	}
+	reconcile(ctx, aw.w, aw.workers, aw.refresher)
+	aw.refresher.request(aw.w.DesktopPath)
+}
+
+// integrate (re)renders the entry of the AppImage at path, extracting its
+// icon again if the file changed.
+func (aw *appWatcher) integrate(ctx context.Context, path string) {
+	_, known := currentState().get(path)
+	if integrateAppImage(ctx, aw.w, path, aw.refresher) {
+		aw.refresher.request(aw.w.DesktopPath)
+		if !known {
+			notifyAdded(aw.w, path)
+		}
+	}
+	flushState(currentState())
+}
+
+// removeDesktopFile removes the entry, extracted icon and state of the
+// AppImage at appImagePath and reports whether an entry was removed.
+func removeDesktopFile(w WatcherConfig, appImagePath string) bool {
+	appName := appNameFromPath(appImagePath)
+	st := currentState()
+	desktopFilePath := entryFile(st, w, appImagePath)
+	_, recorded := st.desktopFile(w.DesktopPath, appImagePath)
+	if target := entryExecTarget(desktopFilePath); target != "" && !launchesAppImage(w, appImagePath, target) &&
+		!(recorded && w.Symlinks == symlinksTarget) {
+		// Named like this AppImage's would be, but another one's.
+		return false
+	}
+	if auditMode() {
+		if _, err := fsys.Stat(desktopFilePath); err != nil {
+			return false
+		}
+		w.logger().Infof("Audit mode: would remove .desktop file for %s", appName)
+		return true
+	}
+	opts, _ := currentExtraction()
+	artifacts := st.artifactsOf(appImagePath, opts.iconDir, opts.metainfoDir)
+	ownWrites.note(desktopFilePath, fsnotify.Remove|fsnotify.Rename)
+	err := fsys.Remove(desktopFilePath)
+	if errors.Is(err, fs.ErrPermission) && elevated(desktopFilePath) {
+		err = removeElevated(desktopFilePath, err)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			// The record keeps the name of the entry and what was
+			// generated with it for the next attempt.
+			w.logger().Errorf("Error removing .desktop file for %s: %v", appName, err)
+			return false
+		}
+		st.remove(appImagePath)
+		if _, err := os.Lstat(appImagePath); !os.IsNotExist(err) {
+			return false
+		}
+		// The entry is gone already, but what else was generated for the
+		// vanished AppImage is still to be cleaned up.
+		if removed := removeArtifacts(artifacts); len(removed) > 0 {
+			w.logger().Infof("Removed the files generated for %s: %s", appName, strings.Join(removed, ", "))
+		}
+		return false
+	}
+
+	st.remove(appImagePath)
+	w.logger().Infof("Removed .desktop file for %s", appName)
+	removeArtifacts(artifacts)
+	return true
+}
+
+// ensureExecutable reports whether the AppImage at path can be launched,
+// granting the execute bit first when the watcher is configured to.
+func ensureExecutable(w WatcherConfig, path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	mode := info.Mode().Perm()
+	if mode&0111 != 0 {
+		return true, nil
+	}
+	if !w.AutoGrantExecutable {
+		return false, nil
+	}
+
+	if auditMode() {
+		w.logger().Infof("Audit mode: would make %s executable", path)
+		return true, nil
+	}
+	// Grant execute to everyone who may read the file.
+	ownWrites.note(path, fsnotify.Chmod)
+	if err := os.Chmod(path, mode|(mode&0444)>>2); err != nil {
+		return false, err
+	}
+	w.logger().Infof("Made %s executable", path)
+	return true, nil
+}
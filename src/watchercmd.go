@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"text/tabwriter"
+
+	"github.com/pelletier/go-toml"
+)
+
+var watcherNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func runWatcherCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "watcher: missing subcommand\n\n%s", usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "enable", "disable":
+		fs := flag.NewFlagSet("watcher "+args[0], flag.ContinueOnError)
+		persist := fs.Bool("persist", false, "save the change to the configuration file too")
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if fs.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "watcher %s: expected a watcher name\n", args[0])
+			return exitUsage
+		}
+		req := controlRequest{Command: args[0] + "-watcher", Watcher: fs.Arg(0), Persist: *persist}
+		if _, err := sendControl(controlSocketPath(), req); err != nil {
+			fmt.Fprintf(os.Stderr, "watcher %s: %v\n", args[0], err)
+			return exitCode(err)
+		}
+		if *persist {
+			fmt.Printf("Watcher %s %sd and saved to the configuration.\n", fs.Arg(0), args[0])
+		} else {
+			fmt.Printf("Watcher %s %sd.\n", fs.Arg(0), args[0])
+		}
+		return 0
+	case "pause", "resume":
+		return watcherPause(args[0], args[1:])
+	case "add":
+		return watcherAdd(args[1:])
+	case "remove":
+		return watcherRemove(args[1:])
+	case "list":
+		return watcherList(args[1:])
+	case "trace":
+		return watcherTrace(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "watcher: unknown subcommand %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+}
+
+// watcherPause pauses or resumes a watcher of the running daemon.
+func watcherPause(command string, args []string) int {
+	fs := flag.NewFlagSet("watcher "+command, flag.ContinueOnError)
+	var policy *string
+	if command == "pause" {
+		policy = fs.String("policy", "", "queue the events, or drop them and rescan on resume (default pause_policy)")
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "watcher %s: expected a watcher name\n", command)
+		return exitUsage
+	}
+	req := controlRequest{Command: command + "-watcher", Watcher: fs.Arg(0)}
+	if policy != nil {
+		req.Policy = *policy
+	}
+	if _, err := sendControl(controlSocketPath(), req); err != nil {
+		fmt.Fprintf(os.Stderr, "watcher %s: %v\n", command, err)
+		return exitCode(err)
+	}
+	fmt.Printf("Watcher %s %sd.\n", fs.Arg(0), command)
+	return 0
+}
+
+func watcherAdd(args []string) int {
+	fs := flag.NewFlagSet("watcher add", flag.ContinueOnError)
+	var w WatcherConfig
+	fs.StringVar(&w.Name, "name", "", "name of the new watcher (required)")
+	fs.StringVar(&w.AppPath, "app-path", "", "directory to watch for AppImages, or a single AppImage (required)")
+	fs.StringVar(&w.DesktopPath, "desktop-path", "", "directory to write .desktop files to (required)")
+	fs.StringVar(&w.IconPath, "icon-path", "", "fallback icon for the entries")
+	fs.StringVar(&w.Categories, "categories", "", "categories of the entries, defaults to those in [defaults] or Application")
+	fs.BoolVar(&w.AutoGrantExecutable, "auto-grant-executable", false, "make AppImages executable instead of waiting for chmod +x")
+	disabled := fs.Bool("disabled", false, "add the watcher but keep it disabled")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *disabled {
+		enabled := false
+		w.Enabled = &enabled
+	}
+
+	if err := validateNewWatcher(w); err != nil {
+		fmt.Fprintf(os.Stderr, "watcher add: %v\n", err)
+		return exitUsage
+	}
+	if _, err := os.Stat(w.AppPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	if w.Categories == "" {
+		if cfg, err := readConfig(configFilePath); err != nil || cfg.Defaults.Categories == "" {
+			w.Categories = "Application"
+		}
+	}
+
+	path := filepath.Join(configDropInDir(configFilePath), w.Name+".toml")
+	if err := writeDropIn(path, dropInConfig{Watchers: []WatcherConfig{w}}); err != nil {
+		fmt.Fprintf(os.Stderr, "watcher add: %v\n", err)
+		return exitCode(err)
+	}
+	fmt.Printf("Added watcher %s in %s.\n", w.Name, path)
+	notifyReload()
+	return 0
+}
+
+func validateNewWatcher(w WatcherConfig) error {
+	if !watcherNamePattern.MatchString(w.Name) {
+		return errors.New("--name is required and may only contain letters, digits, '.', '_' and '-'")
+	}
+	if !filepath.IsAbs(w.AppPath) || !filepath.IsAbs(w.DesktopPath) {
+		return errors.New("--app-path and --desktop-path are required and must be absolute")
+	}
+
+	cfg, err := readConfig(configFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, existing := range cfg.watchers() {
+		if existing.label() == w.Name {
+			return fmt.Errorf("a watcher named %q already exists", w.Name)
+		}
+	}
+	return nil
+}
+
+func watcherRemove(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "watcher remove: expected a watcher name")
+		return exitUsage
+	}
+	name := args[0]
+
+	m := newConfManager(configFilePath)
+	path := m.Source(name)
+	if err := m.RemoveWatcher(name); err != nil {
+		fmt.Fprintf(os.Stderr, "watcher remove: %v\n", err)
+		return exitCode(err)
+	}
+	if err := m.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "watcher remove: %v\n", err)
+		return exitCode(err)
+	}
+	fmt.Printf("Removed watcher %s from %s.\n", name, path)
+	notifyReload()
+	return 0
+}
+
+func watcherList(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "watcher list: unexpected arguments")
+		return exitUsage
+	}
+
+	var statuses []watcherStatus
+	running := "-"
+	if resp, err := sendControl(controlSocketPath(), controlRequest{Command: "list-watchers"}); err == nil {
+		if err := json.Unmarshal(resp.Data, &statuses); err != nil {
+			fmt.Fprintf(os.Stderr, "watcher list: %v\n", err)
+			return exitCode(err)
+		}
+		running = ""
+	} else {
+		// Fall back to what is configured when the daemon isn't running.
+		cfg, err := readConfig(configFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "watcher list: %v\n", err)
+			return exitCode(err)
+		}
+		for _, w := range cfg.watchers() {
+			statuses = append(statuses, watcherStatus{Name: w.label(), AppPath: w.AppPath, DesktopPath: w.DesktopPath, Enabled: w.enabled()})
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tAPP PATH\tDESKTOP PATH\tENABLED\tRUNNING")
+	for _, s := range statuses {
+		isRunning := running
+		if isRunning == "" {
+			isRunning = fmt.Sprint(s.Running)
+		}
+		if s.Paused != "" {
+			isRunning = "paused"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\n", s.Name, s.AppPath, s.DesktopPath, s.Enabled, isRunning)
+	}
+	tw.Flush()
+	return 0
+}
+
+// watcherTrace prints the raw events the running daemon recorded for the
+// watcher named in args, or for all of them.
+func watcherTrace(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "watcher trace: expected at most a watcher name")
+		return exitUsage
+	}
+	req := controlRequest{Command: "get-event-trace"}
+	if len(args) == 1 {
+		req.Watcher = args[0]
+	}
+	resp, err := sendControl(controlSocketPath(), req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "watcher trace: %v\n", err)
+		return exitCode(err)
+	}
+	var traced []tracedEvent
+	if err := json.Unmarshal(resp.Data, &traced); err != nil {
+		fmt.Fprintf(os.Stderr, "watcher trace: %v\n", err)
+		return exitCode(err)
+	}
+	if len(traced) == 0 {
+		fmt.Println("No events recorded. Set trace_events = true to record them.")
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tWATCHER\tOP\tNAME")
+	for _, e := range traced {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Time.Format("15:04:05.000"), e.Watcher, e.Op, e.Name)
+	}
+	tw.Flush()
+	return 0
+}
+
+// writeDropIn atomically replaces the drop-in file at path.
+func writeDropIn(path string, dropIn dropInConfig) error {
+	content, err := toml.Marshal(dropIn)
+	if err != nil {
+		return err
+	}
+	content = append([]byte("# Managed by \"desktopimage watcher\".\n"), content...)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create drop-in directory: %w", err)
+	}
+	// The temporary name doesn't end in .toml, so the daemon only reloads
+	// once the complete file is renamed into place.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// notifyReload asks a running daemon to pick up configuration changes.
+func notifyReload() {
+	if _, err := sendControl(controlSocketPath(), controlRequest{Command: "reload"}); err != nil {
+		fmt.Printf("The daemon was not notified (%v); it applies the change when it next starts.\n", err)
+	}
+}